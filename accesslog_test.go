@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  float64
+		bytes   float64
+	}{
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("accepted"))
+		}, 202, 8},
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}, 200, 2},
+		{"no body", func(w http.ResponseWriter, r *http.Request) {}, 200, 0},
+		{"http.Error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "teapot", http.StatusTeapot)
+		}, 418, 7},
+		{"status set twice", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, 404, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := captureLogs(t)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/test?x=1", nil)
+			req.Header.Set("User-Agent", "access-log-test")
+			w := httptest.NewRecorder()
+			logRequest("/api/v1/test", tt.handler)(w, req)
+
+			lines := records.find("Request")
+			if len(lines) != 1 {
+				t.Fatalf("%d access log lines, want 1", len(lines))
+			}
+			line := lines[0]
+			if line["status"] != tt.status || line["bytes"] != tt.bytes {
+				t.Errorf("logged status %v and %v bytes, want %v and %v", line["status"], line["bytes"], tt.status, tt.bytes)
+			}
+			if line["method"] != "GET" || line["path"] != "/api/v1/test" || line["user_agent"] != "access-log-test" || line["remote"] != "192.0.2.1" {
+				t.Errorf("log line = %v", line)
+			}
+			if line["level"] != "INFO" || line["request_id"] == "" || line["request_id"] != w.Header().Get(requestIDHeader) {
+				t.Errorf("log line = %v, request ID header %q", line, w.Header().Get(requestIDHeader))
+			}
+		})
+	}
+}
+
+func TestAccessLogQuietRoutes(t *testing.T) {
+	records := captureLogs(t)
+	logRequest("/healthz", func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if lines := records.find("Request"); len(lines) != 1 || lines[0]["level"] != "DEBUG" {
+		t.Errorf("health check logged as %v", lines)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.1, 172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedProxies
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = old })
+
+	tests := []struct {
+		remote, forwarded, want string
+	}{
+		{"192.0.2.7:1234", "", "192.0.2.7"},
+		{"192.0.2.7:1234", "198.51.100.1", "192.0.2.7"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 172.16.0.5", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientAddr(r); got != tt.want {
+			t.Errorf("clientAddr(%s, %q) = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.1, nonsense"); err == nil {
+		t.Error("invalid proxy accepted")
+	}
+}
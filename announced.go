@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"find_cameras/discovery"
+	"net"
+	"net/http"
+	"time"
+)
+
+var announcements = discovery.NewListener()
+
+type announcedDevice struct {
+	IP                string    `json:"ip"`
+	EndpointReference string    `json:"endpoint_reference"`
+	XAddrs            []string  `json:"xaddrs,omitempty"`
+	Scopes            []string  `json:"scopes,omitempty"`
+	Location          []string  `json:"location,omitempty"`
+	Hardware          []string  `json:"hardware,omitempty"`
+	Name              []string  `json:"name,omitempty"`
+	Profile           []string  `json:"profile,omitempty"`
+	Online            bool      `json:"online"`
+	LastSeen          time.Time `json:"last_seen"`
+}
+
+func listenForAnnouncements(ctx context.Context) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logger.Error("Error listing interfaces for WS-Discovery listener", "err", err)
+		return
+	}
+
+	var multicast []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		multicast = append(multicast, iface)
+	}
+
+	announcements.Failed = func(iface string, err error) {
+		logger.Warn("WS-Discovery listener failed on interface", "interface", iface, "err", err)
+	}
+	if err := announcements.Listen(ctx, multicast); err != nil {
+		logger.Error("WS-Discovery listener stopped", "err", err)
+	}
+}
+
+func onlineAnnouncements() []discovery.Match {
+	var matches []discovery.Match
+	for _, a := range announcements.Announcements() {
+		if a.Online {
+			matches = append(matches, a.Match)
+		}
+	}
+	return matches
+}
+
+func handleGetAnnouncedDevices(w http.ResponseWriter, r *http.Request) {
+	devices := []announcedDevice{}
+	for _, a := range announcements.Announcements() {
+		scopes := discovery.ParseScopes(a.Scopes)
+		devices = append(devices, announcedDevice{
+			IP:                a.IP,
+			EndpointReference: a.EndpointReference,
+			XAddrs:            a.XAddrs,
+			Scopes:            a.Scopes,
+			Location:          scopes.Location,
+			Hardware:          scopes.Hardware,
+			Name:              scopes.Name,
+			Profile:           scopes.Profile,
+			Online:            a.Online,
+			LastSeen:          a.LastSeen,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const arpSettleTime = time.Second
+
+var errNeighborTableUnavailable = errors.New("neighbor table is not available on this platform")
+
+type neighbor struct {
+	IP        string
+	MAC       string
+	Interface string
+}
+
+type neighborTable interface {
+	Neighbors() ([]neighbor, error)
+}
+
+var neighbors = defaultNeighborTable()
+
+type unavailableNeighborTable struct{}
+
+func (unavailableNeighborTable) Neighbors() ([]neighbor, error) {
+	return nil, errNeighborTableUnavailable
+}
+
+func parseProcARP(r io.Reader) ([]neighbor, error) {
+	var entries []neighbor
+	scanner := bufio.NewScanner(r)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		ip, flags, mac, iface := fields[0], fields[2], fields[3], fields[5]
+		if flags == "0x0" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		entries = append(entries, neighbor{IP: ip, MAC: mac, Interface: iface})
+	}
+	return entries, scanner.Err()
+}
+
+func warmNeighborTable(ctx context.Context, ips []string) {
+	for _, ip := range ips {
+		if ctx.Err() != nil {
+			return
+		}
+		conn, err := net.Dial("udp4", net.JoinHostPort(ip, "9"))
+		if err != nil {
+			continue
+		}
+		conn.Write([]byte{0})
+		conn.Close()
+	}
+
+	select {
+	case <-time.After(arpSettleTime):
+	case <-ctx.Done():
+	}
+}
+
+func arpCandidates(ctx context.Context, ips []string) ([]string, error) {
+	if _, err := neighbors.Neighbors(); err != nil {
+		return nil, err
+	}
+	warmNeighborTable(ctx, ips)
+
+	entries, err := neighbors.Neighbors()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		present[e.IP] = true
+	}
+
+	var candidates []string
+	for _, ip := range ips {
+		if present[ip] {
+			candidates = append(candidates, ip)
+		}
+	}
+	return candidates, nil
+}
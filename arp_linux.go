@@ -0,0 +1,20 @@
+package main
+
+import "os"
+
+type procNeighborTable struct {
+	path string
+}
+
+func (t procNeighborTable) Neighbors() ([]neighbor, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcARP(f)
+}
+
+func defaultNeighborTable() neighborTable {
+	return procNeighborTable{path: "/proc/net/arp"}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcNeighborTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arp")
+	if err := os.WriteFile(path, []byte(procARP), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := procNeighborTable{path: path}.Neighbors()
+	if err != nil || len(entries) != 3 {
+		t.Errorf("Neighbors() = %+v, %v", entries, err)
+	}
+	if _, err := (procNeighborTable{path: filepath.Join(t.TempDir(), "missing")}).Neighbors(); err == nil {
+		t.Error("Neighbors() of a missing table succeeded")
+	}
+}
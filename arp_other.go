@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func defaultNeighborTable() neighborTable {
+	return unavailableNeighborTable{}
+}
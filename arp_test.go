@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const procARP = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         a4:91:b1:0c:11:02     *        eth0
+192.168.1.64     0x1         0x2         44:19:b6:3a:20:9f     *        eth0
+192.168.1.70     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.71     0x1         0x2         00:00:00:00:00:00     *        eth0
+10.8.0.5         0x1         0x6         bc:ad:28:00:00:01     *        wg0
+truncated line
+`
+
+func TestParseProcARP(t *testing.T) {
+	got, err := parseProcARP(strings.NewReader(procARP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []neighbor{
+		{IP: "192.168.1.1", MAC: "a4:91:b1:0c:11:02", Interface: "eth0"},
+		{IP: "192.168.1.64", MAC: "44:19:b6:3a:20:9f", Interface: "eth0"},
+		{IP: "10.8.0.5", MAC: "bc:ad:28:00:00:01", Interface: "wg0"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got, err := parseProcARP(strings.NewReader("")); err != nil || len(got) != 0 {
+		t.Errorf("empty table: %+v, %v", got, err)
+	}
+}
+
+type fakeNeighborTable struct {
+	entries []neighbor
+	err     error
+}
+
+func (t fakeNeighborTable) Neighbors() ([]neighbor, error) { return t.entries, t.err }
+
+func withNeighbors(t *testing.T, table neighborTable) {
+	t.Helper()
+	old := neighbors
+	neighbors = table
+	t.Cleanup(func() { neighbors = old })
+}
+
+func TestARPCandidates(t *testing.T) {
+	withNeighbors(t, fakeNeighborTable{entries: []neighbor{{IP: "192.168.1.64"}, {IP: "192.168.1.1"}, {IP: "10.0.0.1"}}})
+	// A done context skips warming the table, which would dial the hosts.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got, err := arpCandidates(ctx, []string{"192.168.1.1", "192.168.1.2", "192.168.1.64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "192.168.1.1 192.168.1.64" {
+		t.Errorf("candidates = %v", got)
+	}
+}
+
+func TestARPCandidatesUnavailable(t *testing.T) {
+	withNeighbors(t, unavailableNeighborTable{})
+	if _, err := arpCandidates(context.Background(), []string{"192.168.1.1"}); !errors.Is(err, errNeighborTableUnavailable) {
+		t.Errorf("err = %v, want %v", err, errNeighborTableUnavailable)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	authMissing = "missing"
+	authInvalid = "invalid"
+)
+
+// apiKeys are the SHA-256 digests of the keys accepted by the API. Several
+// keys may be configured at once so they can be rotated without downtime.
+// Authentication is disabled when there are none.
+var apiKeys [][sha256.Size]byte
+
+func parseAPIKeys(s string) [][sha256.Size]byte {
+	var keys [][sha256.Size]byte
+	for _, key := range splitList(s) {
+		keys = append(keys, sha256.Sum256([]byte(key)))
+	}
+	return keys
+}
+
+// validAPIKey compares key with every configured key in constant time, so
+// neither the position of a match nor the length of the keys leaks.
+func validAPIKey(key string) bool {
+	digest := sha256.Sum256([]byte(key))
+	valid := 0
+	for i := range apiKeys {
+		valid |= subtle.ConstantTimeCompare(digest[:], apiKeys[i][:])
+	}
+	return valid == 1
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// requireAPIKey answers 401 to requests without a valid API key when keys are
+// configured.
+func requireAPIKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			h(w, r)
+			return
+		}
+		key := requestAPIKey(r)
+		if key != "" && validAPIKey(key) {
+			h(w, r)
+			return
+		}
+		reason := authInvalid
+		if key == "" {
+			reason = authMissing
+		}
+		authFailuresTotal.inc(reason)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="onvif-finder"`)
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, reason+" API key, send it in the Authorization: Bearer or X-API-Key header")
+	}
+}
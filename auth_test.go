@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func withAPIKeys(t *testing.T, keys string) {
+	t.Helper()
+	old := apiKeys
+	apiKeys = parseAPIKeys(keys)
+	t.Cleanup(func() { apiKeys = old })
+}
+
+// authStatus requests path of srv with the headers and returns the status.
+func authStatus(t *testing.T, srv *httptest.Server, path string, headers map[string]string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("WWW-Authenticate")
+}
+
+func TestAPIKeys(t *testing.T) {
+	withStore(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	cameras := apiPrefix + "/cameras/"
+
+	tests := []struct {
+		name    string
+		keys    string
+		headers map[string]string
+		status  int
+	}{
+		{"disabled", "", nil, 200},
+		{"missing", "old-key", nil, 401},
+		{"wrong", "old-key", map[string]string{"X-API-Key": "other-key"}, 401},
+		{"prefix of the key", "old-key", map[string]string{"X-API-Key": "old"}, 401},
+		{"header", "old-key", map[string]string{"X-API-Key": "old-key"}, 200},
+		{"bearer", "old-key", map[string]string{"Authorization": "Bearer old-key"}, 200},
+		{"bearer case", "old-key", map[string]string{"Authorization": "bearer old-key"}, 200},
+		{"basic", "old-key", map[string]string{"Authorization": "Basic b2xkLWtleQ=="}, 401},
+		// During a rotation both keys are accepted, then only the new one.
+		{"rotating old", "old-key,new-key", map[string]string{"X-API-Key": "old-key"}, 200},
+		{"rotating new", "old-key,new-key", map[string]string{"Authorization": "Bearer new-key"}, 200},
+		{"rotated old", "new-key", map[string]string{"X-API-Key": "old-key"}, 401},
+		{"rotated new", "new-key", map[string]string{"X-API-Key": "new-key"}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAPIKeys(t, tt.keys)
+			status, challenge := authStatus(t, srv, cameras, tt.headers)
+			if status != tt.status {
+				t.Errorf("status %d, want %d", status, tt.status)
+			}
+			if status == http.StatusUnauthorized && challenge == "" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAPIKeysPublicRoutes(t *testing.T) {
+	withAPIKeys(t, "secret")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	for _, path := range []string{"/healthz", apiPrefix + "/openapi.json"} {
+		if status, _ := authStatus(t, srv, path, nil); status != http.StatusOK {
+			t.Errorf("GET %s without a key = %d, want 200", path, status)
+		}
+	}
+}
+
+func TestAPIKeyFailureMetrics(t *testing.T) {
+	withAPIKeys(t, "secret")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	failures := func(reason string) uint64 { return atomic.LoadUint64(authFailuresTotal.counts[reason]) }
+	missing, invalid := failures(authMissing), failures(authInvalid)
+	authStatus(t, srv, apiPrefix+"/cameras/", nil)
+	authStatus(t, srv, apiPrefix+"/cameras/", map[string]string{"X-API-Key": "wrong"})
+	authStatus(t, srv, apiPrefix+"/cameras/", map[string]string{"X-API-Key": "secret"})
+	if failures(authMissing) != missing+1 || failures(authInvalid) != invalid+1 {
+		t.Errorf("failures: %d missing, %d invalid, want %d and %d", failures(authMissing), failures(authInvalid), missing+1, invalid+1)
+	}
+}
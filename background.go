@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backgroundScanner rescans the local networks periodically with the default
+// options, keeping the camera registry up to date.
+type backgroundScanner struct {
+	interval time.Duration
+	running  int32
+
+	mu            sync.Mutex
+	started       time.Time
+	lastCompleted time.Time
+}
+
+var background = &backgroundScanner{interval: 10 * time.Minute}
+
+func (b *backgroundScanner) run(ctx context.Context) {
+	if b.interval <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.started = time.Now()
+	b.mu.Unlock()
+	jitter := time.Duration(rand.Int63n(int64(b.interval/10) + 1))
+	select {
+	case <-time.After(jitter):
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		b.startCycle(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// startCycle starts a scan unless the previous cycle is still running.
+func (b *backgroundScanner) startCycle(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&b.running, 0, 1) {
+		logger.Warn("Background scan still running, skipping this cycle")
+		return
+	}
+	ctx = withRequestID(ctx, "background-"+newRequestID())
+	go func() {
+		defer atomic.StoreInt32(&b.running, 0)
+		networks, opts, err := resolveScan(url.Values{})
+		if err != nil {
+			loggerFrom(ctx).Error("Background scan failed", "err", err)
+			return
+		}
+		result := scanNetworks(ctx, networks, opts, nil)
+		if ctx.Err() != nil {
+			return
+		}
+		// Registered cameras are probed on their own, they may lie outside
+		// the scanned networks.
+		probeManualCameras(ctx)
+		resultCache.put(scanKey(networks, opts), result)
+
+		b.mu.Lock()
+		b.lastCompleted = result.ScannedAt
+		b.mu.Unlock()
+	}()
+}
+
+type camerasResponse struct {
+	LastScan *time.Time `json:"last_scan"`
+	page
+	Devices []cameraRecord `json:"devices"`
+}
+
+func handleGetCameras(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseCameraFilters(r.URL.Query())
+	if err != nil {
+		reqErr := err.(*requestError)
+		reqErr.response.Error.RequestID = requestID(r.Context())
+		writeJSON(w, reqErr.status, reqErr.response)
+		return
+	}
+	list := filterCameras(cameras.list(), filters)
+	if enc := inventoryFormat(r); enc != nil {
+		// Inventories list every matching camera, unpaginated.
+		rows := make([]inventoryRow, len(list))
+		for i, c := range list {
+			rows[i] = newInventoryRow(c.device, c.LastSeen)
+			if c.Metadata != nil {
+				rows[i].Name, rows[i].Labels = c.Metadata.Name, c.Metadata.labelList()
+			}
+		}
+		writeInventory(w, enc, rows)
+		return
+	}
+	p, err := parsePage(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	resp := camerasResponse{page: p}
+	resp.Devices = paginate(list, &resp.page)
+	background.mu.Lock()
+	last := background.lastCompleted
+	background.mu.Unlock()
+	if !last.IsZero() {
+		resp.LastScan = &last
+	}
+	// The registry also changes between scans, with metadata, ignore entries,
+	// registrations and rescans, so the listing is only revalidated by its
+	// ETag.
+	writeJSONCacheable(w, r, resp, time.Time{})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanCache keeps the last complete result of every distinct scan for a TTL.
+// All entries are dropped when the local networks change.
+type scanCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	networks string
+	entries  map[string]*scanResult
+}
+
+func newScanCache(ttl time.Duration) *scanCache {
+	return &scanCache{ttl: ttl, entries: make(map[string]*scanResult)}
+}
+
+var resultCache = newScanCache(5 * time.Minute)
+
+// scanKey identifies the scans returning the same result.
+func scanKey(networks []localNetwork, opts scanOptions) string {
+	var b strings.Builder
+	for _, n := range networks {
+		fmt.Fprintf(&b, "%s@%s,", n, n.Interface)
+	}
+	fmt.Fprintf(&b, "|%s|%s|%s|%s|%t|%t|%t|%t|%t|%t|%d|%s|%s|%d|%t|%s|%s", joinPorts(opts.Ports), joinPorts(opts.ONVIFPorts), joinPorts(opts.tlsPorts()), opts.Prefilter, opts.ProbePaths, opts.VerifyPlay, opts.Verbose, opts.Unicast, opts.IncludeSelf, opts.IPv6, opts.MaxHosts, opts.Exclude, opts.DialTimeout, opts.Retries, opts.AdaptiveTimeout, opts.Deadline, opts.DiscoveryWindow)
+	credentials := sha256.Sum256([]byte(opts.Username + "\x00" + opts.Password))
+	b.WriteString("|" + hex.EncodeToString(credentials[:8]))
+	return b.String()
+}
+
+func networksFingerprint(networks []localNetwork) string {
+	var b strings.Builder
+	for _, n := range networks {
+		if !n.Requested {
+			fmt.Fprintf(&b, "%s@%s,", n, n.Interface)
+		}
+	}
+	return b.String()
+}
+
+// observe drops every entry when the local networks differ from the last
+// observed ones. Networks supplied by the caller are ignored.
+func (c *scanCache) observe(networks []localNetwork) {
+	fingerprint := networksFingerprint(networks)
+	if fingerprint == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.networks != fingerprint {
+		if c.networks != "" {
+			logger.Info("Local networks changed, dropping cached scan results", "results", len(c.entries))
+		}
+		c.networks = fingerprint
+		c.entries = make(map[string]*scanResult)
+	}
+}
+
+func (c *scanCache) get(key string) *scanResult {
+	if c.ttl <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(result.ScannedAt) > c.ttl {
+		delete(c.entries, key)
+		return nil
+	}
+	return result
+}
+
+// put stores complete results only, partial ones would hide cameras for
+// the whole TTL.
+func (c *scanCache) put(key string, result *scanResult) {
+	if c.ttl <= 0 || result.Partial {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = result
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"find_cameras/scanner"
+)
+
+func withCache(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	old := resultCache
+	resultCache = newScanCache(ttl)
+	t.Cleanup(func() { resultCache = old })
+}
+
+// countingProber counts the probes, all of which are refused after delay.
+func countingProber(probes *int64, delay time.Duration) scanner.ProberFunc {
+	return func(ctx context.Context, ip string, port int) scanner.Result {
+		atomic.AddInt64(probes, 1)
+		time.Sleep(delay)
+		return scanner.Result{IP: ip, Outcome: scanner.OutcomeRefused}
+	}
+}
+
+// cachedScan is localScan without refresh, its only host probed by the
+// test prober.
+const cachedScan = "cidr=127.0.0.1/32&include_self=true&discovery_window=0s&onvif_ports=none&ports=554"
+
+func TestScanCacheHit(t *testing.T) {
+	withCache(t, time.Minute)
+	var probes int64
+	withProber(t, countingProber(&probes, 0))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		query  string
+		cached string
+		probes int64
+	}{
+		{cachedScan, "false", 1},
+		{cachedScan, "true", 1},
+		{cachedScan + "&retries=2", "false", 2},
+		{cachedScan + "&refresh=true", "false", 3},
+		{cachedScan, "true", 3},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Scan-Cached"); got != tt.cached {
+			t.Errorf("%s: X-Scan-Cached = %s, want %s", tt.query, got, tt.cached)
+		}
+		if n := atomic.LoadInt64(&probes); n != tt.probes {
+			t.Errorf("%s: %d probes in total, want %d", tt.query, n, tt.probes)
+		}
+	}
+}
+
+// TestScanCacheConcurrent checks that identical scans requested at once
+// probe the network once.
+func TestScanCacheConcurrent(t *testing.T) {
+	withCache(t, time.Minute)
+	var probes int64
+	withProber(t, countingProber(&probes, 50*time.Millisecond))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + cachedScan)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&probes); n != 1 {
+		t.Errorf("%d probes, want 1", n)
+	}
+}
+
+func TestScanCacheEntries(t *testing.T) {
+	c := newScanCache(time.Minute)
+	c.put("fresh", &scanResult{ScannedAt: time.Now()})
+	c.put("stale", &scanResult{ScannedAt: time.Now().Add(-2 * time.Minute)})
+	c.put("partial", &scanResult{ScannedAt: time.Now(), Partial: true})
+	if c.get("fresh") == nil {
+		t.Error("fresh result not cached")
+	}
+	if c.get("stale") != nil {
+		t.Error("result older than the TTL returned")
+	}
+	if c.get("partial") != nil {
+		t.Error("partial result cached")
+	}
+
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
+	c.observe([]localNetwork{{IPNet: ipnet, Interface: "eth0"}})
+	if c.get("fresh") != nil {
+		t.Fatal("result kept once the local networks are first observed")
+	}
+	c.put("fresh", &scanResult{ScannedAt: time.Now()})
+	c.observe([]localNetwork{{IPNet: ipnet, Interface: "eth0"}})
+	if c.get("fresh") == nil {
+		t.Error("result dropped though the local networks didn't change")
+	}
+	c.observe([]localNetwork{{IPNet: ipnet, Interface: "eth1"}})
+	if c.get("fresh") != nil {
+		t.Error("result kept after the local networks changed")
+	}
+
+	disabled := newScanCache(0)
+	disabled.put("key", &scanResult{ScannedAt: time.Now()})
+	if disabled.get("key") != nil {
+		t.Error("result cached with a TTL of 0")
+	}
+}
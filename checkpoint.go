@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// jobInterrupted jobs were cut short by a restart or their deadline and
+	// can be resumed from their checkpoint.
+	jobInterrupted = "interrupted"
+	// jobAbandoned jobs were interrupted longer than checkpointMaxAge ago and
+	// are no longer resumed.
+	jobAbandoned = "abandoned"
+)
+
+var (
+	// checkpointInterval is how often the running jobs are checkpointed to
+	// the store, 0 disables checkpoints.
+	checkpointInterval = 5 * time.Second
+	// checkpointMaxAge is how long an interrupted job stays resumable.
+	checkpointMaxAge = 24 * time.Hour
+)
+
+// scanCheckpoint is the stored state of a scan job: the query it was started
+// with, the addresses probed and the cameras found so far. The credentials
+// of the query are never stored.
+type scanCheckpoint struct {
+	ID        string     `json:"id"`
+	RequestID string     `json:"request_id,omitempty"`
+	Status    string     `json:"status"`
+	StartedAt time.Time  `json:"started_at"`
+	SavedAt   time.Time  `json:"saved_at"`
+	Query     url.Values `json:"query"`
+	// Probed lists the probed addresses, consecutive IPv4 addresses as
+	// first-last ranges.
+	Probed  []string `json:"probed"`
+	Devices []device `json:"devices"`
+}
+
+func (c *scanCheckpoint) status() jobStatus {
+	saved := c.SavedAt
+	s := jobStatus{ID: c.ID, RequestID: c.RequestID, Status: c.Status, StartedAt: c.StartedAt, CheckpointedAt: &saved, Devices: c.Devices}
+	if s.Devices == nil {
+		s.Devices = []device{}
+	}
+	s.Found = len(s.Devices)
+	s.Progress.Probed = int64(len(expandIPs(c.Probed)))
+	s.Progress.Found = int64(s.Found)
+	return s
+}
+
+// checkpointQuery returns the query of a scan without its credentials.
+func checkpointQuery(query url.Values) url.Values {
+	stored := make(url.Values, len(query))
+	for k, v := range query {
+		if k != "user" && k != "pass" {
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+// checkpoint returns the current state of a job.
+func (j *scanJob) checkpoint(status string) *scanCheckpoint {
+	return &scanCheckpoint{
+		ID:        j.id,
+		RequestID: j.requestID,
+		Status:    status,
+		StartedAt: j.started,
+		SavedAt:   time.Now(),
+		Query:     j.query,
+		Probed:    compactIPs(j.progress.probedIPs()),
+		Devices:   j.progress.devices(),
+	}
+}
+
+// checkpointLoop has the store saved every checkpointInterval until the job
+// is done, which writes its checkpoint.
+func (j *scanJob) checkpointLoop() {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			state.changed()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// checkpoints returns the checkpoints of the running jobs and the
+// interrupted ones, oldest first.
+func (s *jobStore) checkpoints() []scanCheckpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]scanCheckpoint, 0, len(s.interrupted))
+	for _, cp := range s.interrupted {
+		list = append(list, *cp)
+	}
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		running := job.result == nil && job.query != nil
+		job.mu.Unlock()
+		if running {
+			list = append(list, *job.checkpoint(jobRunning))
+		}
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].StartedAt.Before(list[k].StartedAt) })
+	return list
+}
+
+// restoreCheckpoints loads the checkpoints of the store. Jobs that were still
+// running when the store was saved were interrupted by the process exiting.
+func (s *jobStore) restoreCheckpoints(list []scanCheckpoint, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range list {
+		cp := list[i]
+		if cp.Status == jobRunning {
+			cp.Status = jobInterrupted
+		}
+		s.interrupted[cp.ID] = &cp
+	}
+	s.abandonCheckpoints(now)
+}
+
+// abandonCheckpoints marks the checkpoints older than checkpointMaxAge
+// abandoned, dropping what they recorded, and removes the abandoned ones
+// older than the retention on top. s.mu must be held.
+func (s *jobStore) abandonCheckpoints(now time.Time) (changed bool) {
+	for id, cp := range s.interrupted {
+		age := now.Sub(cp.SavedAt)
+		switch {
+		case cp.Status == jobAbandoned && age > checkpointMaxAge+s.retention:
+			delete(s.interrupted, id)
+			changed = true
+		case cp.Status == jobInterrupted && age > checkpointMaxAge:
+			cp.Status = jobAbandoned
+			cp.Probed, cp.Devices = nil, nil
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (s *jobStore) interruptedJob(id string) *scanCheckpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interrupted[id]
+}
+
+// resume restarts an interrupted job under its id. Only the addresses the
+// checkpoint doesn't list are probed, the cameras it found are merged into
+// the result.
+func (s *jobStore) resume(cp *scanCheckpoint, networks []localNetwork, opts scanOptions) (*scanJob, error) {
+	s.mu.Lock()
+	if s.interrupted[cp.ID] != cp {
+		s.mu.Unlock()
+		return nil, errNotResumable
+	}
+	if s.running >= s.maxRunning {
+		s.mu.Unlock()
+		return nil, errTooManyJobs
+	}
+	delete(s.interrupted, cp.ID)
+	progress := newScanProgress()
+	progress.resume(expandIPs(cp.Probed), cp.Devices)
+	resumed := time.Now()
+	ctx, job := s.add(cp.ID, cp.RequestID, progress, cp.StartedAt, opts)
+	job.resumed = &resumed
+	s.mu.Unlock()
+
+	s.run(ctx, job, networks, opts)
+	return job, nil
+}
+
+func handleListCheckpoints(w http.ResponseWriter, r *http.Request) {
+	list := scanJobs.checkpoints()
+	statuses := make([]jobStatus, 0, len(list))
+	for i := range list {
+		statuses = append(statuses, list[i].status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// handleResumeScan resumes an interrupted scan job. The credentials of the
+// original request aren't stored and must be given again.
+func handleResumeScan(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		writeShuttingDown(w)
+		return
+	}
+	id := pathParam(r, "id")
+	cp := scanJobs.interruptedJob(id)
+	if cp == nil {
+		if job := scanJobs.get(id); job != nil {
+			writeError(w, http.StatusConflict, codeNotResumable, "scan "+id+" is "+job.snapshot().Status)
+			return
+		}
+		writeError(w, http.StatusNotFound, codeNotFound, "unknown scan "+id)
+		return
+	}
+	if cp.Status == jobAbandoned {
+		writeError(w, http.StatusConflict, codeNotResumable, "scan "+id+" was interrupted more than "+checkpointMaxAge.String()+" ago and is abandoned")
+		return
+	}
+
+	query := checkpointQuery(cp.Query)
+	for _, k := range []string{"user", "pass"} {
+		if v := r.URL.Query().Get(k); v != "" {
+			query.Set(k, v)
+		}
+	}
+	networks, opts, err := resolveScan(query)
+	if err != nil {
+		reqErr := err.(*requestError)
+		reqErr.response.Error.RequestID = requestID(r.Context())
+		writeJSON(w, reqErr.status, reqErr.response)
+		return
+	}
+	if !allowScan(w, r) {
+		return
+	}
+	job, err := scanJobs.resume(cp, networks, opts)
+	switch err {
+	case nil:
+	case errTooManyJobs:
+		writeError(w, http.StatusTooManyRequests, codeTooManyScans, err.Error())
+		return
+	case errNotResumable:
+		writeError(w, http.StatusConflict, codeNotResumable, "scan "+id+" is already resumed")
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	loggerFrom(r.Context()).Info("Resumed scan job", "job", job.id, "ranges", len(cp.Probed), "found", len(cp.Devices))
+	w.Header().Set("Location", apiPrefix+"/scans/"+job.id)
+	writeJSON(w, http.StatusAccepted, startedScan{job.id, jobRunning})
+}
+
+// compactIPs sorts ips and joins the runs of consecutive IPv4 addresses into
+// first-last ranges.
+func compactIPs(ips []string) []string {
+	sorted := append([]string(nil), ips...)
+	sort.Slice(sorted, func(i, k int) bool { return compareIPs(sorted[i], sorted[k]) < 0 })
+
+	var ranges []string
+	var first, last net.IP
+	flush := func() {
+		switch {
+		case first == nil:
+		case first.Equal(last):
+			ranges = append(ranges, first.String())
+		default:
+			ranges = append(ranges, first.String()+"-"+last.String())
+		}
+		first, last = nil, nil
+	}
+	for _, s := range sorted {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			flush()
+			ranges = append(ranges, s)
+			continue
+		}
+		if last != nil && ipv4Uint(ip) == ipv4Uint(last)+1 {
+			last = ip
+			continue
+		}
+		if last != nil && ip.Equal(last) {
+			continue
+		}
+		flush()
+		first, last = ip, ip
+	}
+	flush()
+	return ranges
+}
+
+// expandIPs lists the addresses of the ranges of compactIPs.
+func expandIPs(ranges []string) []string {
+	var ips []string
+	for _, r := range ranges {
+		from, to, ok := strings.Cut(r, "-")
+		first, last := net.ParseIP(from).To4(), net.ParseIP(to).To4()
+		if !ok || first == nil || last == nil {
+			ips = append(ips, r)
+			continue
+		}
+		for n, end := ipv4Uint(first), ipv4Uint(last); ; n++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, n)
+			ips = append(ips, ip.String())
+			if n >= end {
+				break
+			}
+		}
+	}
+	return ips
+}
+
+func ipv4Uint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+const (
+	commandServe = "serve"
+	commandScan  = "scan"
+	commandProbe = "probe"
+)
+
+// exitNoCameras is the exit code of the scan and probe commands when no camera
+// was found, distinct from 1 for errors and 2 for invalid flags.
+const exitNoCameras = 3
+
+// parseCommand splits the command, serve when none is given, from its flags.
+func parseCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commandServe, args, nil
+	}
+	switch args[0] {
+	case commandServe, commandScan, commandProbe:
+		return args[0], args[1:], nil
+	}
+	return "", nil, fmt.Errorf("unknown command %q, expected serve, scan or probe", args[0])
+}
+
+// cliOptions are the flags of the scan and probe commands on top of the
+// settings of the service.
+type cliOptions struct {
+	cidrs      string
+	interfaces string
+	json       bool
+}
+
+// runCommand runs a scan or probe command with the settings of the service and
+// returns the exit code. Nothing is sent to the webhooks or the MQTT broker.
+func runCommand(command string, args []string, cli cliOptions) int {
+	webhooks = &webhookNotifier{}
+	mqttPublisher = nil
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = withRequestID(ctx, "cli-"+newRequestID())
+
+	query := url.Values{}
+	for _, cidr := range splitList(cli.cidrs) {
+		query.Add("cidr", cidr)
+	}
+	if cli.interfaces != "" {
+		query.Set("iface", cli.interfaces)
+	}
+
+	if command == commandProbe {
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: onvif-finder probe [flags] <ip>")
+			return 2
+		}
+		ip, err := parseUnicastIP(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defaults := defaultScanOptions
+		defaults.Deadline = probeCameraDeadline
+		opts, err := parseScanOptions(query, defaults)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		d, result := probeCamera(ctx, ip.String(), opts)
+		if d == nil {
+			fmt.Fprintf(os.Stderr, "no camera found at %s: %s\n", ip, result.Outcome)
+			return exitNoCameras
+		}
+		printDevices(cli.json, d, []device{*d})
+		return 0
+	}
+
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %q\n", args)
+		return 2
+	}
+	networks, opts, err := resolveScan(query)
+	if err != nil {
+		if reqErr, ok := err.(*requestError); ok {
+			err = fmt.Errorf("%s", reqErr.response.Error.Message)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result := scanNetworks(ctx, networks, opts, nil)
+	printDevices(cli.json, result.response(false), result.Devices)
+	if len(result.Devices) == 0 {
+		return exitNoCameras
+	}
+	return 0
+}
+
+// printDevices writes v as JSON, or devices as a table.
+func printDevices(asJSON bool, v interface{}, devices []device) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tPORTS\tMAC\tVENDOR\tHOSTNAME\tDISCOVERED VIA")
+	for _, d := range devices {
+		ports := make([]string, len(d.Ports))
+		for i, p := range d.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.IP, dash(strings.Join(ports, ",")), dash(d.MAC), dash(d.Vendor), dash(d.Hostname), strings.Join(d.Sources, ","))
+	}
+	tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
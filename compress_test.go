@@ -0,0 +1,109 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	large := `{"devices":[` + strings.Repeat(`{"ip":"10.0.0.7","ports":[554]},`, 100) + `{}]}`
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		status         int
+		body           string
+		flush          bool
+		gzipped        bool
+	}{
+		{"large json", "gzip", "application/json", http.StatusOK, large, false, true},
+		{"error status kept", "gzip, deflate", "application/json", http.StatusNotFound, large, false, true},
+		{"small json", "gzip", "application/json", http.StatusOK, `{"devices":[]}`, false, false},
+		{"not accepted", "", "application/json", http.StatusOK, large, false, false},
+		{"refused", "br, gzip;q=0", "application/json", http.StatusOK, large, false, false},
+		{"any coding", "*", "application/json", http.StatusOK, large, false, true},
+		{"event stream", "gzip", "text/event-stream", http.StatusOK, large, false, false},
+		{"flushed early", "gzip", "application/x-ndjson", http.StatusOK, `{"type":"device"}` + "\n", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withCompression(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				if tt.flush {
+					w.(http.Flusher).Flush()
+				}
+				// Written in pieces, the way encoders do.
+				for body := tt.body; body != ""; {
+					n := min(len(body), 100)
+					io.WriteString(w, body[:n])
+					body = body[n:]
+				}
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			h(rec, r)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+				t.Fatalf("Content-Encoding = %q", rec.Header().Get("Content-Encoding"))
+			}
+			var body io.Reader = rec.Body
+			if tt.gzipped {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			if got, err := io.ReadAll(body); err != nil || string(got) != tt.body {
+				t.Errorf("body = %.60q…, %v", got, err)
+			}
+		})
+	}
+}
+
+// TestCompressionRoutes checks the compression of the routes through the whole
+// middleware chain.
+func TestCompressionRoutes(t *testing.T) {
+	withStore(t)
+	withProber(t, countingProber(new(int64), 0))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		path    string
+		gzipped bool
+	}{
+		{apiPrefix + "/openapi.json", true},
+		{"/healthz", false},
+		{apiPrefix + "/scan/stream?" + localScan(554), false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = resp.Body
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+			t.Errorf("%s: Content-Encoding = %q", tt.path, resp.Header.Get("Content-Encoding"))
+		} else if got {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("%s: %v", tt.path, err)
+			}
+		}
+		if _, err := io.ReadAll(body); err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the layout of the -config file. Every setting is the counterpart
+// of the flag named by its flag tag, and of the ONVIF_FINDER_* environment
+// variable derived from that flag.
+type Config struct {
+	Server struct {
+		Listen          string        `yaml:"listen" flag:"listen"`
+		DebugListen     string        `yaml:"debug_listen" flag:"debug-listen"`
+		ShutdownGrace   time.Duration `yaml:"shutdown_grace" flag:"shutdown-grace"`
+		TrustedProxies  []string      `yaml:"trusted_proxies" flag:"trusted-proxies"`
+		LogLevel        string        `yaml:"log_level" flag:"log-level"`
+		LogFormat       string        `yaml:"log_format" flag:"log-format"`
+		APIKeys         []string      `yaml:"api_keys" flag:"api-keys" secret:"true"`
+		CORSOrigins     []string      `yaml:"cors_origins" flag:"cors-origins"`
+		CompressMinSize int           `yaml:"compress_min_size" flag:"compress-min-size"`
+		SwaggerUI       bool          `yaml:"swagger_ui" flag:"swagger-ui"`
+		Site            string        `yaml:"site" flag:"site"`
+		InstanceID      string        `yaml:"instance_id" flag:"instance-id"`
+		Timeouts        struct {
+			ReadHeader  time.Duration `yaml:"read_header" flag:"read-header-timeout"`
+			Read        time.Duration `yaml:"read" flag:"read-timeout"`
+			Write       time.Duration `yaml:"write" flag:"write-timeout"`
+			Idle        time.Duration `yaml:"idle" flag:"idle-timeout"`
+			Request     time.Duration `yaml:"request" flag:"request-timeout"`
+			StreamWrite time.Duration `yaml:"stream_write" flag:"stream-write-timeout"`
+		} `yaml:"timeouts"`
+	} `yaml:"server"`
+	TLS struct {
+		Cert       string        `yaml:"cert" flag:"tls-cert"`
+		Key        string        `yaml:"key" flag:"tls-key"`
+		SelfSigned bool          `yaml:"self_signed" flag:"tls-self-signed"`
+		ClientCA   string        `yaml:"client_ca" flag:"tls-client-ca"`
+		Reload     time.Duration `yaml:"reload" flag:"tls-reload"`
+	} `yaml:"tls"`
+	Scan struct {
+		Ports              []int         `yaml:"ports" flag:"ports"`
+		ONVIFPorts         []int         `yaml:"onvif_ports" flag:"onvif-ports"`
+		RTSPS              bool          `yaml:"rtsps" flag:"rtsps"`
+		RTSPSPorts         []int         `yaml:"rtsps_ports" flag:"rtsps-ports"`
+		RTSPSVerify        bool          `yaml:"rtsps_verify" flag:"rtsps-verify"`
+		RTSPSHandshake     time.Duration `yaml:"rtsps_handshake_timeout" flag:"rtsps-handshake-timeout"`
+		Workers            int           `yaml:"workers" flag:"workers"`
+		MaxWorkers         int           `yaml:"max_workers" flag:"max-workers"`
+		ConnectionRate     int           `yaml:"connection_rate" flag:"connection-rate"`
+		MaxConnectionRate  int           `yaml:"max_connection_rate" flag:"max-connection-rate"`
+		EnrichWorkers      int           `yaml:"enrich_workers" flag:"enrich-workers"`
+		EnrichTimeout      time.Duration `yaml:"enrich_timeout" flag:"enrich-timeout"`
+		Timeout            time.Duration `yaml:"timeout" flag:"timeout"`
+		Retries            int           `yaml:"retries" flag:"retries"`
+		VerifyMaxDevices   int           `yaml:"verify_max_devices" flag:"verify-max-devices"`
+		RTSPCredentials    []string      `yaml:"rtsp_credentials" flag:"rtsp-credentials" secret:"true"`
+		ONVIFCredentials   []string      `yaml:"onvif_credentials" flag:"onvif-credentials" secret:"true"`
+		ONVIFInsecureBasic bool          `yaml:"onvif_insecure_basic" flag:"onvif-insecure-basic"`
+		AdaptiveTimeout    bool          `yaml:"adaptive_timeout" flag:"adaptive-timeout"`
+		MinTimeout         time.Duration `yaml:"min_timeout" flag:"min-timeout"`
+		Deadline           time.Duration `yaml:"deadline" flag:"deadline"`
+		MaxHosts           int           `yaml:"max_hosts" flag:"max-hosts"`
+		VerboseMaxHosts    int           `yaml:"verbose_max_hosts" flag:"verbose-max-hosts"`
+		Exclude            []string      `yaml:"exclude" flag:"exclude"`
+		IPv6               bool          `yaml:"ipv6" flag:"ipv6"`
+		Interfaces         []string      `yaml:"interfaces" flag:"interfaces"`
+		ExcludeInterfaces  []string      `yaml:"exclude_interfaces" flag:"exclude-interfaces"`
+		InterfaceFilter    bool          `yaml:"interface_filter" flag:"interface-filter"`
+		DHCPLeases         string        `yaml:"dhcp_leases" flag:"dhcp-leases"`
+		Interval           time.Duration `yaml:"interval" flag:"scan-interval"`
+		CacheTTL           time.Duration `yaml:"cache_ttl" flag:"cache-ttl"`
+		History            int           `yaml:"history" flag:"history"`
+		Rate               time.Duration `yaml:"rate" flag:"scan-rate"`
+		Burst              int           `yaml:"burst" flag:"scan-burst"`
+		RatePerClient      bool          `yaml:"rate_per_client" flag:"scan-rate-per-client"`
+	} `yaml:"scan"`
+	Discovery struct {
+		Window     time.Duration `yaml:"window" flag:"discovery-window"`
+		Repeats    int           `yaml:"repeats" flag:"discovery-repeats"`
+		Interval   time.Duration `yaml:"interval" flag:"discovery-interval"`
+		Interfaces []string      `yaml:"interfaces" flag:"discovery-interfaces"`
+	} `yaml:"discovery"`
+	Jobs struct {
+		Retention time.Duration `yaml:"retention" flag:"job-retention"`
+		Max       int           `yaml:"max" flag:"max-jobs"`
+		// Checkpoints only take effect with a store.
+		CheckpointInterval time.Duration `yaml:"checkpoint_interval" flag:"checkpoint-interval"`
+		CheckpointMaxAge   time.Duration `yaml:"checkpoint_max_age" flag:"checkpoint-max-age"`
+	} `yaml:"jobs"`
+	Registry struct {
+		RemoveAfter int    `yaml:"remove_after" flag:"remove-after"`
+		Store       string `yaml:"store" flag:"store"`
+	} `yaml:"registry"`
+	Webhooks struct {
+		URLs   []string `yaml:"urls" flag:"webhooks"`
+		Secret string   `yaml:"secret" flag:"webhook-secret" secret:"true"`
+	} `yaml:"webhooks"`
+	Report struct {
+		URLs     []string `yaml:"urls" flag:"report-urls"`
+		Token    string   `yaml:"token" flag:"report-token" secret:"true"`
+		Attempts int      `yaml:"attempts" flag:"report-attempts"`
+	} `yaml:"report"`
+	// Schedules maps the name of every schedule to its cron expression and
+	// the parameters of its scans.
+	Schedules map[string]map[string]string `yaml:"schedules" flag:"schedules"`
+	// Export is written after every scheduled scan.
+	Export struct {
+		Dir    string `yaml:"dir" flag:"export-dir"`
+		Format string `yaml:"format" flag:"export-format"`
+	} `yaml:"export"`
+	MQTT struct {
+		Broker      string `yaml:"broker" flag:"mqtt-broker"`
+		Username    string `yaml:"username" flag:"mqtt-username"`
+		Password    string `yaml:"password" flag:"mqtt-password" secret:"true"`
+		TopicPrefix string `yaml:"topic_prefix" flag:"mqtt-topic-prefix"`
+	} `yaml:"mqtt"`
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func flagEnv(name string) string {
+	return "ONVIF_FINDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configFlagName returns the -config flag given on the command line, or the
+// ONVIF_FINDER_CONFIG environment variable. It runs before the flags are
+// parsed because the file provides their defaults.
+func configFlagName(args []string) string {
+	path := os.Getenv("ONVIF_FINDER_CONFIG")
+	for i, arg := range args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch {
+		case name != "config":
+		case hasValue:
+			path = value
+		case i+1 < len(args):
+			path = args[i+1]
+		}
+	}
+	return path
+}
+
+// loadConfig reads the file at path and returns the flag values it sets, the
+// keys it doesn't know and every invalid setting.
+func loadConfig(path string) (values map[string]string, unknown []string, problems []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	values = make(map[string]string)
+	decodeConfig(doc, reflect.TypeOf(Config{}), "", values, &unknown, &problems)
+	sort.Strings(unknown)
+	return values, unknown, problems, nil
+}
+
+func decodeConfig(doc map[string]interface{}, t reflect.Type, prefix string, values map[string]string, unknown, problems *[]string) {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("yaml")] = t.Field(i)
+	}
+	for key, v := range doc {
+		path := prefix + key
+		field, ok := fields[key]
+		if !ok {
+			*unknown = append(*unknown, path)
+			continue
+		}
+		if field.Type.Kind() == reflect.Map {
+			value, err := scheduleConfigValue(v)
+			if err != nil {
+				*problems = append(*problems, fmt.Sprintf("%s.%v", path, err))
+				continue
+			}
+			values[field.Tag.Get("flag")] = value
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			nested, ok := v.(map[string]interface{})
+			if !ok {
+				*problems = append(*problems, path+": expected a mapping")
+				continue
+			}
+			decodeConfig(nested, field.Type, path+".", values, unknown, problems)
+			continue
+		}
+		value, err := configValue(field.Type, v)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		values[field.Tag.Get("flag")] = value
+	}
+}
+
+// configValue checks v against the type of its setting and returns it in the
+// syntax of the matching flag.
+func configValue(t reflect.Type, v interface{}) (string, error) {
+	if t.Kind() == reflect.Slice {
+		var items []string
+		switch v := v.(type) {
+		case []string:
+			items = v
+		case string:
+			items = splitList(v)
+		default:
+			return "", errors.New("expected a list")
+		}
+		for _, item := range items {
+			if _, err := configValue(t.Elem(), item); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.New("expected a single value")
+	}
+	switch {
+	case t == durationType:
+		if _, err := time.ParseDuration(s); err != nil {
+			return "", fmt.Errorf("invalid duration %q", s)
+		}
+	case t.Kind() == reflect.Int:
+		if _, err := strconv.Atoi(s); err != nil {
+			return "", fmt.Errorf("invalid number %q", s)
+		}
+	case t.Kind() == reflect.Bool:
+		if _, err := strconv.ParseBool(s); err != nil {
+			return "", fmt.Errorf("invalid boolean %q", s)
+		}
+	}
+	return s, nil
+}
+
+// applyConfig sets the flags from the config file values, except those whose
+// environment variable is set, which take precedence. Flags given on the
+// command line are parsed afterwards and override both.
+func applyConfig(fs *flag.FlagSet, values map[string]string) []string {
+	var problems []string
+	for name, value := range values {
+		if os.Getenv(flagEnv(name)) != "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// printConfig writes the effective value of every setting as a config file.
+// Secrets are masked.
+func printConfig(w io.Writer, fs *flag.FlagSet) {
+	writeConfigSection(w, fs, reflect.TypeOf(Config{}), "")
+}
+
+func writeConfigSection(w io.Writer, fs *flag.FlagSet, t reflect.Type, indent string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			fmt.Fprintf(w, "%s%s:\n", indent, key)
+			writeConfigSection(w, fs, field.Type, indent+"  ")
+			continue
+		}
+		if field.Type.Kind() == reflect.Map {
+			fmt.Fprintf(w, "%s%s:\n", indent, key)
+			if f := fs.Lookup(field.Tag.Get("flag")); f != nil {
+				writeScheduleConfig(w, f.Value.String(), indent+"  ")
+			}
+			continue
+		}
+		f := fs.Lookup(field.Tag.Get("flag"))
+		if f == nil {
+			continue
+		}
+		value := f.Value.String()
+		if field.Tag.Get("secret") == "true" && value != "" {
+			value = "********"
+		}
+		if field.Type.Kind() == reflect.Slice {
+			fmt.Fprintf(w, "%s%s: [%s]\n", indent, key, strings.Join(splitList(value), ", "))
+			continue
+		}
+		if field.Type.Kind() == reflect.String {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", indent, key, value)
+	}
+}
+
+// scheduleConfigValue turns the schedules mapping of a config file into the
+// value of the -schedules flag. List parameters are joined by commas, except
+// cidr, which is repeated.
+func scheduleConfigValue(v interface{}) (string, error) {
+	if s, ok := v.(string); ok && s == "" {
+		return "", nil
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return "", errors.New("expected a mapping")
+	}
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries []string
+	for _, name := range names {
+		settings, ok := doc[name].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%s: expected a mapping", name)
+		}
+		cron, _ := settings["cron"].(string)
+		if cron == "" {
+			return "", fmt.Errorf("%s.cron: missing", name)
+		}
+		if strings.ContainsAny(cron, ";?") {
+			return "", fmt.Errorf("%s.cron: invalid cron %q", name, cron)
+		}
+		query := url.Values{}
+		for key, value := range settings {
+			switch value := value.(type) {
+			case string:
+				if key != "cron" {
+					query.Set(key, value)
+				}
+			case []string:
+				if key == "cidr" {
+					query[key] = value
+				} else {
+					query.Set(key, strings.Join(value, ","))
+				}
+			default:
+				return "", fmt.Errorf("%s.%s: expected a single value or a list", name, key)
+			}
+		}
+		entries = append(entries, name+"="+cron+"?"+query.Encode())
+	}
+	return strings.Join(entries, ";"), nil
+}
+
+// writeScheduleConfig writes the value of the -schedules flag as the
+// schedules mapping of a config file.
+func writeScheduleConfig(w io.Writer, value, indent string) {
+	list, err := parseSchedules(value)
+	if err != nil {
+		return
+	}
+	for _, s := range list {
+		fmt.Fprintf(w, "%s%s:\n", indent, s.name)
+		fmt.Fprintf(w, "%s  cron: %s\n", indent, strconv.Quote(s.spec))
+		if s.credentials != "" {
+			fmt.Fprintf(w, "%s  credentials: %s\n", indent, strconv.Quote(s.credentials))
+		}
+		keys := make([]string, 0, len(s.query))
+		for key := range s.query {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if values := s.query[key]; len(values) == 1 && key != "cidr" {
+				fmt.Fprintf(w, "%s  %s: %s\n", indent, key, strconv.Quote(values[0]))
+			} else {
+				fmt.Fprintf(w, "%s  %s: [%s]\n", indent, key, strings.Join(values, ", "))
+			}
+		}
+	}
+}
+
+// parseYAML parses the subset of YAML used by config files: nested mappings,
+// scalars, block lists of scalars and flow lists like [a, b].
+func parseYAML(data string) (map[string]interface{}, error) {
+	type line struct {
+		number int
+		indent int
+		text   string
+	}
+	var lines []line
+	for i, raw := range strings.Split(data, "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \r")
+		if strings.TrimSpace(text) == "" || text == "---" {
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, line{i + 1, len(text) - len(trimmed), trimmed})
+	}
+
+	var parse func(start, indent int) (map[string]interface{}, int, error)
+	parse = func(start, indent int) (map[string]interface{}, int, error) {
+		m := make(map[string]interface{})
+		i := start
+		for i < len(lines) {
+			l := lines[i]
+			if l.indent < indent {
+				break
+			}
+			if l.indent > indent {
+				return nil, 0, fmt.Errorf("line %d: unexpected indentation", l.number)
+			}
+			key, value, ok := strings.Cut(l.text, ":")
+			if !ok || strings.HasPrefix(l.text, "- ") {
+				return nil, 0, fmt.Errorf("line %d: expected key: value", l.number)
+			}
+			key = strings.TrimSpace(key)
+			if _, dup := m[key]; dup {
+				return nil, 0, fmt.Errorf("line %d: duplicate key %q", l.number, key)
+			}
+			value = strings.TrimSpace(value)
+			i++
+			switch {
+			case value != "":
+				m[key] = parseYAMLScalar(value)
+			case i < len(lines) && lines[i].indent > indent && strings.HasPrefix(lines[i].text, "-"):
+				list := []string{}
+				child := lines[i].indent
+				for i < len(lines) && lines[i].indent == child && strings.HasPrefix(lines[i].text, "-") {
+					item, _ := parseYAMLScalar(strings.TrimSpace(strings.TrimPrefix(lines[i].text, "-"))).(string)
+					list = append(list, item)
+					i++
+				}
+				m[key] = list
+			case i < len(lines) && lines[i].indent > indent:
+				nested, next, err := parse(i, lines[i].indent)
+				if err != nil {
+					return nil, 0, err
+				}
+				m[key] = nested
+				i = next
+			default:
+				m[key] = ""
+			}
+		}
+		return m, i, nil
+	}
+
+	doc, _, err := parse(0, 0)
+	return doc, err
+}
+
+func parseYAMLScalar(s string) interface{} {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		list := []string{}
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, unquoteYAML(item))
+			}
+		}
+		return list
+	}
+	return unquoteYAML(s)
+}
+
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
+
+// stripYAMLComment removes a # comment that is outside of quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
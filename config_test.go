@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]interface{}
+	}{
+		{
+			"nested mappings",
+			"server:\n  listen: \":8080\"\n  timeouts:\n    request: 30s\nscan:\n  workers: 64\n",
+			map[string]interface{}{
+				"server": map[string]interface{}{"listen": ":8080", "timeouts": map[string]interface{}{"request": "30s"}},
+				"scan":   map[string]interface{}{"workers": "64"},
+			},
+		},
+		{
+			"lists",
+			"ports: [554, \"8554\", ]\nexclude:\n  - 10.0.0.1\n  - '10.0.0.2'\nempty: []\n",
+			map[string]interface{}{"ports": []string{"554", "8554"}, "exclude": []string{"10.0.0.1", "10.0.0.2"}, "empty": []string{}},
+		},
+		{
+			"comments and quotes",
+			"---\n# settings\nsecret: \"a#b\" # the secret\nname: 'it''s'\nurl: http://example.com/#frag\nnone:\n",
+			map[string]interface{}{"secret": "a#b", "name": "it's", "url": "http://example.com/#frag", "none": ""},
+		},
+		{"empty", "\n# nothing\n", map[string]interface{}{}},
+		{"tab indentation", "server:\n\tlisten: :8080\n", nil},
+		{"unexpected indentation", "listen: :8080\n  workers: 4\n", nil},
+		{"duplicate key", "scan:\n  workers: 4\n  workers: 8\n", nil},
+		{"not a mapping", "scan:\n  - 554\nworkers\n", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML(tt.yaml)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parseYAML = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseYAML = %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  listen: ":9090"
+  api_keys: [one, two]
+  timeouts:
+    request: 45s
+    reqeust: 1m
+scan:
+  ports: [554, 8554]
+  workers: many
+  timeout: soon
+  ipv6: maybe
+  exclude:
+    - 10.0.0.1
+  portz: [554]
+tls: self_signed
+webhooks:
+  urls: http://hooks.local/cameras
+schedules:
+  nightly:
+    cron: "0 3 * * *"
+    cidr: [10.0.0.0/24, 10.0.1.0/24]
+    ports: [554, 8554]
+metrics: true
+`)
+	values, unknown, problems, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"listen":          ":9090",
+		"api-keys":        "one,two",
+		"request-timeout": "45s",
+		"ports":           "554,8554",
+		"exclude":         "10.0.0.1",
+		"webhooks":        "http://hooks.local/cameras",
+		"schedules":       "nightly=0 3 * * *?cidr=10.0.0.0%2F24&cidr=10.0.1.0%2F24&ports=554%2C8554",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+	if want := []string{"metrics", "scan.portz", "server.timeouts.reqeust"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown = %v, want %v", unknown, want)
+	}
+	// Every problem is reported, not only the first.
+	for _, want := range []string{"scan.workers: invalid number", "scan.timeout: invalid duration", "scan.ipv6: invalid boolean", "tls: expected a mapping"} {
+		if !strings.Contains(strings.Join(problems, "\n"), want) {
+			t.Errorf("problems %q lack %q", problems, want)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("problems = %q, want 4", problems)
+	}
+
+	if _, _, _, err := loadConfig(writeConfig(t, "scan:\n\tworkers: 4\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("loadConfig of a malformed file: %v", err)
+	}
+	if _, _, _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loadConfig of a missing file succeeded")
+	}
+}
+
+// configFlags returns a flag set with a string flag for every setting of
+// Config.
+func configFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var define func(t reflect.Type)
+	define = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+				define(field.Type)
+				continue
+			}
+			value := ""
+			switch {
+			case field.Type == durationType:
+				value = "0s"
+			case field.Type.Kind() == reflect.Int:
+				value = "0"
+			case field.Type.Kind() == reflect.Bool:
+				value = "false"
+			}
+			fs.String(field.Tag.Get("flag"), value, "")
+		}
+	}
+	define(reflect.TypeOf(Config{}))
+	return fs
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs := configFlags()
+	t.Setenv(flagEnv("workers"), "8")
+	problems := applyConfig(fs, map[string]string{"listen": ":9090", "workers": "64", "timeout": "3s", "unknown-flag": "1"})
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "unknown-flag:") {
+		t.Errorf("problems = %q", problems)
+	}
+	if err := fs.Parse([]string{"-timeout", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	// The environment wins over the file for workers, which keeps the flag
+	// default the environment sets, and the command line for timeout.
+	for name, want := range map[string]string{"listen": ":9090", "workers": "0", "timeout": "5s"} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestConfigFlagName(t *testing.T) {
+	tests := []struct {
+		env  string
+		args []string
+		want string
+	}{
+		{"", []string{"-workers", "4"}, ""},
+		{"", []string{"-config", "/etc/finder.yaml", "-workers", "4"}, "/etc/finder.yaml"},
+		{"", []string{"--config=/etc/finder.yaml"}, "/etc/finder.yaml"},
+		{"/env.yaml", nil, "/env.yaml"},
+		{"/env.yaml", []string{"-config", "/flag.yaml"}, "/flag.yaml"},
+		{"", []string{"--", "-config", "/etc/finder.yaml"}, ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("ONVIF_FINDER_CONFIG", tt.env)
+		if got := configFlagName(tt.args); got != tt.want {
+			t.Errorf("configFlagName(%q) with %q = %q, want %q", tt.args, tt.env, got, tt.want)
+		}
+	}
+}
+
+// TestPrintConfig checks that the printed configuration loads back to the
+// same settings, with the secrets masked.
+func TestPrintConfig(t *testing.T) {
+	fs := configFlags()
+	for name, value := range map[string]string{
+		"listen":         ":9090",
+		"ports":          "554,8554",
+		"timeout":        "2s",
+		"ipv6":           "true",
+		"api-keys":       "one,two",
+		"webhook-secret": "hunter2",
+		"schedules":      "nightly=0 3 * * *?cidr=10.0.0.0/24&cidr=10.0.1.0/24&ports=554,8554",
+	} {
+		if err := fs.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var printed bytes.Buffer
+	printConfig(&printed, fs)
+	for _, secret := range []string{"one", "hunter2"} {
+		if strings.Contains(printed.String(), secret) {
+			t.Errorf("secret %q printed:\n%s", secret, printed.String())
+		}
+	}
+
+	values, unknown, problems, err := loadConfig(writeConfig(t, printed.String()))
+	if err != nil || len(unknown) > 0 || len(problems) > 0 {
+		t.Fatalf("loading the printed config: %v, unknown %q, problems %q:\n%s", err, unknown, problems, printed.String())
+	}
+	reloaded := configFlags()
+	if problems := applyConfig(reloaded, values); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	for name, want := range map[string]string{"listen": ":9090", "ports": "554,8554", "timeout": "2s", "ipv6": "true", "webhook-secret": "********"} {
+		if got := reloaded.Lookup(name).Value.String(); got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+	var again bytes.Buffer
+	printConfig(&again, reloaded)
+	if again.String() != printed.String() {
+		t.Errorf("printed config changed on reload:\n%s\nwant:\n%s", again.String(), printed.String())
+	}
+}
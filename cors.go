@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, X-API-Key, Content-Type, X-Request-ID, If-Match"
+	corsExposeHeaders = "X-Request-ID, X-Scan-Cached, X-Scan-Scanned-At, X-Scan-Progress, X-Scan-Partial, X-Scan-Excluded, Location, Retry-After, ETag"
+	corsMaxAge        = "600"
+)
+
+// corsOrigins are the origins browsers may call the API from, "*" for any.
+// No CORS headers are sent when it is empty.
+var corsOrigins []string
+
+func parseCORSOrigins(s string) ([]string, error) {
+	var origins []string
+	for _, origin := range splitList(s) {
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+				return nil, fmt.Errorf("invalid origin %q, expected scheme://host[:port] or *", origin)
+			}
+			origin = strings.TrimSuffix(origin, "/")
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+func allowedOrigin(origin string) bool {
+	for _, o := range corsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds the CORS headers for allowed origins and answers the preflight
+// requests, before the API key is checked since browsers never send
+// credentials with them. Requests from other origins get no CORS headers, so
+// browsers block them.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsOrigins) == 0 || origin == "" {
+			h(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowedOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			h(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		h(w, r)
+	}
+}
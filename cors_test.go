@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	withStore(t)
+	withAPIKeys(t, "secret")
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		origins   []string
+		method    string
+		origin    string
+		preflight bool
+		status    int
+		allow     string
+	}{
+		{"disabled", nil, http.MethodGet, "https://installer.example.com", false, http.StatusOK, ""},
+		{"allowed preflight", []string{"https://installer.example.com"}, http.MethodOptions, "https://installer.example.com", true, http.StatusNoContent, "https://installer.example.com"},
+		{"allowed request", []string{"https://installer.example.com"}, http.MethodGet, "https://installer.example.com", false, http.StatusOK, "https://installer.example.com"},
+		{"origin case", []string{"https://installer.example.com"}, http.MethodGet, "https://Installer.example.com", false, http.StatusOK, "https://Installer.example.com"},
+		{"any origin", []string{"*"}, http.MethodOptions, "http://10.0.0.5:8080", true, http.StatusNoContent, "http://10.0.0.5:8080"},
+		{"disallowed preflight", []string{"https://installer.example.com"}, http.MethodOptions, "https://evil.example.com", true, http.StatusNoContent, ""},
+		{"disallowed request", []string{"https://installer.example.com"}, http.MethodGet, "https://evil.example.com", false, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corsOrigins = tt.origins
+			req, _ := http.NewRequest(tt.method, srv.URL+apiPrefix+"/cameras/", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+			} else {
+				req.Header.Set("X-API-Key", "secret")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			want := map[string]string{
+				"Access-Control-Allow-Methods":  "",
+				"Access-Control-Allow-Headers":  "",
+				"Access-Control-Max-Age":        "",
+				"Access-Control-Expose-Headers": "",
+			}
+			if tt.allow != "" && tt.preflight {
+				want["Access-Control-Allow-Methods"] = corsAllowMethods
+				want["Access-Control-Allow-Headers"] = corsAllowHeaders
+				want["Access-Control-Max-Age"] = corsMaxAge
+			} else if tt.allow != "" {
+				want["Access-Control-Expose-Headers"] = corsExposeHeaders
+			}
+			for header, value := range want {
+				if got := resp.Header.Get(header); got != value {
+					t.Errorf("%s = %q, want %q", header, got, value)
+				}
+			}
+			if vary := resp.Header.Values("Vary"); tt.origins != nil && !containsString(vary, "Origin") {
+				t.Errorf("Vary = %q, want Origin", vary)
+			}
+		})
+	}
+}
+
+func TestParseCORSOrigins(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"*", []string{"*"}, true},
+		{"https://installer.example.com/, http://10.0.0.5:8080", []string{"https://installer.example.com", "http://10.0.0.5:8080"}, true},
+		{"installer.example.com", nil, false},
+		{"ftp://installer.example.com", nil, false},
+		{"https://installer.example.com/app", nil, false},
+		{"https://installer.example.com?x=1", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCORSOrigins(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCORSOrigins(%q) err = %v", tt.in, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseCORSOrigins(%q) = %q, want %q", tt.in, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseCORSOrigins(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		}
+	}
+}
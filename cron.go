@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMaxDays bounds the search for the next run, beyond which a schedule is
+// considered to never run.
+const cronMaxDays = 5 * 366
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// cronField is the set of values a field of a cron expression matches.
+type cronField uint64
+
+func (f cronField) has(n int) bool { return f&(1<<uint(n)) != 0 }
+
+// cronSchedule is a parsed cron expression with the fields minute, hour, day
+// of month, month and day of week, evaluated in loc. When both day fields are
+// restricted, a day matching either of them matches, as in cron.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+// parseCron parses a five field cron expression or one of the @daily-style
+// macros, optionally prefixed with CRON_TZ=<zone> or TZ=<zone>. Without a
+// zone the expression is evaluated in the local time zone.
+func parseCron(expr string) (*cronSchedule, error) {
+	c := &cronSchedule{loc: time.Local}
+	fields := strings.Fields(expr)
+	if len(fields) > 0 {
+		if zone, ok := cutAnyPrefix(fields[0], "CRON_TZ=", "TZ="); ok {
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("unknown time zone %q", zone)
+			}
+			c.loc = loc
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		macro, ok := cronMacros[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown macro %q", fields[0])
+		}
+		fields = strings.Fields(macro)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	// 7 is Sunday as well.
+	if c.dow.has(7) {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = fields[2] == "*" || fields[2] == "?", fields[4] == "*" || fields[4] == "?"
+	return c, nil
+}
+
+func cutAnyPrefix(s string, prefixes ...string) (string, bool) {
+	for _, p := range prefixes {
+		if rest, ok := strings.CutPrefix(s, p); ok {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// parseCronField parses a comma-separated list of *, values, ranges like 1-5
+// and steps like */15 or 1-30/2. names are the names of the values from min
+// on, matched case-insensitively.
+func parseCronField(field string, min, max int, names []string) (cronField, error) {
+	var set cronField
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+
+		first, last := min, max
+		switch {
+		case rng == "*" || rng == "?":
+		default:
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = cronValue(from, min, max, names); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = cronValue(to, min, max, names); err != nil {
+					return 0, err
+				}
+				if last < first {
+					return 0, fmt.Errorf("invalid range %q", rng)
+				}
+			} else if hasStep {
+				// A single value with a step runs up to the maximum.
+				last = max
+			}
+		}
+		for n := first; n <= last; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+func cronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", s, min, max)
+	}
+	return n, nil
+}
+
+func (c *cronSchedule) matchesDay(year int, month time.Month, day int) bool {
+	if !c.month.has(int(month)) {
+		return false
+	}
+	dom := c.dom.has(day)
+	dow := c.dow.has(int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()))
+	switch {
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first run after the given time, or the zero time when the
+// schedule never runs. Times skipped when the clocks go forward don't run.
+// Times repeated when they go back run once, unless the schedule runs every
+// hour, which then runs by the hours actually elapsed.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.In(c.loc)
+	// The days are walked in UTC, which has no DST transitions.
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= cronMaxDays; i++ {
+		day := start.AddDate(0, 0, i)
+		if !c.matchesDay(day.Year(), day.Month(), day.Day()) {
+			continue
+		}
+		// The instants of a day aren't ordered like its wall clock times
+		// when the clocks go back, so the earliest one is searched.
+		var best time.Time
+		for h := 0; h < 24; h++ {
+			if !c.hour.has(h) {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if !c.minute.has(m) {
+					continue
+				}
+				for _, run := range c.occurrences(day, h, m) {
+					if run.After(after) && (best.IsZero() || run.Before(best)) {
+						best = run
+					}
+				}
+			}
+		}
+		if !best.IsZero() {
+			return best
+		}
+	}
+	return time.Time{}
+}
+
+// occurrences returns the instants the wall clock of loc shows h:m on day,
+// in order: none when the clocks skip the time, two when they go back over
+// it, of which schedules with fixed hours only keep the first.
+func (c *cronSchedule) occurrences(day time.Time, h, m int) []time.Time {
+	guess := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, c.loc)
+	var runs []time.Time
+	for _, run := range []time.Time{guess.Add(-time.Hour), guess, guess.Add(time.Hour)} {
+		w := run.In(c.loc)
+		if w.Year() == day.Year() && w.YearDay() == day.YearDay() && w.Hour() == h && w.Minute() == m {
+			runs = append(runs, run)
+		}
+	}
+	if len(runs) > 1 && c.hour != 1<<24-1 {
+		runs = runs[:1]
+	}
+	return runs
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"*/5 * * * *", true},
+		{"0 3 * * *", true},
+		{"0,30 9-17/2 1-15 jan-MAR mon-fri", true},
+		{"0 12 * * 7", true},
+		{"@daily", true},
+		{"@Hourly", true},
+		{"CRON_TZ=Europe/Berlin 30 2 * * *", true},
+		{"TZ=UTC @weekly", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"10-5 * * * *", false},
+		{"* * * foo *", false},
+		{"@fortnightly", false},
+		{"CRON_TZ=Mars/Olympus 0 0 * * *", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err == nil) != tt.ok {
+			t.Errorf("parseCron(%q) err = %v", tt.expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	if _, err := time.LoadLocation("Europe/Berlin"); err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		name  string
+		expr  string
+		after string
+		want  string
+	}{
+		{"every 5 minutes", "CRON_TZ=UTC */5 * * * *", "2024-09-06T10:42:10Z", "2024-09-06T10:45:00Z"},
+		{"exactly on a run", "CRON_TZ=UTC */5 * * * *", "2024-09-06T10:45:00Z", "2024-09-06T10:50:00Z"},
+		{"weekdays", "CRON_TZ=UTC */20 9-10 * * mon-fri", "2024-09-06T10:45:00Z", "2024-09-09T09:00:00Z"},
+		{"sunday as 7", "CRON_TZ=UTC 0 12 * * 7", "2024-09-02T00:00:00Z", "2024-09-08T12:00:00Z"},
+		{"day of month or week", "CRON_TZ=UTC 0 0 13 * 5", "2024-09-01T00:00:00Z", "2024-09-06T00:00:00Z"},
+		{"leap day", "CRON_TZ=UTC 0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"never", "CRON_TZ=UTC 0 0 30 2 *", "2024-03-01T00:00:00Z", ""},
+		{"zone", "CRON_TZ=Europe/Berlin 0 3 * * *", "2024-07-01T00:00:00Z", "2024-07-01T01:00:00Z"},
+
+		// The clocks of Berlin go from 02:00 to 03:00 on 2024-03-31.
+		{"skipped time", "CRON_TZ=Europe/Berlin 30 2 * * *", "2024-03-30T12:00:00Z", "2024-04-01T00:30:00Z"},
+		{"hourly over the gap", "CRON_TZ=Europe/Berlin 0 * * * *", "2024-03-31T00:30:00Z", "2024-03-31T01:00:00Z"},
+		{"after the gap", "CRON_TZ=Europe/Berlin 0 3 * * *", "2024-03-30T12:00:00Z", "2024-03-31T01:00:00Z"},
+
+		// They go from 03:00 back to 02:00 on 2024-10-27.
+		{"repeated time once", "CRON_TZ=Europe/Berlin 30 2 * * *", "2024-10-26T12:00:00Z", "2024-10-27T00:30:00Z"},
+		{"repeated time not twice", "CRON_TZ=Europe/Berlin 30 2 * * *", "2024-10-27T00:30:00Z", "2024-10-28T01:30:00Z"},
+		{"hourly in the first pass", "CRON_TZ=Europe/Berlin 30 * * * *", "2024-10-27T00:00:00Z", "2024-10-27T00:30:00Z"},
+		{"hourly in the second pass", "CRON_TZ=Europe/Berlin 30 * * * *", "2024-10-27T00:30:00Z", "2024-10-27T01:30:00Z"},
+		{"hourly after the overlap", "CRON_TZ=Europe/Berlin 30 * * * *", "2024-10-27T01:30:00Z", "2024-10-27T02:30:00Z"},
+		{"after the overlap", "CRON_TZ=Europe/Berlin 0 3 * * *", "2024-10-27T00:00:00Z", "2024-10-27T02:00:00Z"},
+
+		// New York goes forward on 2024-03-10, back on 2024-11-03.
+		{"new york gap", "CRON_TZ=America/New_York 15 2 * * *", "2024-03-09T12:00:00Z", "2024-03-11T06:15:00Z"},
+		{"new york overlap", "CRON_TZ=America/New_York 15 1 * * *", "2024-11-03T04:00:00Z", "2024-11-03T05:15:00Z"},
+		{"new york after the overlap", "CRON_TZ=America/New_York 15 1 * * *", "2024-11-03T05:15:00Z", "2024-11-04T06:15:00Z"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := c.next(utc(tt.after))
+		var want time.Time
+		if tt.want != "" {
+			want = utc(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: next(%s) = %s, want %s", tt.name, tt.after, got.UTC().Format(time.RFC3339), tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"find_cameras/scanner"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+type debugStats struct {
+	Goroutines     int    `json:"goroutines"`
+	RunningJobs    int    `json:"running_jobs"`
+	Workers        int64  `json:"workers"`
+	BusyWorkers    int64  `json:"busy_workers"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+}
+
+func handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	scanJobs.mu.Lock()
+	running := scanJobs.running
+	scanJobs.mu.Unlock()
+	workers, busy := scanner.Workers()
+	writeJSON(w, http.StatusOK, debugStats{
+		Goroutines:     runtime.NumGoroutine(),
+		RunningJobs:    running,
+		Workers:        workers,
+		BusyWorkers:    busy,
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapInuseBytes: mem.HeapInuse,
+		SysBytes:       mem.Sys,
+		NumGC:          mem.NumGC,
+	})
+}
+
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stats", handleDebugStats)
+	mux.HandleFunc("/debug/deliveries", handleDebugDeliveries)
+	return mux
+}
+
+// listenDebug checks that addr is a loopback address, so the profiles are
+// never exposed on the camera network, and starts listening on it.
+func listenDebug(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s is not a loopback address", host)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveDebug(ctx context.Context, ln net.Listener) {
+	server := &http.Server{Handler: debugMux()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("Serving debug endpoints", "addr", ln.Addr().String())
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		logger.Error("Debug server stopped", "err", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestDebugEndpointsAbsent checks that the API listener never serves the
+// debug endpoints.
+func TestDebugEndpointsAbsent(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline", "/debug/stats", "/debug/deliveries", apiPrefix + "/debug/pprof/"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestListenDebug(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", ":0", "192.0.2.1:6060", "example.com:6060", "127.0.0.1"} {
+		if ln, err := listenDebug(addr); err == nil {
+			ln.Close()
+			t.Errorf("listenDebug(%q) succeeded", addr)
+		}
+	}
+
+	ln, err := listenDebug("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serveDebug(ctx, ln)
+		close(done)
+	}()
+	base := "http://" + ln.Addr().String()
+
+	resp, err := http.Get(base + "/debug/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats debugStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil || stats.Goroutines == 0 {
+		t.Errorf("stats = %+v, %v", stats, err)
+	}
+	resp.Body.Close()
+	if resp, err := http.Get(base + "/debug/pprof/"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /debug/pprof/ = %v, %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("debug server still running after its context is done")
+	}
+	if _, err := http.Get(base + "/debug/stats"); err == nil {
+		t.Error("debug server still answering after being stopped")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"find_cameras/discovery"
+	"find_cameras/onvif"
+	"find_cameras/scanner"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sourceRTSP        = "rtsp"
+	sourceWSDiscovery = "ws-discovery"
+	sourceHello       = "hello"
+	sourceSSDP        = "ssdp"
+	sourceMDNS        = "mdns"
+)
+
+type device struct {
+	IP                string                   `json:"ip"`
+	Ports             []int                    `json:"ports"`
+	Hostname          string                   `json:"hostname"`
+	MAC               string                   `json:"mac"`
+	Vendor            string                   `json:"vendor"`
+	Sources           []string                 `json:"sources"`
+	Interface         string                   `json:"interface,omitempty"`
+	Network           string                   `json:"network,omitempty"`
+	Networks          []networkRef             `json:"networks,omitempty"`
+	DHCPHostname      string                   `json:"dhcp_hostname,omitempty"`
+	FriendlyName      string                   `json:"friendly_name,omitempty"`
+	Model             string                   `json:"model,omitempty"`
+	VendorGuess       string                   `json:"vendor_guess,omitempty"`
+	ModelGuess        string                   `json:"model_guess,omitempty"`
+	Banners           *deviceBanners           `json:"banners,omitempty"`
+	MDNSInstance      string                   `json:"mdns_instance,omitempty"`
+	MDNSPort          int                      `json:"mdns_port,omitempty"`
+	RTSPStatus        int                      `json:"rtsp_status,omitempty"`
+	RTSPS             bool                     `json:"rtsps,omitempty"`
+	RTSPSPorts        []int                    `json:"rtsps_ports,omitempty"`
+	Certificate       *tlsCertificate          `json:"certificate,omitempty"`
+	Auth              string                   `json:"auth,omitempty"`
+	AuthError         string                   `json:"auth_error,omitempty"`
+	RTTMS             float64                  `json:"rtt_ms,omitempty"`
+	ONVIFRTTMS        float64                  `json:"onvif_rtt_ms,omitempty"`
+	Attempts          int                      `json:"attempts,omitempty"`
+	Server            string                   `json:"server,omitempty"`
+	XAddrs            []string                 `json:"xaddrs,omitempty"`
+	EndpointReference string                   `json:"endpoint_reference,omitempty"`
+	Scopes            []string                 `json:"scopes,omitempty"`
+	Location          []string                 `json:"location,omitempty"`
+	Hardware          []string                 `json:"hardware,omitempty"`
+	Name              []string                 `json:"name,omitempty"`
+	Profile           []string                 `json:"profile,omitempty"`
+	Paths             []streamPath             `json:"paths,omitempty"`
+	RTSPURLs          []string                 `json:"rtsp_urls,omitempty"`
+	Playable          *bool                    `json:"playable,omitempty"`
+	Playback          []playbackCheck          `json:"playback,omitempty"`
+	Services          map[string]onvif.Service `json:"services,omitempty"`
+	CapabilitiesError string                   `json:"capabilities_error,omitempty"`
+	Profiles          []mediaProfile           `json:"profiles,omitempty"`
+	MediaError        string                   `json:"media_error,omitempty"`
+	ONVIFCredential   string                   `json:"onvif_credential,omitempty"`
+	PTZ               *ptzInfo                 `json:"ptz"`
+	PTZError          string                   `json:"ptz_error,omitempty"`
+	ONVIFHostname     string                   `json:"onvif_hostname,omitempty"`
+	Addresses         []string                 `json:"addresses,omitempty"`
+	HwAddresses       []string                 `json:"hw_addresses,omitempty"`
+	NetworkInterfaces []onvif.NetworkInterface `json:"network_interfaces,omitempty"`
+	StrayAddresses    []string                 `json:"stray_addresses,omitempty"`
+	NetworkError      string                   `json:"network_error,omitempty"`
+	// FirmwareVersion and SerialNumber are reported by GetDeviceInformation.
+	FirmwareVersion        string `json:"firmware_version,omitempty"`
+	SerialNumber           string `json:"serial_number,omitempty"`
+	DeviceInformationError string `json:"device_information_error,omitempty"`
+	// EnrichmentTimeout tells that the ONVIF enrichment ran out of its
+	// budget, the ONVIF details being incomplete.
+	EnrichmentTimeout bool `json:"enrichment_timeout,omitempty"`
+
+	SnapshotURI          string `json:"snapshot_uri,omitempty"`
+	SnapshotAuthRequired bool   `json:"snapshot_auth_required,omitempty"`
+	SnapshotError        string `json:"snapshot_error,omitempty"`
+
+	// rtspCredential are the credentials the RTSP server accepted, only
+	// ever embedded in the URLs of a response on request.
+	rtspCredential *credential
+}
+
+type deviceSet struct {
+	devices []device
+	index   map[string]int
+}
+
+func newDeviceSet() *deviceSet {
+	return &deviceSet{devices: []device{}, index: make(map[string]int)}
+}
+
+func (s *deviceSet) get(ip, source string) *device {
+	i, ok := s.index[ip]
+	if !ok {
+		i = len(s.devices)
+		s.index[ip] = i
+		s.devices = append(s.devices, device{IP: ip, Ports: []int{}})
+	}
+	d := &s.devices[i]
+	for _, existing := range d.Sources {
+		if existing == source {
+			return d
+		}
+	}
+	d.Sources = append(d.Sources, source)
+	return d
+}
+
+func (s *deviceSet) addRTSP(results []scanner.Result) {
+	for _, result := range results {
+		d := s.get(result.IP, sourceRTSP)
+		d.Ports = result.Ports
+		d.RTSPStatus = result.StatusCode
+		d.RTTMS = milliseconds(result.RTT)
+		d.Server = result.Server
+		d.Attempts = result.Attempts
+		d.RTSPS = len(result.TLSPorts) > 0
+		d.RTSPSPorts = result.TLSPorts
+		d.Certificate = newTLSCertificate(result.Certificate)
+	}
+}
+
+// addEnriched merges the ONVIF details of enriched devices, adding those
+// not found otherwise.
+func (s *deviceSet) addEnriched(devices []device) {
+	for i := range devices {
+		if j, ok := s.index[devices[i].IP]; ok {
+			copyEnrichment(&s.devices[j], &devices[i])
+			continue
+		}
+		s.index[devices[i].IP] = len(s.devices)
+		s.devices = append(s.devices, devices[i])
+	}
+}
+
+// addResumed adds the cameras a resumed scan found before it was
+// interrupted.
+func (s *deviceSet) addResumed(devices []device) {
+	for _, d := range devices {
+		if _, ok := s.index[d.IP]; ok {
+			continue
+		}
+		s.index[d.IP] = len(s.devices)
+		s.devices = append(s.devices, d)
+	}
+}
+
+func (s *deviceSet) addONVIFHTTP(results []scanner.Result) {
+	for _, result := range results {
+		d := s.get(result.IP, sourceONVIFHTTP)
+		if rtt := milliseconds(result.RTT); rtt > 0 && (d.RTTMS == 0 || rtt < d.RTTMS) {
+			d.RTTMS = rtt
+		}
+		for _, port := range result.Ports {
+			if xaddr := onvifServiceURL(result.IP, port); !containsString(d.XAddrs, xaddr) {
+				d.XAddrs = append(d.XAddrs, xaddr)
+			}
+		}
+	}
+}
+
+func (s *deviceSet) addMatches(matches []discovery.Match, source string) {
+	for _, m := range matches {
+		d := s.get(m.IP, source)
+		if d.EndpointReference == "" {
+			d.XAddrs = m.XAddrs
+			d.EndpointReference = m.EndpointReference
+			d.setScopes(m.Scopes)
+		}
+	}
+}
+
+// firmware returns the firmware version the device reported over ONVIF, or
+// else its RTSP server banner, which sometimes carries the version.
+func (d *device) firmware() string {
+	if d.FirmwareVersion != "" {
+		return d.FirmwareVersion
+	}
+	return d.Server
+}
+
+// setScopes keeps the WS-Discovery scopes of a device along with the values
+// of the categories they were parsed into.
+func (d *device) setScopes(scopes []string) {
+	parsed := discovery.ParseScopes(scopes)
+	d.Scopes = scopes
+	d.Location, d.Hardware, d.Name, d.Profile = parsed.Location, parsed.Hardware, parsed.Name, parsed.Profile
+}
+
+func (s *deviceSet) addSSDP(devices []discovery.SSDPDevice) {
+	for _, sd := range devices {
+		d := s.get(sd.IP, sourceSSDP)
+		d.FriendlyName = sd.FriendlyName
+		d.Model = sd.ModelName
+	}
+}
+
+func (s *deviceSet) addMDNS(services []discovery.MDNSService) {
+	for _, ms := range services {
+		d := s.get(ms.IP, sourceMDNS)
+		if d.MDNSInstance == "" {
+			d.MDNSInstance = ms.Instance
+			d.MDNSPort = ms.Port
+		}
+	}
+}
+
+func (s *deviceSet) addNeighbors(entries []neighbor) {
+	macs := make(map[string]string, len(entries))
+	for _, e := range entries {
+		macs[e.IP] = e.MAC
+	}
+	for i := range s.devices {
+		d := &s.devices[i]
+		if mac, ok := macs[d.IP]; ok {
+			d.MAC = mac
+			d.Vendor = vendors.vendor(mac)
+		}
+	}
+}
+
+// milliseconds converts d to fractional milliseconds with microsecond
+// precision.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// sortDevices puts devices in their canonical order, by IP compared
+// numerically, along with their ports and profiles, so scans of an unchanged
+// network give identical responses.
+func sortDevices(devices []device) {
+	sort.Slice(devices, func(i, j int) bool { return compareIPs(devices[i].IP, devices[j].IP) < 0 })
+	for i := range devices {
+		d := &devices[i]
+		sort.Ints(d.Ports)
+		sort.Ints(d.RTSPSPorts)
+		sort.SliceStable(d.Profiles, func(a, b int) bool { return d.Profiles[a].Token < d.Profiles[b].Token })
+	}
+}
+
+// networkRef names a network of a device.
+type networkRef struct {
+	Network   string `json:"network"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// addNetworks records the networks every device is on, the first of them
+// as its network.
+func (s *deviceSet) addNetworks(networks []localNetwork) {
+	for i := range s.devices {
+		d := &s.devices[i]
+		host, zone, _ := strings.Cut(d.IP, "%")
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		for _, network := range networks {
+			if network.Contains(ip) && (zone == "" || zone == network.Interface) {
+				if d.Network == "" {
+					d.Interface, d.Network = network.Interface, network.String()
+				}
+				d.Networks = append(d.Networks, networkRef{Network: network.String(), Interface: network.Interface})
+			}
+		}
+	}
+}
+
+// flagStrayAddresses lists the IPv4 addresses devices report over ONVIF that
+// are on a swept network but answered nothing there. IPv6 networks are left
+// out, only their neighbors are probed.
+func flagStrayAddresses(devices []device, networks []localNetwork, exclude exclusionList) {
+	// The hostnames are resolved meanwhile, so the devices aren't copied.
+	found := make(map[string]bool, len(devices))
+	for i := range devices {
+		found[devices[i].IP] = true
+	}
+	for i := range devices {
+		d := &devices[i]
+		for _, addr := range d.Addresses {
+			ip, _, err := net.ParseCIDR(addr)
+			if err != nil || ip.To4() == nil || ip.IsLinkLocalUnicast() || found[ip.String()] || exclude.contains(ip.String()) {
+				continue
+			}
+			for _, network := range networks {
+				if network.Contains(ip) {
+					d.StrayAddresses = append(d.StrayAddresses, ip.String())
+					break
+				}
+			}
+		}
+	}
+}
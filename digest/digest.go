@@ -0,0 +1,134 @@
+package digest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync/atomic"
+)
+
+// Challenge is a parsed Digest WWW-Authenticate challenge as described in RFC 7616.
+type Challenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	QOP       string
+	Stale     bool
+
+	nc uint32
+}
+
+// ParseChallenge parses the value of a WWW-Authenticate header carrying a
+// Digest challenge.
+func ParseChallenge(header string) (*Challenge, error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, errors.New("not a digest challenge")
+	}
+
+	c := &Challenge{}
+	for _, param := range splitParams(params) {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "realm":
+			c.Realm = value
+		case "nonce":
+			c.Nonce = value
+		case "opaque":
+			c.Opaque = value
+		case "algorithm":
+			c.Algorithm = value
+		case "qop":
+			for _, qop := range strings.Split(value, ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					c.QOP = "auth"
+				}
+			}
+		case "stale":
+			c.Stale = strings.EqualFold(value, "true")
+		}
+	}
+	if c.Nonce == "" {
+		return nil, errors.New("digest challenge without nonce")
+	}
+	return c, nil
+}
+
+func splitParams(s string) []string {
+	var params []string
+	var quoted bool
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(params, s[start:])
+}
+
+// Authorize returns the value of the Authorization header answering the
+// challenge for a request with the given method and uri.
+func (c *Challenge) Authorize(username, password, method, uri string) (string, error) {
+	var h func() hash.Hash
+	switch strings.ToUpper(c.Algorithm) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", c.Algorithm)
+	}
+	sum := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := sum(username + ":" + c.Realm + ":" + password)
+	ha2 := sum(method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, c.Realm, c.Nonce, uri)
+	if c.QOP == "auth" {
+		cnonce, err := newCnonce()
+		if err != nil {
+			return "", err
+		}
+		nc := fmt.Sprintf("%08x", atomic.AddUint32(&c.nc, 1))
+		fmt.Fprintf(&b, `, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce,
+			sum(ha1+":"+c.Nonce+":"+nc+":"+cnonce+":auth:"+ha2))
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, sum(ha1+":"+c.Nonce+":"+ha2))
+	}
+	if c.Algorithm != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", c.Algorithm)
+	}
+	if c.Opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, c.Opaque)
+	}
+	return b.String(), nil
+}
+
+func newCnonce() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
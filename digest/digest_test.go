@@ -0,0 +1,130 @@
+package digest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   *Challenge
+	}{
+		{
+			`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			&Challenge{Realm: "testrealm@host.com", Nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", Opaque: "5ccc069c403ebaf9f0171e9517f40e41", QOP: "auth"},
+		},
+		{
+			`digest realm="IP Camera(C3168)", nonce="b79f8a2d", algorithm=SHA-256, stale=TRUE`,
+			&Challenge{Realm: "IP Camera(C3168)", Nonce: "b79f8a2d", Algorithm: "SHA-256", Stale: true},
+		},
+		{
+			`Digest realm="a, b=c", nonce="n"`,
+			&Challenge{Realm: "a, b=c", Nonce: "n"},
+		},
+		{
+			`  Digest  nonce="n" , qop="auth-int", broken, realm = "cam" `,
+			&Challenge{Realm: "cam", Nonce: "n"},
+		},
+		{`Digest realm="cam"`, nil},
+		{`Basic realm="cam"`, nil},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseChallenge(tt.header)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseChallenge(%q) = %+v, want an error", tt.header, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseChallenge(%q) = %+v, %v, want %+v", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+// authParams returns the parameters of an Authorization header.
+func authParams(t *testing.T, header string) map[string]string {
+	t.Helper()
+	rest, ok := strings.CutPrefix(header, "Digest ")
+	if !ok {
+		t.Fatalf("Authorization %q", header)
+	}
+	params := map[string]string{}
+	for _, param := range splitParams(rest) {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.TrimSpace(key)] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge Challenge
+		password  string
+		want      map[string]string
+	}{
+		{
+			"rfc 2069",
+			Challenge{Realm: "testrealm@host.com", Nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", Opaque: "5ccc069c403ebaf9f0171e9517f40e41"},
+			"Circle Of Life",
+			map[string]string{
+				"username": "Mufasa", "realm": "testrealm@host.com", "nonce": "dcd98b7102dd2f0e8b11d0f600bfb0c093", "uri": "/dir/index.html",
+				"response": "670fd8c2df070c60b045671b8b24ff02", "opaque": "5ccc069c403ebaf9f0171e9517f40e41",
+			},
+		},
+		{
+			"sha-256",
+			Challenge{Realm: "http-auth@example.org", Nonce: "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", Algorithm: "SHA-256"},
+			"Circle of Life",
+			map[string]string{
+				"username": "Mufasa", "realm": "http-auth@example.org", "nonce": "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", "uri": "/dir/index.html",
+				"response": "a1306b0595a6c7fe96c448631fb5cfbd5107bd1fe1da729d978dd7446b812363", "algorithm": "SHA-256",
+			},
+		},
+	}
+	for _, tt := range tests {
+		header, err := tt.challenge.Authorize("Mufasa", tt.password, "GET", "/dir/index.html")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := authParams(t, header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Authorization %q, want %v", tt.name, header, tt.want)
+		}
+	}
+
+	c := &Challenge{Algorithm: "SHA-512-256", Nonce: "n"}
+	if _, err := c.Authorize("admin", "secret", "GET", "/"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
+
+func TestAuthorizeQOP(t *testing.T) {
+	md5sum := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	c := &Challenge{Realm: "camera", Nonce: "abc", QOP: "auth"}
+	var cnonces []string
+	for _, nc := range []string{"00000001", "00000002"} {
+		header, err := c.Authorize("admin", "secret", "DESCRIBE", "rtsp://192.168.1.10:554/live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := authParams(t, header)
+		want := md5sum(md5sum("admin:camera:secret") + ":abc:" + nc + ":" + p["cnonce"] + ":auth:" + md5sum("DESCRIBE:rtsp://192.168.1.10:554/live"))
+		if p["qop"] != "auth" || p["nc"] != nc || p["cnonce"] == "" || p["response"] != want {
+			t.Errorf("Authorization %q, want nc=%s and response %s", header, nc, want)
+		}
+		cnonces = append(cnonces, p["cnonce"])
+	}
+	if cnonces[0] == cnonces[1] {
+		t.Errorf("cnonce %s reused", cnonces[0])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"find_cameras/discovery"
+	"net"
+	"time"
+)
+
+const maxDiscoveryRepeats = 10
+
+var (
+	// multicast is how often and how far apart the discovery queries are
+	// sent from every local address.
+	multicast = discovery.Multicast{Repeats: 2, Interval: discovery.DefaultInterval}
+	// discoveryInterfaces are the interfaces the queries are sent out of,
+	// all those of the scanned networks when empty.
+	discoveryInterfaces []string
+)
+
+func localAddrs(networks []localNetwork, includeIPv6 bool) []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, network := range networks {
+		if network.Requested || (network.isIPv6() && !includeIPv6) {
+			continue
+		}
+		if len(discoveryInterfaces) > 0 && !containsString(discoveryInterfaces, network.Interface) {
+			continue
+		}
+		addrs = append(addrs, network.localAddr())
+	}
+	return addrs
+}
+
+// multicastFor returns the multicast settings of a discovery protocol,
+// logging the addresses its queries could not be sent from.
+func multicastFor(ctx context.Context, protocol string) discovery.Multicast {
+	m := multicast
+	m.Failed = func(local net.IPAddr, err error) {
+		loggerFrom(ctx).Warn("Skipping discovery address", "protocol", protocol, "addr", local.String(), "err", err)
+	}
+	return m
+}
+
+func discoverONVIF(ctx context.Context, networks []localNetwork, window time.Duration) []discovery.Match {
+	ips := localAddrs(networks, true)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	prober := &discovery.Prober{Window: window, Multicast: multicastFor(ctx, "WS-Discovery")}
+	matches, err := prober.Probe(ctx, ips)
+	if err != nil {
+		loggerFrom(ctx).Warn("WS-Discovery failed", "err", err)
+		return nil
+	}
+	return matches
+}
+
+func discoverSSDP(ctx context.Context, networks []localNetwork, window time.Duration, exclude exclusionList) []discovery.SSDPDevice {
+	ips := localAddrs(networks, false)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	searcher := &discovery.SSDPSearcher{Window: window, Skip: exclude.contains, Multicast: multicastFor(ctx, "SSDP")}
+	devices, err := searcher.Search(ctx, ips)
+	if err != nil {
+		loggerFrom(ctx).Warn("SSDP discovery failed", "err", err)
+		return nil
+	}
+	return devices
+}
+
+func discoverMDNS(ctx context.Context, networks []localNetwork, window time.Duration) []discovery.MDNSService {
+	ips := localAddrs(networks, true)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	browser := &discovery.MDNSBrowser{Window: window, Multicast: multicastFor(ctx, "mDNS")}
+	services, err := browser.Browse(ctx, ips)
+	if err != nil {
+		loggerFrom(ctx).Warn("mDNS discovery failed", "err", err)
+		return nil
+	}
+	return services
+}
@@ -0,0 +1,39 @@
+package discovery
+
+import "net"
+
+// destination returns the network and the address a message sent from local
+// goes to: override when it is set, otherwise the IPv4 or IPv6 group
+// depending on the family of local.
+func destination(local net.IPAddr, override, group4, group6 string) (string, *net.UDPAddr, error) {
+	network, addr := "udp4", group4
+	if local.IP.To4() == nil {
+		network, addr = "udp6", group6
+	}
+	if override != "" {
+		addr = override
+	}
+	dst, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return "", nil, err
+	}
+	if network == "udp6" && dst.IP.IsMulticast() && dst.Zone == "" {
+		dst.Zone = local.Zone
+	}
+	return network, dst, nil
+}
+
+func listenLocal(network string, local net.IPAddr) (*net.UDPConn, error) {
+	addr := &net.UDPAddr{IP: local.IP}
+	if local.IP.IsLinkLocalUnicast() {
+		addr.Zone = local.Zone
+	}
+	return net.ListenUDP(network, addr)
+}
+
+func hostString(addr *net.UDPAddr) string {
+	if addr.Zone != "" && addr.IP.IsLinkLocalUnicast() {
+		return addr.IP.String() + "%" + addr.Zone
+	}
+	return addr.IP.String()
+}
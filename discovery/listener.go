@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Announcement is the last known state of a device that announced itself
+// with a WS-Discovery Hello message.
+type Announcement struct {
+	Match
+	Online   bool
+	LastSeen time.Time
+}
+
+// Listener keeps a table of devices announced by WS-Discovery Hello and Bye
+// multicast messages.
+type Listener struct {
+	// Failed is called with the error of every interface the group could
+	// not be joined on or announcements no longer be read from. The other
+	// interfaces keep listening.
+	Failed func(iface string, err error)
+
+	mu      sync.Mutex
+	devices map[string]*Announcement
+}
+
+func NewListener() *Listener {
+	return &Listener{devices: make(map[string]*Announcement)}
+}
+
+// Listen joins the WS-Discovery multicast group on the given interfaces and
+// records announcements until ctx is cancelled.
+func (l *Listener) Listen(ctx context.Context, ifaces []net.Interface) error {
+	group, err := net.ResolveUDPAddr("udp4", MulticastAddr)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var joined int
+	for i := range ifaces {
+		conn, err := net.ListenMulticastUDP("udp4", &ifaces[i], group)
+		if err != nil {
+			l.failed(ifaces[i].Name, fmt.Errorf("joining WS-Discovery group: %w", err))
+			continue
+		}
+		joined++
+		wg.Add(1)
+		go func(conn *net.UDPConn, iface string) {
+			defer wg.Done()
+			l.serve(ctx, conn, iface)
+		}(conn, ifaces[i].Name)
+	}
+	if joined == 0 {
+		return errors.New("could not join WS-Discovery group on any interface")
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// failed passes the error of iface on to Failed.
+func (l *Listener) failed(iface string, err error) {
+	if l.Failed != nil {
+		l.Failed(iface, err)
+	}
+}
+
+func (l *Listener) serve(ctx context.Context, conn *net.UDPConn, iface string) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				l.failed(iface, fmt.Errorf("reading WS-Discovery announcements: %w", err))
+			}
+			return
+		}
+		l.handle(buf[:n], from.IP.String())
+	}
+}
+
+type announcementEnvelope struct {
+	Header struct {
+		Action string `xml:"Action"`
+	} `xml:"Header"`
+	Body struct {
+		Hello *announcementBody `xml:"Hello"`
+		Bye   *announcementBody `xml:"Bye"`
+	} `xml:"Body"`
+}
+
+type announcementBody struct {
+	EndpointReference struct {
+		Address string `xml:"Address"`
+	} `xml:"EndpointReference"`
+	Types  string `xml:"Types"`
+	Scopes string `xml:"Scopes"`
+	XAddrs string `xml:"XAddrs"`
+}
+
+func (l *Listener) handle(data []byte, ip string) error {
+	var env announcementEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return err
+	}
+
+	switch {
+	case env.Body.Hello != nil:
+		hello := env.Body.Hello
+		ref := strings.TrimSpace(hello.EndpointReference.Address)
+		if ref == "" {
+			return errors.New("hello without endpoint reference")
+		}
+		l.mu.Lock()
+		l.devices[ref] = &Announcement{
+			Match: Match{
+				IP:                ip,
+				EndpointReference: ref,
+				XAddrs:            strings.Fields(hello.XAddrs),
+				Types:             strings.Fields(hello.Types),
+				Scopes:            strings.Fields(hello.Scopes),
+			},
+			Online:   true,
+			LastSeen: time.Now(),
+		}
+		l.mu.Unlock()
+	case env.Body.Bye != nil:
+		ref := strings.TrimSpace(env.Body.Bye.EndpointReference.Address)
+		l.mu.Lock()
+		if a, ok := l.devices[ref]; ok {
+			a.Online = false
+			a.LastSeen = time.Now()
+		}
+		l.mu.Unlock()
+	default:
+		return fmt.Errorf("unexpected message %q", env.Header.Action)
+	}
+	return nil
+}
+
+// Announcements returns the announced devices, most recently seen first.
+func (l *Listener) Announcements() []Announcement {
+	l.mu.Lock()
+	announcements := make([]Announcement, 0, len(l.devices))
+	for _, a := range l.devices {
+		announcements = append(announcements, *a)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(announcements, func(i, j int) bool {
+		return announcements[i].LastSeen.After(announcements[j].LastSeen)
+	})
+	return announcements
+}
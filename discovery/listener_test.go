@@ -0,0 +1,19 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenFailed(t *testing.T) {
+	l := NewListener()
+	var failed []string
+	l.Failed = func(iface string, err error) { failed = append(failed, iface) }
+	if err := l.Listen(context.Background(), []net.Interface{{Index: 1 << 20, Name: "missing0"}}); err == nil {
+		t.Error("Listen without any joined interface succeeded")
+	}
+	if len(failed) != 1 || failed[0] != "missing0" {
+		t.Errorf("failed interfaces = %q", failed)
+	}
+}
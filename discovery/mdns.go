@@ -0,0 +1,291 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MDNSMulticastAddr  = "224.0.0.251:5353"
+	MDNSMulticastAddr6 = "[ff02::fb]:5353"
+)
+
+// DefaultMDNSServices are the DNS-SD service types browsed for cameras.
+var DefaultMDNSServices = []string{"_rtsp._tcp.local.", "_onvif._tcp.local.", "_axis-video._tcp.local."}
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeSRV  = 33
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// MDNSService is a service instance advertised over mDNS.
+type MDNSService struct {
+	IP       string
+	Service  string
+	Instance string
+	Host     string
+	Port     int
+}
+
+// MDNSBrowser queries DNS-SD service types over multicast DNS.
+type MDNSBrowser struct {
+	// Addr is the destination of the queries, MDNSMulticastAddr or
+	// MDNSMulticastAddr6 when empty.
+	Addr string
+	// Services are the service types to browse, DefaultMDNSServices when empty.
+	Services []string
+	// Window is how long responses are collected after the query is sent.
+	Window time.Duration
+	Multicast
+}
+
+type mdnsRecords struct {
+	ptr map[string][]string
+	srv map[string]srvRecord
+	a   map[string][]string
+	src map[string]string
+}
+
+type srvRecord struct {
+	target string
+	port   int
+}
+
+// Browse queries the service types from every given local address and
+// returns the resolved service instances.
+func (b *MDNSBrowser) Browse(ctx context.Context, localAddrs []net.IPAddr) ([]MDNSService, error) {
+	services := b.Services
+	if len(services) == 0 {
+		services = DefaultMDNSServices
+	}
+	query := buildQuery(services)
+
+	ctx, cancel := context.WithTimeout(ctx, b.Window)
+	defer cancel()
+
+	records := &mdnsRecords{
+		ptr: make(map[string][]string),
+		srv: make(map[string]srvRecord),
+		a:   make(map[string][]string),
+		src: make(map[string]string),
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for _, local := range localAddrs {
+		wg.Add(1)
+		go func(local net.IPAddr) {
+			defer wg.Done()
+			err := b.queryFrom(ctx, local, query, func(msg []byte, from *net.UDPAddr) {
+				mu.Lock()
+				defer mu.Unlock()
+				records.add(msg, from)
+			})
+			if err != nil {
+				err = fmt.Errorf("query from %s: %w", local.String(), err)
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				b.failed(local, err)
+			}
+		}(local)
+	}
+	wg.Wait()
+
+	found := records.resolve(services)
+	if len(found) == 0 && len(errs) > 0 && len(errs) == len(localAddrs) {
+		return nil, errs[0]
+	}
+	return found, nil
+}
+
+func (b *MDNSBrowser) queryFrom(ctx context.Context, local net.IPAddr, query []byte, handle func([]byte, *net.UDPAddr)) error {
+	network, dst, err := destination(local, b.Addr, MDNSMulticastAddr, MDNSMulticastAddr6)
+	if err != nil {
+		return err
+	}
+	conn, err := listenMulticast(network, local, dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := b.send(ctx, conn, dst, query); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		handle(buf[:n], from)
+	}
+}
+
+func buildQuery(services []string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(services)))
+	for _, service := range services {
+		for _, label := range strings.Split(strings.TrimSuffix(service, "."), ".") {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypePTR)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	return msg
+}
+
+func (r *mdnsRecords) add(msg []byte, from *net.UDPAddr) {
+	if len(msg) < 12 {
+		return
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return
+		}
+		rrtype := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return
+		}
+		off = rdata + rdlen
+		name = strings.ToLower(name)
+
+		switch rrtype {
+		case dnsTypePTR:
+			instance, _, err := readName(msg, rdata)
+			if err != nil {
+				continue
+			}
+			r.ptr[name] = appendUnique(r.ptr[name], instance)
+			r.src[strings.ToLower(instance)] = hostString(from)
+		case dnsTypeSRV:
+			if rdlen < 7 {
+				continue
+			}
+			target, _, err := readName(msg, rdata+6)
+			if err != nil {
+				continue
+			}
+			r.srv[name] = srvRecord{target: strings.ToLower(target), port: int(binary.BigEndian.Uint16(msg[rdata+4:]))}
+		case dnsTypeA:
+			if rdlen == 4 {
+				r.a[name] = append(r.a[name], net.IP(msg[rdata:rdata+4]).String())
+			}
+		case dnsTypeAAAA:
+			if rdlen == 16 {
+				ip := &net.UDPAddr{IP: append(net.IP(nil), msg[rdata:rdata+16]...), Zone: from.Zone}
+				r.a[name] = append(r.a[name], hostString(ip))
+			}
+		}
+	}
+}
+
+func (r *mdnsRecords) resolve(services []string) []MDNSService {
+	var found []MDNSService
+	for _, service := range services {
+		for _, instance := range r.ptr[strings.ToLower(service)] {
+			key := strings.ToLower(instance)
+			s := MDNSService{
+				Service:  service,
+				Instance: strings.TrimSuffix(strings.TrimSuffix(instance, "."+service), "."),
+			}
+			if srv, ok := r.srv[key]; ok {
+				s.Host, s.Port = srv.target, srv.port
+				if ips := r.a[srv.target]; len(ips) > 0 {
+					s.IP = ips[0]
+				}
+			}
+			if s.IP == "" {
+				s.IP = r.src[key]
+			}
+			if s.IP != "" {
+				found = append(found, s)
+			}
+		}
+	}
+	return found
+}
+
+var errBadName = errors.New("malformed dns name")
+
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errBadName
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errBadName
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errBadName
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errBadName
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultInterval separates the repetitions of a query when
+// Multicast.Interval is not set.
+const DefaultInterval = 250 * time.Millisecond
+
+// Multicast configures how the queries of a discovery protocol are sent to
+// its multicast group.
+type Multicast struct {
+	// Repeats is how often a query is sent from every local address, once
+	// when below 1, Interval apart, as UDP datagrams get lost.
+	Repeats  int
+	Interval time.Duration
+	// Failed is called with the error of every local address no query
+	// could be sent from, e.g. of an interface without multicast. The
+	// other addresses are still queried.
+	Failed func(local net.IPAddr, err error)
+}
+
+// failed passes the error of local on to Failed.
+func (m Multicast) failed(local net.IPAddr, err error) {
+	if m.Failed != nil {
+		m.Failed(local, err)
+	}
+}
+
+// send writes the messages to dst, then again Repeats-1 times in the
+// background until ctx is done. Only the errors of the first send are
+// returned.
+func (m Multicast) send(ctx context.Context, conn *net.UDPConn, dst *net.UDPAddr, messages ...[]byte) error {
+	write := func() error {
+		for _, msg := range messages {
+			if _, err := conn.WriteToUDP(msg, dst); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	if m.Repeats < 2 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(m.interval())
+		defer ticker.Stop()
+		for i := 1; i < m.Repeats; i++ {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if write() != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (m Multicast) interval() time.Duration {
+	if m.Interval <= 0 {
+		return DefaultInterval
+	}
+	return m.Interval
+}
+
+// listenMulticast opens the socket a query to the group dst is sent from
+// and answered on. It is bound to local and, when dst is a multicast group,
+// sends out of the interface of local and joins dst there, so multi-homed
+// hosts reach every network and IGMP snooping switches forward the group.
+func listenMulticast(network string, local net.IPAddr, dst *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := listenLocal(network, local)
+	if err != nil || !dst.IP.IsMulticast() {
+		return conn, err
+	}
+	ifi, err := localInterface(local)
+	if err == nil {
+		err = bindMulticast(conn, ifi, dst.IP)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+var errNoInterface = errors.New("no interface has the address")
+
+// localInterface returns the interface local is an address of.
+func localInterface(local net.IPAddr) (*net.Interface, error) {
+	if local.Zone != "" {
+		return net.InterfaceByName(local.Zone)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local.IP) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, errNoInterface
+}
@@ -0,0 +1,34 @@
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindMulticast makes conn send its multicast datagrams out of ifi and joins
+// group on ifi.
+func bindMulticast(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ip4 := group.To4(); ip4 != nil {
+			mreq := &syscall.IPMreqn{Multiaddr: [4]byte(ip4), Ifindex: int32(ifi.Index)}
+			if serr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq); serr == nil {
+				serr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+			}
+			return
+		}
+		mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+		copy(mreq.Multiaddr[:], group.To16())
+		if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index); serr == nil {
+			serr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
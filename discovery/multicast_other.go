@@ -0,0 +1,11 @@
+//go:build !linux
+
+package discovery
+
+import "net"
+
+// bindMulticast leaves the choice of the interface to the system, which
+// picks it from the route to group.
+func bindMulticast(conn *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	return nil
+}
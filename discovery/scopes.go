@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"net/url"
+	"strings"
+)
+
+const onvifScopePrefix = "onvif://www.onvif.org/"
+
+// Scopes are the values of the ONVIF scope categories a device announces.
+// A category may carry several values; the values of a nested category like
+// location/city/lund keep their path.
+type Scopes struct {
+	Location []string
+	Hardware []string
+	Name     []string
+	Profile  []string
+}
+
+// ParseScopes sorts the onvif://www.onvif.org scopes of the location,
+// hardware, name and Profile categories into Scopes, URL-decoding their
+// values. Scopes of other categories and vendor namespaces are left out.
+func ParseScopes(scopes []string) Scopes {
+	var s Scopes
+	for _, scope := range scopes {
+		if len(scope) < len(onvifScopePrefix) || !strings.EqualFold(scope[:len(onvifScopePrefix)], onvifScopePrefix) {
+			continue
+		}
+		category, rest, _ := strings.Cut(scope[len(onvifScopePrefix):], "/")
+		value := decodeScopeValue(rest)
+		if value == "" {
+			continue
+		}
+		switch strings.ToLower(category) {
+		case "location":
+			s.Location = appendUnique(s.Location, value)
+		case "hardware":
+			s.Hardware = appendUnique(s.Hardware, value)
+		case "name":
+			s.Name = appendUnique(s.Name, value)
+		case "profile":
+			s.Profile = appendUnique(s.Profile, value)
+		}
+	}
+	return s
+}
+
+// decodeScopeValue URL-decodes the segments of a scope value, dropping empty
+// ones and keeping those that don't decode.
+func decodeScopeValue(rest string) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(rest, "/"), "/") {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segment = decoded
+		}
+		if segment = strings.TrimSpace(segment); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		want   Scopes
+	}{
+		{
+			"hikvision",
+			"onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/Profile/Streaming onvif://www.onvif.org/MediaVersion/2 " +
+				"onvif://www.onvif.org/Profile/G onvif://www.onvif.org/Profile/T onvif://www.onvif.org/hardware/DS-2CD2043G0-I " +
+				"onvif://www.onvif.org/name/HIKVISION%20DS-2CD2043G0-I onvif://www.onvif.org/location/city/hangzhou",
+			Scopes{
+				Location: []string{"city/hangzhou"},
+				Hardware: []string{"DS-2CD2043G0-I"},
+				Name:     []string{"HIKVISION DS-2CD2043G0-I"},
+				Profile:  []string{"Streaming", "G", "T"},
+			},
+		},
+		{
+			"dahua",
+			"onvif://www.onvif.org/location/country/china onvif://www.onvif.org/name/Dahua onvif://www.onvif.org/hardware/IPC-HFW4431R-Z " +
+				"onvif://www.onvif.org/Profile/Streaming onvif://www.onvif.org/type/Network_Video_Transmitter " +
+				"onvif://www.onvif.org/extension/unique_identifier/1 onvif://www.onvif.org/Profile/G onvif://www.onvif.org/Profile/T",
+			Scopes{
+				Location: []string{"country/china"},
+				Hardware: []string{"IPC-HFW4431R-Z"},
+				Name:     []string{"Dahua"},
+				Profile:  []string{"Streaming", "G", "T"},
+			},
+		},
+		{
+			"axis",
+			"onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/type/audio_encoder onvif://www.onvif.org/type/ptz " +
+				"onvif://www.onvif.org/hardware/P5635-E onvif://www.onvif.org/name/AXIS%20P5635-E%20Mk%20II onvif://www.onvif.org/location/ " +
+				"onvif://www.onvif.org/Profile/Streaming onvif://www.onvif.org/Profile/G http://www.axis.com/serial/ACCC8E123456",
+			Scopes{
+				Hardware: []string{"P5635-E"},
+				Name:     []string{"AXIS P5635-E Mk II"},
+				Profile:  []string{"Streaming", "G"},
+			},
+		},
+		{
+			"several values",
+			"onvif://www.onvif.org/location/building/north onvif://www.onvif.org/location/floor/2 onvif://www.onvif.org/location/floor/2 " +
+				"onvif://www.onvif.org/name/gate onvif://www.onvif.org/name/Eingang%20S%C3%BCd",
+			Scopes{
+				Location: []string{"building/north", "floor/2"},
+				Name:     []string{"gate", "Eingang Süd"},
+			},
+		},
+		{
+			"malformed",
+			"ONVIF://WWW.ONVIF.ORG/Name/Lobby onvif://www.onvif.org/name/100%25%zz onvif://www.onvif.org/hardware//  onvif://www.onvif.org onvif:/",
+			Scopes{Name: []string{"Lobby", "100%25%zz"}},
+		},
+		{"none", "", Scopes{}},
+	}
+	for _, tt := range tests {
+		if got := ParseScopes(strings.Fields(tt.scopes)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseScopes = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SSDPMulticastAddr  = "239.255.255.250:1900"
+	SSDPMulticastAddr6 = "[ff02::c]:1900"
+)
+
+var ssdpSearchTargets = []string{"ssdp:all", "urn:schemas-upnp-org:device:Basic:1"}
+
+var cameraKeywords = []string{"camera", "ipcam", "ip cam", "webcam", "nvt", "video", "ipc", "dome", "bullet", "ptz"}
+
+// SSDPDevice is a UPnP device that answered an SSDP M-SEARCH and whose
+// description looks like a camera.
+type SSDPDevice struct {
+	IP               string
+	Location         string
+	DeviceType       string
+	FriendlyName     string
+	Manufacturer     string
+	ModelName        string
+	ModelDescription string
+}
+
+// SSDPSearcher sends SSDP M-SEARCH requests and fetches the description of
+// every device that answers.
+type SSDPSearcher struct {
+	// Addr is the destination of the M-SEARCH, SSDPMulticastAddr or
+	// SSDPMulticastAddr6 when empty.
+	Addr string
+	// Window is how long responses are collected after the search is sent.
+	Window time.Duration
+	// HTTPClient fetches the device descriptions.
+	HTTPClient *http.Client
+	// Skip reports hosts whose description must not be fetched.
+	Skip func(host string) bool
+	Multicast
+}
+
+// Search sends M-SEARCH requests from every given local address and returns
+// the devices that look like cameras.
+func (s *SSDPSearcher) Search(ctx context.Context, localAddrs []net.IPAddr) ([]SSDPDevice, error) {
+	searchCtx, cancel := context.WithTimeout(ctx, s.Window)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	locations := make(map[string]string)
+
+	for _, local := range localAddrs {
+		wg.Add(1)
+		go func(local net.IPAddr) {
+			defer wg.Done()
+			found, err := s.searchFrom(searchCtx, local)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				err = fmt.Errorf("search from %s: %w", local.String(), err)
+				errs = append(errs, err)
+				s.failed(local, err)
+				return
+			}
+			for location, from := range found {
+				locations[location] = from
+			}
+		}(local)
+	}
+	wg.Wait()
+
+	if len(locations) == 0 && len(errs) > 0 && len(errs) == len(localAddrs) {
+		return nil, errs[0]
+	}
+
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+
+	var devices []SSDPDevice
+	for location, ip := range locations {
+		if s.skip(ip, location) {
+			continue
+		}
+		wg.Add(1)
+		go func(location, ip string) {
+			defer wg.Done()
+			d, err := fetchDescription(ctx, client, location)
+			if err != nil || !looksLikeCamera(d) {
+				return
+			}
+			d.IP = ip
+			mu.Lock()
+			devices = append(devices, *d)
+			mu.Unlock()
+		}(location, ip)
+	}
+	wg.Wait()
+
+	return dedupeSSDP(devices), nil
+}
+
+func (s *SSDPSearcher) skip(ip, location string) bool {
+	if s.Skip == nil {
+		return false
+	}
+	if s.Skip(ip) {
+		return true
+	}
+	u, err := url.Parse(location)
+	return err == nil && s.Skip(u.Hostname())
+}
+
+func (s *SSDPSearcher) searchFrom(ctx context.Context, local net.IPAddr) (map[string]string, error) {
+	network, dst, err := destination(local, s.Addr, SSDPMulticastAddr, SSDPMulticastAddr6)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenMulticast(network, local, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var messages [][]byte
+	for _, st := range ssdpSearchTargets {
+		messages = append(messages, []byte(fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: %s\r\n\r\n", dst, st)))
+	}
+	if err := s.send(ctx, conn, dst, messages...); err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	locations := make(map[string]string)
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return locations, nil
+			}
+			return locations, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			locations[location] = hostString(from)
+		}
+	}
+}
+
+type deviceDescription struct {
+	Device struct {
+		DeviceType       string `xml:"deviceType"`
+		FriendlyName     string `xml:"friendlyName"`
+		Manufacturer     string `xml:"manufacturer"`
+		ModelName        string `xml:"modelName"`
+		ModelDescription string `xml:"modelDescription"`
+	} `xml:"device"`
+}
+
+func fetchDescription(ctx context.Context, client *http.Client, location string) (*SSDPDevice, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var desc deviceDescription
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&desc); err != nil {
+		return nil, err
+	}
+	return &SSDPDevice{
+		Location:         location,
+		DeviceType:       strings.TrimSpace(desc.Device.DeviceType),
+		FriendlyName:     strings.TrimSpace(desc.Device.FriendlyName),
+		Manufacturer:     strings.TrimSpace(desc.Device.Manufacturer),
+		ModelName:        strings.TrimSpace(desc.Device.ModelName),
+		ModelDescription: strings.TrimSpace(desc.Device.ModelDescription),
+	}, nil
+}
+
+func looksLikeCamera(d *SSDPDevice) bool {
+	text := strings.ToLower(strings.Join([]string{d.DeviceType, d.FriendlyName, d.ModelName, d.ModelDescription}, " "))
+	for _, keyword := range cameraKeywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func dedupeSSDP(devices []SSDPDevice) []SSDPDevice {
+	seen := make(map[string]bool)
+	var unique []SSDPDevice
+	for _, d := range devices {
+		if seen[d.IP] {
+			continue
+		}
+		seen[d.IP] = true
+		unique = append(unique, d)
+	}
+	return unique
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Port is the UDP port devices receive WS-Discovery Probes on.
+const Port = 3702
+
+// ProbeUnicast sends a Probe directly to port 3702 of ip, which reaches
+// devices multicast doesn't route to, and returns the first ProbeMatch the
+// device answers within timeout. It returns nil and a timeout error when
+// nothing arrived, so the caller can retry over a lossy link, and an
+// ECONNREFUSED error when the host reported the port unreachable.
+func ProbeUnicast(ctx context.Context, ip string, timeout time.Duration) (*Match, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip, strconv.Itoa(Port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	messageID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(fmt.Sprintf(probeTemplate, messageID))); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// The connected socket only receives datagrams of ip.
+		found, err := ParseProbeMatches(buf[:n])
+		if err != nil || len(found) == 0 {
+			continue
+		}
+		m := found[0]
+		m.IP = ip
+		return &m, nil
+	}
+}
@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MulticastAddr  = "239.255.255.250:3702"
+	MulticastAddr6 = "[ff02::c]:3702"
+)
+
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<e:Header>
+<w:MessageID>uuid:%s</w:MessageID>
+<w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To>
+<w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action>
+</e:Header>
+<e:Body>
+<d:Probe>
+<d:Types>dn:NetworkVideoTransmitter</d:Types>
+</d:Probe>
+</e:Body>
+</e:Envelope>`
+
+// Match is a single ProbeMatch received in answer to a WS-Discovery Probe.
+type Match struct {
+	IP                string
+	EndpointReference string
+	XAddrs            []string
+	Types             []string
+	Scopes            []string
+}
+
+// Prober sends WS-Discovery Probe messages and collects the ProbeMatch responses.
+type Prober struct {
+	// Addr is the destination of the Probe, MulticastAddr or MulticastAddr6
+	// when empty.
+	Addr string
+	// Window is how long responses are collected after the Probe is sent.
+	Window time.Duration
+	Multicast
+}
+
+// Probe sends a Probe from every given local address, out of its interface,
+// and returns the matches received within the collection window,
+// deduplicated by endpoint reference across the interfaces and repeats.
+func (p *Prober) Probe(ctx context.Context, localAddrs []net.IPAddr) ([]Match, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Window)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var matches []Match
+	var errs []error
+	seen := make(map[string]bool)
+
+	for _, local := range localAddrs {
+		wg.Add(1)
+		go func(local net.IPAddr) {
+			defer wg.Done()
+			found, err := p.probeFrom(ctx, local)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				err = fmt.Errorf("probe from %s: %w", local.String(), err)
+				errs = append(errs, err)
+				p.failed(local, err)
+				return
+			}
+			for _, m := range found {
+				key := m.EndpointReference
+				if key == "" {
+					key = m.IP
+				}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				matches = append(matches, m)
+			}
+		}(local)
+	}
+	wg.Wait()
+
+	if len(matches) == 0 && len(errs) > 0 && len(errs) == len(localAddrs) {
+		return nil, errs[0]
+	}
+	return matches, nil
+}
+
+func (p *Prober) probeFrom(ctx context.Context, local net.IPAddr) ([]Match, error) {
+	network, dst, err := destination(local, p.Addr, MulticastAddr, MulticastAddr6)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenMulticast(network, local, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The repeats carry the same MessageID, which devices answer once.
+	messageID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.send(ctx, conn, dst, []byte(fmt.Sprintf(probeTemplate, messageID))); err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	var matches []Match
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return matches, nil
+			}
+			return matches, err
+		}
+		found, err := ParseProbeMatches(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range found {
+			m.IP = hostString(from)
+			matches = append(matches, m)
+		}
+	}
+}
+
+type probeMatchesEnvelope struct {
+	Body struct {
+		ProbeMatches struct {
+			ProbeMatch []struct {
+				EndpointReference struct {
+					Address string `xml:"Address"`
+				} `xml:"EndpointReference"`
+				Types  string `xml:"Types"`
+				Scopes string `xml:"Scopes"`
+				XAddrs string `xml:"XAddrs"`
+			} `xml:"ProbeMatch"`
+		} `xml:"ProbeMatches"`
+	} `xml:"Body"`
+}
+
+// ParseProbeMatches extracts the ProbeMatch entries from a SOAP envelope.
+func ParseProbeMatches(data []byte) ([]Match, error) {
+	var env probeMatchesEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	var matches []Match
+	for _, pm := range env.Body.ProbeMatches.ProbeMatch {
+		matches = append(matches, Match{
+			EndpointReference: strings.TrimSpace(pm.EndpointReference.Address),
+			XAddrs:            strings.Fields(pm.XAddrs),
+			Types:             strings.Fields(pm.Types),
+			Scopes:            strings.Fields(pm.Scopes),
+		})
+	}
+	return matches, nil
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
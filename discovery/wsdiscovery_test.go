@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const probeMatchesTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<SOAP-ENV:Header>
+<wsa:MessageID>uuid:2419d68a-2dd2-21b2-a205-ec3b3c4f1a21</wsa:MessageID>
+<wsa:RelatesTo>uuid:%s</wsa:RelatesTo>
+<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</wsa:Action>
+</SOAP-ENV:Header>
+<SOAP-ENV:Body>
+<d:ProbeMatches>
+<d:ProbeMatch>
+<wsa:EndpointReference><wsa:Address>
+urn:uuid:%s
+</wsa:Address></wsa:EndpointReference>
+<d:Types>dn:NetworkVideoTransmitter tds:Device</d:Types>
+<d:Scopes>onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/hardware/DS-2CD2143G0-I onvif://www.onvif.org/name/HIKVISION%%20DS-2CD2143G0-I</d:Scopes>
+<d:XAddrs>http://192.0.2.10/onvif/device_service http://[fe80::1]/onvif/device_service</d:XAddrs>
+<d:MetadataVersion>10</d:MetadataVersion>
+</d:ProbeMatch>
+</d:ProbeMatches>
+</SOAP-ENV:Body>
+</SOAP-ENV:Envelope>`
+
+var messageIDPattern = regexp.MustCompile(`<w:MessageID>uuid:([0-9a-f-]+)</w:MessageID>`)
+
+// fakeResponder answers the Probes received on conn with a ProbeMatch of
+// every endpoint, relating it to the Probe. It returns the message IDs of
+// the Probes received.
+func fakeResponder(t *testing.T, conn *net.UDPConn, endpoints ...string) <-chan string {
+	t.Helper()
+	t.Cleanup(func() { conn.Close() })
+	probes := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m := messageIDPattern.FindSubmatch(buf[:n])
+			if m == nil {
+				continue
+			}
+			select {
+			case probes <- string(m[1]):
+			default:
+			}
+			for _, endpoint := range endpoints {
+				conn.WriteToUDP([]byte(fmt.Sprintf(probeMatchesTemplate, m[1], endpoint)), from)
+			}
+		}
+	}()
+	return probes
+}
+
+func listenUDP(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(addr)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestProbe(t *testing.T) {
+	conn := listenUDP(t, "127.0.0.1")
+	probes := fakeResponder(t, conn, "4419d68a-0000-0000-0000-ec3b3c4f1a21", "5519d68a-0000-0000-0000-ec3b3c4f1a21")
+	p := &Prober{
+		Addr:      conn.LocalAddr().String(),
+		Window:    300 * time.Millisecond,
+		Multicast: Multicast{Repeats: 3, Interval: 20 * time.Millisecond},
+	}
+	matches, err := p.Probe(context.Background(), []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every repeat is answered, the matches of the repeats are one.
+	if len(matches) != 2 {
+		t.Fatalf("%d matches, want 2: %+v", len(matches), matches)
+	}
+	m := matches[0]
+	if m.IP != "127.0.0.1" || m.EndpointReference != "urn:uuid:4419d68a-0000-0000-0000-ec3b3c4f1a21" {
+		t.Errorf("match = %+v", m)
+	}
+	if len(m.XAddrs) != 2 || m.XAddrs[0] != "http://192.0.2.10/onvif/device_service" || len(m.Types) != 2 || len(m.Scopes) != 3 {
+		t.Errorf("match = %+v", m)
+	}
+
+	// The repeats carry the MessageID of the first Probe.
+	first := <-probes
+	for i := 1; i < 3; i++ {
+		select {
+		case id := <-probes:
+			if id != first {
+				t.Errorf("repeat %d has MessageID %s, want %s", i, id, first)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%d Probes received, want 3", i)
+		}
+	}
+}
+
+func TestProbeWindow(t *testing.T) {
+	conn := listenUDP(t, "127.0.0.1")
+	// Nothing answers.
+	t.Cleanup(func() { conn.Close() })
+	p := &Prober{Addr: conn.LocalAddr().String(), Window: 100 * time.Millisecond}
+	start := time.Now()
+	matches, err := p.Probe(context.Background(), []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}})
+	if err != nil || len(matches) != 0 {
+		t.Fatalf("Probe() = %v, %v", matches, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("collected for %s, want the 100ms window", elapsed)
+	}
+}
+
+func TestProbeFailedAddresses(t *testing.T) {
+	var failed []string
+	p := &Prober{
+		Addr:      "127.0.0.1:9",
+		Window:    50 * time.Millisecond,
+		Multicast: Multicast{Failed: func(local net.IPAddr, err error) { failed = append(failed, local.String()) }},
+	}
+	// 192.0.2.1 is no local address, so nothing can be sent from it.
+	_, err := p.Probe(context.Background(), []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}})
+	if err == nil {
+		t.Error("Probe() from no usable address succeeded")
+	}
+	if len(failed) != 1 || failed[0] != "192.0.2.1" {
+		t.Errorf("failed = %v", failed)
+	}
+}
+
+func TestParseProbeMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		matches int
+		err     bool
+	}{
+		{"match", fmt.Sprintf(probeMatchesTemplate, "1", "2"), 1, false},
+		{"no match", `<Envelope><Body><ProbeMatches/></Body></Envelope>`, 0, false},
+		{"other message", fmt.Sprintf(probeTemplate, "1"), 0, false},
+		{"not xml", "M-SEARCH * HTTP/1.1\r\n\r\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := ParseProbeMatches([]byte(tt.data))
+			if (err != nil) != tt.err || len(matches) != tt.matches {
+				t.Errorf("ParseProbeMatches() = %d matches, %v", len(matches), err)
+			}
+		})
+	}
+}
+
+func TestProbeUnicast(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: Port})
+	if err != nil {
+		t.Skipf("cannot listen on port %d: %v", Port, err)
+	}
+	fakeResponder(t, conn, "6619d68a-0000-0000-0000-ec3b3c4f1a21")
+	m, err := ProbeUnicast(context.Background(), "127.0.0.1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IP != "127.0.0.1" || m.EndpointReference != "urn:uuid:6619d68a-0000-0000-0000-ec3b3c4f1a21" {
+		t.Errorf("match = %+v", m)
+	}
+	conn.Close()
+
+	_, err = ProbeUnicast(context.Background(), "127.0.0.1", 200*time.Millisecond)
+	var ne net.Error
+	if !errors.Is(err, syscall.ECONNREFUSED) && !(errors.As(err, &ne) && ne.Timeout()) {
+		t.Errorf("ProbeUnicast() of a closed port = %v", err)
+	}
+}
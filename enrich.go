@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"find_cameras/discovery"
+	"find_cameras/onvif"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	onvifCallTimeout    = 3 * time.Second
+	capabilitiesTimeout = 3 * time.Second
+	mediaTimeout        = 5 * time.Second
+	ptzTimeout          = 3 * time.Second
+	networkTimeout      = 3 * time.Second
+	deviceInfoTimeout   = 3 * time.Second
+)
+
+var onvifHTTPClient = &http.Client{Timeout: onvifCallTimeout}
+
+// onvifCredentials are tried in order on devices rejecting the enrichment
+// calls without the credentials of a request.
+var onvifCredentials = &credentialList{}
+
+// onvifInsecureBasic lets the ONVIF clients and the snapshot proxy answer HTTP
+// Basic challenges of plain http services, sending the passwords in clear.
+var onvifInsecureBasic bool
+
+type enrichOptions struct {
+	Username string
+	Password string
+}
+
+// ptzInfo sums up the PTZ nodes of a device for layout tools: the movement
+// spaces any node supports and the presets all of them can store.
+type ptzInfo struct {
+	Spaces         []string                 `json:"spaces"`
+	MaxPresets     int                      `json:"max_presets"`
+	Nodes          []onvif.PTZNode          `json:"nodes"`
+	Configurations []onvif.PTZConfiguration `json:"configurations,omitempty"`
+}
+
+type mediaProfile struct {
+	onvif.Profile
+	StreamURI      string `json:"stream_uri,omitempty"`
+	StreamURIError string `json:"stream_uri_error,omitempty"`
+}
+
+// deviceServiceURL returns the device service of d at its IP. The XAddrs of
+// a WS-Discovery match are unauthenticated and may name any host, so when
+// none is at the IP the first one is pinned to it: the credentials are only
+// ever sent to the device probed.
+func deviceServiceURL(d *device) string {
+	for _, xaddr := range d.XAddrs {
+		u, err := url.Parse(xaddr)
+		if err == nil && net.ParseIP(u.Hostname()).Equal(net.ParseIP(d.IP)) {
+			return xaddr
+		}
+	}
+	for _, xaddr := range d.XAddrs {
+		if pinned, ok := pinHost(xaddr, d.IP); ok {
+			return pinned
+		}
+	}
+	return ""
+}
+
+// pinHost replaces the host of the http or https URL rawURL by ip, keeping
+// its port.
+func pinHost(rawURL, ip string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(ip, port)
+	} else if strings.Contains(ip, ":") {
+		u.Host = "[" + ip + "]"
+	} else {
+		u.Host = ip
+	}
+	return u.String(), true
+}
+
+// serviceURL returns the address of a service the device reported, pinned
+// to its IP like the device service.
+func serviceURL(d *device, s onvif.Service) string {
+	if pinned, ok := pinHost(s.XAddr, d.IP); ok {
+		return pinned
+	}
+	return s.XAddr
+}
+
+// newONVIFClient returns a client of the device service at xaddr with the
+// credentials of opts.
+func newONVIFClient(xaddr string, opts enrichOptions) *onvif.Client {
+	client := onvif.NewClient(xaddr, onvifHTTPClient)
+	client.Username, client.Password = opts.Username, opts.Password
+	client.AllowInsecureBasic = onvifInsecureBasic
+	return client
+}
+
+var (
+	// enrichWorkers bounds the devices of a scan enriched at once.
+	enrichWorkers = 16
+	// enrichTimeout is the budget of the enrichment of a single device, on
+	// top of the timeouts of its calls.
+	enrichTimeout = 15 * time.Second
+)
+
+const (
+	enrichCompleted = "completed"
+	enrichTimedOut  = "timeout"
+)
+
+// enrichStage enriches the ONVIF devices of a scan as the sweep and the
+// discovery find them, with workers of its own, so the SOAP round-trips of
+// the cameras overlap with the sweep instead of following it. Devices are
+// enriched once per IP, with the first device service known.
+type enrichStage struct {
+	ctx     context.Context
+	opts    enrichOptions
+	exclude exclusionList
+	slots   chan struct{}
+	// enriched is called with every device once its enrichment completes,
+	// from the workers concurrently.
+	enriched func(device)
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	devices map[string]*device
+	started time.Time
+}
+
+func newEnrichStage(ctx context.Context, opts enrichOptions, exclude exclusionList, enriched func(device)) *enrichStage {
+	return &enrichStage{ctx: ctx, opts: opts, exclude: exclude, slots: make(chan struct{}, enrichWorkers), enriched: enriched, devices: make(map[string]*device)}
+}
+
+// submit queues the enrichment of d, a copy of it being enriched, unless d
+// has no device service or a device at its IP was submitted already. It
+// never blocks.
+func (e *enrichStage) submit(d device) {
+	xaddr := deviceServiceURL(&d)
+	if xaddr == "" || e.exclude.contains(d.IP) || e.ctx.Err() != nil {
+		return
+	}
+	e.mu.Lock()
+	if _, ok := e.devices[d.IP]; ok {
+		e.mu.Unlock()
+		return
+	}
+	e.devices[d.IP] = nil
+	if e.started.IsZero() {
+		e.started = time.Now()
+	}
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		select {
+		case e.slots <- struct{}{}:
+		case <-e.ctx.Done():
+			return
+		}
+		client := newONVIFClient(xaddr, e.opts)
+		ctx, cancel := context.WithTimeout(e.ctx, enrichTimeout)
+		enrichDevice(ctx, &d, client)
+		// A device out of budget keeps what was gathered until then.
+		d.EnrichmentTimeout = ctx.Err() == context.DeadlineExceeded && e.ctx.Err() == nil
+		cancel()
+		<-e.slots
+		if d.EnrichmentTimeout {
+			enrichmentsTotal.inc(enrichTimedOut)
+		} else {
+			enrichmentsTotal.inc(enrichCompleted)
+		}
+
+		e.mu.Lock()
+		e.devices[d.IP] = &d
+		e.mu.Unlock()
+		if e.enriched != nil {
+			e.enriched(d)
+		}
+	}()
+}
+
+func (e *enrichStage) submitMatches(matches []discovery.Match, source string) {
+	set := newDeviceSet()
+	set.addMatches(matches, source)
+	for _, d := range set.devices {
+		e.submit(d)
+	}
+}
+
+// wait waits for the enrichments submitted, which stop early when the scan
+// is done.
+func (e *enrichStage) wait() {
+	e.wg.Wait()
+	if !e.started.IsZero() {
+		scanStageDurationSeconds.observe(time.Since(e.started).Seconds(), stageEnrichment)
+	}
+}
+
+// apply copies the ONVIF details of the enriched devices to devices.
+func (e *enrichStage) apply(devices []device) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range devices {
+		if enriched := e.devices[devices[i].IP]; enriched != nil {
+			copyEnrichment(&devices[i], enriched)
+		}
+	}
+}
+
+// copyEnrichment copies the fields the enrichment of src set to dst.
+func copyEnrichment(dst, src *device) {
+	dst.Services, dst.CapabilitiesError = src.Services, src.CapabilitiesError
+	dst.Profiles, dst.MediaError = src.Profiles, src.MediaError
+	dst.ONVIFCredential = src.ONVIFCredential
+	dst.PTZ, dst.PTZError = src.PTZ, src.PTZError
+	dst.ONVIFHostname, dst.Addresses, dst.HwAddresses = src.ONVIFHostname, src.Addresses, src.HwAddresses
+	dst.NetworkInterfaces, dst.NetworkError = src.NetworkInterfaces, src.NetworkError
+	dst.FirmwareVersion, dst.SerialNumber, dst.DeviceInformationError = src.FirmwareVersion, src.SerialNumber, src.DeviceInformationError
+	dst.SnapshotURI, dst.SnapshotAuthRequired, dst.SnapshotError = src.SnapshotURI, src.SnapshotAuthRequired, src.SnapshotError
+	dst.ONVIFRTTMS = src.ONVIFRTTMS
+	dst.EnrichmentTimeout = src.EnrichmentTimeout
+}
+
+func enrichDevice(ctx context.Context, d *device, client *onvif.Client) {
+	capCtx, cancel := context.WithTimeout(ctx, capabilitiesTimeout)
+	services, err := client.Services(capCtx)
+	cancel()
+	enrichServices(ctx, d, client, services, err)
+}
+
+// enrichServices fills in d from the result of a Services call and queries
+// the media and PTZ services it points to, then the network configuration.
+func enrichServices(ctx context.Context, d *device, client *onvif.Client, services map[string]onvif.Service, err error) {
+	if err != nil {
+		d.CapabilitiesError = err.Error()
+	} else {
+		d.Services = services
+	}
+
+	// The device service is asked for the media profiles when the services
+	// are unknown.
+	media, hasMedia := d.Services["media"]
+	if !hasMedia && d.Services == nil {
+		media, hasMedia = onvif.Service{XAddr: client.XAddr}, true
+	}
+	if hasMedia {
+		mediaCtx, cancel := context.WithTimeout(ctx, mediaTimeout)
+		enrichMedia(mediaCtx, d, client, serviceURL(d, media))
+		cancel()
+	}
+
+	ptz, hasPTZ := d.Services["ptz"]
+	if hasPTZ {
+		ptzCtx, cancel := context.WithTimeout(ctx, ptzTimeout)
+		// The credentials were already tried on the media service.
+		enrichPTZ(ptzCtx, d, client, serviceURL(d, ptz), !hasMedia)
+		cancel()
+	}
+
+	networkCtx, cancel := context.WithTimeout(ctx, networkTimeout)
+	enrichNetwork(networkCtx, d, client, !hasMedia && !hasPTZ)
+	cancel()
+
+	// The credentials were already tried by one of the calls above.
+	infoCtx, cancel := context.WithTimeout(ctx, deviceInfoTimeout)
+	enrichDeviceInformation(infoCtx, d, client)
+	cancel()
+	d.ONVIFRTTMS = milliseconds(client.RTT())
+}
+
+func enrichMedia(ctx context.Context, d *device, client *onvif.Client, xaddr string) {
+	var profiles []onvif.Profile
+	err := authorizedCall(d, client, true, func() (err error) {
+		profiles, err = client.GetProfiles(ctx, xaddr)
+		return err
+	})
+	if err != nil {
+		d.MediaError = err.Error()
+		return
+	}
+
+	d.Profiles = make([]mediaProfile, len(profiles))
+	for i, p := range profiles {
+		d.Profiles[i].Profile = p
+		uri, err := client.GetStreamURI(ctx, xaddr, p.Token)
+		if err != nil {
+			d.Profiles[i].StreamURIError = err.Error()
+			continue
+		}
+		d.Profiles[i].StreamURI = uri
+	}
+
+	if len(profiles) > 0 {
+		enrichSnapshot(ctx, d, client, xaddr, profiles[0].Token)
+	}
+}
+
+// enrichPTZ reports the PTZ nodes of a device. Fixed cameras don't expose a
+// PTZ service and keep a nil PTZ.
+func enrichPTZ(ctx context.Context, d *device, client *onvif.Client, xaddr string, tryCredentials bool) {
+	var nodes []onvif.PTZNode
+	err := authorizedCall(d, client, tryCredentials, func() (err error) {
+		nodes, err = client.GetNodes(ctx, xaddr)
+		return err
+	})
+	if err != nil {
+		d.PTZError = err.Error()
+		return
+	}
+	configs, err := client.GetConfigurations(ctx, xaddr)
+	if err != nil {
+		d.PTZError = err.Error()
+		return
+	}
+
+	info := &ptzInfo{Spaces: []string{}, Nodes: nodes, Configurations: configs}
+	if info.Nodes == nil {
+		info.Nodes = []onvif.PTZNode{}
+	}
+	for _, n := range nodes {
+		for _, space := range n.Spaces {
+			if !containsString(info.Spaces, space) {
+				info.Spaces = append(info.Spaces, space)
+			}
+		}
+		info.MaxPresets += n.MaxPresets
+	}
+	d.PTZ = info
+}
+
+// enrichNetwork reports the hostname the device is configured with and the
+// addresses of its network interfaces, which reverse DNS rarely knows.
+func enrichNetwork(ctx context.Context, d *device, client *onvif.Client, tryCredentials bool) {
+	var hostname onvif.Hostname
+	err := authorizedCall(d, client, tryCredentials, func() (err error) {
+		hostname, err = client.GetHostname(ctx)
+		return err
+	})
+	if err != nil {
+		d.NetworkError = err.Error()
+		if onvif.IsAuthFault(err) || ctx.Err() != nil {
+			return
+		}
+	}
+	d.ONVIFHostname = hostname.Name
+
+	interfaces, err := client.GetNetworkInterfaces(ctx)
+	if err != nil {
+		if d.NetworkError == "" {
+			d.NetworkError = err.Error()
+		}
+		return
+	}
+	d.NetworkInterfaces = interfaces
+	for _, iface := range interfaces {
+		d.Addresses = append(d.Addresses, iface.Addresses...)
+		if iface.HwAddress != "" && !containsString(d.HwAddresses, iface.HwAddress) {
+			d.HwAddresses = append(d.HwAddresses, iface.HwAddress)
+		}
+	}
+}
+
+// enrichDeviceInformation reports the firmware version and the serial number
+// of the device, which the RTSP server banner rarely carries.
+func enrichDeviceInformation(ctx context.Context, d *device, client *onvif.Client) {
+	info, err := client.GetDeviceInformation(ctx)
+	if err != nil {
+		d.DeviceInformationError = err.Error()
+		return
+	}
+	d.FirmwareVersion, d.SerialNumber = info.FirmwareVersion, info.SerialNumber
+}
+
+// authorizedCall runs the first authenticated call of the enrichment. When
+// the device rejects it without the credentials of a request, the call is
+// retried with the configured credentials in order if tryCredentials is set,
+// and the first ones the device accepts are kept on client.
+func authorizedCall(d *device, client *onvif.Client, tryCredentials bool, call func() error) error {
+	err := call()
+	switch {
+	case client.Username == "" && onvif.IsAuthFault(err) && tryCredentials:
+		return tryONVIFCredentials(d, client, call)
+	case client.Username != "" && err == nil && d.ONVIFCredential == "":
+		d.ONVIFCredential = "request"
+	}
+	return err
+}
+
+func tryONVIFCredentials(d *device, client *onvif.Client, call func() error) error {
+	err := onvif.ErrUnauthorized
+	for _, cred := range onvifCredentials.credentials {
+		client.Username, client.Password = cred.username, cred.password
+		if err = call(); !onvif.IsAuthFault(err) {
+			if err == nil {
+				d.ONVIFCredential = cred.label
+			}
+			return err
+		}
+	}
+	client.Username, client.Password = "", ""
+	return err
+}
+
+func enrichSnapshot(ctx context.Context, d *device, client *onvif.Client, xaddr, token string) {
+	uri, err := client.GetSnapshotURI(ctx, xaddr, token)
+	if err != nil {
+		d.SnapshotError = err.Error()
+		return
+	}
+	d.SnapshotURI = rewriteHost(uri, d.IP)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.SnapshotURI, nil)
+	if err != nil {
+		d.SnapshotError = err.Error()
+		return
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		d.SnapshotError = err.Error()
+		return
+	}
+	resp.Body.Close()
+	d.SnapshotAuthRequired = resp.StatusCode == http.StatusUnauthorized
+}
+
+func rewriteHost(rawURL, ip string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	host := net.ParseIP(u.Hostname())
+	if host == nil || host.Equal(net.ParseIP(ip)) {
+		return rawURL
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(ip, port)
+	} else if strings.Contains(ip, ":") {
+		u.Host = "[" + ip + "]"
+	} else {
+		u.Host = ip
+	}
+	return u.String()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"find_cameras/onvif"
+)
+
+func TestDeviceServiceURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		xaddrs []string
+		want   string
+	}{
+		{"matching address", "10.0.0.7", []string{"http://10.0.0.7/onvif/device_service"}, "http://10.0.0.7/onvif/device_service"},
+		{"matching address preferred", "10.0.0.7", []string{"http://10.0.0.99/onvif/device_service", "http://10.0.0.7:8080/onvif/device_service"}, "http://10.0.0.7:8080/onvif/device_service"},
+		{"foreign address pinned", "10.0.0.7", []string{"http://192.0.2.1:8080/onvif/device_service"}, "http://10.0.0.7:8080/onvif/device_service"},
+		{"host name pinned", "10.0.0.7", []string{"https://camera.example.com/onvif/device_service"}, "https://10.0.0.7/onvif/device_service"},
+		{"ipv6 pinned", "fe80::1", []string{"http://10.0.0.7/onvif/device_service"}, "http://[fe80::1]/onvif/device_service"},
+		{"ipv6 pinned with port", "fe80::1", []string{"http://10.0.0.7:8000/onvif/device_service"}, "http://[fe80::1]:8000/onvif/device_service"},
+		{"other scheme", "10.0.0.7", []string{"soap.udp://192.0.2.1/onvif"}, ""},
+		{"none", "10.0.0.7", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &device{IP: tt.ip, XAddrs: tt.xaddrs}
+			if got := deviceServiceURL(d); got != tt.want {
+				t.Errorf("deviceServiceURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// snapshotURIResponse is the GetSnapshotUri response of a Hikvision
+// DS-2CD2143G0-I, which reports the address it was configured with rather
+// than the one it is reached at.
+const snapshotURIResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope" xmlns:tt="http://www.onvif.org/ver10/schema" xmlns:trt="http://www.onvif.org/ver10/media/wsdl">
+<env:Body><trt:GetSnapshotUriResponse><trt:MediaUri>
+<tt:Uri>http://192.168.1.64:%d/onvif-http/snapshot?Profile_1</tt:Uri>
+<tt:InvalidAfterConnect>false</tt:InvalidAfterConnect>
+<tt:InvalidAfterReboot>false</tt:InvalidAfterReboot>
+<tt:Timeout>PT0S</tt:Timeout>
+</trt:MediaUri></trt:GetSnapshotUriResponse></env:Body>
+</env:Envelope>`
+
+func TestEnrichSnapshot(t *testing.T) {
+	for _, digest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("digest=%t", digest), func(t *testing.T) {
+			var port int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/onvif/media_service":
+					fmt.Fprintf(w, snapshotURIResponse, port)
+				case "/onvif-http/snapshot":
+					if digest {
+						w.Header().Set("WWW-Authenticate", `Digest realm="IP Camera", nonce="4e5445", qop="auth"`)
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					w.Header().Set("Content-Type", "image/jpeg")
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			port = srv.Listener.Addr().(*net.TCPAddr).Port
+
+			d := &device{IP: "127.0.0.1"}
+			client := onvif.NewClient(srv.URL+"/onvif/device_service", srv.Client())
+			enrichSnapshot(context.Background(), d, client, srv.URL+"/onvif/media_service", "Profile_1")
+			if want := fmt.Sprintf("http://127.0.0.1:%d/onvif-http/snapshot?Profile_1", port); d.SnapshotURI != want {
+				t.Errorf("SnapshotURI = %q, want %q", d.SnapshotURI, want)
+			}
+			if d.SnapshotAuthRequired != digest || d.SnapshotError != "" {
+				t.Errorf("SnapshotAuthRequired = %t, SnapshotError = %q", d.SnapshotAuthRequired, d.SnapshotError)
+			}
+		})
+	}
+}
+
+func TestEnrichSnapshotFault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault><env:Code><env:Value>env:Receiver</env:Value><env:Subcode><env:Value>ter:ActionNotSupported</env:Value></env:Subcode></env:Code><env:Reason><env:Text xml:lang="en">Optional Action Not Implemented</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>`))
+	}))
+	defer srv.Close()
+	d := &device{IP: "127.0.0.1"}
+	enrichSnapshot(context.Background(), d, onvif.NewClient(srv.URL, srv.Client()), srv.URL, "Profile_1")
+	if d.SnapshotURI != "" || !strings.Contains(d.SnapshotError, "Not Implemented") {
+		t.Errorf("SnapshotURI = %q, SnapshotError = %q", d.SnapshotURI, d.SnapshotError)
+	}
+}
+
+// deviceInformationResponse is the GetDeviceInformation response of a
+// Hikvision DS-2CD2143G0-I.
+const deviceInformationResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl">
+<env:Body><tds:GetDeviceInformationResponse>
+<tds:Manufacturer>HIKVISION</tds:Manufacturer>
+<tds:Model>DS-2CD2143G0-I</tds:Model>
+<tds:FirmwareVersion>V5.5.82 build 190909</tds:FirmwareVersion>
+<tds:SerialNumber>DS-2CD2143G0-I20190101AAWRC12345678</tds:SerialNumber>
+<tds:HardwareId>88</tds:HardwareId>
+</tds:GetDeviceInformationResponse></env:Body>
+</env:Envelope>`
+
+func TestEnrichDeviceInformation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(deviceInformationResponse))
+	}))
+	defer srv.Close()
+	d := &device{IP: "127.0.0.1", Server: "Hikvision RTSP Server"}
+	enrichDeviceInformation(context.Background(), d, onvif.NewClient(srv.URL, srv.Client()))
+	if d.FirmwareVersion != "V5.5.82 build 190909" || d.SerialNumber != "DS-2CD2143G0-I20190101AAWRC12345678" || d.DeviceInformationError != "" {
+		t.Errorf("FirmwareVersion = %q, SerialNumber = %q, DeviceInformationError = %q", d.FirmwareVersion, d.SerialNumber, d.DeviceInformationError)
+	}
+	if got := d.firmware(); got != "V5.5.82 build 190909" {
+		t.Errorf("firmware() = %q", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	d = &device{IP: "127.0.0.1", Server: "Hikvision RTSP Server"}
+	enrichDeviceInformation(context.Background(), d, onvif.NewClient(failing.URL, failing.Client()))
+	if d.FirmwareVersion != "" || d.DeviceInformationError == "" || d.firmware() != "Hikvision RTSP Server" {
+		t.Errorf("FirmwareVersion = %q, DeviceInformationError = %q, firmware() = %q", d.FirmwareVersion, d.DeviceInformationError, d.firmware())
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// conditionalGet requests url with If-None-Match set to etag when not empty.
+func conditionalGet(t *testing.T, url, etag string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestCamerasETag(t *testing.T) {
+	withStore(t)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stored := storeTestCameras(at)
+	cameras.restore(stored)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	url := srv.URL + apiPrefix + "/cameras/"
+
+	resp, _ := conditionalGet(t, url, "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q", resp.StatusCode, etag)
+	}
+	resp, body := conditionalGet(t, url, etag)
+	if resp.StatusCode != http.StatusNotModified || body != "" || resp.Header.Get("ETag") != etag {
+		t.Errorf("same set: status %d, ETag %q, body %q", resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+
+	added := storedCamera{cameraRecord: cameraRecord{ID: "ip:10.0.0.9", FirstSeen: at, LastSeen: at, device: device{IP: "10.0.0.9", Ports: []int{554}}}}
+	cameras.restore(append(stored, added))
+	resp, body = conditionalGet(t, url, etag)
+	changed := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || body == "" || changed == "" || changed == etag {
+		t.Fatalf("device added: status %d, ETag %q, body %q", resp.StatusCode, changed, body)
+	}
+	if resp, _ := conditionalGet(t, url, `"stale", `+changed); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("new ETag in a list: status %d", resp.StatusCode)
+	}
+}
+
+// TestScanETag checks that only the cached results are revalidated.
+func TestScanETag(t *testing.T) {
+	withStore(t)
+	withCache(t, time.Minute)
+	withProber(t, countingProber(new(int64), 0))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	url := srv.URL + apiPrefix + "/scan?" + cachedScan
+
+	if resp, _ := conditionalGet(t, url, ""); resp.Header.Get("ETag") != "" {
+		t.Errorf("fresh scan has ETag %q", resp.Header.Get("ETag"))
+	}
+	resp, _ := conditionalGet(t, url, "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Fatalf("cached result: ETag %q, Last-Modified %q", etag, resp.Header.Get("Last-Modified"))
+	}
+	if resp, _ := conditionalGet(t, url, etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("cached result: status %d, want 304", resp.StatusCode)
+	}
+	if resp, _ := conditionalGet(t, url+"&refresh=true", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("refreshed scan: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"unconditional", nil, false},
+		{"match", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak match", map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"list", map[string]string{"If-None-Match": `"old", "abc"`}, true},
+		{"any", map[string]string{"If-None-Match": "*"}, true},
+		{"mismatch", map[string]string{"If-None-Match": `"old"`}, false},
+		{"not modified since", map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 12:00:00 GMT"}, true},
+		{"modified since", map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 11:59:59 GMT"}, false},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"etag first", map[string]string{"If-None-Match": `"old"`, "If-Modified-Since": "Fri, 01 Mar 2024 12:00:00 GMT"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := notModified(r, `"abc"`, modified); got != tt.want {
+			t.Errorf("%s: notModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestCamerasChangedBetweenScans checks that changes of the registry between
+// scans aren't answered with 304.
+func TestCamerasChangedBetweenScans(t *testing.T) {
+	withStore(t)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cameras.restore(storeTestCameras(at))
+	background.mu.Lock()
+	last := background.lastCompleted
+	background.lastCompleted = at
+	background.mu.Unlock()
+	t.Cleanup(func() {
+		background.mu.Lock()
+		background.lastCompleted = last
+		background.mu.Unlock()
+	})
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	url := srv.URL + apiPrefix + "/cameras/"
+
+	resp, _ := conditionalGet(t, url, "")
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		t.Errorf("listing has Last-Modified %q", lm)
+	}
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"metadata", func() {
+			req, _ := http.NewRequest(http.MethodPatch, url+"mac:00:11:22:33:44:55/metadata", strings.NewReader(`{"name":"Gate"}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}},
+		{"ignore entry", func() { postJSON(t, srv.URL+apiPrefix+"/ignored", `{"ip":"10.0.0.7"}`).Body.Close() }},
+	}
+	for _, c := range changes {
+		etag := resp.Header.Get("ETag")
+		c.change()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("If-Modified-Since", at.Add(time.Hour).Format(http.TimeFormat))
+		if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s changed, If-Modified-Since: %v, %v", c.name, resp, err)
+		} else {
+			resp.Body.Close()
+		}
+		if resp, _ = conditionalGet(t, url, etag); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s changed, If-None-Match: status %d", c.name, resp.StatusCode)
+		}
+	}
+}
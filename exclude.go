@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type exclusionList []*net.IPNet
+
+// parseExclusions parses a comma-separated list of IPs and CIDRs. Overlapping
+// entries are rejected since they usually hide a typo.
+func parseExclusions(s string) (exclusionList, error) {
+	var list exclusionList
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		network, err := parseExclusion(field)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range list {
+			if other.Contains(network.IP) || network.Contains(other.IP) {
+				return nil, fmt.Errorf("%s overlaps %s", field, other)
+			}
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func parseExclusion(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (l exclusionList) String() string {
+	fields := make([]string, len(l))
+	for i, network := range l {
+		fields[i] = network.String()
+	}
+	return strings.Join(fields, ",")
+}
+
+func (l exclusionList) contains(host string) bool {
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter splits ips into the addresses to probe and the excluded ones.
+func (l exclusionList) filter(ips []string) (kept, excluded []string) {
+	if len(l) == 0 {
+		return ips, nil
+	}
+	for _, ip := range ips {
+		if l.contains(ip) {
+			excluded = append(excluded, ip)
+		} else {
+			kept = append(kept, ip)
+		}
+	}
+	return kept, excluded
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// site names the installation in the file names of the exports.
+	site string
+	// exportDir and exportFormat configure the export written after every
+	// scheduled scan.
+	exportDir    string
+	exportFormat = "json"
+)
+
+// cameraExporter writes the registry as a file, one camera at a time, so the
+// output is never held in memory as a whole.
+type cameraExporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, list []cameraRecord) error
+}
+
+var cameraExporters = map[string]cameraExporter{
+	"json": {"application/json; charset=utf-8", "json", exportJSON},
+	"csv":  {"text/csv; charset=utf-8", "csv", exportCSV},
+}
+
+func exportJSON(w io.Writer, list []cameraRecord) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := range list {
+		data, err := json.Marshal(&list[i])
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if i == 0 {
+			sep = "\n"
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+var exportColumns = []string{
+	"id", "name", "labels", "status", "ip", "ports", "mac", "vendor", "vendor_guess", "model", "model_guess", "firmware",
+	"hostname", "onvif_hostname", "friendly_name", "hardware", "location", "sources", "auth",
+	"rtsp_urls", "snapshot_uri", "first_seen", "last_seen",
+}
+
+func exportCSV(w io.Writer, list []cameraRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	for i := range list {
+		c := &list[i]
+		ports := make([]string, len(c.Ports))
+		for i, p := range c.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		var name string
+		if c.Metadata != nil {
+			name = c.Metadata.Name
+		}
+		cw.Write([]string{
+			c.ID, csvCell(name), csvCell(strings.Join(c.Metadata.labelList(), ";")), c.Status, c.IP, strings.Join(ports, ";"), c.MAC, csvCell(c.Vendor), csvCell(c.VendorGuess),
+			csvCell(c.Model), csvCell(c.ModelGuess), csvCell(c.firmware()), csvCell(c.Hostname), csvCell(c.ONVIFHostname),
+			csvCell(c.FriendlyName), csvCell(strings.Join(c.Hardware, ";")), csvCell(strings.Join(c.Location, ";")),
+			strings.Join(c.Sources, ";"), c.Auth, csvCell(strings.Join(c.RTSPURLs, " ")), csvCell(c.SnapshotURI),
+			c.FirstSeen.UTC().Format(time.RFC3339), c.LastSeen.UTC().Format(time.RFC3339),
+		})
+		// Every row is flushed, the csv writer buffers otherwise.
+		if cw.Flush(); cw.Error() != nil {
+			return cw.Error()
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportFileName names an export by the site and the time it was taken.
+func exportFileName(exp cameraExporter, at time.Time) string {
+	name := "cameras"
+	if s := strings.Trim(strings.Map(fileNameRune, site), "-"); s != "" {
+		name += "-" + s
+	}
+	return fmt.Sprintf("%s-%s.%s", name, at.UTC().Format("20060102T150405Z"), exp.extension)
+}
+
+func fileNameRune(r rune) rune {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' {
+		return r
+	}
+	return '-'
+}
+
+// handleExportCameras returns the registry as a file, filtered like the
+// camera listing.
+func handleExportCameras(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	exp, ok := cameraExporters[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid format %q, expected json or csv", format))
+		return
+	}
+	filters, err := parseCameraFilters(query)
+	if err != nil {
+		reqErr := err.(*requestError)
+		reqErr.response.Error.RequestID = requestID(r.Context())
+		writeJSON(w, reqErr.status, reqErr.response)
+		return
+	}
+	list := filterCameras(cameras.list(), filters)
+	w.Header().Set("Content-Type", exp.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": exportFileName(exp, time.Now())}))
+	w.WriteHeader(http.StatusOK)
+	if err := exp.write(w, list); err != nil {
+		// The status is sent, the client sees a truncated file.
+		loggerFrom(r.Context()).Warn("Error writing export", "err", err)
+	}
+}
+
+// exportToDir writes the whole registry to exportDir, atomically so a backup
+// job never picks up a partial file.
+func exportToDir(at time.Time) (string, error) {
+	exp := cameraExporters[exportFormat]
+	path := filepath.Join(exportDir, exportFileName(exp, at))
+	tmp, err := os.CreateTemp(exportDir, ".export-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	// The backup jobs picking the files up usually run as another user.
+	tmp.Chmod(0o644)
+	buf := bufio.NewWriter(tmp)
+	list := filterSlice(cameras.list(), func(c cameraRecord) bool { return !c.Ignored })
+	if err := exp.write(buf, list); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
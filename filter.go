@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// cameraParams are the query parameters of the camera listing, the filters
+// among them combined with AND semantics.
+var cameraParams = map[string]func(value string) (cameraFilter, error){
+	"format":          nil,
+	"include_ignored": nil,
+	"limit":           nil,
+	"offset":          nil,
+	"vendor": func(v string) (cameraFilter, error) {
+		return func(c *cameraRecord) bool { return containsFold(v, c.Vendor, c.VendorGuess) }, nil
+	},
+	"model": func(v string) (cameraFilter, error) {
+		return func(c *cameraRecord) bool {
+			return containsFold(v, append([]string{c.Model, c.ModelGuess}, c.Hardware...)...)
+		}, nil
+	},
+	"network":        parseNetworkFilter,
+	"label":          parseLabelFilter,
+	"status":         parseStatusFilter,
+	"discovered_via": parseSourceFilter,
+	"q": func(v string) (cameraFilter, error) {
+		return func(c *cameraRecord) bool {
+			fields := []string{c.Hostname, c.DHCPHostname, c.ONVIFHostname, c.Model, c.ModelGuess, c.FriendlyName}
+			if c.Metadata != nil {
+				fields = append(fields, c.Metadata.Name)
+			}
+			fields = append(fields, c.Scopes...)
+			fields = append(fields, c.Location...)
+			fields = append(fields, c.Hardware...)
+			fields = append(fields, c.Name...)
+			return containsFold(v, fields...)
+		}, nil
+	},
+}
+
+// cameraFilter keeps the cameras of the listing it matches.
+type cameraFilter func(*cameraRecord) bool
+
+// parseCameraFilters returns the filters of a camera listing request,
+// rejecting the query parameters the listing doesn't know.
+func parseCameraFilters(query url.Values) ([]cameraFilter, error) {
+	var filters []cameraFilter
+	for key, values := range query {
+		parse, ok := cameraParams[key]
+		if !ok {
+			valid := make([]string, 0, len(cameraParams))
+			for name := range cameraParams {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			return nil, &requestError{http.StatusBadRequest, errorResponse{apiError{
+				Code:            codeInvalidRequest,
+				Message:         fmt.Sprintf("unknown parameter %q, valid parameters are %s", key, strings.Join(valid, ", ")),
+				ValidParameters: valid,
+			}}}
+		}
+		if parse == nil {
+			continue
+		}
+		for _, v := range values {
+			filter, err := parse(v)
+			if err != nil {
+				return nil, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeInvalidRequest, Message: fmt.Sprintf("invalid %s: %v", key, err)}}}
+			}
+			filters = append(filters, filter)
+		}
+	}
+	if v := query.Get("include_ignored"); v != "true" {
+		if v != "" && v != "false" {
+			return nil, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeInvalidRequest, Message: fmt.Sprintf("invalid include_ignored: %q is neither true nor false", v)}}}
+		}
+		filters = append(filters, func(c *cameraRecord) bool { return !c.Ignored })
+	}
+	return filters, nil
+}
+
+func filterCameras(list []cameraRecord, filters []cameraFilter) []cameraRecord {
+	if len(filters) == 0 {
+		return list
+	}
+	return filterSlice(list, func(c cameraRecord) bool {
+		for _, keep := range filters {
+			if !keep(&c) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// parseNetworkFilter matches the cameras inside a CIDR, or else those on the
+// interface named v.
+func parseNetworkFilter(v string) (cameraFilter, error) {
+	if !strings.Contains(v, "/") {
+		return func(c *cameraRecord) bool {
+			if c.Interface == v {
+				return true
+			}
+			for _, n := range c.Networks {
+				if n.Interface == v {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *cameraRecord) bool {
+		host, _, _ := strings.Cut(c.IP, "%")
+		ip := net.ParseIP(host)
+		return ip != nil && ipNet.Contains(ip)
+	}, nil
+}
+
+// parseLabelFilter matches the cameras labeled key=value, or carrying the
+// label key with any value.
+func parseLabelFilter(v string) (cameraFilter, error) {
+	key, value, hasValue := strings.Cut(v, "=")
+	if key == "" {
+		return nil, fmt.Errorf("expected key or key=value, got %q", v)
+	}
+	return func(c *cameraRecord) bool {
+		if c.Metadata == nil {
+			return false
+		}
+		got, ok := c.Metadata.Labels[key]
+		return ok && (!hasValue || got == value)
+	}, nil
+}
+
+func parseStatusFilter(v string) (cameraFilter, error) {
+	if v != statusOnline && v != statusOffline {
+		return nil, fmt.Errorf("%q is neither %s nor %s", v, statusOnline, statusOffline)
+	}
+	return func(c *cameraRecord) bool { return c.Status == v }, nil
+}
+
+func parseSourceFilter(v string) (cameraFilter, error) {
+	switch v {
+	case sourceRTSP, sourceONVIF, sourceONVIFHTTP, sourceWSDiscovery, sourceWSDiscoveryUnicast, sourceHello, sourceSSDP, sourceMDNS, sourceManual:
+	default:
+		return nil, fmt.Errorf("unknown source %q", v)
+	}
+	return func(c *cameraRecord) bool {
+		for _, s := range c.Sources {
+			if s == v {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// containsFold reports whether any of fields contains sub, ignoring case.
+func containsFold(sub string, fields ...string) bool {
+	sub = strings.ToLower(sub)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), sub) {
+			return true
+		}
+	}
+	return false
+}
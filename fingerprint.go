@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bannerSourceRTSPServer = "rtsp_server"
+	bannerSourceHTTPServer = "http_server"
+	bannerSourceRealm      = "realm"
+
+	fingerprintTimeout = 2 * time.Second
+)
+
+//go:embed fingerprints.json
+var embeddedFingerprints []byte
+
+// fingerprintRule guesses the vendor, and with a named model group the
+// model, of a device whose banner of the given source matches.
+type fingerprintRule struct {
+	Source string `json:"source"`
+	Match  string `json:"match"`
+	Vendor string `json:"vendor"`
+
+	re *regexp.Regexp
+}
+
+var fingerprintRules = mustParseFingerprints(embeddedFingerprints)
+
+func mustParseFingerprints(data []byte) []fingerprintRule {
+	rules, err := parseFingerprints(data)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func parseFingerprints(data []byte) ([]fingerprintRule, error) {
+	var rules []fingerprintRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		switch r.Source {
+		case bannerSourceRTSPServer, bannerSourceHTTPServer, bannerSourceRealm:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown source %q", i+1, r.Source)
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		r.re = re
+	}
+	return rules, nil
+}
+
+// loadFingerprintFile adds the rules of a file, taking precedence over the
+// built-in ones.
+func loadFingerprintFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	rules, err := parseFingerprints(data)
+	if err != nil {
+		return 0, err
+	}
+	fingerprintRules = append(rules, fingerprintRules...)
+	return len(rules), nil
+}
+
+// deviceBanners are the banners a device was fingerprinted by.
+type deviceBanners struct {
+	RTSPServer string `json:"rtsp_server,omitempty"`
+	HTTPServer string `json:"http_server,omitempty"`
+	Realm      string `json:"realm,omitempty"`
+}
+
+func (b deviceBanners) get(source string) string {
+	switch source {
+	case bannerSourceRTSPServer:
+		return b.RTSPServer
+	case bannerSourceHTTPServer:
+		return b.HTTPServer
+	default:
+		return b.Realm
+	}
+}
+
+// match returns the vendor guessed by the first matching rule, and the model
+// captured by the first matching rule of that vendor that has a model group.
+func (b deviceBanners) match(rules []fingerprintRule) (vendor, model string, ok bool) {
+	for _, r := range rules {
+		banner := b.get(r.Source)
+		if banner == "" || (ok && r.Vendor != vendor) {
+			continue
+		}
+		m := r.re.FindStringSubmatch(banner)
+		if m == nil {
+			continue
+		}
+		vendor, ok = r.Vendor, true
+		if i := r.re.SubexpIndex("model"); i > 0 && m[i] != "" {
+			return vendor, m[i], true
+		}
+	}
+	return vendor, "", ok
+}
+
+// bannerHTTPClient fetches the HTTP banner with a single request, redirects
+// are not followed.
+var bannerHTTPClient = &http.Client{
+	Timeout: fingerprintTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// fingerprintDevices guesses the vendor and model of every device from its
+// RTSP Server header and the Server header and authentication realm of its
+// web interface. Devices no rule matches keep their banners.
+func fingerprintDevices(ctx context.Context, devices []device) {
+	ctx, cancel := context.WithTimeout(ctx, fingerprintTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			banners := deviceBanners{RTSPServer: d.Server}
+			banners.HTTPServer, banners.Realm = httpBanners(ctx, d.IP)
+			if vendor, model, ok := banners.match(fingerprintRules); ok {
+				d.VendorGuess, d.ModelGuess = vendor, model
+				return
+			}
+			if banners != (deviceBanners{}) {
+				d.Banners = &banners
+			}
+		}(&devices[i])
+	}
+	wg.Wait()
+}
+
+func httpBanners(ctx context.Context, ip string) (server, realm string) {
+	if strings.Contains(ip, "%") {
+		// Zoned link-local addresses are not reachable through net/http.
+		return "", ""
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+net.JoinHostPort(ip, "80")+"/", nil)
+	if err != nil {
+		return "", ""
+	}
+	resp, err := bannerHTTPClient.Do(req)
+	if err != nil {
+		return "", ""
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		if realm = challengeRealm(challenge); realm != "" {
+			break
+		}
+	}
+	return resp.Header.Get("Server"), realm
+}
+
+func challengeRealm(challenge string) string {
+	i := strings.Index(strings.ToLower(challenge), "realm=")
+	if i < 0 {
+		return ""
+	}
+	value := challenge[i+len("realm="):]
+	if strings.HasPrefix(value, `"`) {
+		value, _, _ = strings.Cut(value[1:], `"`)
+		return value
+	}
+	value, _, _ = strings.Cut(value, ",")
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// scanFlight is a scan shared by every request with the same key that arrives
+// while it runs.
+type scanFlight struct {
+	done    chan struct{}
+	result  *scanResult
+	cancel  context.CancelFunc
+	waiters int
+	// requestID is the ID of the request that started the scan.
+	requestID string
+}
+
+type scanGroup struct {
+	mu      sync.Mutex
+	flights map[string]*scanFlight
+	// running counts the scans until they return, cancelled ones included.
+	running sync.WaitGroup
+}
+
+var scanFlights = &scanGroup{flights: make(map[string]*scanFlight)}
+
+// do runs scan once for all concurrent callers with the same key. A caller
+// whose context ends stops waiting; the scan itself is only cancelled when no
+// caller is left. shared reports whether the caller joined a running scan.
+func (g *scanGroup) do(ctx context.Context, key string, scan func(context.Context) *scanResult) (result *scanResult, shared bool, err error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if shared {
+		f.waiters++
+		loggerFrom(ctx).Info("Coalescing scan request with a running identical scan", "scan_request_id", f.requestID, "waiting", f.waiters)
+	} else {
+		scanCtx, cancel := context.WithCancel(withRequestID(context.Background(), requestID(ctx)))
+		f = &scanFlight{done: make(chan struct{}), cancel: cancel, waiters: 1, requestID: requestID(ctx)}
+		g.flights[key] = f
+		g.running.Add(1)
+		go func() {
+			defer g.running.Done()
+			defer cancel()
+			f.result = scan(scanCtx)
+			g.mu.Lock()
+			// A cancelled flight was removed already and its key may start
+			// another scan.
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, shared, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Requests arriving from now on start a new scan rather than
+			// joining the cancelled one, whose result is cut short.
+			delete(g.flights, key)
+			f.cancel()
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScanGroupShared(t *testing.T) {
+	g := &scanGroup{flights: make(map[string]*scanFlight)}
+	release := make(chan struct{})
+	want := &scanResult{}
+	scan := func(context.Context) *scanResult {
+		<-release
+		return want
+	}
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			result, shared, err := g.do(context.Background(), "key", scan)
+			if err != nil || result != want {
+				t.Errorf("do = %v, %v", result, err)
+			}
+			results <- shared
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		f := g.flights["key"]
+		waiters := 0
+		if f != nil {
+			waiters = f.waiters
+		}
+		g.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second request didn't join the scan")
+		}
+	}
+	close(release)
+	if a, b := <-results, <-results; a == b {
+		t.Errorf("shared = %v and %v, want one of each", a, b)
+	}
+}
+
+// TestScanGroupJoinAfterCancel checks that a request arriving while a
+// cancelled scan winds down starts a new scan instead of getting the result
+// cut short.
+func TestScanGroupJoinAfterCancel(t *testing.T) {
+	g := &scanGroup{flights: make(map[string]*scanFlight)}
+	release := make(chan struct{})
+	cancelled := &scanResult{Partial: true}
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := g.do(ctx, "key", func(ctx context.Context) *scanResult {
+			close(started)
+			<-ctx.Done()
+			<-release
+			return cancelled
+		})
+		errs <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("cancelled request: %v", err)
+	}
+
+	// Joining the cancelled scan would wait for it until the timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := &scanResult{}
+	result, shared, err := g.do(ctx, "key", func(context.Context) *scanResult { return want })
+	if err != nil || shared || result != want {
+		t.Errorf("do after the cancel = %+v, shared %v, %v, want a new scan", result, shared, err)
+	}
+	close(release)
+	g.running.Wait()
+	if len(g.flights) != 0 {
+		t.Errorf("flights left: %v", g.flights)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inventoryRow is a camera as listed by the flat inventory formats.
+type inventoryRow struct {
+	IP       string    `xml:"ip"`
+	Ports    []int     `xml:"ports>port"`
+	MAC      string    `xml:"mac"`
+	Vendor   string    `xml:"vendor"`
+	Model    string    `xml:"model"`
+	Firmware string    `xml:"firmware"`
+	Hostname string    `xml:"hostname"`
+	LastSeen time.Time `xml:"last_seen"`
+	// Name and Labels are the metadata of registry cameras, as key=value.
+	Name   string   `xml:"name,omitempty"`
+	Labels []string `xml:"labels>label,omitempty"`
+}
+
+func newInventoryRow(d device, lastSeen time.Time) inventoryRow {
+	return inventoryRow{IP: d.IP, Ports: d.Ports, MAC: d.MAC, Vendor: d.Vendor, Model: d.Model, Firmware: d.firmware(), Hostname: d.Hostname, LastSeen: lastSeen.UTC().Truncate(time.Second)}
+}
+
+// inventoryEncoder writes a camera inventory in a format other than JSON.
+type inventoryEncoder interface {
+	contentType() string
+	extension() string
+	encode(w io.Writer, rows []inventoryRow) error
+}
+
+var inventoryEncoders = map[string]inventoryEncoder{
+	"csv": csvEncoder{},
+	"xml": xmlEncoder{},
+}
+
+// inventoryMediaTypes maps the media types of the Accept header to the
+// inventoryEncoders.
+var inventoryMediaTypes = map[string]string{
+	"text/csv":        "csv",
+	"application/xml": "xml",
+	"text/xml":        "xml",
+}
+
+// inventoryFormat returns the encoder requested with the format parameter or
+// the Accept header, nil for JSON.
+func inventoryFormat(r *http.Request) inventoryEncoder {
+	if enc, ok := inventoryEncoders[r.URL.Query().Get("format")]; ok {
+		return enc
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || mediaType == "*/*" {
+			return nil
+		}
+		if name, ok := inventoryMediaTypes[mediaType]; ok {
+			return inventoryEncoders[name]
+		}
+	}
+	return nil
+}
+
+// writeInventory writes rows sorted by IP with enc, suggesting a file name
+// with the time of the listing.
+func writeInventory(w http.ResponseWriter, enc inventoryEncoder, rows []inventoryRow) {
+	sort.Slice(rows, func(i, j int) bool { return compareIPs(rows[i].IP, rows[j].IP) < 0 })
+	var buf bytes.Buffer
+	if err := enc.encode(&buf, rows); err != nil {
+		logger.Error("Error encoding inventory", "err", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	name := fmt.Sprintf("cameras-%s.%s", time.Now().UTC().Format("20060102T150405Z"), enc.extension())
+	w.Header().Set("Content-Type", enc.contentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func compareIPs(a, b string) int {
+	ipA, ipB := net.ParseIP(strings.Split(a, "%")[0]), net.ParseIP(strings.Split(b, "%")[0])
+	if ipA == nil || ipB == nil {
+		return strings.Compare(a, b)
+	}
+	if c := bytes.Compare(ipA.To16(), ipB.To16()); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+type csvEncoder struct{}
+
+func (csvEncoder) contentType() string { return "text/csv; charset=utf-8" }
+func (csvEncoder) extension() string   { return "csv" }
+
+func (csvEncoder) encode(w io.Writer, rows []inventoryRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ip", "ports", "mac", "vendor", "model", "firmware", "hostname", "last_seen", "name", "labels"})
+	for _, row := range rows {
+		ports := make([]string, len(row.Ports))
+		for i, p := range row.Ports {
+			ports[i] = strconv.Itoa(p)
+		}
+		cw.Write([]string{
+			row.IP, strings.Join(ports, ";"), row.MAC, csvCell(row.Vendor), csvCell(row.Model),
+			csvCell(row.Firmware), csvCell(row.Hostname), row.LastSeen.Format(time.RFC3339),
+			csvCell(row.Name), csvCell(strings.Join(row.Labels, ";")),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell keeps spreadsheets from evaluating values reported by cameras as
+// formulas.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+type xmlEncoder struct{}
+
+func (xmlEncoder) contentType() string { return "application/xml; charset=utf-8" }
+func (xmlEncoder) extension() string   { return "xml" }
+
+func (xmlEncoder) encode(w io.Writer, rows []inventoryRow) error {
+	doc := struct {
+		XMLName xml.Name       `xml:"cameras"`
+		Cameras []inventoryRow `xml:"camera"`
+	}{Cameras: rows}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
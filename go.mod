@@ -1,10 +1,12 @@
 module find_cameras
 
-go 1.20
+go 1.21
 
 require (
 	github.com/clbanning/mxj v1.8.4 // indirect
 	github.com/deepch/go-onvif v0.0.0-20180622022735-9742ea6affba // indirect
 	github.com/google/gopacket v1.1.19 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/sys v0.4.0 // indirect
 )
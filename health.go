@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// quietRoutes are polled every few seconds by the orchestrator and Prometheus,
+// their requests are only logged at debug level.
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+type readinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+func checkNetworks() readinessCheck {
+	check := readinessCheck{Name: "networks"}
+	names, _, err := selectInterfaces(nil, defaultScanOptions.AllowInterfaces, defaultScanOptions.DenyInterfaces)
+	var networks []localNetwork
+	if err == nil {
+		networks, err = getLocalNetworks(names, defaultScanOptions.IPv6)
+	}
+	switch {
+	case err != nil:
+		check.Error = err.Error()
+	case len(networks) == 0:
+		check.Error = "no usable network interface"
+	default:
+		check.OK = true
+	}
+	return check
+}
+
+// checkBackground fails when the background scanner hasn't finished a cycle
+// for three intervals.
+func checkBackground() readinessCheck {
+	check := readinessCheck{Name: "background_scanner", OK: true}
+	if background.interval <= 0 {
+		return check
+	}
+	background.mu.Lock()
+	last := background.lastCompleted
+	if last.IsZero() {
+		last = background.started
+	}
+	background.mu.Unlock()
+	if !last.IsZero() && time.Since(last) > 3*background.interval {
+		check.OK = false
+		check.Error = "no background scan finished since " + last.UTC().Format(time.RFC3339)
+	}
+	return check
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readinessResponse{Ready: true, Checks: []readinessCheck{checkNetworks(), checkBackground()}}
+	for _, check := range resp.Checks {
+		if !check.OK {
+			resp.Ready = false
+		}
+	}
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
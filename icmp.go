@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const icmpReplyWait = time.Second
+
+var errICMPUnavailable = errors.New("ICMP sockets are not available")
+
+type icmpSocket struct {
+	conn net.PacketConn
+	raw  bool
+}
+
+func listenICMP() (*icmpSocket, error) {
+	if conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		return &icmpSocket{conn: conn, raw: true}, nil
+	}
+	conn, err := listenUnprivilegedICMP()
+	if err != nil {
+		return nil, errICMPUnavailable
+	}
+	return &icmpSocket{conn: conn}, nil
+}
+
+func (s *icmpSocket) addr(ip net.IP) net.Addr {
+	if s.raw {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+func echoRequest(id, seq uint16) []byte {
+	msg := []byte{8, 0, 0, 0, 0, 0, 0, 0, '5', 's'}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	return msg
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func icmpCandidates(ctx context.Context, ips []string) ([]string, error) {
+	sock, err := listenICMP()
+	if err != nil {
+		return nil, err
+	}
+	defer sock.conn.Close()
+
+	id := uint16(os.Getpid())
+	wanted := make(map[string]bool, len(ips))
+	for i, ip := range ips {
+		parsed := net.ParseIP(ip).To4()
+		if parsed == nil {
+			continue
+		}
+		wanted[ip] = true
+		if _, err := sock.conn.WriteTo(echoRequest(id, uint16(i)), sock.addr(parsed)); err != nil {
+			continue
+		}
+	}
+
+	deadline := time.Now().Add(icmpReplyWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	sock.conn.SetReadDeadline(deadline)
+
+	alive := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := sock.conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n < 8 || buf[0] != 0 {
+			continue
+		}
+		if sock.raw && binary.BigEndian.Uint16(buf[4:]) != id {
+			continue
+		}
+		var ip string
+		switch a := from.(type) {
+		case *net.IPAddr:
+			ip = a.IP.String()
+		case *net.UDPAddr:
+			ip = a.IP.String()
+		}
+		if wanted[ip] {
+			alive[ip] = true
+		}
+	}
+
+	var candidates []string
+	for _, ip := range ips {
+		if alive[ip] {
+			candidates = append(candidates, ip)
+		}
+	}
+	return candidates, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+func listenUnprivilegedICMP() (net.PacketConn, error) {
+	return nil, errICMPUnavailable
+}
+
+func listenUnprivilegedICMPv6() (net.PacketConn, error) {
+	return nil, errICMPUnavailable
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ignoreIP  = "ip"
+	ignoreMAC = "mac"
+	ignoreID  = "id"
+)
+
+// ignoreEntry matches the devices that aren't cameras, by IP, MAC or the ID
+// of their registry record. Its key, <type>:<value>, identifies it.
+type ignoreEntry struct {
+	Key     string    `json:"key"`
+	Type    string    `json:"type"`
+	Value   string    `json:"value"`
+	Reason  string    `json:"reason,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// ignoreList holds the devices that are still probed but left out of the
+// results, the listings, the history and the notifications.
+type ignoreList struct {
+	mu      sync.Mutex
+	entries map[string]ignoreEntry
+}
+
+var ignored = &ignoreList{entries: make(map[string]ignoreEntry)}
+
+// newIgnoreEntry validates and normalizes the value of an entry.
+func newIgnoreEntry(typ, value string) (ignoreEntry, error) {
+	value = strings.TrimSpace(value)
+	switch typ {
+	case ignoreIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return ignoreEntry{}, fmt.Errorf("invalid IP %q", value)
+		}
+		value = ip.String()
+	case ignoreMAC:
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return ignoreEntry{}, fmt.Errorf("invalid MAC %q", value)
+		}
+		value = mac.String()
+	case ignoreID:
+		if value == "" {
+			return ignoreEntry{}, fmt.Errorf("empty id")
+		}
+	}
+	return ignoreEntry{Key: typ + ":" + value, Type: typ, Value: value}, nil
+}
+
+// add stores e unless an entry with its key exists, returning the stored
+// entry and whether it is new.
+func (l *ignoreList) add(e ignoreEntry) (ignoreEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if existing, ok := l.entries[e.Key]; ok {
+		return existing, false
+	}
+	l.entries[e.Key] = e
+	return e, true
+}
+
+func (l *ignoreList) remove(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+// list returns the entries sorted by key.
+func (l *ignoreList) list() []ignoreEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]ignoreEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+func (l *ignoreList) restore(entries []ignoreEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = make(map[string]ignoreEntry, len(entries))
+	for _, e := range entries {
+		l.entries[e.Key] = e
+	}
+}
+
+// matches reports whether d, whose registry record is id when known, is
+// ignored. IDs are also matched against the identities of d, so a device is
+// recognized before it is recorded.
+func (l *ignoreList) matches(d *device, id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == 0 {
+		return false
+	}
+	host, _, _ := strings.Cut(d.IP, "%")
+	if ip := net.ParseIP(host); ip != nil {
+		if _, ok := l.entries[ignoreIP+":"+ip.String()]; ok {
+			return true
+		}
+	}
+	if mac, err := net.ParseMAC(d.MAC); err == nil {
+		if _, ok := l.entries[ignoreMAC+":"+mac.String()]; ok {
+			return true
+		}
+	}
+	if _, ok := l.entries[ignoreID+":"+id]; ok && id != "" {
+		return true
+	}
+	for _, key := range identityKeys(d) {
+		if _, ok := l.entries[ignoreID+":"+key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnored reports whether d or the registry record of the camera known at
+// its address is ignored, for devices found before their MAC is resolved.
+func isIgnored(d *device) bool {
+	if ignored.matches(d, "") {
+		return true
+	}
+	r, ok := cameras.lookup(d)
+	return ok && ignored.matches(&r.device, r.ID)
+}
+
+// dropIgnored removes the ignored devices of a scan together with their
+// records, which update returned in the same order.
+func dropIgnored(devices []device, records []cameraRecord) ([]device, []cameraRecord, int) {
+	keptDevices, keptRecords := devices[:0:0], records[:0:0]
+	for i := range devices {
+		if ignored.matches(&records[i].device, records[i].ID) {
+			continue
+		}
+		keptDevices = append(keptDevices, devices[i])
+		keptRecords = append(keptRecords, records[i])
+	}
+	return keptDevices, keptRecords, len(devices) - len(keptDevices)
+}
+
+// ignoreRequest is the body of POST /ignored, naming exactly one of ip, mac
+// and id.
+type ignoreRequest struct {
+	IP     string `json:"ip,omitempty"`
+	MAC    string `json:"mac,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func handleListIgnored(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ignored.list())
+}
+
+func handleAddIgnored(w http.ResponseWriter, r *http.Request) {
+	var body ignoreRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	var typ, value string
+	n := 0
+	for _, field := range []struct{ typ, value string }{{ignoreIP, body.IP}, {ignoreMAC, body.MAC}, {ignoreID, body.ID}} {
+		if field.value != "" {
+			typ, value = field.typ, field.value
+			n++
+		}
+	}
+	if n != 1 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "expected exactly one of ip, mac and id")
+		return
+	}
+	e, err := newIgnoreEntry(typ, value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	e.Reason, e.AddedAt = body.Reason, time.Now()
+	e, added := ignored.add(e)
+	if !added {
+		writeJSON(w, http.StatusOK, e)
+		return
+	}
+	state.changed()
+	loggerFrom(r.Context()).Info("Ignoring device", "key", e.Key, "reason", e.Reason)
+	writeJSON(w, http.StatusCreated, e)
+}
+
+func handleDeleteIgnored(w http.ResponseWriter, r *http.Request) {
+	key := pathParam(r, "key")
+	// Keys are normalized like new entries, so an uppercase MAC finds its
+	// entry.
+	if typ, value, ok := strings.Cut(key, ":"); ok {
+		if e, err := newIgnoreEntry(typ, value); err == nil {
+			key = e.Key
+		}
+	}
+	if !ignored.remove(key) {
+		writeError(w, http.StatusNotFound, codeNotFound, "no ignore entry "+key)
+		return
+	}
+	state.changed()
+	loggerFrom(r.Context()).Info("No longer ignoring device", "key", key)
+	w.WriteHeader(http.StatusNoContent)
+}
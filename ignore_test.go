@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIgnoreEntry(t *testing.T) {
+	tests := []struct {
+		typ, value string
+		key        string
+	}{
+		{ignoreIP, " 10.0.0.9 ", "ip:10.0.0.9"},
+		{ignoreIP, "2001:DB8:0::9", "ip:2001:db8::9"},
+		{ignoreIP, "10.0.0.300", ""},
+		{ignoreMAC, "00-11-22-AA-BB-CC", "mac:00:11:22:aa:bb:cc"},
+		{ignoreMAC, "0011.22aa.bbcc", "mac:00:11:22:aa:bb:cc"},
+		{ignoreMAC, "00:11:22", ""},
+		{ignoreID, "mac:00:11:22:aa:bb:cc", "id:mac:00:11:22:aa:bb:cc"},
+		{ignoreID, " ", ""},
+	}
+	for _, tt := range tests {
+		e, err := newIgnoreEntry(tt.typ, tt.value)
+		if tt.key == "" {
+			if err == nil {
+				t.Errorf("newIgnoreEntry(%s, %q) = %+v, want an error", tt.typ, tt.value, e)
+			}
+			continue
+		}
+		if err != nil || e.Key != tt.key {
+			t.Errorf("newIgnoreEntry(%s, %q) = %q, %v, want %q", tt.typ, tt.value, e.Key, err, tt.key)
+		}
+	}
+}
+
+// TestIgnoredAfterIPChange checks that a device ignored by MAC or by the ID
+// of its record stays ignored at a new IP, even before its MAC is resolved
+// there.
+func TestIgnoredAfterIPChange(t *testing.T) {
+	tests := []struct {
+		typ, value string
+	}{
+		{ignoreMAC, "00-11-22-AA-BB-CC"},
+		{ignoreID, "mac:00:11:22:aa:bb:cc"},
+	}
+	for _, tt := range tests {
+		withStore(t)
+		e, err := newIgnoreEntry(tt.typ, tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ignored.add(e)
+		at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		cameras.update([]device{{IP: "10.0.0.7", MAC: "00:11:22:aa:bb:cc"}}, at, nil, false)
+		cameras.update([]device{{IP: "10.0.0.9", MAC: "00:11:22:aa:bb:cc"}}, at.Add(time.Minute), nil, false)
+
+		if !isIgnored(&device{IP: "10.0.0.9", MAC: "00:11:22:aa:bb:cc"}) || !isIgnored(&device{IP: "10.0.0.9"}) {
+			t.Errorf("%s: device at its new IP not ignored", e.Key)
+		}
+		if isIgnored(&device{IP: "10.0.0.7"}) {
+			t.Errorf("%s: device at its old IP still ignored", e.Key)
+		}
+	}
+}
+
+func TestIgnoredEndpoints(t *testing.T) {
+	withStore(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		key    string
+	}{
+		{`{"mac":"00-11-22-AA-BB-CC","reason":"intercom"}`, http.StatusCreated, "mac:00:11:22:aa:bb:cc"},
+		{`{"mac":"00:11:22:aa:bb:cc","reason":"other"}`, http.StatusOK, "mac:00:11:22:aa:bb:cc"},
+		{`{"ip":"10.0.0.9"}`, http.StatusCreated, "ip:10.0.0.9"},
+		{`{"id":"ip:10.0.0.8"}`, http.StatusCreated, "id:ip:10.0.0.8"},
+		{`{}`, http.StatusBadRequest, ""},
+		{`{"ip":"10.0.0.9","mac":"00:11:22:aa:bb:cc"}`, http.StatusBadRequest, ""},
+		{`{"ip":"camera"}`, http.StatusBadRequest, ""},
+		{`{"host":"10.0.0.9"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp := postJSON(t, srv.URL+apiPrefix+"/ignored", tt.body)
+		var e ignoreEntry
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode != tt.status || e.Key != tt.key {
+			t.Errorf("POST %s: %d %q, want %d %q", tt.body, resp.StatusCode, e.Key, tt.status, tt.key)
+		}
+	}
+	// The existing entry keeps its reason.
+	if l := ignored.list(); len(l) != 3 || l[2].Key != "mac:00:11:22:aa:bb:cc" || l[2].Reason != "intercom" {
+		t.Errorf("ignored = %+v", l)
+	}
+
+	for _, tt := range []struct {
+		key    string
+		status int
+	}{
+		{"mac:00-11-22-AA-BB-CC", http.StatusNoContent},
+		{"mac:00:11:22:aa:bb:cc", http.StatusNotFound},
+		{"ip:10.0.0.9", http.StatusNoContent},
+		{"ip:10.0.0.10", http.StatusNotFound},
+	} {
+		if resp, body := doRequest(t, srv, http.MethodDelete, apiPrefix+"/ignored/"+tt.key); resp.StatusCode != tt.status {
+			t.Errorf("DELETE %s: %d %s, want %d", tt.key, resp.StatusCode, body, tt.status)
+		}
+	}
+	if l := ignored.list(); len(l) != 1 || l[0].Key != "id:ip:10.0.0.8" {
+		t.Errorf("ignored = %+v", l)
+	}
+}
+
+// TestIgnoredDevices checks that an ignored device is still probed but left
+// out of the scan results, the listings, the exports, the diffs and the
+// webhooks.
+func TestIgnoredDevices(t *testing.T) {
+	withStore(t)
+	port := fakeRTSP(t, "Hikvision")
+	hooks := webhooks
+	webhooks = newWebhookNotifier([]string{"http://127.0.0.1:1/events"}, "")
+	t.Cleanup(func() { webhooks = hooks })
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	scan := func() (found, ignoredDevices int) {
+		t.Helper()
+		_, body := doRequest(t, srv, http.MethodGet, apiPrefix+"/scan?"+localScan(port))
+		var result struct {
+			Found   int `json:"found"`
+			Ignored int `json:"ignored"`
+		}
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatalf("scan: %v: %s", err, body)
+		}
+		return result.Found, result.Ignored
+	}
+	postJSON(t, srv.URL+apiPrefix+"/ignored", `{"ip":"127.0.0.1","reason":"intercom"}`)
+	if found, ignoredDevices := scan(); found != 0 || ignoredDevices != 1 {
+		t.Errorf("scan with the device ignored found %d, ignored %d", found, ignoredDevices)
+	}
+	if n := webhooks.pending(); n != 0 {
+		t.Errorf("%d webhook events for an ignored device", n)
+	}
+
+	tests := []struct {
+		path    string
+		devices int
+	}{
+		{"/cameras", 0},
+		{"/cameras?include_ignored=true", 1},
+		{"/cameras/export", 0},
+		{"/cameras/export?include_ignored=true", 1},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, srv, http.MethodGet, apiPrefix+tt.path)
+		var records []cameraRecord
+		if strings.HasPrefix(tt.path, "/cameras?") || tt.path == "/cameras" {
+			var page camerasResponse
+			json.Unmarshal([]byte(body), &page)
+			records = page.Devices
+		} else {
+			json.Unmarshal([]byte(body), &records)
+		}
+		if resp.StatusCode != http.StatusOK || len(records) != tt.devices {
+			t.Errorf("GET %s: %d, %d devices, want %d: %s", tt.path, resp.StatusCode, len(records), tt.devices, body)
+			continue
+		}
+		if len(records) > 0 && !records[0].Ignored {
+			t.Errorf("GET %s: device not flagged as ignored: %s", tt.path, body)
+		}
+	}
+	diff := func() cameraDiff {
+		t.Helper()
+		resp, body := doRequest(t, srv, http.MethodGet, apiPrefix+"/cameras/diff")
+		var diff cameraDiff
+		if err := json.Unmarshal([]byte(body), &diff); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /cameras/diff: %d %s", resp.StatusCode, body)
+		}
+		return diff
+	}
+	doRequest(t, srv, http.MethodDelete, apiPrefix+"/ignored/ip:127.0.0.1")
+	if found, _ := scan(); found != 1 {
+		t.Errorf("scan after the entry was deleted found %d", found)
+	}
+	if d := diff(); len(d.Added) != 1 {
+		t.Errorf("diff after the entry was deleted: %+v", d)
+	}
+	// Devices ignored after the scans are left out of their diff too.
+	postJSON(t, srv.URL+apiPrefix+"/ignored", `{"ip":"127.0.0.1"}`)
+	if d := diff(); len(d.Added)+len(d.Removed)+len(d.Changed) != 0 {
+		t.Errorf("diff with the device ignored again: %+v", d)
+	}
+}
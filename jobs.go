@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+var (
+	errTooManyJobs  = errors.New("too many scans are running")
+	errNotResumable = errors.New("the scan cannot be resumed")
+)
+
+type scanJob struct {
+	id        string
+	requestID string
+	progress  *scanProgress
+	cancel    context.CancelFunc
+	done      chan struct{}
+	// query is the query the job is checkpointed with, nil when it isn't.
+	query   url.Values
+	resumed *time.Time
+
+	mu       sync.Mutex
+	status   string
+	started  time.Time
+	finished time.Time
+	result   *scanResult
+
+	cancelled bool
+	// interrupted jobs were stopped by the shutdown and keep their
+	// checkpoint.
+	interrupted bool
+}
+
+type jobStatus struct {
+	ID         string           `json:"id"`
+	RequestID  string           `json:"request_id,omitempty"`
+	Status     string           `json:"status"`
+	StartedAt  time.Time        `json:"started_at"`
+	ResumedAt  *time.Time       `json:"resumed_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Partial    bool             `json:"partial,omitempty"`
+	Found      int              `json:"found"`
+	Progress   progressReport   `json:"progress"`
+	Prefilters []string         `json:"prefilters,omitempty"`
+	Networks   []networkStats   `json:"networks,omitempty"`
+	Skipped    []skippedNetwork `json:"skipped,omitempty"`
+	Excluded   int              `json:"excluded,omitempty"`
+	Ignored    int              `json:"ignored,omitempty"`
+	Devices    []device         `json:"devices"`
+	// CheckpointedAt is when the checkpoint of an interrupted job was saved.
+	CheckpointedAt *time.Time `json:"checkpointed_at,omitempty"`
+}
+
+func (j *scanJob) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobStatus{ID: j.id, RequestID: j.requestID, Status: j.status, StartedAt: j.started, ResumedAt: j.resumed}
+	if j.result == nil {
+		s.Progress = j.progress.report()
+		s.Devices = filterSlice(j.progress.devices(), func(d device) bool { return !isIgnored(&d) })
+		s.Found = len(s.Devices)
+		return s
+	}
+
+	finished := j.finished
+	s.FinishedAt = &finished
+	s.Partial = j.result.Partial || j.status == jobCancelled
+	s.Prefilters = j.result.Prefilters
+	s.Skipped = j.result.Skipped
+	s.Excluded = j.result.Excluded
+	s.Ignored = j.result.Ignored
+	s.Networks = j.result.Networks
+	s.Progress = j.result.Progress
+	s.Devices = j.result.Devices
+	s.Found = len(s.Devices)
+	return s
+}
+
+type jobStore struct {
+	retention  time.Duration
+	maxRunning int
+
+	mu      sync.Mutex
+	jobs    map[string]*scanJob
+	running int
+	// interrupted holds the checkpoints of the interrupted jobs by id.
+	interrupted map[string]*scanCheckpoint
+}
+
+func newJobStore(retention time.Duration, maxRunning int) *jobStore {
+	return &jobStore{retention: retention, maxRunning: maxRunning, jobs: make(map[string]*scanJob), interrupted: make(map[string]*scanCheckpoint)}
+}
+
+var scanJobs = newJobStore(time.Hour, 4)
+
+// start runs a scan in the background. The scan outlives the request that
+// started it and is only bounded by its deadline.
+func (s *jobStore) start(requestID string, networks []localNetwork, opts scanOptions) (*scanJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.running >= s.maxRunning {
+		s.mu.Unlock()
+		return nil, errTooManyJobs
+	}
+	ctx, job := s.add(id, requestID, newScanProgress(), time.Now(), opts)
+	s.mu.Unlock()
+
+	s.run(ctx, job, networks, opts)
+	return job, nil
+}
+
+// add registers a running job. The job is checkpointed when the state is
+// persisted. s.mu must be held.
+func (s *jobStore) add(id, requestID string, progress *scanProgress, started time.Time, opts scanOptions) (context.Context, *scanJob) {
+	ctx, cancel := context.WithCancel(withRequestID(context.Background(), requestID))
+	job := &scanJob{id: id, requestID: requestID, progress: progress, cancel: cancel, done: make(chan struct{}), status: jobRunning, started: started}
+	job.progress.id = id
+	if state != nil && checkpointInterval > 0 {
+		job.query = checkpointQuery(opts.query)
+		job.progress.checkpointing = true
+	}
+	s.jobs[id] = job
+	s.running++
+	return ctx, job
+}
+
+// run scans in the background for job. A job cut short by the shutdown or
+// its deadline leaves its checkpoint to be resumed.
+func (s *jobStore) run(ctx context.Context, job *scanJob, networks []localNetwork, opts scanOptions) {
+	if job.query != nil {
+		go job.checkpointLoop()
+	}
+	go func() {
+		defer job.cancel()
+		result := scanNetworks(ctx, networks, opts, job.progress)
+
+		job.mu.Lock()
+		job.status = jobDone
+		if job.cancelled {
+			job.status = jobCancelled
+		}
+		job.finished = time.Now()
+		job.result = result
+		interrupted := job.query != nil && (job.interrupted || result.Partial)
+		job.mu.Unlock()
+
+		s.mu.Lock()
+		if interrupted {
+			s.interrupted[job.id] = job.checkpoint(jobInterrupted)
+		}
+		s.running--
+		s.mu.Unlock()
+		close(job.done)
+		state.changed()
+		loggerFrom(ctx).Info("Scan job finished", "job", job.id, "status", job.status, "interrupted", interrupted, "duration_ms", time.Since(job.started).Milliseconds())
+	}()
+}
+
+// stop cancels a running job and waits until its partial results are stored.
+// Stopping a finished job does nothing.
+func (j *scanJob) stop() {
+	j.mu.Lock()
+	if j.result == nil {
+		j.cancelled = true
+	}
+	j.mu.Unlock()
+	j.cancel()
+	<-j.done
+}
+
+func (s *jobStore) get(id string) *scanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// expire removes the jobs that finished longer than the retention ago and
+// abandons the old checkpoints.
+func (s *jobStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.abandonCheckpoints(now) {
+		state.changed()
+	}
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		expired := job.result != nil && now.Sub(job.finished) > s.retention
+		job.mu.Unlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *jobStore) expireLoop(ctx context.Context) {
+	interval := s.retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.expire(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func handleGetScan(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	if job := scanJobs.get(id); job != nil {
+		writeJSON(w, http.StatusOK, job.snapshot())
+		return
+	}
+	if cp := scanJobs.interruptedJob(id); cp != nil {
+		writeJSON(w, http.StatusOK, cp.status())
+		return
+	}
+	if snap, ok := snapshots.get(id); ok {
+		writeJSON(w, http.StatusOK, snap)
+		return
+	}
+	writeError(w, http.StatusNotFound, codeNotFound, "unknown scan "+id)
+}
+
+// handleStopScan cancels a running scan job. Stopping a finished job just
+// returns its final state.
+func handleStopScan(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	job := scanJobs.get(id)
+	if job == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "unknown scan "+id)
+		return
+	}
+	job.stop()
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+func handleListScans(w http.ResponseWriter, r *http.Request) {
+	limit := snapshots.keep
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid limit: "+v)
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, snapshots.list(limit))
+}
+
+// startedScan is the response of a started scan job.
+type startedScan struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func handleStartScan(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		writeShuttingDown(w)
+		return
+	}
+	networks, opts, ok := prepareScan(w, r)
+	if !ok {
+		return
+	}
+	if !allowScan(w, r) {
+		return
+	}
+	job, err := scanJobs.start(requestID(r.Context()), networks, opts)
+	if err == errTooManyJobs {
+		writeError(w, http.StatusTooManyRequests, codeTooManyScans, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	loggerFrom(r.Context()).Info("Started scan job", "job", job.id)
+	w.Header().Set("Location", apiPrefix+"/scans/"+job.id)
+	writeJSON(w, http.StatusAccepted, startedScan{job.id, jobRunning})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"find_cameras/scanner"
+)
+
+// withProber makes the scans probe with prober rather than dialing.
+func withProber(t *testing.T, prober scanner.ProberFunc) {
+	t.Helper()
+	scanProber = prober
+	t.Cleanup(func() { scanProber = nil })
+}
+
+func getJob(t *testing.T, url string) jobStatus {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var job jobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func deleteJob(t *testing.T, url string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStopScan(t *testing.T) {
+	withStore(t)
+	var probes int64
+	withProber(t, func(ctx context.Context, ip string, port int) scanner.Result {
+		atomic.AddInt64(&probes, 1)
+		if ip == "10.0.0.1" {
+			return scanner.Result{IP: ip, Outcome: scanner.OutcomeRTSP, StatusCode: 200}
+		}
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		return scanner.Result{IP: ip, Outcome: scanner.OutcomeTimeout}
+	})
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	resp := postJSON(t, srv.URL+apiPrefix+"/scans?cidr=10.0.0.0/22&mode=full&unicast=false&discovery_window=0s&onvif_ports=none&ports=554&concurrency=4", "")
+	var started startedScan
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting the scan: %d %v", resp.StatusCode, err)
+	}
+	jobURL := srv.URL + apiPrefix + "/scans/" + started.ID
+	for atomic.LoadInt64(&probes) < 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if status := deleteJob(t, jobURL); status != http.StatusOK {
+		t.Fatalf("stopping the scan: status %d", status)
+	}
+	var job jobStatus
+	for deadline := time.Now().Add(5 * time.Second); job.Status != jobCancelled; time.Sleep(10 * time.Millisecond) {
+		if job = getJob(t, jobURL); time.Now().After(deadline) {
+			t.Fatalf("job still %s after being stopped", job.Status)
+		}
+	}
+	stopped := atomic.LoadInt64(&probes)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&probes); n != stopped {
+		t.Errorf("%d probes started after the scan was stopped", n-stopped)
+	}
+	if stopped >= 1022 {
+		t.Errorf("all %d hosts probed despite the cancellation", stopped)
+	}
+	if !job.Partial || len(job.Devices) != 1 || job.Devices[0].IP != "10.0.0.1" {
+		t.Errorf("partial results not kept: partial %t, devices %+v", job.Partial, job.Devices)
+	}
+
+	// Stopping the finished job again is a no-op.
+	if status := deleteJob(t, jobURL); status != http.StatusOK {
+		t.Errorf("stopping the stopped scan: status %d", status)
+	}
+	if again := getJob(t, jobURL); again.Status != jobCancelled || again.Found != job.Found {
+		t.Errorf("job = %s with %d found, want %s with %d", again.Status, again.Found, jobCancelled, job.Found)
+	}
+	if status := deleteJob(t, srv.URL+apiPrefix+"/scans/unknown"); status != http.StatusNotFound {
+		t.Errorf("stopping an unknown scan: status %d, want 404", status)
+	}
+}
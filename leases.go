@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaseFile is the dnsmasq or ISC dhcpd lease file whose active leases are
+// probed first by every scan, empty when there is none.
+var leaseFile string
+
+// dhcpLease is an active lease of the DHCP server.
+type dhcpLease struct {
+	IP       string
+	MAC      string
+	Hostname string
+}
+
+// loadLeases reads the active leases of leaseFile by IP. The file is read
+// again by every scan; when it can't be read the scan goes on without it.
+func loadLeases(ctx context.Context) map[string]dhcpLease {
+	if leaseFile == "" {
+		return nil
+	}
+	f, err := os.Open(leaseFile)
+	if err != nil {
+		loggerFrom(ctx).Warn("DHCP leases unavailable, scanning without them", "file", leaseFile, "err", err)
+		return nil
+	}
+	defer f.Close()
+	leases, err := parseLeases(f, time.Now())
+	if err != nil {
+		loggerFrom(ctx).Warn("DHCP leases unavailable, scanning without them", "file", leaseFile, "err", err)
+		return nil
+	}
+	loggerFrom(ctx).Debug("Read DHCP leases", "file", leaseFile, "leases", len(leases))
+	return leases
+}
+
+// parseLeases parses a dnsmasq lease file, one "expiry mac ip hostname
+// client-id" line per lease, or an ISC dhcpd one of "lease ip { ... }"
+// blocks, where later blocks of an address replace earlier ones.
+func parseLeases(r io.Reader, now time.Time) (map[string]dhcpLease, error) {
+	leases := make(map[string]dhcpLease)
+	scanner := bufio.NewScanner(r)
+	var isc *iscLease
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch {
+		case isc != nil:
+			if line == "}" {
+				if isc.active(now) {
+					leases[isc.IP] = isc.dhcpLease
+				} else {
+					delete(leases, isc.IP)
+				}
+				isc = nil
+				continue
+			}
+			isc.parse(fields)
+		case fields[0] == "lease" && len(fields) >= 3 && fields[2] == "{":
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				isc = &iscLease{dhcpLease: dhcpLease{IP: ip.String()}}
+			}
+		case len(fields) >= 4:
+			// dnsmasq, whose DHCPv6 leases carry an IAID instead of a MAC.
+			expiry, err := strconv.ParseInt(fields[0], 10, 64)
+			ip := net.ParseIP(fields[2])
+			if err != nil || ip == nil || (expiry != 0 && time.Unix(expiry, 0).Before(now)) {
+				continue
+			}
+			lease := dhcpLease{IP: ip.String()}
+			if mac, err := net.ParseMAC(fields[1]); err == nil {
+				lease.MAC = mac.String()
+			}
+			if fields[3] != "*" {
+				lease.Hostname = fields[3]
+			}
+			leases[lease.IP] = lease
+		}
+	}
+	return leases, scanner.Err()
+}
+
+// iscLease is a lease block of an ISC dhcpd lease file being parsed.
+type iscLease struct {
+	dhcpLease
+	state string
+	ends  time.Time
+}
+
+func (l *iscLease) parse(fields []string) {
+	switch {
+	case len(fields) >= 3 && fields[0] == "binding" && fields[1] == "state":
+		l.state = fields[2]
+	case len(fields) >= 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+		if mac, err := net.ParseMAC(fields[2]); err == nil {
+			l.MAC = mac.String()
+		}
+	case len(fields) >= 2 && fields[0] == "client-hostname":
+		l.Hostname = strings.Trim(strings.Join(fields[1:], " "), `"`)
+	case len(fields) >= 3 && fields[0] == "ends" && fields[1] == "epoch":
+		if n, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+			l.ends = time.Unix(n, 0)
+		}
+	case len(fields) >= 4 && fields[0] == "ends":
+		// ends 4 2026/10/15 06:00:00, in UTC.
+		if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+			l.ends = t
+		}
+	}
+}
+
+// active reports whether the lease is held: by its binding state when the
+// file records it, otherwise by its end.
+func (l *iscLease) active(now time.Time) bool {
+	if l.state != "" {
+		return l.state == "active"
+	}
+	return l.ends.IsZero() || l.ends.After(now)
+}
+
+// leasesFirst orders the leased addresses of hosts before the other
+// candidates, adding those the pre-filter dropped, and returns how many
+// there are.
+func leasesFirst(candidates, hosts []string, leases map[string]dhcpLease) ([]string, int) {
+	if len(leases) == 0 {
+		return candidates, 0
+	}
+	ordered := make([]string, 0, len(candidates))
+	for _, ip := range hosts {
+		if _, ok := leases[ip]; ok {
+			ordered = append(ordered, ip)
+		}
+	}
+	leased := len(ordered)
+	for _, ip := range candidates {
+		if _, ok := leases[ip]; !ok {
+			ordered = append(ordered, ip)
+		}
+	}
+	return ordered, leased
+}
+
+// addLeases attaches the MAC and hostname of their lease to the devices
+// found. Leases never add devices themselves.
+func (s *deviceSet) addLeases(leases map[string]dhcpLease) {
+	for i := range s.devices {
+		d := &s.devices[i]
+		lease, ok := leases[d.IP]
+		if !ok {
+			continue
+		}
+		if d.MAC == "" && lease.MAC != "" {
+			d.MAC = lease.MAC
+			d.Vendor = vendors.vendor(lease.MAC)
+		}
+		d.DHCPHostname = lease.Hostname
+	}
+}
@@ -1,145 +1,628 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
-	"sync"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-const rtspPort = 554
-
-func logRequest(handlerFunc http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		log.Printf("Received request: Method=%s URL=%s From=%s", r.Method, r.URL.Path, r.RemoteAddr)
+// requestError is an invalid request together with its response.
+type requestError struct {
+	status   int
+	response errorResponse
+}
 
-		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
-		handlerFunc(recorder, r)
+func (e *requestError) Error() string {
+	return e.response.Error.Message
+}
 
-		log.Printf("Responded: Status=%d Duration=%s", recorder.statusCode, time.Since(start))
+// resolveScan parses the options of a scan request and determines the networks
+// it covers.
+func resolveScan(query url.Values) ([]localNetwork, scanOptions, error) {
+	opts, err := parseScanOptions(query, defaultScanOptions)
+	opts.query = query
+	if err != nil {
+		return nil, opts, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeInvalidRequest, Message: err.Error()}}}
 	}
-}
 
-type statusRecorder struct {
-	http.ResponseWriter
-	statusCode int
+	if len(opts.CIDRs) > 0 {
+		networks := requestedNetworks(opts.CIDRs)
+		if err := checkVerbose(networks, opts); err != nil {
+			return nil, opts, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeInvalidRequest, Message: err.Error()}}}
+		}
+		return networks, opts, nil
+	}
+	names, statuses, err := selectInterfaces(opts.Interfaces, opts.AllowInterfaces, opts.DenyInterfaces)
+	opts.interfaces = statuses
+	var ifaceErr *interfaceError
+	if errors.As(err, &ifaceErr) {
+		return nil, opts, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeUnknownInterface, Message: err.Error(), AvailableInterfaces: ifaceErr.available}}}
+	}
+	var networks []localNetwork
+	if err == nil {
+		networks, err = getLocalNetworks(names, opts.IPv6)
+	}
+	if err != nil {
+		return nil, opts, &requestError{http.StatusInternalServerError, errorResponse{apiError{Code: codeNetworkEnumeration, Message: fmt.Sprintf("Error determining local networks: %v", err)}}}
+	}
+	if err := checkVerbose(networks, opts); err != nil {
+		return nil, opts, &requestError{http.StatusBadRequest, errorResponse{apiError{Code: codeInvalidRequest, Message: err.Error()}}}
+	}
+	return networks, opts, nil
 }
 
-func checkRTSP(ip string) bool {
-	address := fmt.Sprintf("%s:%d", ip, rtspPort)
-	conn, err := net.DialTimeout("tcp", address, 50*time.Millisecond)
+// prepareScan parses the options and networks of a scan request, writing the
+// error response and returning false when they are invalid.
+func prepareScan(w http.ResponseWriter, r *http.Request) ([]localNetwork, scanOptions, bool) {
+	query, err := scanQuery(r)
 	if err != nil {
-		return false
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, scanOptions{}, false
 	}
-	conn.Close()
-	return true
+	networks, opts, err := resolveScan(query)
+	if err != nil {
+		reqErr := err.(*requestError)
+		reqErr.response.Error.RequestID = requestID(r.Context())
+		writeJSON(w, reqErr.status, reqErr.response)
+		return nil, scanOptions{}, false
+	}
+	return networks, opts, true
 }
 
-func getIPsInNetwork(network *net.IPNet) []string {
-	var ips []string
-	for ip := network.IP.Mask(network.Mask); network.Contains(ip); incrementIP(ip) {
-		ips = append(ips, ip.String())
+func handleGetAllRTSPDevices(w http.ResponseWriter, r *http.Request) {
+	networks, opts, ok := prepareScan(w, r)
+	if !ok {
+		return
+	}
+	streaming := strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/stream") || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	ndjson := r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if (streaming || ndjson) && !allowScan(w, r) {
+		return
+	}
+	if streaming {
+		streamScan(w, r, networks, opts)
+		return
+	}
+	if ndjson {
+		ndjsonScan(w, r, networks, opts)
+		return
 	}
-	return ips
-}
 
-func incrementIP(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+	resultCache.observe(networks)
+	key := scanKey(networks, opts)
+	result := resultCache.get(key)
+	cached := result != nil && !opts.Refresh
+	if !cached {
+		if !allowScan(w, r) {
+			return
+		}
+		var err error
+		result, _, err = scanFlights.do(r.Context(), key, func(ctx context.Context) *scanResult {
+			result := scanNetworks(ctx, networks, opts, nil)
+			if ctx.Err() == nil {
+				resultCache.put(key, result)
+			}
+			return result
+		})
+		if err != nil {
+			if isShuttingDown() {
+				writeShuttingDown(w)
+			} else if requestTimedOut(r) {
+				writeRequestTimeout(w)
+			}
+			return
 		}
 	}
-}
 
-func scanIPs(ips []string) []string {
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var devices []string
-
-	for _, ip := range ips {
-		wg.Add(1)
-		go func(ip string) {
-			defer wg.Done()
-			if checkRTSP(ip) {
-				mu.Lock()
-				devices = append(devices, ip)
-				mu.Unlock()
-			}
-		}(ip)
+	w.Header().Set("X-Scan-Cached", strconv.FormatBool(cached))
+	w.Header().Set("X-Scan-Scanned-At", result.ScannedAt.UTC().Format(time.RFC3339))
+	for _, used := range result.Prefilters {
+		w.Header().Add("X-Scan-Prefilter", used)
+	}
+	for _, s := range result.Networks {
+		w.Header().Add("X-Scan-Network", fmt.Sprintf("%s; hosts=%d; candidates=%d; probed=%d; found=%d", s.Network, s.Hosts, s.Candidates, s.Probed, s.Found))
+	}
+	for _, s := range result.Skipped {
+		w.Header().Add("X-Scan-Skipped", fmt.Sprintf("%s; %s", s.Network, s.Reason))
+	}
+	p := result.Progress
+	w.Header().Set("X-Scan-Progress", fmt.Sprintf("candidates=%d; probed=%d; found=%d; elapsed_ms=%d", p.Candidates, p.Probed, p.Found, p.ElapsedMS))
+	if result.Excluded > 0 {
+		w.Header().Set("X-Scan-Excluded", strconv.Itoa(result.Excluded))
+	}
+	if result.Partial {
+		w.Header().Set("X-Scan-Partial", "true")
 	}
+	if opts.EmbedCredentials {
+		view := *result
+		view.Devices = embedCredentials(result.Devices)
+		result = &view
+	}
+	if enc := inventoryFormat(r); enc != nil {
+		rows := make([]inventoryRow, len(result.Devices))
+		for i, d := range result.Devices {
+			rows[i] = newInventoryRow(d, result.ScannedAt)
+		}
+		writeInventory(w, enc, rows)
+		return
+	}
+	// Only cached results can be revalidated, a fresh scan always returns its
+	// result.
+	var body interface{} = result.response(cached)
+	if wantsLegacyFormat(r) {
+		ips := make([]string, len(result.Devices))
+		for i, d := range result.Devices {
+			ips[i] = d.IP
+		}
+		body = ips
+	}
+	if cached {
+		writeJSONCacheable(w, r, body, result.ScannedAt)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
 
-	wg.Wait()
-	return devices
+// legacyMediaType requests the bare array of IP strings returned before the
+// responses carried the devices and the scan metadata.
+const legacyMediaType = "application/vnd.onvif-finder.legacy+json"
+
+func wantsLegacyFormat(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "legacy" || strings.Contains(r.Header.Get("Accept"), legacyMediaType)
+}
+
+// scanQuery returns the query parameters of a scan request, with the cidr list
+// of a JSON POST body appended.
+func scanQuery(r *http.Request) (url.Values, error) {
+	query := r.URL.Query()
+	if r.Method != http.MethodPost {
+		return query, nil
+	}
+	var body struct {
+		CIDR []string `json:"cidr"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid request body: %v", err)
+	}
+	query["cidr"] = append(query["cidr"], body.CIDR...)
+	return query, nil
 }
 
-func getLocalNetworks() ([]*net.IPNet, error) {
-	var networks []*net.IPNet
+func main() {
+	ports := flag.String("ports", envOr("ONVIF_FINDER_PORTS", joinPorts(defaultScanOptions.Ports)), "comma-separated list of RTSP ports probed by default")
+	onvifPorts := flag.String("onvif-ports", envOr("ONVIF_FINDER_ONVIF_PORTS", joinPorts(defaultScanOptions.ONVIFPorts)), "comma-separated list of ports whose ONVIF device service is probed over HTTP, or none")
+	rtsps := flag.Bool("rtsps", envOr("ONVIF_FINDER_RTSPS", "") == "true", "also probe the rtsps ports with RTSP over TLS by default")
+	rtspsPorts := flag.String("rtsps-ports", envOr("ONVIF_FINDER_RTSPS_PORTS", joinPorts(defaultScanOptions.RTSPSPorts)), "comma-separated list of ports probed with RTSP over TLS by scans asking for rtsps")
+	flag.BoolVar(&rtspsVerify, "rtsps-verify", envOr("ONVIF_FINDER_RTSPS_VERIFY", "") == "true", "verify the certificates of rtsps servers against the system roots")
+	flag.DurationVar(&rtspsHandshakeTimeout, "rtsps-handshake-timeout", envDuration("ONVIF_FINDER_RTSPS_HANDSHAKE_TIMEOUT", rtspsHandshakeTimeout), "how long the TLS handshake with an rtsps server may take once connected")
+	workers := flag.Int("workers", envInt("ONVIF_FINDER_WORKERS", defaultScanOptions.Workers), "number of concurrent probes of a scan")
+	maxConcurrency := flag.Int("max-workers", envInt("ONVIF_FINDER_MAX_WORKERS", maxWorkers), "largest number of concurrent probes the concurrency parameter of a request may ask for")
+	connectionRate := flag.Int("connection-rate", envInt("ONVIF_FINDER_CONNECTION_RATE", 0), "new connections per second of a scan, 0 for no limit")
+	maxConnRate := flag.Int("max-connection-rate", envInt("ONVIF_FINDER_MAX_CONNECTION_RATE", 0), "largest number of new connections per second the rate parameter of a request may ask for, 0 for no ceiling")
+	flag.IntVar(&enrichWorkers, "enrich-workers", envInt("ONVIF_FINDER_ENRICH_WORKERS", enrichWorkers), "number of devices of a scan enriched over ONVIF at once")
+	flag.DurationVar(&enrichTimeout, "enrich-timeout", envDuration("ONVIF_FINDER_ENRICH_TIMEOUT", enrichTimeout), "time the ONVIF enrichment of a single device may take")
+	timeout := flag.String("timeout", envOr("ONVIF_FINDER_TIMEOUT", defaultScanOptions.DialTimeout.String()), "default timeout of a single dial")
+	credentials := flag.String("rtsp-credentials", os.Getenv("ONVIF_FINDER_RTSP_CREDENTIALS"), "comma-separated [label=]user:pass RTSP credentials checked on the cameras found")
+	onvifCreds := flag.String("onvif-credentials", os.Getenv("ONVIF_FINDER_ONVIF_CREDENTIALS"), "comma-separated [label=]user:pass ONVIF credentials tried in order on cameras rejecting anonymous requests")
+	flag.BoolVar(&onvifInsecureBasic, "onvif-insecure-basic", envOr("ONVIF_FINDER_ONVIF_INSECURE_BASIC", "") == "true", "answer HTTP Basic challenges of ONVIF services and snapshots over plain http, sending the passwords in clear")
+	adaptiveTimeout := flag.Bool("adaptive-timeout", envOr("ONVIF_FINDER_ADAPTIVE_TIMEOUT", "") == "true", "adapt the dial timeout of every network to the round-trip times observed by default")
+	minTimeout := flag.Duration("min-timeout", envDuration("ONVIF_FINDER_MIN_TIMEOUT", defaultScanOptions.MinDialTimeout), "lower bound of adaptive dial timeouts")
+	verifyMax := flag.Int("verify-max-devices", envInt("ONVIF_FINDER_VERIFY_MAX_DEVICES", playVerifyLimit), "number of cameras whose streams a scan with verify=play plays")
+	retries := flag.Int("retries", envInt("ONVIF_FINDER_RETRIES", defaultScanOptions.Retries), "how often a probe that timed out or was reset is retried")
+	deadline := flag.String("deadline", envOr("ONVIF_FINDER_DEADLINE", defaultScanOptions.Deadline.String()), "default deadline of a whole scan")
+	verboseMax := flag.Int("verbose-max-hosts", envInt("ONVIF_FINDER_VERBOSE_MAX_HOSTS", verboseMaxHosts), "largest network a scan with verbose=true may sweep")
+	maxHosts := flag.Int("max-hosts", envInt("ONVIF_FINDER_MAX_HOSTS", defaultScanOptions.MaxHosts), "largest number of hosts of a network that is swept")
+	exclude := flag.String("exclude", os.Getenv("ONVIF_FINDER_EXCLUDE"), "comma-separated IPs and CIDRs that are never probed")
+	allowInterfaces := flag.String("interfaces", os.Getenv("ONVIF_FINDER_INTERFACES"), "comma-separated interfaces that are scanned, all when empty")
+	denyInterfaces := flag.String("exclude-interfaces", os.Getenv("ONVIF_FINDER_EXCLUDE_INTERFACES"), "comma-separated interfaces that are never scanned")
+	interfaceFilter := flag.Bool("interface-filter", envOr("ONVIF_FINDER_INTERFACE_FILTER", "true") != "false", "skip virtual, container, VPN and point-to-point interfaces unless -interfaces names them")
+	dhcpLeases := flag.String("dhcp-leases", os.Getenv("ONVIF_FINDER_DHCP_LEASES"), "dnsmasq or ISC dhcpd lease file whose leased hosts every scan probes first")
+	discoveryWindow := flag.Duration("discovery-window", envDuration("ONVIF_FINDER_DISCOVERY_WINDOW", defaultScanOptions.DiscoveryWindow), "how long WS-Discovery, SSDP and mDNS answers are collected by default, 0 disables multicast discovery")
+	flag.IntVar(&multicast.Repeats, "discovery-repeats", envInt("ONVIF_FINDER_DISCOVERY_REPEATS", multicast.Repeats), "how often every discovery query is sent from every local address")
+	flag.DurationVar(&multicast.Interval, "discovery-interval", envDuration("ONVIF_FINDER_DISCOVERY_INTERVAL", multicast.Interval), "interval between the repetitions of a discovery query")
+	discoveryIfaces := flag.String("discovery-interfaces", os.Getenv("ONVIF_FINDER_DISCOVERY_INTERFACES"), "comma-separated interfaces the discovery queries are sent out of, all scanned ones when empty")
+	jobRetention := flag.Duration("job-retention", envDuration("ONVIF_FINDER_JOB_RETENTION", scanJobs.retention), "how long finished scan jobs are kept")
+	maxJobs := flag.Int("max-jobs", envInt("ONVIF_FINDER_MAX_JOBS", scanJobs.maxRunning), "number of scan jobs that may run at the same time")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", envDuration("ONVIF_FINDER_CHECKPOINT_INTERVAL", checkpointInterval), "how often running scan jobs are checkpointed to the store, 0 disables checkpoints")
+	flag.DurationVar(&checkpointMaxAge, "checkpoint-max-age", envDuration("ONVIF_FINDER_CHECKPOINT_MAX_AGE", checkpointMaxAge), "how long an interrupted scan job can be resumed before it is abandoned")
+	history := flag.Int("history", envInt("ONVIF_FINDER_HISTORY", snapshots.keep), "number of scan snapshots kept in the history")
+	cacheTTL := flag.Duration("cache-ttl", envDuration("ONVIF_FINDER_CACHE_TTL", resultCache.ttl), "how long scan results are served from the cache, 0 disables the cache")
+	scanInterval := flag.Duration("scan-interval", envDuration("ONVIF_FINDER_SCAN_INTERVAL", background.interval), "interval of the background scans, 0 disables them")
+	scheduleSpecs := flag.String("schedules", os.Getenv("ONVIF_FINDER_SCHEDULES"), "semicolon-separated name=cron?parameters scan schedules, the parameters those of the scan endpoint and credentials=<label>")
+	flag.StringVar(&exportDir, "export-dir", os.Getenv("ONVIF_FINDER_EXPORT_DIR"), "directory the registry is exported to after every scheduled scan, disabled when empty")
+	flag.StringVar(&exportFormat, "export-format", envOr("ONVIF_FINDER_EXPORT_FORMAT", exportFormat), "format of the exports written to -export-dir: json or csv")
+	reportURLs := flag.String("report-urls", os.Getenv("ONVIF_FINDER_REPORT_URLS"), "comma-separated HTTPS URLs the result of every completed scan is posted to, disabled when empty")
+	reportToken := flag.String("report-token", os.Getenv("ONVIF_FINDER_REPORT_TOKEN"), "bearer token of the report requests")
+	flag.IntVar(&reportAttempts, "report-attempts", envInt("ONVIF_FINDER_REPORT_ATTEMPTS", reportAttempts), "how often a report is posted before it is given up, retrying network errors and 5xx responses")
+	webhookURLs := flag.String("webhooks", os.Getenv("ONVIF_FINDER_WEBHOOKS"), "comma-separated URLs notified when cameras appear or disappear")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("ONVIF_FINDER_WEBHOOK_SECRET"), "key of the HMAC-SHA256 signature of webhook requests")
+	removeAfter := flag.Int("remove-after", envInt("ONVIF_FINDER_REMOVE_AFTER", cameras.removeAfter), "number of consecutive scans a camera must be missing from before it is reported as removed")
+	mqttBroker := flag.String("mqtt-broker", os.Getenv("ONVIF_FINDER_MQTT_BROKER"), "URL of the MQTT broker cameras are published to, e.g. tcp://host:1883")
+	mqttUsername := flag.String("mqtt-username", os.Getenv("ONVIF_FINDER_MQTT_USERNAME"), "username of the MQTT broker")
+	mqttPassword := flag.String("mqtt-password", os.Getenv("ONVIF_FINDER_MQTT_PASSWORD"), "password of the MQTT broker")
+	mqttPrefix := flag.String("mqtt-topic-prefix", envOr("ONVIF_FINDER_MQTT_TOPIC_PREFIX", "onvif-finder"), "prefix of the MQTT topics")
+	storePath := flag.String("store", os.Getenv("ONVIF_FINDER_STORE"), "bbolt database file the camera registry and scan history are persisted to, disabled when empty")
+	proxies := flag.String("trusted-proxies", os.Getenv("ONVIF_FINDER_TRUSTED_PROXIES"), "comma-separated IPs and CIDRs of reverse proxies whose X-Forwarded-For header is logged as the client address")
+	logLevel := flag.String("log-level", envOr("ONVIF_FINDER_LOG_LEVEL", "info"), "lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", envOr("ONVIF_FINDER_LOG_FORMAT", "text"), "format of the log lines: text or json")
+	debugAddr := flag.String("debug-listen", os.Getenv("ONVIF_FINDER_DEBUG_LISTEN"), "loopback address serving /debug/pprof/ and /debug/stats, e.g. 127.0.0.1:6060, disabled when empty")
+	shutdownGrace := flag.Duration("shutdown-grace", envDuration("ONVIF_FINDER_SHUTDOWN_GRACE", 15*time.Second), "how long in-flight requests and deliveries may take to finish on shutdown")
+	listen := flag.String("listen", envOr("ONVIF_FINDER_LISTEN", ":7654"), "address the HTTP server listens on, e.g. 127.0.0.1:8080")
+	ipv6 := flag.Bool("ipv6", envOr("ONVIF_FINDER_IPV6", "") == "true", "scan IPv6 networks by default")
+	flag.String("config", os.Getenv("ONVIF_FINDER_CONFIG"), "YAML file with the default settings, overridden by the environment and the flags")
+	keys := flag.String("api-keys", os.Getenv("ONVIF_FINDER_API_KEYS"), "comma-separated API keys of which one is required by every endpoint except /healthz and /readyz, authentication is disabled when empty")
+	tlsCert := flag.String("tls-cert", os.Getenv("ONVIF_FINDER_TLS_CERT"), "PEM certificate file, HTTPS is served when set together with -tls-key")
+	tlsKey := flag.String("tls-key", os.Getenv("ONVIF_FINDER_TLS_KEY"), "PEM private key file of -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", envOr("ONVIF_FINDER_TLS_SELF_SIGNED", "") == "true", "serve HTTPS with a generated self-signed certificate")
+	tlsClientCA := flag.String("tls-client-ca", os.Getenv("ONVIF_FINDER_TLS_CLIENT_CA"), "PEM file of the CAs client certificates must be signed by, enables mutual TLS")
+	tlsReload := flag.Duration("tls-reload", envDuration("ONVIF_FINDER_TLS_RELOAD", 0), "interval the TLS files are reloaded at, they are always reloaded on SIGHUP")
+	origins := flag.String("cors-origins", os.Getenv("ONVIF_FINDER_CORS_ORIGINS"), "comma-separated origins browsers may call the API from, * for any, no CORS headers are sent when empty")
+	scanRate := flag.Duration("scan-rate", envDuration("ONVIF_FINDER_SCAN_RATE", 10*time.Second), "interval at which scans may be started once the burst is used up, 0 disables the limit")
+	scanBurst := flag.Int("scan-burst", envInt("ONVIF_FINDER_SCAN_BURST", 2), "number of scans that may be started at once")
+	scanRatePerClient := flag.Bool("scan-rate-per-client", envOr("ONVIF_FINDER_SCAN_RATE_PER_CLIENT", "") == "true", "limit the scans started by every client address separately instead of globally")
+	flag.DurationVar(&timeouts.readHeader, "read-header-timeout", envDuration("ONVIF_FINDER_READ_HEADER_TIMEOUT", timeouts.readHeader), "how long a client may take to send the request headers")
+	flag.DurationVar(&timeouts.read, "read-timeout", envDuration("ONVIF_FINDER_READ_TIMEOUT", timeouts.read), "how long a client may take to send the whole request, 0 for no limit")
+	flag.DurationVar(&timeouts.write, "write-timeout", envDuration("ONVIF_FINDER_WRITE_TIMEOUT", timeouts.write), "how long a response may take, except streamed ones, 0 for no limit")
+	flag.DurationVar(&timeouts.idle, "idle-timeout", envDuration("ONVIF_FINDER_IDLE_TIMEOUT", timeouts.idle), "how long an idle keep-alive connection is kept open")
+	flag.DurationVar(&timeouts.request, "request-timeout", envDuration("ONVIF_FINDER_REQUEST_TIMEOUT", timeouts.request), "how long the scans of a request may take before it is answered with 504")
+	flag.DurationVar(&timeouts.streamWrite, "stream-write-timeout", envDuration("ONVIF_FINDER_STREAM_WRITE_TIMEOUT", timeouts.streamWrite), "how long a single write of a streamed response may take")
+	flag.IntVar(&compressMinSize, "compress-min-size", envInt("ONVIF_FINDER_COMPRESS_MIN_SIZE", compressMinSize), "size in bytes from which responses are gzipped for clients accepting it, 0 disables compression")
+	flag.StringVar(&instanceID, "instance-id", envOr("ONVIF_FINDER_INSTANCE_ID", defaultInstanceID()), "ID of the finder in the scan reports, the hostname by default")
+	flag.StringVar(&site, "site", os.Getenv("ONVIF_FINDER_SITE"), "name of the site, part of the file names of exports")
+	flag.BoolVar(&swaggerUI, "swagger-ui", envOr("ONVIF_FINDER_SWAGGER_UI", "") == "true", "serve the Swagger UI at /api/v1/docs, it is loaded from unpkg.com")
+	printCfg := flag.Bool("print-config", false, "print the effective configuration and exit")
+
+	command, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fatal("Invalid command", "err", err)
+	}
+	var cli cliOptions
+	if command != commandServe {
+		flag.StringVar(&cli.cidrs, "cidr", "", "comma-separated networks to scan instead of the local ones")
+		flag.StringVar(&cli.interfaces, "iface", "", "comma-separated interfaces to scan")
+		flag.BoolVar(&cli.json, "json", false, "print the result as JSON instead of a table")
+	}
 
-	interfaces, err := net.Interfaces()
+	var problems []string
+	if path := configFlagName(args); path != "" {
+		values, unknown, invalid, err := loadConfig(path)
+		if err != nil {
+			fatal("Error loading config file", "path", path, "err", err)
+		}
+		if len(unknown) > 0 {
+			logger.Warn("Ignoring unknown keys of the config file", "path", path, "keys", unknown)
+		}
+		problems = append(invalid, applyConfig(flag.CommandLine, values)...)
+	}
+	flag.CommandLine.Parse(args)
+
+	configured, err := newLogger(*logLevel, *logFormat)
 	if err != nil {
-		return nil, err
+		problems = append(problems, fmt.Sprintf("log: %v", err))
+	} else {
+		logger = configured
+		slog.SetDefault(logger)
+	}
+
+	if defaultScanOptions.Ports, err = parsePorts(*ports); err != nil {
+		problems = append(problems, fmt.Sprintf("ports: %v", err))
+	}
+	if defaultScanOptions.ONVIFPorts, err = parseONVIFPorts(*onvifPorts); err != nil {
+		problems = append(problems, fmt.Sprintf("onvif-ports: %v", err))
+	}
+	defaultScanOptions.RTSPS = *rtsps
+	if defaultScanOptions.RTSPSPorts, err = parsePorts(*rtspsPorts); err != nil {
+		problems = append(problems, fmt.Sprintf("rtsps-ports: %v", err))
+	}
+	if rtspsHandshakeTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("rtsps-handshake-timeout: must be positive, got %s", rtspsHandshakeTimeout))
+	}
+	if *discoveryWindow < 0 {
+		problems = append(problems, fmt.Sprintf("discovery-window: must not be negative, got %s", *discoveryWindow))
+	}
+	defaultScanOptions.DiscoveryWindow = *discoveryWindow
+	if multicast.Repeats < 1 || multicast.Repeats > maxDiscoveryRepeats {
+		problems = append(problems, fmt.Sprintf("discovery-repeats: must be between 1 and %d, got %d", maxDiscoveryRepeats, multicast.Repeats))
+	}
+	if multicast.Interval <= 0 {
+		problems = append(problems, fmt.Sprintf("discovery-interval: must be positive, got %s", multicast.Interval))
+	}
+	discoveryInterfaces = splitList(*discoveryIfaces)
+	if *workers < 1 {
+		problems = append(problems, fmt.Sprintf("workers: must be at least 1, got %d", *workers))
+	}
+	defaultScanOptions.Workers = *workers
+	if *maxConcurrency < *workers {
+		problems = append(problems, fmt.Sprintf("max-workers: must be at least workers=%d, got %d", *workers, *maxConcurrency))
+	}
+	maxWorkers = *maxConcurrency
+	if *connectionRate < 0 {
+		problems = append(problems, fmt.Sprintf("connection-rate: must not be negative, got %d", *connectionRate))
+	}
+	if *maxConnRate < 0 {
+		problems = append(problems, fmt.Sprintf("max-connection-rate: must not be negative, got %d", *maxConnRate))
+	}
+	if *maxConnRate > 0 && *connectionRate > *maxConnRate {
+		problems = append(problems, fmt.Sprintf("max-connection-rate: must be at least connection-rate=%d, got %d", *connectionRate, *maxConnRate))
+	}
+	defaultScanOptions.Rate = *connectionRate
+	if enrichWorkers < 1 {
+		problems = append(problems, fmt.Sprintf("enrich-workers: must be at least 1, got %d", enrichWorkers))
+	}
+	if enrichTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("enrich-timeout: must be positive, got %s", enrichTimeout))
+	}
+	maxConnectionRate = *maxConnRate
+	if *verboseMax < 1 {
+		problems = append(problems, fmt.Sprintf("verbose-max-hosts: must be at least 1, got %d", *verboseMax))
+	}
+	verboseMaxHosts = *verboseMax
+	if *retries < 0 || *retries > maxRetries {
+		problems = append(problems, fmt.Sprintf("retries: must be between 0 and %d, got %d", maxRetries, *retries))
+	}
+	defaultScanOptions.Retries = *retries
+	if *verifyMax < 0 {
+		problems = append(problems, fmt.Sprintf("verify-max-devices: must not be negative, got %d", *verifyMax))
+	}
+	playVerifyLimit = *verifyMax
+	defaultScanOptions.AdaptiveTimeout = *adaptiveTimeout
+	if rtspCredentials, err = parseCredentials(splitList(*credentials)); err != nil {
+		problems = append(problems, fmt.Sprintf("rtsp-credentials: %v", err))
+	}
+	if onvifCredentials, err = parseCredentials(splitList(*onvifCreds)); err != nil {
+		problems = append(problems, fmt.Sprintf("onvif-credentials: %v", err))
+	}
+	if *minTimeout < minDialTimeout || *minTimeout > maxDialTimeout {
+		problems = append(problems, fmt.Sprintf("min-timeout: must be between %s and %s, got %s", minDialTimeout, maxDialTimeout, *minTimeout))
+	}
+	defaultScanOptions.MinDialTimeout = *minTimeout
+	if *maxHosts < 1 {
+		problems = append(problems, fmt.Sprintf("max-hosts: must be at least 1, got %d", *maxHosts))
+	}
+	defaultScanOptions.MaxHosts = *maxHosts
+	defaultScanOptions.IPv6 = *ipv6
+	if *maxJobs < 1 {
+		problems = append(problems, fmt.Sprintf("max-jobs: must be at least 1, got %d", *maxJobs))
+	}
+	if checkpointInterval < 0 {
+		problems = append(problems, fmt.Sprintf("checkpoint-interval: must not be negative, got %s", checkpointInterval))
+	}
+	if checkpointMaxAge <= 0 {
+		problems = append(problems, fmt.Sprintf("checkpoint-max-age: must be positive, got %s", checkpointMaxAge))
+	}
+	scanJobs = newJobStore(*jobRetention, *maxJobs)
+	resultCache = newScanCache(*cacheTTL)
+	if *history < 2 {
+		problems = append(problems, fmt.Sprintf("history: must be at least 2, got %d", *history))
+	}
+	snapshots.keep = *history
+	background.interval = *scanInterval
+	if *removeAfter < 1 {
+		problems = append(problems, fmt.Sprintf("remove-after: must be at least 1, got %d", *removeAfter))
+	}
+	cameras.removeAfter = *removeAfter
+	webhooks = newWebhookNotifier(splitList(*webhookURLs), *webhookSecret)
+	if err := checkReportURLs(splitList(*reportURLs)); err != nil {
+		problems = append(problems, fmt.Sprintf("report-urls: %v", err))
+	}
+	if reportAttempts < 1 {
+		problems = append(problems, fmt.Sprintf("report-attempts: must be at least 1, got %d", reportAttempts))
+	}
+	reports = newReportSinks(splitList(*reportURLs), *reportToken)
+	if mqttPublisher, err = newMQTTPublisher(*mqttBroker, *mqttUsername, *mqttPassword, *mqttPrefix); err != nil {
+		problems = append(problems, fmt.Sprintf("mqtt-broker: %v", err))
+	}
+	filterInterfaces = *interfaceFilter
+	leaseFile = *dhcpLeases
+	defaultScanOptions.AllowInterfaces = splitList(*allowInterfaces)
+	defaultScanOptions.DenyInterfaces = splitList(*denyInterfaces)
+	if defaultScanOptions.Exclude, err = parseExclusions(*exclude); err != nil {
+		problems = append(problems, fmt.Sprintf("exclude: %v", err))
+	}
+	if defaultScanOptions.DialTimeout, err = parseBoundedDuration(*timeout, minDialTimeout, maxDialTimeout); err != nil {
+		problems = append(problems, fmt.Sprintf("timeout: %v", err))
+	}
+	if defaultScanOptions.Deadline, err = parseBoundedDuration(*deadline, time.Second, maxScanDeadline); err != nil {
+		problems = append(problems, fmt.Sprintf("deadline: %v", err))
+	}
+	// The parameters of the schedules are checked against the defaults of
+	// the scans.
+	if schedules, err = parseSchedules(*scheduleSpecs); err != nil {
+		problems = append(problems, fmt.Sprintf("schedules: %v", err))
+	}
+	for _, s := range schedules {
+		if err := s.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("schedules: %v", err))
+		}
+	}
+	if _, ok := cameraExporters[exportFormat]; !ok {
+		problems = append(problems, fmt.Sprintf("export-format: must be json or csv, got %q", exportFormat))
+	}
+	if exportDir != "" {
+		if fi, err := os.Stat(exportDir); err != nil {
+			problems = append(problems, fmt.Sprintf("export-dir: %v", err))
+		} else if !fi.IsDir() {
+			problems = append(problems, fmt.Sprintf("export-dir: %s is not a directory", exportDir))
+		}
 	}
 
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
+	if path := os.Getenv("ONVIF_FINDER_OUI_FILE"); path != "" {
+		n, err := loadOUIFile(path)
+		if err != nil {
+			fatal("Error loading OUI file", "path", path, "err", err)
+		}
+		logger.Info("Loaded OUI entries", "entries", n, "path", path)
+	}
+	if path := os.Getenv("ONVIF_FINDER_FINGERPRINTS_FILE"); path != "" {
+		n, err := loadFingerprintFile(path)
+		if err != nil {
+			fatal("Error loading fingerprint file", "path", path, "err", err)
 		}
+		logger.Info("Loaded fingerprint rules", "rules", n, "path", path)
+	}
 
-		addrs, err := iface.Addrs()
+	apiKeys = parseAPIKeys(*keys)
+	if *scanBurst < 1 {
+		problems = append(problems, fmt.Sprintf("scan-burst: must be at least 1, got %d", *scanBurst))
+	}
+	scanLimiter = newRateLimiter(*scanRate, *scanBurst, *scanRatePerClient)
+	if corsOrigins, err = parseCORSOrigins(*origins); err != nil {
+		problems = append(problems, fmt.Sprintf("cors-origins: %v", err))
+	}
+	if trustedProxies, err = parseTrustedProxies(*proxies); err != nil {
+		problems = append(problems, fmt.Sprintf("trusted-proxies: %v", err))
+	}
+	if err := validateListenAddr(*listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen: %v", err))
+	}
+	if err := validateTLS(*tlsCert, *tlsKey, *tlsClientCA, *tlsSelfSigned); err != nil {
+		problems = append(problems, fmt.Sprintf("tls: %v", err))
+	}
+	if err := timeouts.validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("timeouts: %v", err))
+	}
+	if len(problems) > 0 {
+		fatal("Invalid configuration", "problems", problems)
+	}
+	if *printCfg {
+		printConfig(os.Stdout, flag.CommandLine)
+		return
+	}
+	if command != commandServe {
+		os.Exit(runCommand(command, flag.Args(), cli))
+	}
+
+	state = newStateStore(*storePath)
+	state.load()
+
+	if *debugAddr != "" {
+		ln, err := listenDebug(*debugAddr)
 		if err != nil {
-			log.Printf("Error getting addresses for interface %s: %v", iface.Name, err)
-			continue
-		}
-
-		for _, addr := range addrs {
-			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
-				if ipNet.IP[0] == 172 {
-					log.Printf("Excluding network: Interface=%s IP=%s Network=%s", iface.Name, ipNet.IP, ipNet)
-					continue
-				}
-				networks = append(networks, ipNet)
-				log.Printf("Found network: Interface=%s IP=%s Network=%s", iface.Name, ipNet.IP, ipNet)
+			fatal("Invalid debug-listen", "err", err)
+		}
+		go serveDebug(context.Background(), ln)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("Error listening", "addr", *listen, "err", err)
+	}
+	var certs *tlsFiles
+	if *tlsCert != "" || *tlsSelfSigned {
+		certs = &tlsFiles{certFile: *tlsCert, keyFile: *tlsKey, clientCAFile: *tlsClientCA}
+		if err := certs.load(); err != nil {
+			fatal("Error loading TLS files", "err", err)
+		}
+		if *tlsSelfSigned {
+			cert, err := selfSignedCertificate()
+			if err != nil {
+				fatal("Error generating self-signed certificate", "err", err)
 			}
+			certs.cert = cert
+			logger.Warn("Serving a self-signed certificate", "sha256", certificateFingerprint(cert))
 		}
+		ln = tls.NewListener(ln, certs.config())
 	}
+	logger.Info("Starting server", "addr", ln.Addr().String(), "tls", certs != nil, "mutual_tls", *tlsClientCA != "")
+	ctx, stopScans := context.WithCancel(context.Background())
+	defer stopScans()
+	deliveries, stopDeliveries := context.WithCancel(context.Background())
+	defer stopDeliveries()
 
-	if len(networks) == 0 {
-		log.Println("No active networks found.")
+	go listenForAnnouncements(ctx)
+	go scanJobs.expireLoop(ctx)
+	go background.run(ctx)
+	runSchedules(ctx)
+	webhooks.run(deliveries)
+	reports.run(deliveries)
+	go mqttPublisher.run(deliveries)
+	go state.run(ctx)
+	if certs != nil {
+		go certs.watch(ctx, *tlsReload)
 	}
 
-	return networks, nil
+	// Requests inherit ctx, so their scans are cancelled as soon as the
+	// shutdown starts.
+	server := &http.Server{Handler: newRouter(), BaseContext: func(net.Listener) context.Context { return ctx }}
+	timeouts.apply(server)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ln) }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		fatal("Server stopped", "err", err)
+	case sig := <-signals:
+		logger.Info("Received signal", "signal", sig.String())
+	}
+	signal.Stop(signals)
+	if shutdown(server, *shutdownGrace, stopScans, stopDeliveries) {
+		os.Exit(1)
+	}
 }
 
-func handleGetAllRTSPDevices(w http.ResponseWriter, r *http.Request) {
-	networks, err := getLocalNetworks()
+// validateListenAddr checks that addr is a host:port the server can bind.
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error determining local networks: %v", err), http.StatusInternalServerError)
-		return
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
 	}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid host %q, expected an IP address", host)
+	}
+	return nil
+}
 
-	var allDevices []string
-	for _, network := range networks {
-		ips := getIPsInNetwork(network)
-		devices := scanIPs(ips)
-		allDevices = append(allDevices, devices...)
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(allDevices)
-	log.Println("Found cameras:", allDevices)
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		fatal("Invalid environment variable", "key", key, "value", v)
+	}
+	return fallback
 }
 
-func main() {
-	fmt.Println("Starting server on :7654...")
-	http.HandleFunc("/get_all_rtsp_cameras/", logRequest(handleGetAllRTSPDevices))
+func envInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		fatal("Invalid environment variable", "key", key, "value", v)
+	}
+	return fallback
+}
 
-	if err := http.ListenAndServe(":7654", nil); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+func splitList(s string) []string {
+	var list []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
 	}
+	return list
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeRTSP serves RTSP on a local port, answering every request with 200 OK
+// and server as the Server header. It returns the port.
+func fakeRTSP(t *testing.T, server string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cseq := "1"
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if v, ok := strings.CutPrefix(strings.TrimSpace(line), "CSeq: "); ok {
+						cseq = v
+					}
+					if line == "\r\n" {
+						io.WriteString(conn, "RTSP/1.0 200 OK\r\nCSeq: "+cseq+"\r\nServer: "+server+"\r\nPublic: OPTIONS, DESCRIBE\r\n\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+// localScan is the query of a scan of the local host alone, without the
+// discovery mechanisms a test can't control.
+func localScan(port int) string {
+	return "cidr=127.0.0.1/32&include_self=true&refresh=true&discovery_window=0s&onvif_ports=none&ports=" + strconv.Itoa(port)
+}
+
+// logRecords collects the records of the logger as decoded JSON objects.
+type logRecords struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logRecords) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// find returns the records with the message msg.
+func (l *logRecords) find(msg string) []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []map[string]interface{}
+	for _, line := range strings.Split(l.buf.String(), "\n") {
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == msg {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// captureLogs makes the logger write JSON records of every level to the
+// returned collection for the rest of the test.
+func captureLogs(t *testing.T) *logRecords {
+	t.Helper()
+	records := &logRecords{}
+	old := logger
+	logger = slog.New(slog.NewJSONHandler(records, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { logger = old })
+	return records
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const sourceManual = "manual"
+
+const defaultManualPort = 554
+
+// manualEntry is the registration of a camera the scans can't find, e.g.
+// behind a NAT gateway. It is replaced rather than modified, like metadata.
+type manualEntry struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Credentials is the label of the configured credentials the probes use.
+	Credentials  string     `json:"credentials,omitempty"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	ProbedAt     *time.Time `json:"probed_at,omitempty"`
+	// Error tells why the last probe found no camera.
+	Error string `json:"error,omitempty"`
+}
+
+// registerRequest is the body of POST /cameras.
+type registerRequest struct {
+	Host        string            `json:"host"`
+	Port        int               `json:"port,omitempty"`
+	Credentials string            `json:"credentials,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+func appendSource(sources []string, source string) []string {
+	for _, s := range sources {
+		if s == source {
+			return sources
+		}
+	}
+	// The sources may be shared with the device the record was copied from.
+	return append(append([]string(nil), sources...), source)
+}
+
+// lookupCredential looks a label up in the ONVIF credentials, then in the
+// RTSP ones.
+func lookupCredential(label string) (credential, bool) {
+	for _, list := range []*credentialList{onvifCredentials, rtspCredentials} {
+		if list == nil {
+			continue
+		}
+		for _, c := range list.credentials {
+			if c.label == label {
+				return c, true
+			}
+		}
+	}
+	return credential{}, false
+}
+
+// resolveHost returns the address of host, preferring IPv4.
+func resolveHost(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return ips[0].String(), nil
+}
+
+// register marks the camera known at ip as registered, or adds a record for
+// it, offline until probed. A record removed by the scans is revived.
+func (g *registry) register(ip string, entry *manualEntry) (record cameraRecord, added bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	d := device{IP: ip}
+	r := g.find(&d)
+	if r == nil {
+		d.Ports = []int{entry.Port}
+		r = &cameraRecord{ID: identityKeys(&d)[0], FirstSeen: entry.RegisteredAt, LastSeen: entry.RegisteredAt, device: d, missed: 1, removed: true}
+		g.records[r.ID] = r
+		g.index[r.ID] = r
+	}
+	added = r.removed
+	r.removed = false
+	r.Manual = entry
+	r.Sources = appendSource(r.Sources, sourceManual)
+	c := *r
+	c.Status = r.status()
+	return c, added
+}
+
+// delete removes the record id, returning it.
+func (g *registry) delete(id string) (cameraRecord, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[id]
+	if !ok {
+		return cameraRecord{}, false
+	}
+	delete(g.records, id)
+	for key, indexed := range g.index {
+		if indexed == r {
+			delete(g.index, key)
+		}
+	}
+	return *r, true
+}
+
+func (g *registry) manual() []cameraRecord {
+	return filterSlice(g.list(), func(c cameraRecord) bool { return c.Manual != nil })
+}
+
+// probeManualCamera probes the registered camera id at its host and port
+// with its credentials and updates its record.
+func probeManualCamera(ctx context.Context, id string, m manualEntry) {
+	opts, _ := probeOptions(url.Values{})
+	opts.Ports = []int{m.Port}
+	opts = withCredential(opts, m.Credentials)
+	ip, err := resolveHost(ctx, m.Host)
+	if err != nil {
+		// The record is marked unreachable with the error of the lookup.
+		cameras.setProbe(id, nil, err, time.Now())
+		state.changed()
+		loggerFrom(ctx).Info("Registered camera unreachable", "id", id, "host", m.Host, "err", err)
+		return
+	}
+	if _, err := reprobeCamera(ctx, id, []string{ip}, opts); err != nil && ctx.Err() == nil {
+		loggerFrom(ctx).Info("Registered camera unreachable", "id", id, "host", m.Host, "port", m.Port, "err", err)
+	}
+}
+
+// probeManualCameras probes every registered camera, as part of the
+// background scans.
+func probeManualCameras(ctx context.Context) {
+	list := cameras.manual()
+	concurrently(len(list), func(i int) {
+		probeManualCamera(ctx, list[i].ID, *list[i].Manual)
+	})
+}
+
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	return strings.IndexFunc(host, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.')
+	}) < 0
+}
+
+// handleRegisterCamera adds a camera the scans can't reach to the registry,
+// or marks the camera discovered at its address as registered, and probes
+// it once.
+func handleRegisterCamera(w http.ResponseWriter, r *http.Request) {
+	var body registerRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	body.Host = strings.TrimSpace(body.Host)
+	if !validHost(body.Host) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid host %q, expected an IP or a hostname", body.Host))
+		return
+	}
+	if body.Port == 0 {
+		body.Port = defaultManualPort
+	}
+	if body.Port < 1 || body.Port > 65535 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid port %d", body.Port))
+		return
+	}
+	if _, ok := lookupCredential(body.Credentials); body.Credentials != "" && !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("unknown credentials %q", body.Credentials))
+		return
+	}
+	if err := validateMetadata(body.Name, body.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	ip, err := resolveHost(r.Context(), body.Host)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("cannot resolve host %s: %v", body.Host, err))
+		return
+	}
+	if defaultScanOptions.Exclude.contains(ip) {
+		writeError(w, http.StatusBadRequest, codeExcluded, fmt.Sprintf("ip %s is excluded from probing", ip))
+		return
+	}
+
+	entry := &manualEntry{Host: body.Host, Port: body.Port, Credentials: body.Credentials, RegisteredAt: time.Now()}
+	record, added := cameras.register(ip, entry)
+	if body.Name != "" || len(body.Labels) > 0 {
+		cameras.setMetadata(record.ID, "", func(old *cameraMetadata) (*cameraMetadata, error) {
+			m := &cameraMetadata{Labels: make(map[string]string)}
+			if old != nil {
+				m.Name = old.Name
+				for k, v := range old.Labels {
+					m.Labels[k] = v
+				}
+			}
+			if body.Name != "" {
+				m.Name = body.Name
+			}
+			for k, v := range body.Labels {
+				m.Labels[k] = v
+			}
+			return m, validateMetadata(m.Name, m.Labels)
+		})
+	}
+	loggerFrom(r.Context()).Info("Registered camera", "id", record.ID, "host", body.Host, "port", body.Port, "merged", !added)
+	probeManualCamera(r.Context(), record.ID, *entry)
+	record, _ = cameras.get(record.ID)
+	record.Status = record.status()
+	if added && !ignored.matches(&record.device, record.ID) {
+		events := []cameraEvent{{Event: eventCameraAdded, Time: entry.RegisteredAt, Device: record}}
+		webhooks.notify(events)
+		mqttPublisher.publish(nil, events)
+	}
+	state.changed()
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, record)
+}
+
+// handleDeleteCamera removes a camera from the registry. Discovered cameras
+// are added again by the next scan finding them, registered ones are gone.
+func handleDeleteCamera(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	record, ok := cameras.delete(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	}
+	if !record.removed && !ignored.matches(&record.device, record.ID) {
+		events := []cameraEvent{{Event: eventCameraRemoved, Time: time.Now(), Device: record}}
+		webhooks.notify(events)
+		mqttPublisher.publish(nil, events)
+	}
+	state.changed()
+	loggerFrom(r.Context()).Info("Deleted camera", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxMetadataName   = 128
+	maxMetadataLabels = 32
+	maxLabelKey       = 63
+	maxLabelValue     = 256
+)
+
+var (
+	errMetadataConflict = errors.New("the metadata was changed since it was read")
+	errUnknownCamera    = errors.New("unknown camera")
+)
+
+// cameraMetadata is set by operators on a camera identity, so it survives
+// the IP changes of the camera. A record's metadata is never modified in
+// place but replaced, so copies of the record can share it. Once set it is
+// kept, empty, when cleared, so its version never goes back.
+type cameraMetadata struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Version is incremented by every change and serves as ETag.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// metadataResponse is the metadata of a camera, the zero version for a
+// camera without metadata.
+type metadataResponse struct {
+	ID string `json:"id"`
+	cameraMetadata
+}
+
+// metadataUpdate is the body of a PUT, replacing the metadata.
+type metadataUpdate struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// metadataPatch is the body of a PATCH, a JSON merge patch: a null name or
+// label deletes it, labels left out are kept.
+type metadataPatch struct {
+	Name   json.RawMessage    `json:"name"`
+	Labels map[string]*string `json:"labels"`
+}
+
+func (m *cameraMetadata) version() int {
+	if m == nil {
+		return 0
+	}
+	return m.Version
+}
+
+func (m *cameraMetadata) etag() string {
+	return `"` + strconv.Itoa(m.version()) + `"`
+}
+
+// labelList formats the labels as sorted key=value pairs.
+func (m *cameraMetadata) labelList() []string {
+	if m == nil {
+		return nil
+	}
+	list := make([]string, 0, len(m.Labels))
+	for k, v := range m.Labels {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func validateMetadata(name string, labels map[string]string) error {
+	if utf8.RuneCountInString(name) > maxMetadataName {
+		return fmt.Errorf("name is longer than %d characters", maxMetadataName)
+	}
+	if len(labels) > maxMetadataLabels {
+		return fmt.Errorf("%d labels, at most %d are allowed", len(labels), maxMetadataLabels)
+	}
+	for k, v := range labels {
+		if k == "" || len(k) > maxLabelKey || strings.IndexFunc(k, func(r rune) bool { return !isLabelKeyRune(r) }) >= 0 {
+			return fmt.Errorf("invalid label key %q, expected 1 to %d letters, digits, -, _, . and /", k, maxLabelKey)
+		}
+		if utf8.RuneCountInString(v) > maxLabelValue {
+			return fmt.Errorf("label %s is longer than %d characters", k, maxLabelValue)
+		}
+	}
+	return nil
+}
+
+func isLabelKeyRune(r rune) bool {
+	return isScheduleNameRune(r) || r == '/'
+}
+
+// setMetadata replaces the metadata of the camera id with the one change
+// returns for the current metadata. ifMatch is the If-Match header of the
+// request, checked against the current version in the same critical section
+// as the change, so concurrent edits can't overwrite each other unnoticed.
+func (g *registry) setMetadata(id, ifMatch string, change func(old *cameraMetadata) (*cameraMetadata, error)) (*cameraMetadata, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[id]
+	if !ok {
+		return nil, errUnknownCamera
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, r.Metadata.etag()) {
+		return nil, errMetadataConflict
+	}
+	m, err := change(r.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	m.Version = r.Metadata.version() + 1
+	m.UpdatedAt = time.Now()
+	r.Metadata = m
+	return m, nil
+}
+
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMetadata(w http.ResponseWriter, id string, m *cameraMetadata) {
+	resp := metadataResponse{ID: id}
+	if m != nil {
+		resp.cameraMetadata = *m
+	}
+	w.Header().Set("ETag", m.etag())
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	record, ok := cameras.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	}
+	writeMetadata(w, id, record.Metadata)
+}
+
+func handlePutMetadata(w http.ResponseWriter, r *http.Request) {
+	var body metadataUpdate
+	if !decodeMetadataBody(w, r, &body) {
+		return
+	}
+	if err := validateMetadata(body.Name, body.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	updateMetadata(w, r, func(*cameraMetadata) (*cameraMetadata, error) {
+		return &cameraMetadata{Name: body.Name, Labels: body.Labels}, nil
+	})
+}
+
+func handlePatchMetadata(w http.ResponseWriter, r *http.Request) {
+	var body metadataPatch
+	if !decodeMetadataBody(w, r, &body) {
+		return
+	}
+	var name *string
+	if len(body.Name) > 0 && string(body.Name) != "null" {
+		name = new(string)
+		if err := json.Unmarshal(body.Name, name); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "invalid name: expected a string or null")
+			return
+		}
+	}
+	updateMetadata(w, r, func(old *cameraMetadata) (*cameraMetadata, error) {
+		m := &cameraMetadata{Labels: make(map[string]string)}
+		if old != nil {
+			m.Name = old.Name
+			for k, v := range old.Labels {
+				m.Labels[k] = v
+			}
+		}
+		if name != nil {
+			m.Name = *name
+		} else if len(body.Name) > 0 {
+			m.Name = ""
+		}
+		for k, v := range body.Labels {
+			if v == nil {
+				delete(m.Labels, k)
+			} else {
+				m.Labels[k] = *v
+			}
+		}
+		// The merged metadata is validated, so a patch deleting labels is
+		// always accepted.
+		if err := validateMetadata(m.Name, m.Labels); err != nil {
+			return nil, err
+		}
+		return m, nil
+	})
+}
+
+func handleDeleteMetadata(w http.ResponseWriter, r *http.Request) {
+	updateMetadata(w, r, func(*cameraMetadata) (*cameraMetadata, error) { return &cameraMetadata{}, nil })
+}
+
+// updateMetadata applies change to the metadata of the camera of the request
+// and answers with the result.
+func updateMetadata(w http.ResponseWriter, r *http.Request, change func(old *cameraMetadata) (*cameraMetadata, error)) {
+	id := pathParam(r, "id")
+	m, err := cameras.setMetadata(id, r.Header.Get("If-Match"), change)
+	switch {
+	case err == nil:
+	case errors.Is(err, errUnknownCamera):
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	case errors.Is(err, errMetadataConflict):
+		writeError(w, http.StatusPreconditionFailed, codeMetadataConflict, err.Error())
+		return
+	default:
+		// Only the validation of change fails otherwise.
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	state.changed()
+	loggerFrom(r.Context()).Info("Camera metadata changed", "id", id, "version", m.version())
+	writeMetadata(w, id, m)
+}
+
+func decodeMetadataBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"find_cameras/scanner"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metric is a metric family written in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry holds the metrics served at /metrics.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter with a fixed set of label values known upfront, so
+// incrementing it is a single atomic add.
+type counterVec struct {
+	name, help string
+	label      string
+	values     []string
+	counts     map[string]*uint64
+}
+
+func newCounterVec(name, help, label string, values ...string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, values: values, counts: make(map[string]*uint64, len(values))}
+	for _, v := range values {
+		c.counts[v] = new(uint64)
+	}
+	return c
+}
+
+func (c *counterVec) inc(value string) {
+	if n, ok := c.counts[value]; ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	for _, v := range c.values {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels([]string{c.label}, []string{v}), atomic.LoadUint64(c.counts[v]))
+	}
+}
+
+type gauge struct {
+	name, help string
+	value      int64
+}
+
+func (g *gauge) set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+func (g *gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, atomic.LoadInt64(&g.value))
+}
+
+// histogramVec is a histogram partitioned by label values that are only known
+// at run time.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		values := append(append([]string(nil), s.values...), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = formatFloat(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// counterMap is a counter partitioned by label values that are only known at
+// run time.
+type counterMap struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+	values map[string][]string
+}
+
+func newCounterMap(name, help string, labels ...string) *counterMap {
+	return &counterMap{name: name, help: help, labels: labels, counts: make(map[string]uint64), values: make(map[string][]string)}
+}
+
+func (c *counterMap) inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+	c.values[key] = values
+}
+
+func (c *counterMap) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, c.values[key]), c.counts[key])
+	}
+}
+
+const (
+	stageSweep      = "sweep"
+	stageEnrichment = "enrichment"
+)
+
+const (
+	scanStarted   = "started"
+	scanCompleted = "completed"
+	scanFailed    = "failed"
+	scanCancelled = "cancelled"
+)
+
+var (
+	metrics = &metricsRegistry{}
+
+	scanDurationSeconds = newHistogramVec("onvif_finder_scan_duration_seconds", "Duration of the scans.",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+	scanStageDurationSeconds = newHistogramVec("onvif_finder_scan_stage_duration_seconds", "Duration of the stages of the scans, which overlap: the sweep and the ONVIF enrichment of the devices found.",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "stage")
+	enrichmentsTotal = newCounterVec("onvif_finder_enrichments_total", "ONVIF enrichments of the devices found by outcome: completed or timeout (out of budget).",
+		"outcome", enrichCompleted, enrichTimedOut)
+	scansTotal = newCounterVec("onvif_finder_scans_total", "Scans by stage: started, completed, failed (deadline exceeded) or cancelled.",
+		"result", scanStarted, scanCompleted, scanFailed, scanCancelled)
+	lastScanDevices = &gauge{name: "onvif_finder_last_scan_devices", help: "Number of cameras found by the last finished scan."}
+	scanConcurrency = &gauge{name: "onvif_finder_scan_concurrency", help: "Number of concurrent probes of the last started scan."}
+	probesTotal     = newCounterVec("onvif_finder_probes_total", "RTSP, ONVIF HTTP and unicast WS-Discovery probe attempts by outcome.",
+		"outcome", string(scanner.OutcomeRTSP), string(scanner.OutcomeONVIF), string(scanner.OutcomeNotRTSP), string(scanner.OutcomeSilent), string(scanner.OutcomeRefused), string(scanner.OutcomeTimeout), string(scanner.OutcomeError))
+	httpRequestsTotal = newCounterMap("onvif_finder_http_requests_total", "HTTP requests by handler, method and status code.",
+		"handler", "method", "code")
+	httpRequestDurationSeconds = newHistogramVec("onvif_finder_http_request_duration_seconds", "Duration of the HTTP requests by handler.",
+		[]float64{0.005, 0.025, 0.1, 0.5, 1, 5, 30, 120}, "handler")
+	probedHostsTotal = newCounterVec("onvif_finder_probed_hosts_total", "Hosts probed by the reachability of their RTSP ports: open, closed (refused), filtered (timed out) or error.",
+		"class", string(scanner.ClassOpen), string(scanner.ClassClosed), string(scanner.ClassFiltered), string(scanner.ClassError))
+	panicsTotal = newCounterVec("onvif_finder_panics_total", "Panics recovered in HTTP handlers and probes.",
+		"where", panicHandler, panicProbe)
+	authFailuresTotal = newCounterVec("onvif_finder_auth_failures_total", "Requests rejected because of a missing or invalid API key.",
+		"reason", authMissing, authInvalid)
+	reportDeliveriesTotal = newCounterVec("onvif_finder_report_deliveries_total", "Scan reports posted to the report sinks by outcome: delivered, retried, failed (given up) or dropped (queue full).",
+		"outcome", deliveryDelivered, deliveryRetried, deliveryFailed, deliveryDropped)
+)
+
+func init() {
+	metrics.register(scanDurationSeconds)
+	metrics.register(scansTotal)
+	metrics.register(scanStageDurationSeconds)
+	metrics.register(enrichmentsTotal)
+	metrics.register(lastScanDevices)
+	metrics.register(scanConcurrency)
+	metrics.register(probesTotal)
+	metrics.register(probedHostsTotal)
+	metrics.register(httpRequestsTotal)
+	metrics.register(httpRequestDurationSeconds)
+	metrics.register(authFailuresTotal)
+	metrics.register(panicsTotal)
+	metrics.register(reportDeliveriesTotal)
+}
+
+func observeRequest(handler, method string, status int, duration time.Duration) {
+	httpRequestsTotal.inc(handler, method, strconv.Itoa(status))
+	httpRequestDurationSeconds.observe(duration.Seconds(), handler)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeTo(w)
+}
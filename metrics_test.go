@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"find_cameras/scanner"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	r := &metricsRegistry{}
+	counter := newCounterVec("test_probes_total", "Probes.", "outcome", "open", "closed")
+	level := &gauge{name: "test_level", help: "Level."}
+	durations := newHistogramVec("test_duration_seconds", "Durations.", []float64{0.5, 1}, "stage")
+	requests := newCounterMap("test_requests_total", "Requests.", "handler", "code")
+	for _, m := range []metric{counter, level, durations, requests} {
+		r.register(m)
+	}
+	counter.inc("open")
+	counter.inc("open")
+	counter.inc("unknown")
+	level.set(7)
+	durations.observe(0.25, "sweep")
+	durations.observe(0.75, "sweep")
+	durations.observe(3, "sweep")
+	requests.inc("/scan", "200")
+	requests.inc("/healthz", "200")
+
+	var b strings.Builder
+	r.writeTo(&b)
+	want := `# HELP test_probes_total Probes.
+# TYPE test_probes_total counter
+test_probes_total{outcome="open"} 2
+test_probes_total{outcome="closed"} 0
+# HELP test_level Level.
+# TYPE test_level gauge
+test_level 7
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="sweep",le="0.5"} 1
+test_duration_seconds_bucket{stage="sweep",le="1"} 2
+test_duration_seconds_bucket{stage="sweep",le="+Inf"} 3
+test_duration_seconds_sum{stage="sweep"} 4
+test_duration_seconds_count{stage="sweep"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{handler="/healthz",code="200"} 1
+test_requests_total{handler="/scan",code="200"} 1
+`
+	if b.String() != want {
+		t.Errorf("metrics =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// metricValue returns the value of series in the metrics served by srv.
+func metricValue(t *testing.T, srv *httptest.Server, series string) float64 {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("no series %s", series)
+	return 0
+}
+
+func TestMetricsScan(t *testing.T) {
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	series := []string{
+		`onvif_finder_probes_total{outcome="rtsp"}`,
+		`onvif_finder_probed_hosts_total{class="open"}`,
+		`onvif_finder_scans_total{result="started"}`,
+		`onvif_finder_scans_total{result="completed"}`,
+		`onvif_finder_http_requests_total{handler="/api/v1/scan",method="GET",code="200"}`,
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		if strings.HasPrefix(s, "onvif_finder_http") {
+			continue
+		}
+		before[i] = metricValue(t, srv, s)
+	}
+	resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + localScan(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for i, s := range series {
+		if got := metricValue(t, srv, s); got < before[i]+1 {
+			t.Errorf("%s = %v, want at least %v", s, got, before[i]+1)
+		}
+	}
+	if got := metricValue(t, srv, "onvif_finder_last_scan_devices"); got != 1 {
+		t.Errorf("onvif_finder_last_scan_devices = %v, want 1", got)
+	}
+}
+
+// TestProbeMetricsAllocations checks that counting a probe is a lone atomic
+// increment, with nothing allocated.
+func TestProbeMetricsAllocations(t *testing.T) {
+	outcome := string(scanner.OutcomeRefused)
+	if n := testing.AllocsPerRun(1000, func() { probesTotal.inc(outcome) }); n != 0 {
+		t.Errorf("%v allocations per probe", n)
+	}
+}
+
+func BenchmarkProbeMetrics(b *testing.B) {
+	outcome := string(scanner.OutcomeRefused)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			probesTotal.inc(outcome)
+		}
+	})
+}
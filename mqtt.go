@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	mqttQueueSize    = 1024
+	mqttKeepAlive    = 60 * time.Second
+	mqttDialTimeout  = 5 * time.Second
+	mqttMaxReconnect = time.Minute
+)
+
+// mqttClient is the part of an MQTT connection the publisher needs.
+type mqttClient interface {
+	Publish(topic string, payload []byte, retain bool) error
+	Ping() error
+	Close() error
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// mqttPub publishes the cameras of every scan as retained messages. Messages
+// are queued while the broker is unreachable and sent once it reconnects.
+type mqttPub struct {
+	dial   func(ctx context.Context) (mqttClient, error)
+	prefix string
+	queue  chan mqttMessage
+}
+
+var mqttPublisher *mqttPub
+
+// newMQTTPublisher returns nil, which publishes nothing, when broker is empty.
+func newMQTTPublisher(broker, username, password, prefix string) (*mqttPub, error) {
+	if broker == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %q", broker)
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	clientID := "onvif-finder-" + id[:8]
+	return &mqttPub{
+		dial: func(ctx context.Context) (mqttClient, error) {
+			return dialMQTT(ctx, u, username, password, clientID)
+		},
+		prefix: strings.TrimSuffix(prefix, "/"),
+		queue:  make(chan mqttMessage, mqttQueueSize),
+	}, nil
+}
+
+func mqttTopicID(id string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(id)
+}
+
+// publish queues the found cameras and the removals of a scan. It does nothing
+// when no broker is configured.
+func (p *mqttPub) publish(records []cameraRecord, events []cameraEvent) {
+	if p == nil {
+		return
+	}
+	for _, r := range records {
+		p.enqueue(r.ID, struct {
+			Status string `json:"status"`
+			cameraRecord
+		}{"online", r})
+	}
+	for _, e := range events {
+		if e.Event == eventCameraRemoved {
+			p.enqueue(e.Device.ID, struct {
+				Status string `json:"status"`
+				cameraRecord
+			}{"removed", e.Device})
+		}
+	}
+}
+
+func (p *mqttPub) enqueue(id string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Error encoding MQTT message", "id", id, "err", err)
+		return
+	}
+	msg := mqttMessage{topic: p.prefix + "/cameras/" + mqttTopicID(id), payload: payload}
+	select {
+	case p.queue <- msg:
+	default:
+		logger.Warn("MQTT queue is full, dropping message", "id", id)
+	}
+}
+
+// pending returns the number of queued messages.
+func (p *mqttPub) pending() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.queue)
+}
+
+// run keeps a connection to the broker, reconnecting with a backoff, and sends
+// the queued messages.
+func (p *mqttPub) run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	var pending *mqttMessage
+	backoff := time.Second
+	for ctx.Err() == nil {
+		client, err := p.dial(ctx)
+		if err != nil {
+			logger.Warn("Error connecting to the MQTT broker", "retry_in", backoff.String(), "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			if backoff *= 2; backoff > mqttMaxReconnect {
+				backoff = mqttMaxReconnect
+			}
+			continue
+		}
+		backoff = time.Second
+		pending, err = p.serve(ctx, client, pending)
+		client.Close()
+		if err != nil {
+			logger.Warn("MQTT connection lost", "err", err)
+		}
+	}
+}
+
+func (p *mqttPub) serve(ctx context.Context, client mqttClient, pending *mqttMessage) (*mqttMessage, error) {
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		if pending != nil {
+			if err := client.Publish(pending.topic, pending.payload, true); err != nil {
+				return pending, err
+			}
+			pending = nil
+		}
+		select {
+		case msg := <-p.queue:
+			pending = &msg
+		case <-ping.C:
+			if err := client.Ping(); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// mqttConn is a minimal MQTT 3.1.1 client publishing with QoS 0.
+type mqttConn struct {
+	conn net.Conn
+}
+
+func dialMQTT(ctx context.Context, broker *url.URL, username, password, clientID string) (*mqttConn, error) {
+	host := broker.Host
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+	var err error
+	switch broker.Scheme {
+	case "mqtt", "tcp":
+		if broker.Port() == "" {
+			host = net.JoinHostPort(broker.Hostname(), "1883")
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	case "mqtts", "ssl", "tls":
+		if broker.Port() == "" {
+			host = net.JoinHostPort(broker.Hostname(), "8883")
+		}
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: broker.Hostname()}}).DialContext(ctx, "tcp", host)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT scheme %q", broker.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConn{conn: conn}
+	if err := c.connect(username, password, clientID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.discardIncoming()
+	return c, nil
+}
+
+func (c *mqttConn) connect(username, password, clientID string) error {
+	flags := byte(0x02)
+	var payload []byte
+	payload = appendMQTTString(payload, clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, username)
+		if password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+	if err := c.write(0x10, body); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	var ack [4]byte
+	if _, err := io.ReadFull(c.conn, ack[:]); err != nil {
+		return err
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		return errors.New("unexpected answer to CONNECT")
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("connection refused by the broker (code %d)", ack[3])
+	}
+	return nil
+}
+
+// discardIncoming reads the PINGRESP packets of the broker; any read error
+// closes the connection so the next write fails and triggers a reconnect.
+func (c *mqttConn) discardIncoming() {
+	r := bufio.NewReader(c.conn)
+	for {
+		if _, err := r.ReadByte(); err != nil {
+			c.conn.Close()
+			return
+		}
+		n, err := readMQTTLength(r)
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+		if _, err := r.Discard(n); err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *mqttConn) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+	}
+	return c.write(header, append(appendMQTTString(nil, topic), payload...))
+}
+
+func (c *mqttConn) Ping() error {
+	return c.write(0xc0, nil)
+}
+
+func (c *mqttConn) Close() error {
+	c.write(0xe0, nil)
+	return c.conn.Close()
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func readMQTTLength(r *bufio.Reader) (int, error) {
+	n, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errors.New("malformed remaining length")
+}
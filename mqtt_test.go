@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type published struct {
+	topic  string
+	status string
+	retain bool
+}
+
+// fakeMQTTClient records the messages published, failing the publishes
+// after the first failAfter ones to simulate a lost connection.
+type fakeMQTTClient struct {
+	mu        *sync.Mutex
+	messages  *[]published
+	failAfter int
+	sent      int
+}
+
+func (c *fakeMQTTClient) Publish(topic string, payload []byte, retain bool) error {
+	if c.failAfter >= 0 && c.sent >= c.failAfter {
+		return errors.New("connection lost")
+	}
+	c.sent++
+	var msg struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(payload, &msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.messages = append(*c.messages, published{topic, msg.Status, retain})
+	return nil
+}
+
+func (c *fakeMQTTClient) Ping() error  { return nil }
+func (c *fakeMQTTClient) Close() error { return nil }
+
+func TestMQTTPublishFlow(t *testing.T) {
+	var mu sync.Mutex
+	var messages []published
+	dials := 0
+	p := &mqttPub{
+		prefix: "site1",
+		queue:  make(chan mqttMessage, mqttQueueSize),
+		dial: func(ctx context.Context) (mqttClient, error) {
+			dials++
+			// The first connection is lost after a message.
+			failAfter := -1
+			if dials == 1 {
+				failAfter = 1
+			}
+			return &fakeMQTTClient{mu: &mu, messages: &messages, failAfter: failAfter}, nil
+		},
+	}
+	camera := cameraRecord{ID: "mac:00:11:22:33:44:55", device: device{IP: "10.0.0.7"}}
+	other := cameraRecord{ID: "ref:urn/uuid+1#2", device: device{IP: "10.0.0.8"}}
+	// Published before the broker is reachable, buffered meanwhile.
+	p.publish([]cameraRecord{camera, other}, nil)
+	p.publish(nil, []cameraEvent{{Event: eventCameraRemoved, Device: other}, {Event: eventCameraAdded, Device: camera}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(messages)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages published, want 3", n)
+		}
+	}
+	cancel()
+	<-done
+
+	want := []published{
+		{"site1/cameras/mac:00:11:22:33:44:55", "online", true},
+		{"site1/cameras/ref:urn_uuid_1_2", "online", true},
+		{"site1/cameras/ref:urn_uuid_1_2", "removed", true},
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Errorf("message %d = %+v, want %+v", i, messages[i], want[i])
+		}
+	}
+	if dials != 2 {
+		t.Errorf("%d connections, want 2", dials)
+	}
+}
+
+func TestMQTTDisabled(t *testing.T) {
+	p, err := newMQTTPublisher("", "", "", "cameras")
+	if p != nil || err != nil {
+		t.Fatalf("newMQTTPublisher() = %v, %v", p, err)
+	}
+	p.publish([]cameraRecord{{ID: "ip:10.0.0.7"}}, nil)
+	p.run(context.Background())
+	if n := p.pending(); n != 0 {
+		t.Errorf("%d messages pending", n)
+	}
+	for _, broker := range []string{"mqtt://", "::"} {
+		if _, err := newMQTTPublisher(broker, "", "", "cameras"); err == nil {
+			t.Errorf("newMQTTPublisher(%q) succeeded", broker)
+		}
+	}
+}
+
+// mqttPacket is a control packet read by the fake broker.
+type mqttPacket struct {
+	header byte
+	body   []byte
+}
+
+// fakeBroker accepts a single MQTT connection, acknowledging the CONNECT
+// with code, and passes every packet received on.
+func fakeBroker(t *testing.T, code byte) (*url.URL, <-chan mqttPacket) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	packets := make(chan mqttPacket, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(packets)
+		r := bufio.NewReader(conn)
+		for {
+			header, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			n, err := readMQTTLength(r)
+			if err != nil {
+				return
+			}
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			packets <- mqttPacket{header, body}
+			if header == 0x10 {
+				conn.Write([]byte{0x20, 2, 0, code})
+			}
+		}
+	}()
+	return &url.URL{Scheme: "mqtt", Host: ln.Addr().String()}, packets
+}
+
+// mqttString reads a length-prefixed string of b.
+func mqttString(b []byte) (string, []byte) {
+	n := int(b[0])<<8 | int(b[1])
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func TestMQTTConn(t *testing.T) {
+	broker, packets := fakeBroker(t, 0)
+	c, err := dialMQTT(context.Background(), broker, "finder", "secret", "onvif-finder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := <-packets
+	protocol, rest := mqttString(connect.body)
+	if connect.header != 0x10 || protocol != "MQTT" || rest[0] != 4 || rest[1] != 0xc2 {
+		t.Fatalf("CONNECT = %x", connect.body)
+	}
+	clientID, rest := mqttString(rest[4:])
+	username, rest := mqttString(rest)
+	password, _ := mqttString(rest)
+	if clientID != "onvif-finder-test" || username != "finder" || password != "secret" {
+		t.Errorf("CONNECT client %q, username %q, password %q", clientID, username, password)
+	}
+
+	// A payload over 127 bytes needs two bytes of remaining length.
+	payload := `{"status":"online","ip":"` + strings.Repeat("1", 300) + `"}`
+	if err := c.Publish("site1/cameras/ip:10.0.0.7", []byte(payload), true); err != nil {
+		t.Fatal(err)
+	}
+	publish := <-packets
+	topic, body := mqttString(publish.body)
+	if publish.header != 0x31 || topic != "site1/cameras/ip:10.0.0.7" || string(body) != payload {
+		t.Errorf("PUBLISH header %x, topic %q, payload %q", publish.header, topic, body)
+	}
+	if err := c.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if ping := <-packets; ping.header != 0xc0 || len(ping.body) != 0 {
+		t.Errorf("PINGREQ = %x %x", ping.header, ping.body)
+	}
+	c.Close()
+	if disconnect := <-packets; disconnect.header != 0xe0 {
+		t.Errorf("DISCONNECT = %x", disconnect.header)
+	}
+}
+
+func TestMQTTConnRefused(t *testing.T) {
+	broker, _ := fakeBroker(t, 5)
+	if _, err := dialMQTT(context.Background(), broker, "finder", "wrong", "onvif-finder-test"); err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("err = %v, want the refusal of the broker", err)
+	}
+	if _, err := dialMQTT(context.Background(), &url.URL{Scheme: "ws", Host: "127.0.0.1:1"}, "", "", "id"); err == nil {
+		t.Error("dialMQTT() with an unsupported scheme succeeded")
+	}
+}
+
+func TestReadMQTTLength(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int
+		err  bool
+	}{
+		{[]byte{0x00}, 0, false},
+		{[]byte{0x7f}, 127, false},
+		{[]byte{0x80, 0x01}, 128, false},
+		{[]byte{0xff, 0x7f}, 16383, false},
+		{[]byte{0xff, 0xff, 0xff, 0x7f}, 268435455, false},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x01}, 0, true},
+		{[]byte{0x80}, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := readMQTTLength(bufio.NewReader(strings.NewReader(string(tt.data))))
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("readMQTTLength(%x) = %d, %v", tt.data, got, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const prefilterNDP = "ndp"
+
+var allNodesMulticast = net.ParseIP("ff02::1")
+
+func listenICMPv6() (*icmpSocket, error) {
+	if conn, err := net.ListenPacket("ip6:ipv6-icmp", "::"); err == nil {
+		return &icmpSocket{conn: conn, raw: true}, nil
+	}
+	conn, err := listenUnprivilegedICMPv6()
+	if err != nil {
+		return nil, errICMPUnavailable
+	}
+	return &icmpSocket{conn: conn}, nil
+}
+
+// pingAllNodes sends an ICMPv6 echo request to the all-nodes group on iface and
+// returns the addresses that answered. The kernel fills in the checksum.
+func pingAllNodes(ctx context.Context, iface string) ([]string, error) {
+	sock, err := listenICMPv6()
+	if err != nil {
+		return nil, err
+	}
+	defer sock.conn.Close()
+
+	msg := []byte{128, 0, 0, 0, 0, 0, 0, 0, '5', 's'}
+	id := uint16(os.Getpid())
+	msg[4], msg[5] = byte(id>>8), byte(id)
+	dst := sock.addr(allNodesMulticast)
+	switch a := dst.(type) {
+	case *net.IPAddr:
+		a.Zone = iface
+	case *net.UDPAddr:
+		a.Zone = iface
+	}
+	if _, err := sock.conn.WriteTo(msg, dst); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(icmpReplyWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	sock.conn.SetReadDeadline(deadline)
+
+	var alive []string
+	seen := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := sock.conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n < 8 || buf[0] != 129 {
+			continue
+		}
+		var ip string
+		switch a := from.(type) {
+		case *net.IPAddr:
+			ip = hostWithZone(a.IP, a.Zone)
+		case *net.UDPAddr:
+			ip = hostWithZone(a.IP, a.Zone)
+		}
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			alive = append(alive, ip)
+		}
+	}
+	return alive, nil
+}
+
+// ipv6Candidates lists the hosts worth probing on an IPv6 network. A /64 is far
+// too large to sweep, so only hosts answering an all-nodes ping or present in
+// the neighbor cache are returned.
+func ipv6Candidates(ctx context.Context, network localNetwork, includeSelf bool) ([]string, error) {
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(ip string) {
+		host, _, _ := strings.Cut(ip, "%")
+		parsed := net.ParseIP(host)
+		if parsed == nil || seen[ip] || (!includeSelf && parsed.Equal(network.IP)) {
+			return
+		}
+		if parsed.IsLinkLocalUnicast() != network.IP.IsLinkLocalUnicast() {
+			return
+		}
+		if !parsed.IsLinkLocalUnicast() && !network.Contains(parsed) {
+			return
+		}
+		seen[ip] = true
+		candidates = append(candidates, ip)
+	}
+
+	responders, err := pingAllNodes(ctx, network.Interface)
+	if err != nil {
+		icmpUnavailableLog.Do(func() {
+			loggerFrom(ctx).Warn("ICMPv6 unavailable, relying on the neighbor cache", "err", err)
+		})
+	}
+	for _, ip := range responders {
+		add(ip)
+	}
+	entries, neighborsErr := ipv6Neighbors()
+	if err != nil && neighborsErr != nil {
+		return nil, fmt.Errorf("neither ICMPv6 (%v) nor the neighbor cache (%v) are available", err, neighborsErr)
+	}
+	for _, e := range entries {
+		if e.Interface == network.Interface {
+			add(e.IP)
+		}
+	}
+
+	loggerFrom(ctx).Info("Pre-filtered network", "prefilter", prefilterNDP, "network", network.String(), "candidates", len(candidates))
+	return candidates, nil
+}
+
+func hostWithZone(ip net.IP, zone string) string {
+	if ip.IsLinkLocalUnicast() {
+		return joinZone(ip, zone)
+	}
+	return ip.String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+const (
+	ndaDst    = 1
+	ndaLLAddr = 2
+)
+
+// ipv6Neighbors reads the IPv6 neighbor cache over rtnetlink.
+func ipv6Neighbors() ([]neighbor, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int]string)
+	var entries []neighbor
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < 12 {
+			continue
+		}
+		ifindex := int(int32(binary.LittleEndian.Uint32(m.Data[4:])))
+		state := binary.LittleEndian.Uint16(m.Data[8:])
+		if state&(0x01|0x20) != 0 {
+			// NUD_INCOMPLETE and NUD_FAILED entries have no link-layer address.
+			continue
+		}
+
+		var ip net.IP
+		var mac net.HardwareAddr
+		attrs := m.Data[12:]
+		for len(attrs) >= 4 {
+			l := int(binary.LittleEndian.Uint16(attrs))
+			typ := binary.LittleEndian.Uint16(attrs[2:])
+			if l < 4 || l > len(attrs) {
+				break
+			}
+			switch typ {
+			case ndaDst:
+				ip = append(net.IP(nil), attrs[4:l]...)
+			case ndaLLAddr:
+				mac = append(net.HardwareAddr(nil), attrs[4:l]...)
+			}
+			if next := (l + 3) &^ 3; next < len(attrs) {
+				attrs = attrs[next:]
+			} else {
+				attrs = nil
+			}
+		}
+		if len(ip) != net.IPv6len || len(mac) == 0 {
+			continue
+		}
+
+		name, ok := names[ifindex]
+		if !ok {
+			if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+				name = iface.Name
+			}
+			names[ifindex] = name
+		}
+		entries = append(entries, neighbor{IP: hostWithZone(ip, name), MAC: mac.String(), Interface: name})
+	}
+	return entries, nil
+}
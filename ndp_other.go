@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func ipv6Neighbors() ([]neighbor, error) {
+	return nil, errNeighborTableUnavailable
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+type localNetwork struct {
+	*net.IPNet
+	Interface string
+	// Requested is set for networks supplied by the caller, which are not
+	// necessarily attached to the host and have no local address.
+	Requested bool
+}
+
+func (n localNetwork) isIPv6() bool {
+	return n.IP.To4() == nil
+}
+
+func (n localNetwork) localAddr() net.IPAddr {
+	addr := net.IPAddr{IP: n.IP}
+	if n.isIPv6() {
+		addr.Zone = n.Interface
+	}
+	return addr
+}
+
+// requestedNetworks returns the networks of the requested CIDRs, a CIDR given
+// more than once only once.
+func requestedNetworks(cidrs []*net.IPNet) []localNetwork {
+	networks := make([]localNetwork, 0, len(cidrs))
+	seen := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		if !seen[cidr.String()] {
+			seen[cidr.String()] = true
+			networks = append(networks, localNetwork{IPNet: cidr, Requested: true})
+		}
+	}
+	return networks
+}
+
+type interfaceError struct {
+	name      string
+	available []string
+}
+
+func (e *interfaceError) Error() string {
+	return fmt.Sprintf("interface %q does not exist or is down, available interfaces: %s", e.name, strings.Join(e.available, ", "))
+}
+
+const (
+	interfaceDown         = "down"
+	interfaceLoopback     = "loopback"
+	interfacePointToPoint = "point_to_point"
+	interfaceVirtual      = "virtual"
+	interfaceNotAllowed   = "not_allowed"
+	interfaceDenied       = "denied"
+	interfaceNotRequested = "not_requested"
+)
+
+// virtualInterfaces are the name patterns of container bridges, VM networks
+// and VPN tunnels, which hardly ever have cameras behind them.
+var virtualInterfaces = []string{"docker*", "br-*", "veth*", "virbr*", "tailscale*", "wg*"}
+
+// filterInterfaces skips the virtual and point-to-point interfaces unless the
+// allow list names them.
+var filterInterfaces = true
+
+// interfaceStatus tells whether an interface was scanned, or why not and
+// which pattern of a list filtered it.
+type interfaceStatus struct {
+	Name     string `json:"name"`
+	Selected bool   `json:"selected"`
+	Reason   string `json:"reason,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+}
+
+// matchInterface returns the first pattern of list matching name. Patterns
+// are interface names or shell patterns like eth*.
+func matchInterface(list []string, name string) (string, bool) {
+	for _, pattern := range list {
+		if ok, _ := path.Match(pattern, name); ok || pattern == name {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// checkInterface returns the status of iface given the allow and deny lists.
+// Interfaces the allow list or the request names literally are exempt from
+// the built-in filter.
+func checkInterface(iface net.Interface, allow, deny []string, requested bool) interfaceStatus {
+	status := interfaceStatus{Name: iface.Name}
+	allowed, isAllowed := matchInterface(allow, iface.Name)
+	exempt := requested || allowed == iface.Name
+	switch {
+	case iface.Flags&net.FlagUp == 0:
+		status.Reason = interfaceDown
+	case iface.Flags&net.FlagLoopback != 0:
+		status.Reason = interfaceLoopback
+	case len(allow) > 0 && !isAllowed:
+		status.Reason = interfaceNotAllowed
+	default:
+		if pattern, ok := matchInterface(deny, iface.Name); ok {
+			status.Reason, status.Pattern = interfaceDenied, pattern
+			break
+		}
+		if !filterInterfaces || exempt {
+			status.Selected = true
+			break
+		}
+		if pattern, ok := matchInterface(virtualInterfaces, iface.Name); ok {
+			status.Reason, status.Pattern = interfaceVirtual, pattern
+		} else if iface.Flags&net.FlagPointToPoint != 0 {
+			status.Reason = interfacePointToPoint
+		} else {
+			status.Selected = true
+		}
+	}
+	return status
+}
+
+// selectInterfaces returns the names of the interfaces to scan: the requested
+// ones, or every interface that is up, not a loopback, passes the allow and
+// deny lists and the built-in filter. The statuses of all interfaces explain
+// the choice.
+func selectInterfaces(requested, allow, deny []string) ([]string, []interfaceStatus, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var available []string
+	statuses := make([]interfaceStatus, 0, len(interfaces))
+	for _, iface := range interfaces {
+		isRequested := containsString(requested, iface.Name)
+		status := checkInterface(iface, allow, deny, isRequested)
+		if status.Selected {
+			available = append(available, iface.Name)
+			if len(requested) > 0 && !isRequested {
+				status.Selected, status.Reason = false, interfaceNotRequested
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	if len(requested) == 0 {
+		return available, statuses, nil
+	}
+	for _, name := range requested {
+		if !containsString(available, name) {
+			return nil, statuses, &interfaceError{name: name, available: available}
+		}
+	}
+	return requested, statuses, nil
+}
+
+func getLocalNetworks(names []string, includeIPv6 bool) ([]localNetwork, error) {
+	var networks []localNetwork
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if !containsString(names, iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.Warn("Error getting addresses of interface", "interface", iface.Name, "err", err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.To4() == nil && (!includeIPv6 || iface.Flags&net.FlagMulticast == 0) {
+				continue
+			}
+			networks = append(networks, localNetwork{IPNet: ipNet, Interface: iface.Name})
+			logger.Debug("Found network", "interface", iface.Name, "ip", ipNet.IP.String(), "network", ipNet.String())
+		}
+	}
+
+	if len(networks) == 0 {
+		logger.Warn("No active networks found")
+	}
+
+	return networks, nil
+}
+
+func joinZone(ip net.IP, zone string) string {
+	if zone == "" {
+		return ip.String()
+	}
+	return ip.String() + "%" + zone
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package onvif
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"find_cameras/digest"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const soapEnvelope = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tptz="http://www.onvif.org/ver20/ptz/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">
+%s<s:Body>%s</s:Body>
+</s:Envelope>`
+
+const (
+	maxResponseSize = 4 << 20
+	// minClockSkew is the smallest clock offset worth retrying a rejected
+	// UsernameToken for.
+	minClockSkew = 5 * time.Second
+)
+
+// ErrUnauthorized is returned when the device requires authentication that
+// the client can't provide.
+var ErrUnauthorized = errors.New("authentication required")
+
+// ErrInsecureBasic is returned when the device asks for HTTP Basic
+// authentication over plain HTTP, which would send the password in clear,
+// unless Client.AllowInsecureBasic is set.
+var ErrInsecureBasic = fmt.Errorf("%w: refusing HTTP Basic authentication over plain HTTP", ErrUnauthorized)
+
+// Client issues SOAP requests against the services of a single ONVIF device.
+type Client struct {
+	// XAddr is the URL of the device management service.
+	XAddr      string
+	HTTPClient *http.Client
+	// Username and Password are sent in a WS-Security UsernameToken and
+	// answer HTTP Digest challenges of the device, and Basic ones over TLS.
+	Username string
+	Password string
+	// AllowInsecureBasic answers Basic challenges of http:// services too.
+	AllowInsecureBasic bool
+
+	mu          sync.Mutex
+	clockSynced bool
+	clockOffset time.Duration
+	rtt         time.Duration
+}
+
+// NewClient returns a Client for the device service at xaddr.
+func NewClient(xaddr string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{XAddr: xaddr, HTTPClient: httpClient}
+}
+
+// Fault is a SOAP fault returned by the device.
+type Fault struct {
+	Code    string `xml:"Code>Value"`
+	Subcode string `xml:"Code>Subcode>Value"`
+	Reason  string `xml:"Reason>Text"`
+}
+
+func (f *Fault) Error() string {
+	code := f.Code
+	if f.Subcode != "" {
+		code = f.Subcode
+	}
+	return fmt.Sprintf("soap fault %s: %s", strings.TrimSpace(code), strings.TrimSpace(f.Reason))
+}
+
+type responseEnvelope struct {
+	Body struct {
+		Fault   *Fault `xml:"Fault"`
+		Content []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// Call posts body wrapped in a SOAP envelope to url and decodes the content
+// of the response body into out. When the device rejects the credentials,
+// its clock is compared with ours once and the call is retried with the
+// offset applied to the UsernameToken.
+func (c *Client) Call(ctx context.Context, url, action, body string, out interface{}) error {
+	err := c.call(ctx, url, action, body, out, true)
+	if c.Username != "" && IsAuthFault(err) && c.syncClock(ctx) {
+		err = c.call(ctx, url, action, body, out, true)
+	}
+	return err
+}
+
+func (c *Client) call(ctx context.Context, url, action, body string, out interface{}, authenticate bool) error {
+	authenticate = authenticate && c.Username != ""
+	var header string
+	if authenticate {
+		c.mu.Lock()
+		offset := c.clockOffset
+		c.mu.Unlock()
+		var err error
+		if header, err = usernameToken(c.Username, c.Password, time.Now().Add(offset)); err != nil {
+			return err
+		}
+	}
+	payload := []byte(fmt.Sprintf(soapEnvelope, header, body))
+
+	resp, err := c.post(ctx, url, action, payload, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && authenticate {
+		authorization, err := c.authorization(resp.Header.Values("WWW-Authenticate"), url)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp, err = c.post(ctx, url, action, payload, authorization); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	var env responseEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return fmt.Errorf("decoding soap response: %w", err)
+	}
+	if env.Body.Fault != nil {
+		return env.Body.Fault
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := xml.NewDecoder(bytes.NewReader(env.Body.Content)).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", action[strings.LastIndex(action, "/")+1:], err)
+	}
+	return nil
+}
+
+// syncClock measures the offset of the clock of the device once and reports
+// whether it is large enough to explain a rejected UsernameToken.
+func (c *Client) syncClock(ctx context.Context) bool {
+	c.mu.Lock()
+	synced := c.clockSynced
+	c.clockSynced = true
+	c.mu.Unlock()
+	if synced {
+		return false
+	}
+	deviceTime, err := c.GetSystemDateAndTime(ctx)
+	if err != nil {
+		return false
+	}
+	offset := time.Until(deviceTime)
+	if offset > -minClockSkew && offset < minClockSkew {
+		return false
+	}
+	c.mu.Lock()
+	c.clockOffset = offset
+	c.mu.Unlock()
+	return true
+}
+
+// ClockOffset returns how far the clock of the device was found to be ahead
+// of ours, zero unless it was measured.
+func (c *Client) ClockOffset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clockOffset
+}
+
+func (c *Client) post(ctx context.Context, url, action string, payload []byte, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf(`application/soap+xml; charset=utf-8; action="%s"`, action))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	started := time.Now()
+	resp, err := c.HTTPClient.Do(req)
+	if err == nil {
+		rtt := time.Since(started)
+		c.mu.Lock()
+		if c.rtt == 0 || rtt < c.rtt {
+			c.rtt = rtt
+		}
+		c.mu.Unlock()
+	}
+	return resp, err
+}
+
+// RTT returns the fastest round trip of a SOAP request to the device, from
+// sending it until the response headers arrived, or 0 before any response.
+func (c *Client) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+func (c *Client) authorization(challenges []string, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	for _, challenge := range challenges {
+		if ch, err := digest.ParseChallenge(challenge); err == nil {
+			return ch.Authorize(c.Username, c.Password, http.MethodPost, u.RequestURI())
+		}
+	}
+	for _, challenge := range challenges {
+		if scheme, _, _ := strings.Cut(challenge, " "); strings.EqualFold(scheme, "Basic") {
+			if u.Scheme != "https" && !c.AllowInsecureBasic {
+				return "", ErrInsecureBasic
+			}
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)), nil
+		}
+	}
+	return "", ErrUnauthorized
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
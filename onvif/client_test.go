@@ -0,0 +1,107 @@
+package onvif
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const okResponse = `<?xml version="1.0"?><s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><tds:GetHostnameResponse xmlns:tds="http://www.onvif.org/ver10/device/wsdl"/></s:Body></s:Envelope>`
+
+// challengeServer asks for scheme authentication and answers the requests
+// carrying an Authorization header of that scheme. It records the headers
+// received.
+func challengeServer(t *testing.T, scheme string, tls bool) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var seen []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		seen = append(seen, auth)
+		mu.Unlock()
+		if !strings.HasPrefix(auth, scheme+" ") {
+			w.Header().Set("WWW-Authenticate", scheme+` realm="camera", nonce="abc", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(okResponse))
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	if tls {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		insecure bool
+		err      error
+	}{
+		{"plain http refused", false, false, ErrInsecureBasic},
+		{"plain http allowed", false, true, nil},
+		{"https", true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, seen := challengeServer(t, "Basic", tt.tls)
+			c := NewClient(srv.URL+"/onvif/device_service", srv.Client())
+			c.Username, c.Password = "admin", "secret"
+			c.AllowInsecureBasic = tt.insecure
+			err := c.Call(context.Background(), c.XAddr, "http://www.onvif.org/ver10/device/wsdl/GetHostname", "<tds:GetHostname/>", nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			basic := 0
+			for _, auth := range seen() {
+				if strings.HasPrefix(auth, "Basic ") {
+					basic++
+				}
+			}
+			if want := map[bool]int{true: 0, false: 1}[tt.err != nil]; basic != want {
+				t.Errorf("%d requests with Basic credentials, want %d", basic, want)
+			}
+		})
+	}
+	if !IsAuthFault(ErrInsecureBasic) {
+		t.Error("ErrInsecureBasic is not an authentication fault")
+	}
+}
+
+func TestDigestAuthentication(t *testing.T) {
+	srv, seen := challengeServer(t, "Digest", false)
+	c := NewClient(srv.URL+"/onvif/device_service", srv.Client())
+	c.Username, c.Password = "admin", "secret"
+	if err := c.Call(context.Background(), c.XAddr, "http://www.onvif.org/ver10/device/wsdl/GetHostname", "<tds:GetHostname/>", nil); err != nil {
+		t.Fatal(err)
+	}
+	headers := seen()
+	if len(headers) != 2 || !strings.Contains(headers[1], `username="admin"`) || strings.Contains(headers[1], "secret") {
+		t.Errorf("authorization headers = %q", headers)
+	}
+}
+
+func TestCallWithoutCredentials(t *testing.T) {
+	srv, seen := challengeServer(t, "Basic", false)
+	c := NewClient(srv.URL+"/onvif/device_service", srv.Client())
+	err := c.Call(context.Background(), c.XAddr, "http://www.onvif.org/ver10/device/wsdl/GetHostname", "<tds:GetHostname/>", nil)
+	if err == nil {
+		t.Fatal("unauthenticated call succeeded")
+	}
+	if headers := seen(); len(headers) != 1 || headers[0] != "" {
+		t.Errorf("authorization headers = %q", headers)
+	}
+}
@@ -0,0 +1,182 @@
+package onvif
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	NamespaceDevice    = "http://www.onvif.org/ver10/device/wsdl"
+	NamespaceMedia     = "http://www.onvif.org/ver10/media/wsdl"
+	NamespaceMedia2    = "http://www.onvif.org/ver20/media/wsdl"
+	NamespaceEvents    = "http://www.onvif.org/ver10/events/wsdl"
+	NamespacePTZ       = "http://www.onvif.org/ver20/ptz/wsdl"
+	NamespaceImaging   = "http://www.onvif.org/ver20/imaging/wsdl"
+	NamespaceAnalytics = "http://www.onvif.org/ver20/analytics/wsdl"
+	NamespaceDeviceIO  = "http://www.onvif.org/ver10/deviceIO/wsdl"
+	NamespaceRecording = "http://www.onvif.org/ver10/recording/wsdl"
+	NamespaceSearch    = "http://www.onvif.org/ver10/search/wsdl"
+	NamespaceReplay    = "http://www.onvif.org/ver10/replay/wsdl"
+)
+
+var serviceNames = map[string]string{
+	NamespaceDevice:    "device",
+	NamespaceMedia:     "media",
+	NamespaceMedia2:    "media2",
+	NamespaceEvents:    "events",
+	NamespacePTZ:       "ptz",
+	NamespaceImaging:   "imaging",
+	NamespaceAnalytics: "analytics",
+	NamespaceDeviceIO:  "deviceio",
+	NamespaceRecording: "recording",
+	NamespaceSearch:    "search",
+	NamespaceReplay:    "replay",
+}
+
+// Service is an ONVIF service exposed by a device.
+type Service struct {
+	Namespace string `json:"namespace"`
+	XAddr     string `json:"xaddr"`
+}
+
+// ServiceName returns the short name of the service with the given
+// namespace, or the namespace itself for services that are not known.
+func ServiceName(namespace string) string {
+	if name, ok := serviceNames[namespace]; ok {
+		return name
+	}
+	return namespace
+}
+
+type getServicesResponse struct {
+	Service []struct {
+		Namespace string `xml:"Namespace"`
+		XAddr     string `xml:"XAddr"`
+	} `xml:"Service"`
+}
+
+// GetServices returns the services of the device.
+func (c *Client) GetServices(ctx context.Context) ([]Service, error) {
+	var resp getServicesResponse
+	err := c.Call(ctx, c.XAddr, NamespaceDevice+"/GetServices",
+		`<tds:GetServices><tds:IncludeCapability>false</tds:IncludeCapability></tds:GetServices>`, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []Service
+	for _, s := range resp.Service {
+		services = append(services, Service{Namespace: strings.TrimSpace(s.Namespace), XAddr: strings.TrimSpace(s.XAddr)})
+	}
+	return services, nil
+}
+
+type xaddr struct {
+	XAddr string `xml:"XAddr"`
+}
+
+type getCapabilitiesResponse struct {
+	Capabilities struct {
+		Analytics xaddr `xml:"Analytics"`
+		Device    xaddr `xml:"Device"`
+		Events    xaddr `xml:"Events"`
+		Imaging   xaddr `xml:"Imaging"`
+		Media     xaddr `xml:"Media"`
+		PTZ       xaddr `xml:"PTZ"`
+		Extension struct {
+			DeviceIO  xaddr `xml:"DeviceIO"`
+			Recording xaddr `xml:"Recording"`
+			Search    xaddr `xml:"Search"`
+			Replay    xaddr `xml:"Replay"`
+		} `xml:"Extension"`
+	} `xml:"Capabilities"`
+}
+
+// GetCapabilities returns the services of the device as reported by the
+// older GetCapabilities call.
+func (c *Client) GetCapabilities(ctx context.Context) ([]Service, error) {
+	var resp getCapabilitiesResponse
+	err := c.Call(ctx, c.XAddr, NamespaceDevice+"/GetCapabilities",
+		`<tds:GetCapabilities><tds:Category>All</tds:Category></tds:GetCapabilities>`, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := resp.Capabilities
+	var services []Service
+	for _, s := range []struct {
+		namespace string
+		xaddr     xaddr
+	}{
+		{NamespaceDevice, caps.Device},
+		{NamespaceMedia, caps.Media},
+		{NamespaceEvents, caps.Events},
+		{NamespacePTZ, caps.PTZ},
+		{NamespaceImaging, caps.Imaging},
+		{NamespaceAnalytics, caps.Analytics},
+		{NamespaceDeviceIO, caps.Extension.DeviceIO},
+		{NamespaceRecording, caps.Extension.Recording},
+		{NamespaceSearch, caps.Extension.Search},
+		{NamespaceReplay, caps.Extension.Replay},
+	} {
+		if addr := strings.TrimSpace(s.xaddr.XAddr); addr != "" {
+			services = append(services, Service{Namespace: s.namespace, XAddr: addr})
+		}
+	}
+	return services, nil
+}
+
+// Services returns the services of the device keyed by their short name,
+// falling back to GetCapabilities for devices that don't implement GetServices.
+func (c *Client) Services(ctx context.Context) (map[string]Service, error) {
+	services, err := c.GetServices(ctx)
+	if err != nil || len(services) == 0 {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		services, err = c.GetCapabilities(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	byName := make(map[string]Service, len(services))
+	for _, s := range services {
+		byName[ServiceName(s.Namespace)] = s
+	}
+	return byName, nil
+}
+
+// DeviceInformation is what a device reports about its hardware and
+// firmware.
+type DeviceInformation struct {
+	Manufacturer    string
+	Model           string
+	FirmwareVersion string
+	SerialNumber    string
+	HardwareID      string
+}
+
+type getDeviceInformationResponse struct {
+	Manufacturer    string `xml:"Manufacturer"`
+	Model           string `xml:"Model"`
+	FirmwareVersion string `xml:"FirmwareVersion"`
+	SerialNumber    string `xml:"SerialNumber"`
+	HardwareID      string `xml:"HardwareId"`
+}
+
+// GetDeviceInformation returns the manufacturer, model, firmware version,
+// serial number and hardware ID of the device.
+func (c *Client) GetDeviceInformation(ctx context.Context) (DeviceInformation, error) {
+	var resp getDeviceInformationResponse
+	if err := c.Call(ctx, c.XAddr, NamespaceDevice+"/GetDeviceInformation", `<tds:GetDeviceInformation/>`, &resp); err != nil {
+		return DeviceInformation{}, err
+	}
+	return DeviceInformation{
+		Manufacturer:    strings.TrimSpace(resp.Manufacturer),
+		Model:           strings.TrimSpace(resp.Model),
+		FirmwareVersion: strings.TrimSpace(resp.FirmwareVersion),
+		SerialNumber:    strings.TrimSpace(resp.SerialNumber),
+		HardwareID:      strings.TrimSpace(resp.HardwareID),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Profile is a media profile of a device.
+type Profile struct {
+	Token    string `json:"token"`
+	Name     string `json:"name"`
+	Encoding string `json:"encoding,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+type getProfilesResponse struct {
+	Profiles []struct {
+		Token                     string `xml:"token,attr"`
+		Name                      string `xml:"Name"`
+		VideoEncoderConfiguration struct {
+			Encoding   string `xml:"Encoding"`
+			Resolution struct {
+				Width  int `xml:"Width"`
+				Height int `xml:"Height"`
+			} `xml:"Resolution"`
+		} `xml:"VideoEncoderConfiguration"`
+	} `xml:"Profiles"`
+}
+
+// GetProfiles returns the media profiles served by the media service at xaddr.
+func (c *Client) GetProfiles(ctx context.Context, xaddr string) ([]Profile, error) {
+	var resp getProfilesResponse
+	if err := c.Call(ctx, xaddr, NamespaceMedia+"/GetProfiles", `<trt:GetProfiles/>`, &resp); err != nil {
+		return nil, err
+	}
+
+	var profiles []Profile
+	for _, p := range resp.Profiles {
+		vec := p.VideoEncoderConfiguration
+		profiles = append(profiles, Profile{
+			Token:    p.Token,
+			Name:     strings.TrimSpace(p.Name),
+			Encoding: strings.TrimSpace(vec.Encoding),
+			Width:    vec.Resolution.Width,
+			Height:   vec.Resolution.Height,
+		})
+	}
+	return profiles, nil
+}
+
+type mediaURIResponse struct {
+	MediaUri struct {
+		Uri string `xml:"Uri"`
+	} `xml:"MediaUri"`
+}
+
+// GetStreamURI returns the RTP-Unicast over RTSP stream URI of the profile
+// with the given token.
+func (c *Client) GetStreamURI(ctx context.Context, xaddr, token string) (string, error) {
+	body := fmt.Sprintf(`<trt:GetStreamUri><trt:StreamSetup><tt:Stream>RTP-Unicast</tt:Stream><tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport></trt:StreamSetup><trt:ProfileToken>%s</trt:ProfileToken></trt:GetStreamUri>`, escape(token))
+
+	var resp mediaURIResponse
+	if err := c.Call(ctx, xaddr, NamespaceMedia+"/GetStreamUri", body, &resp); err != nil {
+		return "", err
+	}
+	uri := strings.TrimSpace(resp.MediaUri.Uri)
+	if uri == "" {
+		return "", fmt.Errorf("empty stream uri for profile %q", token)
+	}
+	return uri, nil
+}
+
+// GetSnapshotURI returns the HTTP URI of a JPEG snapshot of the profile with
+// the given token.
+func (c *Client) GetSnapshotURI(ctx context.Context, xaddr, token string) (string, error) {
+	body := fmt.Sprintf(`<trt:GetSnapshotUri><trt:ProfileToken>%s</trt:ProfileToken></trt:GetSnapshotUri>`, escape(token))
+
+	var resp mediaURIResponse
+	if err := c.Call(ctx, xaddr, NamespaceMedia+"/GetSnapshotUri", body, &resp); err != nil {
+		return "", err
+	}
+	uri := strings.TrimSpace(resp.MediaUri.Uri)
+	if uri == "" {
+		return "", fmt.Errorf("empty snapshot uri for profile %q", token)
+	}
+	return uri, nil
+}
@@ -0,0 +1,127 @@
+package onvif
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Hostname is the hostname a device is configured with.
+type Hostname struct {
+	Name     string `json:"name"`
+	FromDHCP bool   `json:"from_dhcp,omitempty"`
+}
+
+type getHostnameResponse struct {
+	HostnameInformation struct {
+		FromDHCP bool   `xml:"FromDHCP"`
+		Name     string `xml:"Name"`
+	} `xml:"HostnameInformation"`
+}
+
+// GetHostname returns the hostname of the device.
+func (c *Client) GetHostname(ctx context.Context) (Hostname, error) {
+	var resp getHostnameResponse
+	if err := c.Call(ctx, c.XAddr, NamespaceDevice+"/GetHostname", `<tds:GetHostname/>`, &resp); err != nil {
+		return Hostname{}, err
+	}
+	info := resp.HostnameInformation
+	return Hostname{Name: strings.TrimSpace(info.Name), FromDHCP: info.FromDHCP}, nil
+}
+
+// NetworkInterface is a network interface of a device with the addresses
+// configured on it, in CIDR notation.
+type NetworkInterface struct {
+	Token     string   `json:"token"`
+	Name      string   `json:"name,omitempty"`
+	Enabled   bool     `json:"enabled"`
+	HwAddress string   `json:"hw_address,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	DHCP      bool     `json:"dhcp,omitempty"`
+}
+
+type prefixedAddress struct {
+	Address      string `xml:"Address"`
+	PrefixLength int    `xml:"PrefixLength"`
+}
+
+type getNetworkInterfacesResponse struct {
+	NetworkInterfaces []struct {
+		Token   string `xml:"token,attr"`
+		Enabled bool   `xml:"Enabled"`
+		Info    struct {
+			Name      string `xml:"Name"`
+			HwAddress string `xml:"HwAddress"`
+		} `xml:"Info"`
+		IPv4 struct {
+			Enabled bool `xml:"Enabled"`
+			Config  struct {
+				Manual    []prefixedAddress `xml:"Manual"`
+				LinkLocal prefixedAddress   `xml:"LinkLocal"`
+				FromDHCP  prefixedAddress   `xml:"FromDHCP"`
+				DHCP      bool              `xml:"DHCP"`
+			} `xml:"Config"`
+		} `xml:"IPv4"`
+		IPv6 struct {
+			Enabled bool `xml:"Enabled"`
+			Config  struct {
+				Manual    []prefixedAddress `xml:"Manual"`
+				LinkLocal []prefixedAddress `xml:"LinkLocal"`
+				FromDHCP  []prefixedAddress `xml:"FromDHCP"`
+				FromRA    []prefixedAddress `xml:"FromRA"`
+			} `xml:"Config"`
+		} `xml:"IPv6"`
+	} `xml:"NetworkInterfaces"`
+}
+
+// GetNetworkInterfaces returns the network interfaces of the device. The
+// addresses of disabled IPv4 or IPv6 configurations are left out.
+func (c *Client) GetNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	var resp getNetworkInterfacesResponse
+	if err := c.Call(ctx, c.XAddr, NamespaceDevice+"/GetNetworkInterfaces", `<tds:GetNetworkInterfaces/>`, &resp); err != nil {
+		return nil, err
+	}
+
+	var interfaces []NetworkInterface
+	for _, n := range resp.NetworkInterfaces {
+		iface := NetworkInterface{
+			Token:     n.Token,
+			Name:      strings.TrimSpace(n.Info.Name),
+			Enabled:   n.Enabled,
+			HwAddress: strings.ToLower(strings.TrimSpace(n.Info.HwAddress)),
+		}
+		var addrs []prefixedAddress
+		if v4 := n.IPv4.Config; n.IPv4.Enabled {
+			iface.DHCP = v4.DHCP
+			addrs = append(addrs, v4.Manual...)
+			addrs = append(addrs, v4.FromDHCP, v4.LinkLocal)
+		}
+		if v6 := n.IPv6.Config; n.IPv6.Enabled {
+			for _, list := range [][]prefixedAddress{v6.Manual, v6.FromDHCP, v6.FromRA, v6.LinkLocal} {
+				addrs = append(addrs, list...)
+			}
+		}
+		for _, a := range addrs {
+			ip := net.ParseIP(strings.TrimSpace(a.Address))
+			if ip == nil {
+				continue
+			}
+			cidr := ip.String() + "/" + strconv.Itoa(a.PrefixLength)
+			if !containsString(iface.Addresses, cidr) {
+				iface.Addresses = append(iface.Addresses, cidr)
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package onvif
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+)
+
+// ptzSpaces are the short names of the coordinate spaces a PTZ node moves in.
+var ptzSpaces = map[string]string{
+	"AbsolutePanTiltPositionSpace":    "absolute_pan_tilt",
+	"AbsoluteZoomPositionSpace":       "absolute_zoom",
+	"RelativePanTiltTranslationSpace": "relative_pan_tilt",
+	"RelativeZoomTranslationSpace":    "relative_zoom",
+	"ContinuousPanTiltVelocitySpace":  "continuous_pan_tilt",
+	"ContinuousZoomVelocitySpace":     "continuous_zoom",
+	"PanTiltSpeedSpace":               "pan_tilt_speed",
+	"ZoomSpeedSpace":                  "zoom_speed",
+}
+
+// PTZNode is a pan, tilt and zoom unit of a device.
+type PTZNode struct {
+	Token         string   `json:"token"`
+	Name          string   `json:"name,omitempty"`
+	Spaces        []string `json:"spaces"`
+	MaxPresets    int      `json:"max_presets"`
+	HomeSupported bool     `json:"home_supported,omitempty"`
+}
+
+// PTZConfiguration binds a PTZ node to the media profiles using it.
+type PTZConfiguration struct {
+	Token     string `json:"token"`
+	Name      string `json:"name,omitempty"`
+	NodeToken string `json:"node_token"`
+}
+
+type getNodesResponse struct {
+	PTZNode []struct {
+		Token              string `xml:"token,attr"`
+		Name               string `xml:"Name"`
+		SupportedPTZSpaces struct {
+			Spaces []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"SupportedPTZSpaces"`
+		MaximumNumberOfPresets int  `xml:"MaximumNumberOfPresets"`
+		HomeSupported          bool `xml:"HomeSupported"`
+	} `xml:"PTZNode"`
+}
+
+// GetNodes returns the PTZ nodes of the PTZ service at xaddr.
+func (c *Client) GetNodes(ctx context.Context, xaddr string) ([]PTZNode, error) {
+	var resp getNodesResponse
+	if err := c.Call(ctx, xaddr, NamespacePTZ+"/GetNodes", `<tptz:GetNodes/>`, &resp); err != nil {
+		return nil, err
+	}
+
+	var nodes []PTZNode
+	for _, n := range resp.PTZNode {
+		node := PTZNode{
+			Token:         n.Token,
+			Name:          strings.TrimSpace(n.Name),
+			Spaces:        []string{},
+			MaxPresets:    n.MaximumNumberOfPresets,
+			HomeSupported: n.HomeSupported,
+		}
+		seen := make(map[string]bool)
+		for _, s := range n.SupportedPTZSpaces.Spaces {
+			name, ok := ptzSpaces[s.XMLName.Local]
+			if !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			node.Spaces = append(node.Spaces, name)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+type getConfigurationsResponse struct {
+	PTZConfiguration []struct {
+		Token     string `xml:"token,attr"`
+		Name      string `xml:"Name"`
+		NodeToken string `xml:"NodeToken"`
+	} `xml:"PTZConfiguration"`
+}
+
+// GetConfigurations returns the PTZ configurations of the PTZ service at
+// xaddr.
+func (c *Client) GetConfigurations(ctx context.Context, xaddr string) ([]PTZConfiguration, error) {
+	var resp getConfigurationsResponse
+	if err := c.Call(ctx, xaddr, NamespacePTZ+"/GetConfigurations", `<tptz:GetConfigurations/>`, &resp); err != nil {
+		return nil, err
+	}
+
+	var configs []PTZConfiguration
+	for _, cfg := range resp.PTZConfiguration {
+		configs = append(configs, PTZConfiguration{
+			Token:     cfg.Token,
+			Name:      strings.TrimSpace(cfg.Name),
+			NodeToken: strings.TrimSpace(cfg.NodeToken),
+		})
+	}
+	return configs, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"find_cameras/scanner"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sourceONVIFHTTP = "onvif-http"
+
+	onvifProbeTimeout = 2 * time.Second
+)
+
+var defaultONVIFPorts = []int{80, 8080, 8899}
+
+const getSystemDateAndTime = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl">
+<s:Body><tds:GetSystemDateAndTime/></s:Body>
+</s:Envelope>`
+
+// onvifHTTPProber detects ONVIF device services by posting a
+// GetSystemDateAndTime request to their well-known path. Any SOAP envelope
+// in response, faults included, is a detection.
+type onvifHTTPProber struct {
+	client *http.Client
+}
+
+func newONVIFHTTPProber(dialTimeout time.Duration) *onvifHTTPProber {
+	p := &onvifHTTPProber{}
+	p.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:       (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			DisableKeepAlives: true,
+		},
+		Timeout: onvifProbeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p
+}
+
+func onvifServiceURL(ip string, port int) string {
+	return fmt.Sprintf("http://%s/onvif/device_service", net.JoinHostPort(ip, strconv.Itoa(port)))
+}
+
+func (p *onvifHTTPProber) Probe(ctx context.Context, ip string, port int) scanner.Result {
+	result := scanner.Result{IP: ip}
+	if strings.Contains(ip, "%") {
+		// Zoned link-local addresses are not reachable through net/http.
+		result.Outcome, result.Err = scanner.OutcomeError, errors.New("zoned address")
+		return result
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, onvifServiceURL(ip, port), strings.NewReader(getSystemDateAndTime))
+	if err != nil {
+		result.Outcome, result.Err = scanner.OutcomeError, err
+		return result
+	}
+	req.Header.Set("Content-Type", `application/soap+xml; charset=utf-8`)
+	var connectStarted time.Time
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(string, string) { connectStarted = time.Now() },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				result.RTT = time.Since(connectStarted)
+			}
+		},
+	}))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			result.Outcome = scanner.ClassifyDialError(opErr)
+		} else {
+			result.Outcome = scanner.OutcomeSilent
+		}
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	result.Server = resp.Header.Get("Server")
+
+	if isSOAPEnvelope(io.LimitReader(resp.Body, 64<<10)) {
+		result.Outcome = scanner.OutcomeONVIF
+	} else {
+		result.Outcome = scanner.OutcomeNotRTSP
+	}
+	return result
+}
+
+func isSOAPEnvelope(r io.Reader) bool {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local == "Envelope"
+		}
+	}
+}
+
+// parseONVIFPorts parses the ONVIF port list, none or an empty list disables
+// the ONVIF HTTP probe.
+func parseONVIFPorts(s string) ([]int, error) {
+	if s == "none" || s == "" {
+		return nil, nil
+	}
+	return parsePorts(s)
+}
+
+// scanONVIFHTTP probes the device services of ips on the ONVIF ports of the
+// scan, sharing the workers of the RTSP sweep.
+func scanONVIFHTTP(ctx context.Context, ips []string, opts scanOptions, limit *scanner.Limiter) []scanner.Result {
+	if len(opts.ONVIFPorts) == 0 || len(ips) == 0 {
+		return nil
+	}
+	so := scannerOptions(ctx, opts)
+	so.Ports = opts.ONVIFPorts
+	so.Prober = newONVIFHTTPProber(opts.DialTimeout)
+	so.Limiter = limit
+	so.Probed = func(r scanner.Result) {
+		if r.Outcome.Found() {
+			set := newDeviceSet()
+			set.addONVIFHTTP([]scanner.Result{r})
+			opts.enrich.submit(set.devices[0])
+		}
+	}
+	results, _ := scanner.New(so).ProbeHosts(ctx, ips)
+	return results
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// operationDoc describes an operation of the API for the OpenAPI document.
+// The paths and methods themselves come from the router and the schemas are
+// derived from the response types, so neither can drift from the code.
+type operationDoc struct {
+	summary    string
+	params     []string
+	bodyCIDRs  bool
+	body       interface{}
+	status     int
+	response   interface{}
+	mediaTypes []string
+	// existing operations answer 200 with the same response when what they
+	// create exists already.
+	existing bool
+}
+
+type parameterDoc struct {
+	in, description string
+	schema          map[string]interface{}
+	required        bool
+}
+
+var (
+	stringSchema   = map[string]interface{}{"type": "string"}
+	durationSchema = map[string]interface{}{"type": "string", "example": "500ms"}
+	boolSchema     = map[string]interface{}{"type": "boolean"}
+	intSchema      = map[string]interface{}{"type": "integer"}
+)
+
+var parameterDocs = map[string]parameterDoc{
+	"unicast":           {"query", "Send a unicast WS-Discovery Probe to every candidate, or to the probed IP.", boolSchema, false},
+	"rtsps":             {"query", "Also probe the rtsps ports, 322 by default, with RTSP over TLS.", boolSchema, false},
+	"verbose":           {"query", "Report the class of every probed address: open, closed, filtered or error.", boolSchema, false},
+	"concurrency":       {"query", "Number of concurrent probes, capped by the max-workers of the service.", intSchema, false},
+	"rate":              {"query", "New connections per second of the sweep, capped by the max-connection-rate of the service.", intSchema, false},
+	"ports":             {"query", "Comma-separated RTSP ports to probe.", map[string]interface{}{"type": "string", "example": "554,8554"}, false},
+	"onvif_ports":       {"query", "Comma-separated ports whose ONVIF device service is probed over HTTP on hosts not answering RTSP, or none.", map[string]interface{}{"type": "string", "example": "80,8080,8899"}, false},
+	"timeout":           {"query", "Timeout of a single dial, between 10ms and 10s.", durationSchema, false},
+	"adaptive_timeout":  {"query", "Shorten the dial timeout of every network to the round-trip times observed, timeout stays the upper bound.", boolSchema, false},
+	"retries":           {"query", "How often a probe that timed out or was reset is retried, between 0 and 5.", intSchema, false},
+	"deadline":          {"query", "Deadline of the whole scan, between 1s and 5m.", durationSchema, false},
+	"discovery_window":  {"query", "How long WS-Discovery, SSDP and mDNS answers are collected.", durationSchema, false},
+	"paths":             {"query", "Probe the common RTSP stream paths of every camera.", boolSchema, false},
+	"verify":            {"query", "play plays the RTSP URLs of the cameras found with DESCRIBE, SETUP and PLAY.", map[string]interface{}{"type": "string", "enum": []string{"play"}}, false},
+	"ipv6":              {"query", "Also scan the IPv6 networks.", boolSchema, false},
+	"max_hosts":         {"query", "Largest network that is scanned.", intSchema, false},
+	"exclude":           {"query", "Comma-separated IPs and CIDRs that are not probed.", stringSchema, false},
+	"iface":             {"query", "Interfaces to scan, repeatable.", stringSchema, false},
+	"cidr":              {"query", "Networks to scan instead of the local ones, repeatable.", map[string]interface{}{"type": "string", "example": "192.168.1.0/24"}, false},
+	"refresh":           {"query", "Bypass the result cache.", boolSchema, false},
+	"include_self":      {"query", "Also probe the addresses of this host.", boolSchema, false},
+	"mode":              {"query", "full disables the pre-filters.", map[string]interface{}{"type": "string", "enum": []string{"full"}}, false},
+	"prefilter":         {"query", "Pre-filter selecting the hosts probed.", stringSchema, false},
+	"user":              {"query", "Username of the ONVIF, RTSP and snapshot requests.", stringSchema, false},
+	"pass":              {"query", "Password of the ONVIF, RTSP and snapshot requests.", stringSchema, false},
+	"embed_credentials": {"query", "Put the validated RTSP credentials into the rtsp_urls of the response.", boolSchema, false},
+	"format":            {"query", "Alternative response format.", map[string]interface{}{"type": "string", "enum": []string{"json", "legacy", "ndjson", "csv", "xml"}}, false},
+	"ip":                {"query", "Address of the camera.", stringSchema, true},
+	"limit":             {"query", "Maximum number of items returned.", intSchema, false},
+	"offset":            {"query", "Number of items skipped before the first one returned.", intSchema, false},
+	"vendor":            {"query", "Only cameras whose vendor contains this text.", stringSchema, false},
+	"model":             {"query", "Only cameras whose model contains this text.", stringSchema, false},
+	"network":           {"query", "Only cameras inside this CIDR or on this interface.", stringSchema, false},
+	"status":            {"query", "Only cameras found (online) or missed (offline) by the latest scan of their network.", map[string]interface{}{"type": "string", "enum": []string{statusOnline, statusOffline}}, false},
+	"discovered_via":    {"query", "Only cameras found by this discovery mechanism.", stringSchema, false},
+	"q":                 {"query", "Only cameras whose hostname, name, model or scopes contain this text.", stringSchema, false},
+	"label":             {"query", "Only cameras with this label, given as key or key=value.", stringSchema, false},
+	"include_ignored":   {"query", "Also list the devices of the ignore list, flagged as ignored.", boolSchema, false},
+	"since":             {"query", "Compare the latest scan with the newest one taken at or before this time.", map[string]interface{}{"type": "string", "format": "date-time"}, false},
+	"id":                {"path", "ID of the scan or the camera.", stringSchema, true},
+	"key":               {"path", "Key of the ignore entry, e.g. mac:00:11:22:33:44:55.", stringSchema, true},
+}
+
+var scanParams = []string{"ports", "onvif_ports", "rtsps", "concurrency", "rate", "timeout", "adaptive_timeout", "retries", "deadline", "discovery_window", "paths", "verify", "verbose", "unicast", "ipv6", "max_hosts", "exclude", "iface", "cidr", "refresh", "include_self", "mode", "prefilter", "user", "pass", "embed_credentials"}
+
+var operationDocs = map[string]operationDoc{
+	"GET " + apiPrefix + "/scan":                     {summary: "Scan the networks and return the cameras found", params: append(scanParams, "format"), response: scanResponse{}, mediaTypes: []string{"text/csv", "application/xml", "application/x-ndjson"}},
+	"POST " + apiPrefix + "/scan":                    {summary: "Scan the networks given in the body", params: append(scanParams, "format"), bodyCIDRs: true, response: scanResponse{}},
+	"GET " + apiPrefix + "/scan/stream":              {summary: "Scan the networks, streaming the cameras as Server-Sent Events", params: scanParams, mediaTypes: []string{"text/event-stream"}},
+	"POST " + apiPrefix + "/scan/stream":             {summary: "Scan the networks given in the body as Server-Sent Events", params: scanParams, bodyCIDRs: true, mediaTypes: []string{"text/event-stream"}},
+	"GET " + apiPrefix + "/scans":                    {summary: "List the scan history, newest first", params: []string{"limit"}, response: []snapshotSummary{}},
+	"POST " + apiPrefix + "/scans":                   {summary: "Start a background scan job", params: scanParams, bodyCIDRs: true, status: http.StatusAccepted, response: startedScan{}},
+	"GET " + apiPrefix + "/scans/{id}":               {summary: "Get a scan job or a scan of the history", params: []string{"id"}, response: jobStatus{}},
+	"DELETE " + apiPrefix + "/scans/{id}":            {summary: "Stop a scan job", params: []string{"id"}, response: jobStatus{}},
+	"GET " + apiPrefix + "/scans/checkpoints":        {summary: "Checkpoints of the running and interrupted scan jobs", response: []jobStatus{}},
+	"POST " + apiPrefix + "/scans/{id}/resume":       {summary: "Resume an interrupted scan job, probing the addresses its checkpoint lacks", params: []string{"id", "user", "pass"}, status: http.StatusAccepted, response: startedScan{}},
+	"GET " + apiPrefix + "/schedules":                {summary: "The configured scan schedules with their next and last runs", response: []scheduleStatus{}},
+	"GET " + apiPrefix + "/probe":                    {summary: "Probe a single camera", params: append([]string{"ip"}, scanParams...), response: device{}},
+	"GET " + apiPrefix + "/announced":                {summary: "Cameras that announced themselves over WS-Discovery", response: []announcedDevice{}},
+	"GET " + apiPrefix + "/ignored":                  {summary: "The ignore list", response: []ignoreEntry{}},
+	"POST " + apiPrefix + "/ignored":                 {summary: "Ignore a device by ip, mac or id", body: ignoreRequest{}, status: http.StatusCreated, existing: true, response: ignoreEntry{}},
+	"DELETE " + apiPrefix + "/ignored/{key}":         {summary: "Stop ignoring a device", params: []string{"key"}, status: http.StatusNoContent},
+	"GET " + apiPrefix + "/cameras":                  {summary: "Every camera found so far, a page at a time", params: []string{"format", "limit", "offset", "vendor", "model", "network", "label", "status", "discovered_via", "q", "include_ignored"}, response: camerasResponse{}, mediaTypes: []string{"text/csv", "application/xml"}},
+	"POST " + apiPrefix + "/cameras":                 {summary: "Register a camera the scans can't find, probed on every background cycle", body: registerRequest{}, status: http.StatusCreated, existing: true, response: cameraRecord{}},
+	"DELETE " + apiPrefix + "/cameras/{id}":          {summary: "Remove a camera from the registry", params: []string{"id"}, status: http.StatusNoContent},
+	"GET " + apiPrefix + "/cameras/export":           {summary: "Every camera of the registry as a downloadable file", params: []string{"format", "vendor", "model", "network", "label", "status", "discovered_via", "q", "include_ignored"}, response: []cameraRecord{}, mediaTypes: []string{"text/csv"}},
+	"GET " + apiPrefix + "/cameras/last":             {summary: "The cameras of the newest complete scan, without scanning", response: lastScanResponse{}},
+	"GET " + apiPrefix + "/cameras/diff":             {summary: "Changes between two scans", params: []string{"since"}, response: cameraDiff{}},
+	"GET " + apiPrefix + "/cameras/{id}/metadata":    {summary: "The name and labels of a camera, versioned by the ETag", params: []string{"id"}, response: metadataResponse{}},
+	"PUT " + apiPrefix + "/cameras/{id}/metadata":    {summary: "Replace the name and labels of a camera, checking If-Match", params: []string{"id"}, body: metadataUpdate{}, response: metadataResponse{}},
+	"PATCH " + apiPrefix + "/cameras/{id}/metadata":  {summary: "Merge a JSON merge patch into the metadata of a camera, null deleting the name or a label", params: []string{"id"}, body: metadataUpdate{}, response: metadataResponse{}},
+	"DELETE " + apiPrefix + "/cameras/{id}/metadata": {summary: "Clear the name and labels of a camera", params: []string{"id"}, response: metadataResponse{}},
+	"POST " + apiPrefix + "/cameras/{id}/rescan":     {summary: "Probe a known camera again at all its known addresses and return its refreshed record", params: append([]string{"id"}, scanParams...), response: cameraRecord{}},
+	"GET " + apiPrefix + "/cameras/{id}/snapshot":    {summary: "JPEG snapshot of a camera, fetched with the configured credentials", params: []string{"id", "user", "pass"}, mediaTypes: []string{"image/jpeg"}},
+	"GET " + apiPrefix + "/ws":                       {summary: "Scan over a WebSocket connection", status: http.StatusSwitchingProtocols},
+	"GET " + apiPrefix + "/openapi.json":             {summary: "This document"},
+	"GET " + apiPrefix + "/docs":                     {summary: "Swagger UI, when enabled", mediaTypes: []string{"text/html"}},
+	"GET /metrics":                                   {summary: "Prometheus metrics", mediaTypes: []string{"text/plain"}},
+	"GET /healthz":                                   {summary: "Liveness probe"},
+	"GET /readyz":                                    {summary: "Readiness probe", response: readinessResponse{}},
+}
+
+// schemaBuilder derives JSON schemas from Go types following encoding/json,
+// collecting named struct types as components.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	b.fields(t, properties, &required)
+	sort.Strings(required)
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// fields adds the JSON fields of t, inlining embedded structs like
+// encoding/json does. Fields of the outer struct hide embedded ones.
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+	for _, e := range embedded {
+		inner := make(map[string]interface{})
+		var innerRequired []string
+		b.fields(e, inner, &innerRequired)
+		for _, name := range innerRequired {
+			if _, hidden := properties[name]; !hidden {
+				*required = append(*required, name)
+			}
+		}
+		for name, s := range inner {
+			if _, hidden := properties[name]; !hidden {
+				properties[name] = s
+			}
+		}
+	}
+}
+
+func schemaName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// buildOpenAPI returns the OpenAPI 3 document of the routes of rt.
+func buildOpenAPI(rt *router) map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	errorSchema := b.schema(reflect.TypeOf(errorResponse{}))
+	paths := make(map[string]interface{})
+	for _, route := range rt.routes {
+		if route.successor != "" {
+			continue
+		}
+		item := make(map[string]interface{})
+		for method := range route.methods {
+			doc := operationDocs[method+" "+route.pattern]
+			op := map[string]interface{}{"summary": doc.summary}
+			var params []interface{}
+			for _, name := range doc.params {
+				p := parameterDocs[name]
+				params = append(params, map[string]interface{}{"name": name, "in": p.in, "description": p.description, "required": p.required, "schema": p.schema})
+			}
+			if len(params) > 0 {
+				op["parameters"] = params
+			}
+			if doc.bodyCIDRs {
+				op["requestBody"] = map[string]interface{}{"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{"cidr": map[string]interface{}{"type": "array", "items": stringSchema}},
+				}}}}
+			}
+			if doc.body != nil {
+				op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(doc.body))}}}
+			}
+			status := doc.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			content := make(map[string]interface{})
+			if doc.response != nil {
+				content["application/json"] = map[string]interface{}{"schema": b.schema(reflect.TypeOf(doc.response))}
+			}
+			for _, mediaType := range doc.mediaTypes {
+				content[mediaType] = map[string]interface{}{"schema": stringSchema}
+			}
+			response := map[string]interface{}{"description": http.StatusText(status)}
+			if len(content) > 0 {
+				response["content"] = content
+			}
+			errorResponse := map[string]interface{}{"description": "Error", "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}}}
+			responses := map[string]interface{}{strconv.Itoa(status): response, "default": errorResponse}
+			if doc.existing {
+				responses[strconv.Itoa(http.StatusOK)] = map[string]interface{}{"description": http.StatusText(http.StatusOK), "content": content}
+			}
+			op["responses"] = responses
+			if route.flags&routePublic != 0 {
+				op["security"] = []interface{}{}
+			}
+			item[strings.ToLower(method)] = op
+		}
+		paths[route.pattern] = item
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "ONVIF finder", "version": "1"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}, map[string]interface{}{"apiKey": []string{}}},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of rt, built on the first request
+// once all routes are registered.
+func (rt *router) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	rt.openAPIOnce.Do(func() {
+		var err error
+		if rt.openAPI, err = json.MarshalIndent(buildOpenAPI(rt), "", "  "); err != nil {
+			logger.Error("Error encoding OpenAPI document", "err", err)
+		}
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rt.openAPI)
+}
+
+// swaggerUI enables the Swagger UI page at /api/v1/docs. It loads the UI from
+// a CDN, so it is off by default.
+var swaggerUI bool
+
+const swaggerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ONVIF finder API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "` + apiPrefix + `/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+func handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	if !swaggerUI {
+		handleNotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerPage))
+}
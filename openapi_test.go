@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIChecker validates JSON values against the schemas of an OpenAPI
+// document, for the subset of JSON schema the document uses. Objects without
+// additionalProperties must not have properties the schema lacks, so the
+// document can't silently drift from the responses.
+type openAPIChecker struct {
+	doc map[string]interface{}
+}
+
+func (c *openAPIChecker) check(path string, v interface{}, schema map[string]interface{}) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		s, ok := c.doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", path, ref)
+		}
+		return c.check(path, v, s)
+	}
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		// Slices and maps encode nil as null.
+		if t := schema["type"]; t == "array" || t == "object" {
+			return nil
+		}
+		return fmt.Errorf("%s: null", path)
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			if err := c.check(path, v, s.(map[string]interface{})); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %T, want an object", path, v)
+		}
+		for _, name := range schemaStrings(schema["required"]) {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: required property %s missing", path, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			s, ok := properties[name].(map[string]interface{})
+			if !ok {
+				s = additional
+			}
+			if s == nil {
+				return fmt.Errorf("%s: property %s not in the schema", path, name)
+			}
+			if err := c.check(path+"."+name, obj[name], s); err != nil {
+				return err
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %T, want an array", path, v)
+		}
+		for i, item := range list {
+			if err := c.check(path+"["+strconv.Itoa(i)+"]", item, schema["items"].(map[string]interface{})); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %T, want a string", path, v)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, s)
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v, want an integer", path, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %T, want a number", path, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %T, want a boolean", path, v)
+		}
+	}
+	return nil
+}
+
+func schemaStrings(v interface{}) []string {
+	var list []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, s := range v {
+			list = append(list, s.(string))
+		}
+	case []string:
+		list = v
+	}
+	return list
+}
+
+// response returns the schema of the JSON response of the operation at the
+// documented path, or of the default response when status isn't documented.
+func (c *openAPIChecker) response(method, path string, status int) (map[string]interface{}, error) {
+	item, ok := c.doc["paths"].(map[string]interface{})[path].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("path %s not documented", path)
+	}
+	op, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s not documented", method, path)
+	}
+	responses := op["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		response = responses["default"].(map[string]interface{})
+	}
+	content, _ := response["content"].(map[string]interface{})
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s: no JSON response %d documented", method, path, status)
+	}
+	return media["schema"].(map[string]interface{}), nil
+}
+
+func loadOpenAPI(t *testing.T, srv *httptest.Server) *openAPIChecker {
+	t.Helper()
+	resp, err := http.Get(srv.URL + apiPrefix + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c := &openAPIChecker{}
+	if err := json.NewDecoder(resp.Body).Decode(&c.doc); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	rt := newRouter().(*router)
+	for _, route := range rt.routes {
+		if route.successor != "" {
+			continue
+		}
+		for method := range route.methods {
+			doc, ok := operationDocs[method+" "+route.pattern]
+			if !ok || doc.summary == "" {
+				t.Errorf("%s %s not documented", method, route.pattern)
+			}
+			for _, name := range doc.params {
+				if _, ok := parameterDocs[name]; !ok {
+					t.Errorf("%s %s: parameter %s not documented", method, route.pattern, name)
+				}
+			}
+		}
+	}
+}
+
+// TestOpenAPIConformance checks the responses of the handlers against the
+// schemas of the document.
+func TestOpenAPIConformance(t *testing.T) {
+	withStore(t)
+	withCache(t, time.Minute)
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c := loadOpenAPI(t, srv)
+
+	var cameraID, jobID string
+	tests := []struct {
+		method, pattern string
+		path            func() string
+		body            string
+		status          int
+	}{
+		{"GET", "/scan", func() string { return "/scan?" + localScan(port) }, "", http.StatusOK},
+		{"GET", "/scan", func() string { return "/scan?" + localScan(port) + "&timeout=1h" }, "", http.StatusBadRequest},
+		{"GET", "/cameras", func() string { return "/cameras" }, "", http.StatusOK},
+		// The camera found by the scan is registered.
+		{"POST", "/cameras", func() string { return "/cameras" }, fmt.Sprintf(`{"host":"127.0.0.1","port":%d,"name":"Gate","labels":{"site":"north"}}`, port), http.StatusOK},
+		{"GET", "/cameras/{id}/metadata", func() string { return "/cameras/" + url.PathEscape(cameraID) + "/metadata" }, "", http.StatusOK},
+		{"POST", "/cameras/{id}/rescan", func() string { return "/cameras/" + url.PathEscape(cameraID) + "/rescan?onvif_ports=none" }, "", http.StatusOK},
+		{"GET", "/cameras/last", func() string { return "/cameras/last" }, "", http.StatusOK},
+		{"GET", "/probe", func() string { return "/probe?ip=127.0.0.1&onvif_ports=none&ports=" + strconv.Itoa(port) }, "", http.StatusOK},
+		{"POST", "/scans", func() string { return "/scans?" + localScan(port) }, "", http.StatusAccepted},
+		{"GET", "/scans/{id}", func() string { return "/scans/" + jobID }, "", http.StatusOK},
+		{"GET", "/scans/{id}", func() string { return "/scans/unknown" }, "", http.StatusNotFound},
+		{"GET", "/scans", func() string { return "/scans" }, "", http.StatusOK},
+		{"GET", "/scans/checkpoints", func() string { return "/scans/checkpoints" }, "", http.StatusOK},
+		{"GET", "/schedules", func() string { return "/schedules" }, "", http.StatusOK},
+		{"POST", "/ignored", func() string { return "/ignored" }, `{"ip":"10.0.0.9","reason":"printer"}`, http.StatusCreated},
+		{"POST", "/ignored", func() string { return "/ignored" }, `{"ip":"10.0.0.9"}`, http.StatusOK},
+		{"GET", "/ignored", func() string { return "/ignored" }, "", http.StatusOK},
+		{"GET", "/announced", func() string { return "/announced" }, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+apiPrefix+tt.path(), strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		name := tt.method + " " + tt.pattern
+		if resp.StatusCode != tt.status {
+			t.Fatalf("%s: status %d, want %d: %s", name, resp.StatusCode, tt.status, data)
+		}
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		switch tt.pattern {
+		case "/cameras":
+			if obj, _ := v.(map[string]interface{}); tt.method == "POST" {
+				cameraID, _ = obj["id"].(string)
+			}
+		case "/scans":
+			if obj, _ := v.(map[string]interface{}); tt.method == "POST" {
+				jobID, _ = obj["id"].(string)
+				waitForJob(t, srv.URL+apiPrefix+"/scans/"+jobID)
+			}
+		}
+		schema, err := c.response(tt.method, apiPrefix+tt.pattern, resp.StatusCode)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if err := c.check("response", v, schema); err != nil {
+			t.Errorf("%s %d: %v in %s", name, resp.StatusCode, err, data)
+		}
+	}
+}
+
+// waitForJob waits until the job at url is no longer running.
+func waitForJob(t *testing.T, url string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if getJob(t, url).Status != jobRunning {
+			return
+		}
+	}
+	t.Fatal("job still running")
+}
+
+func TestOpenAPIChecker(t *testing.T) {
+	c := &openAPIChecker{doc: map[string]interface{}{"components": map[string]interface{}{"schemas": map[string]interface{}{
+		"Item": map[string]interface{}{"type": "object", "required": []interface{}{"id"}, "properties": map[string]interface{}{
+			"id":   map[string]interface{}{"type": "integer"},
+			"seen": map[string]interface{}{"type": "string", "format": "date-time"},
+		}},
+	}}}}
+	schema := map[string]interface{}{"type": "array", "items": map[string]interface{}{"$ref": "#/components/schemas/Item"}}
+	tests := []struct {
+		json string
+		ok   bool
+	}{
+		{`[{"id":1,"seen":"2024-03-01T12:00:00Z"}]`, true},
+		{`null`, true},
+		{`[{"seen":"2024-03-01T12:00:00Z"}]`, false},
+		{`[{"id":1.5}]`, false},
+		{`[{"id":1,"seen":"yesterday"}]`, false},
+		{`[{"id":1,"extra":true}]`, false},
+		{`{"id":1}`, false},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		json.Unmarshal([]byte(tt.json), &v)
+		if err := c.check("response", v, schema); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.json, err)
+		}
+	}
+}
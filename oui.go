@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+)
+
+//go:embed oui.txt
+var embeddedOUI string
+
+type ouiTable map[string]string
+
+var vendors = mustParseOUI(embeddedOUI)
+
+func mustParseOUI(s string) ouiTable {
+	table, err := parseOUI(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+func normalizeOUI(prefix string) string {
+	prefix = strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(prefix))
+	if len(prefix) < 6 {
+		return ""
+	}
+	return prefix[:6]
+}
+
+func parseOUI(r io.Reader) (ouiTable, error) {
+	table := make(ouiTable)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 || strings.Contains(line[:i], "/") {
+			continue
+		}
+		vendor, _, _ := strings.Cut(strings.TrimSpace(line[i:]), "\t")
+		if prefix := normalizeOUI(line[:i]); prefix != "" {
+			table[prefix] = strings.TrimSpace(vendor)
+		}
+	}
+	return table, scanner.Err()
+}
+
+func loadOUIFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	table, err := parseOUI(f)
+	if err != nil {
+		return 0, err
+	}
+	for prefix, vendor := range table {
+		vendors[prefix] = vendor
+	}
+	return len(table), nil
+}
+
+func (t ouiTable) vendor(mac string) string {
+	return t[normalizeOUI(mac)]
+}
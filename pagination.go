@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is the part of a listing a request asked for with the limit and
+// offset query parameters.
+type page struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextOffset is the offset of the next page, null on the last one.
+	NextOffset *int `json:"next_offset"`
+}
+
+func parsePage(query url.Values) (page, error) {
+	p := page{Limit: defaultPageLimit}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return p, fmt.Errorf("invalid limit %q: must be between 1 and %d", v, maxPageLimit)
+		}
+		p.Limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid offset %q: must be a non-negative integer", v)
+		}
+		p.Offset = n
+	}
+	return p, nil
+}
+
+// paginate returns the items of page p, which then knows the total and
+// the next offset. An offset past the end gives an empty page.
+func paginate[T any](items []T, p *page) []T {
+	p.Total = len(items)
+	if p.Offset >= len(items) {
+		return []T{}
+	}
+	end := p.Offset + p.Limit
+	if end < len(items) {
+		p.NextOffset = &end
+	} else {
+		end = len(items)
+	}
+	return items[p.Offset:end]
+}
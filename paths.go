@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"find_cameras/scanner"
+	"sync"
+	"time"
+)
+
+const (
+	pathProbeConcurrency = 4
+	pathProbeTimeout     = 5 * time.Second
+)
+
+var commonStreamPaths = []string{
+	"/Streaming/Channels/101",
+	"/Streaming/Channels/102",
+	"/cam/realmonitor?channel=1&subtype=0",
+	"/cam/realmonitor?channel=1&subtype=1",
+	"/axis-media/media.amp",
+	"/h264Preview_01_main",
+	"/h264Preview_01_sub",
+	"/stream1",
+	"/stream2",
+	"/live/ch0",
+	"/live/ch00_0",
+	"/live/main",
+	"/live",
+	"/onvif1",
+	"/11",
+	"/12",
+	"/media/video1",
+	"/videoMain",
+	"/",
+}
+
+type streamPath struct {
+	Path         string `json:"path"`
+	StatusCode   int    `json:"status"`
+	AuthRequired bool   `json:"auth_required"`
+}
+
+func probeStreamPaths(ctx context.Context, ip string, port int, secure bool) []streamPath {
+	results := make([]*streamPath, len(commonStreamPaths))
+	sem := make(chan struct{}, pathProbeConcurrency)
+	var wg sync.WaitGroup
+
+	for i, path := range commonStreamPaths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			code, err := describe(ctx, ip, port, path, secure)
+			if err != nil {
+				return
+			}
+			if code == 200 || code == 401 {
+				results[i] = &streamPath{Path: path, StatusCode: code, AuthRequired: code == 401}
+			}
+		}(i, path)
+	}
+	wg.Wait()
+
+	var paths []streamPath
+	for _, p := range results {
+		if p != nil {
+			paths = append(paths, *p)
+		}
+	}
+	return paths
+}
+
+func describe(ctx context.Context, ip string, port int, path string, secure bool) (int, error) {
+	conn, err := dialRTSP(ctx, ip, port, scanner.DefaultDialTimeout, secure)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer scanner.AbandonOnCancel(ctx, conn)()
+
+	rc := scanner.NewConn(conn)
+	rc.Deadline, _ = ctx.Deadline()
+	rawURL := scanner.URL(ip, port, path)
+	if secure {
+		rawURL = scanner.SecureURL(ip, port, path)
+	}
+	resp, err := rc.Do("DESCRIBE", rawURL, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+func probeDevicePaths(ctx context.Context, devices []device) {
+	ctx, cancel := context.WithTimeout(ctx, pathProbeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			port := defaultRTSPPort
+			if len(d.Ports) > 0 {
+				port = d.Ports[0]
+			}
+			d.Paths = probeStreamPaths(ctx, d.IP, port, containsInt(d.RTSPSPorts, port))
+		}(&devices[i])
+	}
+	wg.Wait()
+}
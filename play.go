@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"find_cameras/scanner"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	verifyPlay = "play"
+
+	// playTimeout bounds the whole handshake of a single stream.
+	playTimeout = 2 * time.Second
+	// playDataTimeout is how long the first packet is waited for after
+	// PLAY, leaving time for the TEARDOWN.
+	playDataTimeout = time.Second
+
+	playStageConnect  = "connect"
+	playStageDescribe = "describe"
+	playStageSetup    = "setup"
+	playStagePlay     = "play"
+	playStageData     = "data"
+)
+
+// playVerifyLimit is the number of cameras whose streams are played by a
+// single scan with verify=play.
+var playVerifyLimit = 10
+
+// playbackCheck is the result of playing a stream: whether the camera sent
+// media after PLAY, or the stage of the handshake that failed.
+type playbackCheck struct {
+	URL         string `json:"url"`
+	Playable    bool   `json:"playable"`
+	FailedStage string `json:"failed_stage,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// verifyDevicesPlayback plays every RTSP URL of the first playVerifyLimit
+// cameras with RTSP URLs. The streams of a camera are played one after the
+// other, as cameras often only serve a few sessions at a time.
+func verifyDevicesPlayback(ctx context.Context, devices []device, opts scanOptions) {
+	if !opts.VerifyPlay {
+		return
+	}
+	var wg sync.WaitGroup
+	verified := 0
+	for i := range devices {
+		if len(devices[i].RTSPURLs) == 0 {
+			continue
+		}
+		if verified == playVerifyLimit {
+			loggerFrom(ctx).Info("Not verifying the playback of more cameras", "limit", playVerifyLimit)
+			break
+		}
+		verified++
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			playable := false
+			d.Playback = make([]playbackCheck, len(d.RTSPURLs))
+			for j, rawURL := range d.RTSPURLs {
+				d.Playback[j] = checkPlayback(ctx, rawURL, d.rtspCredential, opts.DialTimeout)
+				playable = playable || d.Playback[j].Playable
+			}
+			d.Playable = &playable
+		}(&devices[i])
+	}
+	wg.Wait()
+}
+
+// checkPlayback runs DESCRIBE, SETUP with RTP interleaved over the RTSP
+// connection, so no firewall has to let UDP through, and PLAY, then waits
+// for the first packet. Closing the connection ends the session if the
+// TEARDOWN doesn't make it in time.
+func checkPlayback(ctx context.Context, rawURL string, cred *credential, dialTimeout time.Duration) playbackCheck {
+	check := playbackCheck{URL: rawURL}
+	fail := func(stage string, err error) playbackCheck {
+		check.FailedStage, check.Error = stage, err.Error()
+		return check
+	}
+	ctx, cancel := context.WithTimeout(ctx, playTimeout)
+	defer cancel()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fail(playStageConnect, err)
+	}
+	port, secure := rtspURLPort(u.Scheme, u.Port())
+	conn, err := dialRTSP(ctx, u.Hostname(), port, dialTimeout, secure)
+	if err != nil {
+		return fail(playStageConnect, err)
+	}
+	defer conn.Close()
+	defer scanner.AbandonOnCancel(ctx, conn)()
+
+	s := &playSession{conn: scanner.NewConn(conn), cred: cred}
+	s.conn.Deadline, _ = ctx.Deadline()
+	resp, err := s.do("DESCRIBE", rawURL, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return fail(playStageDescribe, err)
+	}
+	base := rawURL
+	if cb := resp.Header.Get("Content-Base"); cb != "" {
+		base = cb
+	}
+
+	resp, err = s.do("SETUP", mediaControl(string(resp.Body), base), map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"})
+	if err != nil {
+		return fail(playStageSetup, err)
+	}
+	session, _, _ := strings.Cut(resp.Header.Get("Session"), ";")
+	if session = strings.TrimSpace(session); session == "" {
+		return fail(playStageSetup, errors.New("SETUP answered without a session"))
+	}
+	defer s.do("TEARDOWN", base, map[string]string{"Session": session})
+
+	if _, err := s.do("PLAY", base, map[string]string{"Session": session, "Range": "npt=0.000-"}); err != nil {
+		return fail(playStagePlay, err)
+	}
+	deadline := s.conn.Deadline
+	if s.conn.Deadline = time.Now().Add(playDataTimeout); deadline.Before(s.conn.Deadline) {
+		s.conn.Deadline = deadline
+	}
+	_, _, err = s.conn.ReadInterleaved()
+	s.conn.Deadline = deadline
+	if err != nil {
+		return fail(playStageData, err)
+	}
+	check.Playable = true
+	return check
+}
+
+// playSession sends the requests of a playback check, answering the
+// authentication challenge of the camera with cred.
+type playSession struct {
+	conn       *scanner.Conn
+	cred       *credential
+	challenges []string
+}
+
+func (s *playSession) do(method, rawURL string, headers map[string]string) (*scanner.Response, error) {
+	if s.challenges != nil {
+		authorization, err := challengeAuthorization(s.challenges, *s.cred, method, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		headers["Authorization"] = authorization
+	}
+	resp, err := s.conn.Do(method, rawURL, headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 401 && s.cred != nil && s.challenges == nil {
+		s.challenges = resp.Header.Values("WWW-Authenticate")
+		return s.do(method, rawURL, headers)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s answered %d", method, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// mediaControl returns the URL of the first video stream of an SDP session
+// description, or else of its first stream, resolved against base.
+func mediaControl(sdp, base string) string {
+	type stream struct {
+		video   bool
+		control string
+	}
+	var streams []stream
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			streams = append(streams, stream{video: strings.HasPrefix(line, "m=video")})
+		case len(streams) > 0 && strings.HasPrefix(line, "a=control:"):
+			streams[len(streams)-1].control = strings.TrimPrefix(line, "a=control:")
+		}
+	}
+	var control string
+	if len(streams) > 0 {
+		control = streams[0].control
+	}
+	for _, st := range streams {
+		if st.video {
+			control = st.control
+			break
+		}
+	}
+
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://"):
+		return control
+	default:
+		return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(control, "/")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+const (
+	prefilterARP  = "arp"
+	prefilterICMP = "icmp"
+	prefilterNone = "none"
+)
+
+var icmpUnavailableLog sync.Once
+
+func validPrefilter(prefilter string) bool {
+	switch prefilter {
+	case prefilterARP, prefilterICMP, prefilterNone:
+		return true
+	}
+	return false
+}
+
+func prefilterCandidates(ctx context.Context, prefilter string, network *net.IPNet, ips []string) ([]string, string) {
+	var candidates []string
+	var err error
+	switch prefilter {
+	case prefilterARP:
+		candidates, err = arpCandidates(ctx, ips)
+		if err != nil {
+			loggerFrom(ctx).Warn("ARP pre-filter unavailable, scanning all addresses", "network", network.String(), "err", err)
+			return ips, prefilterNone
+		}
+	case prefilterICMP:
+		candidates, err = icmpCandidates(ctx, ips)
+		if err != nil {
+			icmpUnavailableLog.Do(func() {
+				loggerFrom(ctx).Warn("ICMP pre-filter unavailable, scanning all addresses", "err", err)
+			})
+			return ips, prefilterNone
+		}
+	default:
+		return ips, prefilterNone
+	}
+
+	loggerFrom(ctx).Info("Pre-filtered network", "prefilter", prefilter, "network", network.String(), "hosts", len(ips), "candidates", len(candidates))
+	return candidates, prefilter
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"find_cameras/discovery"
+	"find_cameras/onvif"
+	"find_cameras/scanner"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sourceONVIF = "onvif"
+
+	probeCameraDeadline = 5 * time.Second
+)
+
+type probeNotFound struct {
+	apiError
+	IP     string          `json:"ip"`
+	Reason scanner.Outcome `json:"reason"`
+	Detail string          `json:"detail,omitempty"`
+}
+
+func parseUnicastIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", s)
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return nil, fmt.Errorf("invalid ip %q: not a unicast address", s)
+	}
+	return ip, nil
+}
+
+// isONVIF reports whether the error of a Services call still shows an ONVIF
+// device service, one that wants other credentials or refuses the request.
+func isONVIF(err error) bool {
+	var fault *onvif.Fault
+	return err == nil || errors.Is(err, onvif.ErrUnauthorized) || errors.As(err, &fault)
+}
+
+// probeCamera runs the RTSP check and ONVIF enrichment against a single
+// address and records the camera found.
+func probeCamera(ctx context.Context, ip string, opts scanOptions) (*device, scanner.Result) {
+	devices, result := probeDevices(ctx, ip, opts)
+	if len(devices) == 0 {
+		return nil, result
+	}
+	recordScan(devices, time.Now(), nil, false)
+	return &devices[0], result
+}
+
+// probeDevices probes a single address, returning the devices found sorted.
+// The ONVIF device service is looked up at its well-known path.
+func probeDevices(ctx context.Context, ip string, opts scanOptions) ([]device, scanner.Result) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Deadline)
+	defer cancel()
+
+	xaddr := fmt.Sprintf("http://%s/onvif/device_service", net.JoinHostPort(ip, "80"))
+	client := newONVIFClient(xaddr, enrichOptions{Username: opts.Username, Password: opts.Password})
+
+	var result scanner.Result
+	var services map[string]onvif.Service
+	var servicesErr error
+	var matches []discovery.Match
+	var wg sync.WaitGroup
+	if opts.Unicast {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			matches = scanUnicastWSDiscovery(ctx, []string{ip}, opts, nil)
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result = scanner.New(scannerOptions(ctx, opts)).Probe(ctx, ip)
+	}()
+	go func() {
+		defer wg.Done()
+		capCtx, cancel := context.WithTimeout(ctx, capabilitiesTimeout)
+		defer cancel()
+		services, servicesErr = client.Services(capCtx)
+	}()
+	wg.Wait()
+
+	set := newDeviceSet()
+	if result.Outcome == scanner.OutcomeRTSP {
+		set.addRTSP([]scanner.Result{result})
+	}
+	if isONVIF(servicesErr) {
+		d := set.get(ip, sourceONVIF)
+		d.XAddrs = []string{xaddr}
+		enrichServices(ctx, d, client, services, servicesErr)
+	}
+	if len(matches) > 0 {
+		set.addMatches(matches, sourceWSDiscoveryUnicast)
+		if !isONVIF(servicesErr) {
+			// The device service isn't at its well-known path.
+			d := set.get(ip, sourceWSDiscoveryUnicast)
+			if xaddr := deviceServiceURL(d); xaddr != "" {
+				enrichDevice(ctx, d, newONVIFClient(xaddr, enrichOptions{Username: opts.Username, Password: opts.Password}))
+			}
+		}
+	}
+	if len(set.devices) == 0 {
+		return nil, result
+	}
+
+	if entries, err := neighbors.Neighbors(); err == nil {
+		set.addNeighbors(entries)
+	}
+	set.addLeases(loadLeases(ctx))
+	resolveHostnames(ctx, set.devices)
+	fingerprintDevices(ctx, set.devices)
+	if opts.ProbePaths {
+		probeDevicePaths(ctx, set.devices)
+	}
+	checkDevicesAuth(ctx, set.devices, opts)
+	addRTSPURLs(set.devices)
+	verifyDevicesPlayback(ctx, set.devices, opts)
+	sortDevices(set.devices)
+	return set.devices, result
+}
+
+func handleProbeCamera(w http.ResponseWriter, r *http.Request) {
+	opts, err := probeOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	ip, err := parseUnicastIP(r.URL.Query().Get("ip"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if opts.Exclude.contains(ip.String()) {
+		writeError(w, http.StatusBadRequest, codeExcluded, fmt.Sprintf("ip %s is excluded from probing", ip))
+		return
+	}
+
+	d, result := probeCamera(r.Context(), ip.String(), opts)
+	if d == nil && isShuttingDown() {
+		writeShuttingDown(w)
+		return
+	}
+	if d == nil && requestTimedOut(r) {
+		writeRequestTimeout(w)
+		return
+	}
+	if d == nil {
+		notFound := probeNotFound{apiError: apiError{Code: codeCameraNotFound, Message: "no camera found", RequestID: requestID(r.Context())}, IP: ip.String(), Reason: result.Outcome}
+		if result.Err != nil {
+			notFound.Detail = result.Err.Error()
+		}
+		writeJSON(w, http.StatusNotFound, struct {
+			Error probeNotFound `json:"error"`
+		}{notFound})
+		return
+	}
+	if opts.EmbedCredentials {
+		writeJSON(w, http.StatusOK, embedCredentials([]device{*d})[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
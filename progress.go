@@ -0,0 +1,138 @@
+package main
+
+import (
+	"find_cameras/scanner"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanProgress tracks a running scan. The counters are updated by the worker
+// pool without locking; the mutex only guards the cameras found so far, so
+// they can be reported before the scan completes.
+type scanProgress struct {
+	// id identifies the scan in the history, a random one is assigned when
+	// it is empty.
+	id         string
+	started    time.Time
+	candidates int64
+	probed     int64
+	found      int64
+
+	// onFound is called from the worker pool for every camera found. It must
+	// be set before the scan starts.
+	onFound func(scanner.Result)
+	// onEnriched is called from the enrichment workers for every device
+	// enriched. It must be set before the scan starts.
+	onEnriched func(device)
+	// checkpointing records the probed addresses for the checkpoints.
+	checkpointing bool
+	// done holds the addresses probed before the scan was resumed, skipped
+	// counts them.
+	done    map[string]bool
+	skipped int64
+
+	mu       sync.Mutex
+	results  []scanner.Result
+	enriched []device
+	resumed  []device
+	// addresses are the probed addresses of a checkpointed scan.
+	addresses []string
+}
+
+type progressReport struct {
+	Candidates  int64 `json:"candidates"`
+	Probed      int64 `json:"probed"`
+	Found       int64 `json:"found"`
+	ElapsedMS   int64 `json:"elapsed_ms"`
+	RemainingMS int64 `json:"remaining_ms,omitempty"`
+}
+
+func newScanProgress() *scanProgress {
+	return &scanProgress{started: time.Now()}
+}
+
+func (p *scanProgress) addCandidates(n int) {
+	atomic.AddInt64(&p.candidates, int64(n))
+}
+
+func (p *scanProgress) addProbed() {
+	atomic.AddInt64(&p.probed, 1)
+}
+
+// resume starts the progress of a resumed scan with the addresses probed and
+// the cameras found before.
+func (p *scanProgress) resume(probed []string, devices []device) {
+	p.done = make(map[string]bool, len(probed))
+	for _, ip := range probed {
+		p.done[ip] = true
+	}
+	p.addresses = probed
+	p.resumed = devices
+	p.skipped = int64(len(probed))
+	p.candidates, p.probed, p.found = p.skipped, p.skipped, int64(len(devices))
+}
+
+// addAddress records a probed address of a checkpointed scan.
+func (p *scanProgress) addAddress(ip string) {
+	if !p.checkpointing {
+		return
+	}
+	p.mu.Lock()
+	p.addresses = append(p.addresses, ip)
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) probedIPs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.addresses...)
+}
+
+func (p *scanProgress) addFound(result scanner.Result) {
+	atomic.AddInt64(&p.found, 1)
+	p.mu.Lock()
+	p.results = append(p.results, result)
+	p.mu.Unlock()
+	if p.onFound != nil {
+		p.onFound(result)
+	}
+}
+
+func (p *scanProgress) addEnriched(d device) {
+	p.mu.Lock()
+	p.enriched = append(p.enriched, d)
+	p.mu.Unlock()
+	if p.onEnriched != nil {
+		p.onEnriched(d)
+	}
+}
+
+// devices returns the cameras found so far, with the ONVIF details of those
+// enriched already.
+func (p *scanProgress) devices() []device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set := newDeviceSet()
+	set.addResumed(p.resumed)
+	set.addRTSP(p.results)
+	set.addEnriched(p.enriched)
+	return set.devices
+}
+
+// report returns the counters and an estimate of the remaining time based on
+// the probing rate so far.
+func (p *scanProgress) report() progressReport {
+	elapsed := time.Since(p.started)
+	r := progressReport{
+		Candidates: atomic.LoadInt64(&p.candidates),
+		Probed:     atomic.LoadInt64(&p.probed),
+		Found:      atomic.LoadInt64(&p.found),
+		ElapsedMS:  elapsed.Milliseconds(),
+	}
+	// The addresses probed before a resume don't count towards the rate.
+	if probed := r.Probed - p.skipped; probed > 0 && r.Candidates > r.Probed {
+		r.RemainingMS = (elapsed * time.Duration(r.Candidates-r.Probed) / time.Duration(probed)).Milliseconds()
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to burst tokens and gains one every interval.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the scans started, globally or per client address.
+type rateLimiter struct {
+	interval  time.Duration
+	burst     int
+	perClient bool
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// scanLimiter is nil when scans are not rate limited.
+var scanLimiter *rateLimiter
+
+// maxRateBuckets bounds the buckets kept for per-client limiting; full buckets
+// are dropped first as they are identical to a new one.
+const maxRateBuckets = 4096
+
+func newRateLimiter(interval time.Duration, burst int, perClient bool) *rateLimiter {
+	if interval <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: interval, burst: burst, perClient: perClient, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token of the bucket of client, or returns how long to wait
+// until the next one.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	if !l.perClient {
+		client = ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = b
+	}
+	b.refill(now, l.interval, l.burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(l.interval))
+}
+
+func (b *tokenBucket) refill(now time.Time, interval time.Duration, burst int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+float64(elapsed)/float64(interval))
+		b.last = now
+	}
+}
+
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.refill(now, l.interval, l.burst); b.tokens >= float64(l.burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// allowScan writes a 429 response and returns false when the client may not
+// start another scan yet.
+func allowScan(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := scanLimiter.allow(clientAddr(r), time.Now())
+	if ok {
+		return true
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("too many scans started, retry in %ds", seconds))
+	return false
+}
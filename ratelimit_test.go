@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	type attempt struct {
+		client string
+		at     time.Duration
+		ok     bool
+		wait   time.Duration
+	}
+	tests := []struct {
+		name      string
+		perClient bool
+		attempts  []attempt
+	}{
+		{"burst then limited", false, []attempt{
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+			{"a", 0, false, 10 * time.Second},
+			{"a", 4 * time.Second, false, 6 * time.Second},
+		}},
+		{"refill", false, []attempt{
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+			{"a", 10 * time.Second, true, 0},
+			{"a", 10 * time.Second, false, 10 * time.Second},
+			{"a", 15 * time.Second, false, 5 * time.Second},
+		}},
+		{"refill capped at burst", false, []attempt{
+			{"a", 0, true, 0},
+			{"a", time.Hour, true, 0},
+			{"a", time.Hour, true, 0},
+			{"a", time.Hour, false, 10 * time.Second},
+		}},
+		{"global", false, []attempt{
+			{"a", 0, true, 0},
+			{"b", 0, true, 0},
+			{"c", 0, false, 10 * time.Second},
+		}},
+		{"per client", true, []attempt{
+			{"a", 0, true, 0},
+			{"a", 0, true, 0},
+			{"a", 0, false, 10 * time.Second},
+			{"b", 0, true, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(10*time.Second, 2, tt.perClient)
+			for i, a := range tt.attempts {
+				ok, wait := l.allow(a.client, start.Add(a.at))
+				if ok != a.ok || wait != a.wait {
+					t.Errorf("attempt %d of %s at %v: allowed %v, wait %v, want %v and %v", i+1, a.client, a.at, ok, wait, a.ok, a.wait)
+				}
+			}
+		})
+	}
+
+	disabled := newRateLimiter(0, 2, false)
+	for i := 0; i < 5; i++ {
+		if ok, _ := disabled.allow("a", start); !ok {
+			t.Fatal("disabled limiter refused a scan")
+		}
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	l := newRateLimiter(time.Hour, 5, false)
+	now := time.Now()
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.allow("a", now); ok {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 {
+		t.Errorf("%d scans allowed, want 5", allowed)
+	}
+}
+
+// TestRateLimitedEndpoints checks that only the requests starting a scan are
+// limited.
+func TestRateLimitedEndpoints(t *testing.T) {
+	withStore(t)
+	withCache(t, time.Minute)
+	var probes int64
+	withProber(t, countingProber(&probes, 0))
+	limiter := scanLimiter
+	scanLimiter = newRateLimiter(time.Hour, 1, false)
+	t.Cleanup(func() { scanLimiter = limiter })
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{apiPrefix + "/scan?" + cachedScan, http.StatusOK},
+		{apiPrefix + "/scan?" + cachedScan + "&refresh=true", http.StatusTooManyRequests},
+		{apiPrefix + "/scan?" + cachedScan, http.StatusOK},
+		{apiPrefix + "/cameras/", http.StatusOK},
+		{"/healthz", http.StatusOK},
+		{"/metrics", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusTooManyRequests {
+			var body errorResponse
+			json.NewDecoder(resp.Body).Decode(&body)
+			if body.Error.Code != codeRateLimited || resp.Header.Get("Retry-After") != "3600" {
+				t.Errorf("%s: code %q, Retry-After %q", tt.path, body.Error.Code, resp.Header.Get("Retry-After"))
+			}
+		}
+		resp.Body.Close()
+	}
+	if probes != 1 {
+		t.Errorf("%d probes, want 1", probes)
+	}
+}
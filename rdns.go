@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reverseLookupTimeout     = 250 * time.Millisecond
+	reverseLookupBudget      = time.Second
+	reverseLookupConcurrency = 32
+)
+
+func resolveHostnames(ctx context.Context, devices []device) {
+	ctx, cancel := context.WithTimeout(ctx, reverseLookupBudget)
+	defer cancel()
+
+	sem := make(chan struct{}, reverseLookupConcurrency)
+	var wg sync.WaitGroup
+	for i := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			d.Hostname = lookupHostname(ctx, d.IP)
+		}(&devices[i])
+	}
+	wg.Wait()
+}
+
+func lookupHostname(ctx context.Context, ip string) string {
+	ctx, cancel := context.WithTimeout(ctx, reverseLookupTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+const (
+	panicHandler = "handler"
+	panicProbe   = "probe"
+)
+
+// withRecovery turns a panic of a handler into a 500 response, so a single
+// bad request doesn't take the service down. It wraps the handler inside all
+// other middleware, so the error response is compressed and logged with the
+// request ID like any other.
+func withRecovery(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Aborting a response is what this panic is meant for.
+				panic(v)
+			}
+			panicsTotal.inc(panicHandler)
+			loggerFrom(r.Context()).Error("Handler panicked", "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+			if rec.statusCode != 0 {
+				// The response has started, all that's left is ending it.
+				return
+			}
+			writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+		}()
+		h(rec, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"find_cameras/scanner"
+)
+
+func panics(where string) uint64 { return atomic.LoadUint64(panicsTotal.counts[where]) }
+
+func TestHandlerPanic(t *testing.T) {
+	records := captureLogs(t)
+	rt := &router{}
+	rt.handle("/panic", routePublic, map[string]http.HandlerFunc{http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+		var networks map[string][]int
+		networks["10.0.0.0/24"] = append(networks["10.0.0.0/24"], 554)
+	}})
+	rt.handle("/started", routePublic, map[string]http.HandlerFunc{http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		panic("broken after the status")
+	}})
+	rt.handle("/abort", routePublic, map[string]http.HandlerFunc{http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}})
+	rt.handle("/ok", routePublic, map[string]http.HandlerFunc{http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}})
+	rt.notFound = rt.chain("/", routePublic, handleNotFound)
+	srv := httptest.NewServer(rt)
+	defer srv.Close()
+
+	before := panics(panicHandler)
+	resp, body := doRequest(t, srv, http.MethodGet, "/panic")
+	var e errorResponse
+	json.Unmarshal([]byte(body), &e)
+	if resp.StatusCode != http.StatusInternalServerError || e.Error.Code != codeInternal || e.Error.RequestID != "test-request" {
+		t.Errorf("GET /panic: %d %s", resp.StatusCode, body)
+	}
+	logged := records.find("Handler panicked")
+	if len(logged) != 1 || logged[0]["request_id"] != "test-request" || logged[0]["stack"] == "" {
+		t.Errorf("log records = %v", logged)
+	}
+
+	if resp, body := doRequest(t, srv, http.MethodGet, "/started"); resp.StatusCode != http.StatusOK || body != "partial" {
+		t.Errorf("GET /started: %d %q", resp.StatusCode, body)
+	}
+	if resp, err := http.Get(srv.URL + "/abort"); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET /abort: %d, want the connection closed", resp.StatusCode)
+	}
+	if got := panics(panicHandler); got != before+2 {
+		t.Errorf("%d handler panics counted, want 2", got-before)
+	}
+	if resp, _ := doRequest(t, srv, http.MethodGet, "/ok"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /ok after the panics: %d", resp.StatusCode)
+	}
+}
+
+func TestProberPanic(t *testing.T) {
+	withStore(t)
+	records := captureLogs(t)
+	withProber(t, func(context.Context, string, int) scanner.Result { panic("broken prober") })
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	before := panics(panicProbe)
+	resp, body := doRequest(t, srv, http.MethodGet, apiPrefix+"/scan?"+localScan(554))
+	var result struct {
+		Found   int               `json:"found"`
+		Devices []json.RawMessage `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil || resp.StatusCode != http.StatusOK || result.Found != 0 {
+		t.Errorf("scan: %d %s", resp.StatusCode, body)
+	}
+	if got := panics(panicProbe); got == before {
+		t.Error("probe panic not counted")
+	}
+	if logged := records.find("Probe panicked"); len(logged) == 0 || logged[0]["ip"] != "127.0.0.1" || logged[0]["request_id"] != "test-request" {
+		t.Errorf("log records = %v", logged)
+	}
+	if resp, _ := doRequest(t, srv, http.MethodGet, "/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz after the panics: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cameraRecord is a camera of the registry: the latest data of the camera
+// together with when it was first and last seen.
+type cameraRecord struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Status tells whether the camera was found by the latest scan of its
+	// network, set in listings.
+	Status string `json:"status,omitempty"`
+	// Ignored is set in listings including the ignored devices.
+	Ignored bool `json:"ignored,omitempty"`
+	// Metadata is the name and the labels operators set on the camera.
+	Metadata *cameraMetadata `json:"metadata,omitempty"`
+	// Manual is set on cameras registered through the API.
+	Manual *manualEntry `json:"manual,omitempty"`
+	// UnreachableAt is when a probe of the camera alone, a rescan or the
+	// probe of a registered camera, last found it unreachable. It is cleared
+	// once the camera is found again.
+	UnreachableAt *time.Time `json:"unreachable_at,omitempty"`
+	device
+
+	missed  int
+	removed bool
+}
+
+const (
+	eventCameraAdded   = "camera_added"
+	eventCameraRemoved = "camera_removed"
+)
+
+// cameraEvent is a change of the registry caused by a scan.
+type cameraEvent struct {
+	Event  string       `json:"event"`
+	Time   time.Time    `json:"time"`
+	Device cameraRecord `json:"device"`
+}
+
+// registry remembers every camera found by any scan. Cameras are identified by
+// their MAC address when known, otherwise by their ONVIF endpoint reference,
+// otherwise by their IP, so a camera changing its IP keeps its record.
+type registry struct {
+	// removeAfter is the number of consecutive complete scans a camera must
+	// be missing from before it is reported as removed.
+	removeAfter int
+
+	mu      sync.Mutex
+	records map[string]*cameraRecord
+	index   map[string]*cameraRecord
+}
+
+func newRegistry() *registry {
+	return &registry{removeAfter: 3, records: make(map[string]*cameraRecord), index: make(map[string]*cameraRecord)}
+}
+
+var cameras = newRegistry()
+
+func identityKeys(d *device) []string {
+	var keys []string
+	if d.MAC != "" {
+		keys = append(keys, "mac:"+d.MAC)
+	}
+	if d.EndpointReference != "" {
+		keys = append(keys, "epr:"+d.EndpointReference)
+	}
+	return append(keys, "ip:"+d.IP)
+}
+
+// sameCamera reports whether r may describe d: identities known on both sides
+// must agree.
+func sameCamera(r *cameraRecord, d *device) bool {
+	if r.MAC != "" && d.MAC != "" && r.MAC != d.MAC {
+		return false
+	}
+	if r.EndpointReference != "" && d.EndpointReference != "" && r.EndpointReference != d.EndpointReference {
+		return false
+	}
+	return true
+}
+
+func (g *registry) find(d *device) *cameraRecord {
+	for _, key := range identityKeys(d) {
+		if r, ok := g.index[key]; ok && sameCamera(r, d) {
+			return r
+		}
+	}
+	return nil
+}
+
+// update records the devices found by a scan at seen and returns their
+// records and the cameras that appeared or disappeared. Only a complete scan
+// counts as missing the known cameras inside the scanned networks.
+func (g *registry) update(devices []device, seen time.Time, scanned []localNetwork, complete bool) ([]cameraRecord, []cameraEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var records []cameraRecord
+	var events []cameraEvent
+	found := make(map[*cameraRecord]bool, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		r := g.find(d)
+		if r == nil {
+			r = &cameraRecord{ID: identityKeys(d)[0], FirstSeen: seen, removed: true}
+			g.records[r.ID] = r
+		}
+		found[r] = true
+		g.setDevice(r, d, seen)
+		if r.removed {
+			r.removed = false
+			events = append(events, cameraEvent{Event: eventCameraAdded, Time: seen, Device: *r})
+		}
+		records = append(records, *r)
+	}
+
+	if !complete {
+		return records, events
+	}
+	for _, r := range g.records {
+		// Manual cameras are only removed through the API.
+		if found[r] || r.removed || r.Manual != nil || !inScannedNetworks(r.IP, scanned) {
+			continue
+		}
+		r.missed++
+		if r.missed >= g.removeAfter {
+			r.removed = true
+			events = append(events, cameraEvent{Event: eventCameraRemoved, Time: seen, Device: *r})
+		}
+	}
+	return records, events
+}
+
+// setDevice replaces the data of r with d, found at seen, and indexes r by
+// the identities of d.
+func (g *registry) setDevice(r *cameraRecord, d *device, seen time.Time) {
+	for _, key := range identityKeys(&r.device) {
+		if g.index[key] == r {
+			delete(g.index, key)
+		}
+	}
+	r.device = *d
+	if r.Manual != nil {
+		r.Sources = appendSource(r.Sources, sourceManual)
+	}
+	r.LastSeen = seen
+	r.missed = 0
+	r.UnreachableAt = nil
+	for _, key := range identityKeys(d) {
+		g.index[key] = r
+	}
+}
+
+// recordScan updates the registry with the devices found by a scan, publishes
+// the changes and returns the records of the devices.
+func recordScan(devices []device, seen time.Time, scanned []localNetwork, complete bool) []cameraRecord {
+	records, events := cameras.update(devices, seen, scanned, complete)
+	// Ignored devices are recorded, so they are recognized by their MAC
+	// after changing their IP, but never announced.
+	notified := filterSlice(records, func(r cameraRecord) bool { return !ignored.matches(&r.device, r.ID) })
+	events = filterSlice(events, func(e cameraEvent) bool { return !ignored.matches(&e.Device.device, e.Device.ID) })
+	webhooks.notify(events)
+	mqttPublisher.publish(notified, events)
+	state.changed()
+	return records
+}
+
+func inScannedNetworks(host string, scanned []localNetwork) bool {
+	host, _, _ = strings.Cut(host, "%")
+	ip := net.ParseIP(host)
+	for _, n := range scanned {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stored returns every record together with its removal state.
+func (g *registry) stored() []storedCamera {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	list := make([]storedCamera, 0, len(g.records))
+	for _, r := range g.records {
+		list = append(list, storedCamera{cameraRecord: *r, Missed: r.missed, Removed: r.removed})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// restore replaces the registry with stored records.
+func (g *registry) restore(stored []storedCamera) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.records = make(map[string]*cameraRecord, len(stored))
+	g.index = make(map[string]*cameraRecord, len(stored))
+	for _, c := range stored {
+		r := c.cameraRecord
+		r.missed, r.removed = c.Missed, c.Removed
+		g.records[r.ID] = &r
+		for _, key := range identityKeys(&r.device) {
+			g.index[key] = &r
+		}
+	}
+}
+
+// lookup returns the record d would update.
+func (g *registry) lookup(d *device) (cameraRecord, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r := g.find(d)
+	if r == nil {
+		return cameraRecord{}, false
+	}
+	return *r, true
+}
+
+// get returns the record with the given ID.
+func (g *registry) get(id string) (cameraRecord, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[id]
+	if !ok {
+		return cameraRecord{}, false
+	}
+	return *r, true
+}
+
+func (r *cameraRecord) status() string {
+	if r.removed || r.missed > 0 {
+		return statusOffline
+	}
+	return statusOnline
+}
+
+// list returns the cameras sorted by IP.
+func (g *registry) list() []cameraRecord {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	list := make([]cameraRecord, 0, len(g.records))
+	for _, r := range g.records {
+		c := *r
+		c.Status = r.status()
+		c.Ignored = ignored.matches(&r.device, r.ID)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if c := compareIPs(list[i].IP, list[j].IP); c != 0 {
+			return c < 0
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryIdentity(t *testing.T) {
+	const mac, epr = "00:11:22:33:44:55", "urn:uuid:4d454930-0000-1000-8000-001122334455"
+	type want struct {
+		id, ip            string
+		firstRun, lastRun int
+	}
+	tests := []struct {
+		name  string
+		scans [][]device
+		want  []want
+	}{
+		{
+			"mac keeps the record across an ip change",
+			[][]device{{{IP: "10.0.0.7", MAC: mac}}, {{IP: "10.0.0.9", MAC: mac}}},
+			[]want{{"mac:" + mac, "10.0.0.9", 0, 1}},
+		},
+		{
+			"endpoint reference without a mac",
+			[][]device{{{IP: "10.0.0.7", EndpointReference: epr}}, {{IP: "10.0.0.9", EndpointReference: epr}}},
+			[]want{{"epr:" + epr, "10.0.0.9", 0, 1}},
+		},
+		{
+			"mac preferred over the endpoint reference",
+			[][]device{{{IP: "10.0.0.7", MAC: mac, EndpointReference: epr}}, {{IP: "10.0.0.9", EndpointReference: epr}}},
+			[]want{{"mac:" + mac, "10.0.0.9", 0, 1}},
+		},
+		{
+			"ip alone",
+			[][]device{{{IP: "10.0.0.7"}}, {{IP: "10.0.0.7"}, {IP: "10.0.0.8"}}},
+			[]want{{"ip:10.0.0.7", "10.0.0.7", 0, 1}, {"ip:10.0.0.8", "10.0.0.8", 1, 1}},
+		},
+		{
+			"mac learned later",
+			[][]device{{{IP: "10.0.0.7"}}, {{IP: "10.0.0.7", MAC: mac}}, {{IP: "10.0.0.9", MAC: mac}}},
+			[]want{{"ip:10.0.0.7", "10.0.0.9", 0, 2}},
+		},
+		{
+			"another camera taking over the ip",
+			[][]device{{{IP: "10.0.0.7", MAC: mac}}, {{IP: "10.0.0.7", MAC: "66:77:88:99:aa:bb"}}},
+			[]want{{"mac:" + mac, "10.0.0.7", 0, 0}, {"mac:66:77:88:99:aa:bb", "10.0.0.7", 1, 1}},
+		},
+	}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		g := newRegistry()
+		for i, devices := range tt.scans {
+			g.update(devices, start.Add(time.Duration(i)*time.Minute), nil, false)
+		}
+		list := g.list()
+		if len(list) != len(tt.want) {
+			t.Errorf("%s: %d records, want %d: %+v", tt.name, len(list), len(tt.want), list)
+			continue
+		}
+		for _, w := range tt.want {
+			r, ok := g.get(w.id)
+			firstSeen := start.Add(time.Duration(w.firstRun) * time.Minute)
+			last := start.Add(time.Duration(w.lastRun) * time.Minute)
+			if !ok || r.IP != w.ip || !r.FirstSeen.Equal(firstSeen) || !r.LastSeen.Equal(last) {
+				t.Errorf("%s: record %s = %+v, want ip %s first seen %s, last seen %s", tt.name, w.id, r, w.ip, firstSeen, last)
+			}
+		}
+	}
+}
+
+func TestRegistryConcurrentScans(t *testing.T) {
+	g := newRegistry()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for scan := 0; scan < 8; scan++ {
+		wg.Add(1)
+		go func(scan int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// The scans overlap, and each moves the cameras to other IPs.
+				var devices []device
+				for c := 0; c < 10; c++ {
+					devices = append(devices, device{IP: fmt.Sprintf("10.0.%d.%d", scan, c), MAC: fmt.Sprintf("00:11:22:33:44:%02x", c)})
+				}
+				g.update(devices, start.Add(time.Duration(i)*time.Second), nil, true)
+				g.list()
+				g.stored()
+				g.lookup(&devices[0])
+			}
+		}(scan)
+	}
+	wg.Wait()
+
+	list := g.list()
+	if len(list) != 10 {
+		t.Fatalf("%d records, want 10", len(list))
+	}
+	for _, r := range list {
+		if !r.FirstSeen.Equal(start) || r.LastSeen.Before(r.FirstSeen) || r.ID != "mac:"+r.MAC {
+			t.Errorf("record %+v", r)
+		}
+	}
+}
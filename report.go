@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	reportQueueSize   = 16
+	reportBackoff     = time.Second
+	reportMaxBackoff  = time.Minute
+	reportCallTimeout = 30 * time.Second
+	// reportHistory is the number of deliveries of every sink kept for
+	// /debug/deliveries.
+	reportHistory = 20
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryRetried   = "retried"
+	deliveryFailed    = "failed"
+	deliveryDropped   = "dropped"
+)
+
+var (
+	// instanceID tells the reports of several finders apart, together with
+	// the site.
+	instanceID     string
+	reportAttempts = 5
+)
+
+var reportHTTPClient = &http.Client{Timeout: reportCallTimeout}
+
+// reportPayload is the body posted to the report sinks: the result of a scan
+// like GET /scans/{id} returns it, with the finder it comes from.
+type reportPayload struct {
+	InstanceID string `json:"instance_id"`
+	Site       string `json:"site,omitempty"`
+	ScanID     string `json:"scan_id"`
+	scanResponse
+}
+
+// reportSink posts the results of the completed scans to one URL. Results
+// are queued so a slow or dead backend never blocks a scan; they are dropped
+// when the queue is full.
+type reportSink struct {
+	url   string
+	token string
+	queue chan *reportDelivery
+
+	mu          sync.Mutex
+	delivered   int
+	failed      int
+	dropped     int
+	lastSuccess *time.Time
+	lastError   string
+	// recent are the latest deliveries, newest first.
+	recent []*reportDelivery
+}
+
+type reportDelivery struct {
+	ScanID     string     `json:"scan_id"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	body []byte
+}
+
+type reportSinks struct {
+	sinks []*reportSink
+}
+
+// reports is empty, which disables the reports, unless -report-urls is set.
+var reports = &reportSinks{}
+
+func defaultInstanceID() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// checkReportURLs accepts plain HTTP, warning that the token is sent in the
+// clear, so a sink on localhost or behind a sidecar works too.
+func checkReportURLs(urls []string) error {
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		switch {
+		case u.Scheme == "http" && u.Host != "":
+			logger.Warn("Report sink is not HTTPS, the token is sent in the clear", "url", u.Redacted())
+		case u.Scheme != "https" || u.Host == "":
+			return fmt.Errorf("%q is not an absolute HTTPS URL", raw)
+		}
+	}
+	return nil
+}
+
+func newReportSinks(urls []string, token string) *reportSinks {
+	n := &reportSinks{}
+	for _, u := range urls {
+		n.sinks = append(n.sinks, &reportSink{url: u, token: token, queue: make(chan *reportDelivery, reportQueueSize)})
+	}
+	return n
+}
+
+func (n *reportSinks) run(ctx context.Context) {
+	for _, s := range n.sinks {
+		go s.run(ctx)
+	}
+}
+
+// pending returns the number of queued reports.
+func (n *reportSinks) pending() int {
+	count := 0
+	for _, s := range n.sinks {
+		count += len(s.queue)
+	}
+	return count
+}
+
+// send queues the result of a completed scan for every sink.
+func (n *reportSinks) send(ctx context.Context, id string, result *scanResult) {
+	if len(n.sinks) == 0 {
+		return
+	}
+	body, err := json.Marshal(reportPayload{InstanceID: instanceID, Site: site, ScanID: id, scanResponse: result.response(false)})
+	if err != nil {
+		loggerFrom(ctx).Error("Error encoding scan report", "err", err)
+		return
+	}
+	for _, s := range n.sinks {
+		d := &reportDelivery{ScanID: id, QueuedAt: time.Now(), Status: deliveryPending, body: body}
+		s.record(d)
+		select {
+		case s.queue <- d:
+		default:
+			reportDeliveriesTotal.inc(deliveryDropped)
+			s.finish(d, deliveryDropped, errors.New("queue full"))
+			loggerFrom(ctx).Warn("Report queue is full, dropping scan report", "url", s.url, "scan_id", id)
+		}
+	}
+}
+
+func (s *reportSink) run(ctx context.Context) {
+	for {
+		select {
+		case d := <-s.queue:
+			s.deliver(ctx, d)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts a report, retrying network errors and 5xx responses with
+// exponential backoff.
+func (s *reportSink) deliver(ctx context.Context, d *reportDelivery) {
+	backoff := reportBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, d.body)
+		s.mu.Lock()
+		d.Attempts = attempt
+		s.mu.Unlock()
+		if err == nil {
+			reportDeliveriesTotal.inc(deliveryDelivered)
+			s.finish(d, deliveryDelivered, nil)
+			return
+		}
+		if !retry || attempt >= reportAttempts {
+			reportDeliveriesTotal.inc(deliveryFailed)
+			s.finish(d, deliveryFailed, err)
+			logger.Error("Giving up delivering scan report", "url", s.url, "scan_id", d.ScanID, "attempts", attempt, "err", err)
+			return
+		}
+		reportDeliveriesTotal.inc(deliveryRetried)
+		s.mu.Lock()
+		d.Error = err.Error()
+		s.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > reportMaxBackoff {
+			backoff = reportMaxBackoff
+		}
+	}
+}
+
+// post sends body once, telling whether a failure is worth retrying.
+func (s *reportSink) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := reportHTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
+
+func (s *reportSink) record(d *reportDelivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append([]*reportDelivery{d}, s.recent...)
+	if len(s.recent) > reportHistory {
+		s.recent = s.recent[:reportHistory]
+	}
+}
+
+func (s *reportSink) finish(d *reportDelivery, status string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	d.Status, d.FinishedAt, d.body = status, &now, nil
+	d.Error = ""
+	switch status {
+	case deliveryDelivered:
+		s.delivered++
+		s.lastSuccess = &now
+	case deliveryFailed:
+		s.failed++
+	case deliveryDropped:
+		s.dropped++
+	}
+	if err != nil {
+		d.Error = err.Error()
+		s.lastError = d.Error
+	}
+}
+
+// sinkStatus is the delivery state of a sink listed by /debug/deliveries.
+type sinkStatus struct {
+	URL         string           `json:"url"`
+	Queued      int              `json:"queued"`
+	Delivered   int              `json:"delivered"`
+	Failed      int              `json:"failed"`
+	Dropped     int              `json:"dropped"`
+	LastSuccess *time.Time       `json:"last_success,omitempty"`
+	LastError   string           `json:"last_error,omitempty"`
+	Recent      []reportDelivery `json:"recent"`
+}
+
+func (s *reportSink) status() sinkStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := sinkStatus{URL: s.url, Queued: len(s.queue), Delivered: s.delivered, Failed: s.failed, Dropped: s.dropped, LastSuccess: s.lastSuccess, LastError: s.lastError, Recent: make([]reportDelivery, len(s.recent))}
+	for i, d := range s.recent {
+		st.Recent[i] = *d
+	}
+	return st
+}
+
+func handleDebugDeliveries(w http.ResponseWriter, r *http.Request) {
+	list := make([]sinkStatus, 0, len(reports.sinks))
+	for _, s := range reports.sinks {
+		list = append(list, s.status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
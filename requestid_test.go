@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequestIDPropagation checks that the ID of a request reaches the log
+// lines of the probes of its scan.
+func TestRequestIDPropagation(t *testing.T) {
+	records := captureLogs(t)
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+apiPrefix+"/scan?"+localScan(port), nil)
+	req.Header.Set(requestIDHeader, "scan-1234")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(requestIDHeader); id != "scan-1234" {
+		t.Errorf("%s = %q, want the ID of the request", requestIDHeader, id)
+	}
+	probed := records.find("Probed host")
+	if len(probed) == 0 {
+		t.Fatal("no probe logged")
+	}
+	for _, line := range probed {
+		if line["request_id"] != "scan-1234" {
+			t.Errorf("probe logged with request ID %v", line["request_id"])
+		}
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	seen := make(map[string]bool)
+	for _, incoming := range []string{"", "has space", strings.Repeat("a", 129), "<script>"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/healthz", nil)
+		if incoming != "" {
+			req.Header.Set(requestIDHeader, incoming)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		id := resp.Header.Get(requestIDHeader)
+		if !validRequestID(id) || id == incoming || seen[id] {
+			t.Errorf("request ID %q for an incoming %q", id, incoming)
+		}
+		seen[id] = true
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"0f3c9a1b2d4e5f60", true},
+		{"req_1.2:3-four", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"", false},
+		{"with space", false},
+		{"line\nbreak", false},
+		{"ünïcode", false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %t, want %t", tt.id, got, tt.want)
+		}
+	}
+}
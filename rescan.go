@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// probeOptions returns the options of probing a single camera: those of a
+// scan, parsed from query, with the deadline of a single camera.
+func probeOptions(query url.Values) (scanOptions, error) {
+	defaults := defaultScanOptions
+	defaults.Deadline = probeCameraDeadline
+	return parseScanOptions(query, defaults)
+}
+
+// withCredential sets the credentials labelled label on opts, unless the
+// request passed its own.
+func withCredential(opts scanOptions, label string) scanOptions {
+	if c, ok := lookupCredential(label); ok && label != "" && opts.Username == "" {
+		opts.Username, opts.Password = c.username, c.password
+	}
+	return opts
+}
+
+// withKnownPorts adds the ports a camera answered on to opts, so a camera on
+// a port that isn't scanned by default is found again.
+func withKnownPorts(opts scanOptions, r cameraRecord) scanOptions {
+	ports, tlsPorts := append([]int(nil), opts.Ports...), opts.tlsPorts()
+	for _, p := range r.Ports {
+		switch {
+		case containsInt(r.RTSPSPorts, p):
+			if !containsInt(tlsPorts, p) {
+				tlsPorts = append(tlsPorts[:len(tlsPorts):len(tlsPorts)], p)
+			}
+		case !containsInt(ports, p):
+			ports = append(ports, p)
+		}
+	}
+	opts.Ports = ports
+	if len(tlsPorts) > 0 {
+		opts.RTSPS, opts.RTSPSPorts = true, tlsPorts
+	}
+	return opts
+}
+
+// knownAddresses returns the addresses a camera may answer at: its current
+// IP, then those of the network interfaces it reported over ONVIF.
+func knownAddresses(r cameraRecord) []string {
+	list := []string{r.IP}
+	for _, a := range r.Addresses {
+		ip, _, err := net.ParseCIDR(a)
+		if err != nil {
+			ip = net.ParseIP(a)
+		}
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if s := ip.String(); !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// reprobeCamera probes the known camera id at addresses in turn, like a scan
+// probes the cameras it finds, until one of them answers, and updates the
+// record of the camera in place: with the device found, or marking it
+// unreachable. Nothing is changed when ctx is done first.
+func reprobeCamera(ctx context.Context, id string, addresses []string, opts scanOptions) (cameraRecord, error) {
+	var found *device
+	err := errors.New("no address to probe")
+	for _, ip := range addresses {
+		devices, result := probeDevices(ctx, ip, opts)
+		for i := range devices {
+			if devices[i].IP == ip {
+				found = &devices[i]
+			}
+		}
+		if found != nil || ctx.Err() != nil {
+			break
+		}
+		err = fmt.Errorf("no camera at %s: %s", ip, result.Outcome)
+	}
+	if found == nil && ctx.Err() != nil {
+		return cameraRecord{}, ctx.Err()
+	}
+	if found != nil {
+		err = nil
+	}
+	r, events, ok := cameras.setProbe(id, found, err, time.Now())
+	if !ok {
+		// The camera was deleted meanwhile.
+		return cameraRecord{}, errUnknownCamera
+	}
+	// Ignored devices are never announced, like in recordScan.
+	if found != nil && !ignored.matches(&r.device, r.ID) {
+		webhooks.notify(events)
+		mqttPublisher.publish([]cameraRecord{r}, events)
+	}
+	state.changed()
+	return r, err
+}
+
+// setProbe records the outcome of probing the camera id alone: the device
+// found, or why none was. A camera that doesn't answer is only marked
+// offline, its removal is left to the scans; a removed camera answering is
+// added back, returned as a camera_added event.
+func (g *registry) setProbe(id string, d *device, probeErr error, at time.Time) (cameraRecord, []cameraEvent, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[id]
+	if !ok {
+		return cameraRecord{}, nil, false
+	}
+	var events []cameraEvent
+	if r.Manual != nil {
+		m := *r.Manual
+		m.ProbedAt, m.Error = &at, ""
+		if d == nil {
+			m.Error = probeErr.Error()
+		}
+		r.Manual = &m
+	}
+	if d == nil {
+		if r.missed == 0 {
+			r.missed = 1
+		}
+		r.UnreachableAt = &at
+	} else {
+		g.setDevice(r, d, at)
+		if r.removed {
+			r.removed = false
+			events = append(events, cameraEvent{Event: eventCameraAdded, Time: at, Device: *r})
+		}
+	}
+	c := *r
+	c.Status = r.status()
+	return c, events, true
+}
+
+// handleRescanCamera probes a known camera again at once, at all its known
+// addresses, and returns its refreshed record. Rescans count against the
+// scan rate limit.
+func handleRescanCamera(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	record, ok := cameras.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	}
+	opts, err := probeOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if r.URL.Query().Get("ports") == "" {
+		opts = withKnownPorts(opts, record)
+		if record.Manual != nil && !containsInt(opts.Ports, record.Manual.Port) {
+			opts.Ports = append(opts.Ports[:len(opts.Ports):len(opts.Ports)], record.Manual.Port)
+		}
+	}
+	addresses := knownAddresses(record)
+	if record.Manual != nil {
+		opts = withCredential(opts, record.Manual.Credentials)
+		if ip, err := resolveHost(r.Context(), record.Manual.Host); err == nil && !containsString(addresses, ip) {
+			addresses = append([]string{ip}, addresses...)
+		}
+	}
+	addresses = filterSlice(addresses, func(ip string) bool { return !opts.Exclude.contains(ip) })
+	if len(addresses) == 0 {
+		writeError(w, http.StatusBadRequest, codeExcluded, fmt.Sprintf("ip %s is excluded from probing", record.IP))
+		return
+	}
+	if !allowScan(w, r) {
+		return
+	}
+
+	record, err = reprobeCamera(r.Context(), id, addresses, opts)
+	switch {
+	case errors.Is(err, errUnknownCamera):
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	case err != nil && r.Context().Err() != nil:
+		if isShuttingDown() {
+			writeShuttingDown(w)
+		} else if requestTimedOut(r) {
+			writeRequestTimeout(w)
+		}
+		// The client is gone otherwise.
+		return
+	case err != nil:
+		loggerFrom(r.Context()).Info("Rescanned camera unreachable", "id", id, "err", err)
+	}
+	if opts.EmbedCredentials {
+		record.device = embedCredentials([]device{record.device})[0]
+	}
+	writeJSON(w, http.StatusOK, record)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postJSON(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TestRescanRegisteredPort checks that a registered camera is rescanned at
+// its registered port once the scans saw it answer on another one.
+func TestRescanRegisteredPort(t *testing.T) {
+	withStore(t)
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	resp := postJSON(t, srv.URL+apiPrefix+"/cameras", fmt.Sprintf(`{"host":"127.0.0.1","port":%d}`, port))
+	var record cameraRecord
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("registering: %d %v", resp.StatusCode, err)
+	}
+	// A scan found the camera answering on another port meanwhile.
+	cameras.setProbe(record.ID, &device{IP: "127.0.0.1", Ports: []int{closedPort(t)}}, nil, time.Now())
+
+	resp = postJSON(t, srv.URL+apiPrefix+"/cameras/"+url.PathEscape(record.ID)+"/rescan?onvif_ports=none", "")
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("rescanning: %d %v", resp.StatusCode, err)
+	}
+	if record.UnreachableAt != nil || !containsInt(record.Ports, port) {
+		t.Errorf("camera not found at its registered port %d: ports %v, unreachable at %v", port, record.Ports, record.UnreachableAt)
+	}
+}
+
+func TestRescanRateLimited(t *testing.T) {
+	withStore(t)
+	limiter := scanLimiter
+	scanLimiter = newRateLimiter(time.Hour, 1, false)
+	t.Cleanup(func() { scanLimiter = limiter })
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	resp := postJSON(t, srv.URL+apiPrefix+"/cameras", fmt.Sprintf(`{"host":"127.0.0.1","port":%d}`, port))
+	var record cameraRecord
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	rescan := srv.URL + apiPrefix + "/cameras/" + url.PathEscape(record.ID) + "/rescan?onvif_ports=none"
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if resp := postJSON(t, rescan, ""); resp.StatusCode != want {
+			t.Errorf("rescan %d: status %d, want %d", i+1, resp.StatusCode, want)
+		} else if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("no Retry-After header")
+		}
+	}
+}
+
+// TestRescanRemovedCamera checks that a camera the scans reported removed is
+// added back, and announced unless ignored, when a rescan finds it.
+func TestRescanRemovedCamera(t *testing.T) {
+	port := fakeRTSP(t, "Hikvision")
+	hooks := webhooks
+	t.Cleanup(func() { webhooks = hooks })
+	for _, ignore := range []bool{false, true} {
+		withStore(t)
+		webhooks = newWebhookNotifier([]string{"http://127.0.0.1:1/events"}, "")
+		at := time.Now().Add(-time.Hour)
+		cameras.restore([]storedCamera{{cameraRecord: cameraRecord{ID: "ip:127.0.0.1", FirstSeen: at, LastSeen: at, device: device{IP: "127.0.0.1", Ports: []int{port}}}, Missed: 3, Removed: true}})
+		if ignore {
+			ignored.add(ignoreEntry{Key: "ip:127.0.0.1", Type: ignoreIP, Value: "127.0.0.1"})
+		}
+		srv := httptest.NewServer(newRouter())
+
+		want := 1
+		if ignore {
+			want = 0
+		}
+		for i := 0; i < 2; i++ {
+			resp := postJSON(t, srv.URL+apiPrefix+"/cameras/ip:127.0.0.1/rescan?onvif_ports=none", "")
+			var record cameraRecord
+			if err := json.NewDecoder(resp.Body).Decode(&record); err != nil || resp.StatusCode != http.StatusOK || record.Status != statusOnline {
+				t.Errorf("ignored %v, rescan %d: %d %v, status %q", ignore, i+1, resp.StatusCode, err, record.Status)
+			}
+			if n := webhooks.pending(); n != want {
+				t.Errorf("ignored %v, rescan %d: %d webhook events, want %d", ignore, i+1, n, want)
+			}
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnknownInterface     = "unknown_interface"
+	codeNetworkEnumeration   = "network_enumeration_failed"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeTooManyScans         = "too_many_scans"
+	codeRateLimited          = "rate_limited"
+	codeNotEnoughSnapshots   = "not_enough_snapshots"
+	codeStreamingUnsupported = "streaming_unsupported"
+	codeExcluded             = "excluded"
+	codeCameraNotFound       = "camera_not_found"
+	codeNoSnapshot           = "no_snapshot"
+	codeCameraTimeout        = "camera_timeout"
+	codeCameraError          = "camera_error"
+	codeShuttingDown         = "shutting_down"
+	codeNotResumable         = "not_resumable"
+	codeMetadataConflict     = "metadata_conflict"
+	codeRequestTimeout       = "request_timeout"
+	codeUnauthorized         = "unauthorized"
+	codeForbiddenOrigin      = "forbidden_origin"
+	codeInternal             = "internal_error"
+)
+
+// apiError is the error object of every error response.
+type apiError struct {
+	Code                string   `json:"code"`
+	Message             string   `json:"message"`
+	AvailableInterfaces []string `json:"available_interfaces,omitempty"`
+	ValidParameters     []string `json:"valid_parameters,omitempty"`
+	RequestID           string   `json:"request_id,omitempty"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Error encoding response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{apiError{Code: code, Message: message, RequestID: w.Header().Get(requestIDHeader)}})
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, codeNotFound, "no endpoint at "+r.URL.Path)
+}
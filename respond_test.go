@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// doRequest requests path of srv with a fixed request ID, so the error
+// bodies are predictable.
+func doRequest(t *testing.T, srv *httptest.Server, method, path string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	req.Header.Set(requestIDHeader, "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestErrorBodies(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", apiPrefix + "/scan?cidr=bogus", 400, `{"error":{"code":"invalid_request","message":"invalid cidr \"bogus\"","request_id":"test-request"}}`},
+		{"GET", apiPrefix + "/scan?ports=abc", 400, `{"error":{"code":"invalid_request","message":"invalid ports \"abc\": invalid port \"abc\"","request_id":"test-request"}}`},
+		{"GET", apiPrefix + "/nothing", 404, `{"error":{"code":"not_found","message":"no endpoint at /api/v1/nothing","request_id":"test-request"}}`},
+		{"PUT", apiPrefix + "/scan", 405, `{"error":{"code":"method_not_allowed","message":"PUT is not allowed on /api/v1/scan","request_id":"test-request"}}`},
+		{"GET", apiPrefix + "/scans/unknown", 404, `{"error":{"code":"not_found","message":"unknown scan unknown","request_id":"test-request"}}`},
+		{"POST", apiPrefix + "/cameras/unknown/rescan", 404, `{"error":{"code":"camera_not_found","message":"unknown camera unknown","request_id":"test-request"}}`},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, srv, tt.method, tt.path)
+		if resp.StatusCode != tt.status || body != tt.body+"\n" {
+			t.Errorf("%s %s = %d %s, want %d %s", tt.method, tt.path, resp.StatusCode, body, tt.status, tt.body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.path, ct)
+		}
+	}
+}
+
+func TestEmptyBodies(t *testing.T) {
+	withStore(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	resp, body := doRequest(t, srv, "GET", apiPrefix+"/cameras/")
+	if want := `{"last_scan":null,"total":0,"limit":100,"offset":0,"next_offset":null,"devices":[]}` + "\n"; resp.StatusCode != http.StatusOK || body != want {
+		t.Errorf("GET /cameras/ = %d %s, want %s", resp.StatusCode, body, want)
+	}
+
+	resp, body = doRequest(t, srv, "GET", apiPrefix+"/scan?"+localScan(closedPort(t)))
+	var result struct {
+		Found   *int            `json:"found"`
+		Devices json.RawMessage `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Found == nil || *result.Found != 0 || string(result.Devices) != "[]" {
+		t.Errorf("empty scan = %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// apiPrefix is the prefix of the current version of the API.
+const apiPrefix = "/api/v1"
+
+const (
+	// routePublic routes don't require an API key.
+	routePublic = 1 << iota
+	// routeStreaming routes keep their connection open, so their responses
+	// are neither compressed nor bounded by the request timeout.
+	routeStreaming
+)
+
+// route is a path of the API with the handler of every method it accepts.
+// Segments of the pattern like {id} match any single segment.
+type route struct {
+	pattern  string
+	segments []string
+	flags    int
+	// successor is set on the deprecated aliases of the old paths.
+	successor string
+	methods   map[string]http.HandlerFunc
+	handler   http.HandlerFunc
+}
+
+// router dispatches requests by exact path and method, answering unknown paths
+// with 404 and unsupported methods with 405 and an Allow header, both as JSON.
+type router struct {
+	routes   []*route
+	notFound http.HandlerFunc
+
+	openAPIOnce sync.Once
+	openAPI     []byte
+}
+
+// newRouter returns the handler of the API server.
+func newRouter() http.Handler {
+	rt := &router{}
+	rt.handle(apiPrefix+"/scan", 0, map[string]http.HandlerFunc{http.MethodGet: handleGetAllRTSPDevices, http.MethodPost: handleGetAllRTSPDevices})
+	rt.handle(apiPrefix+"/scan/stream", routeStreaming, map[string]http.HandlerFunc{http.MethodGet: handleGetAllRTSPDevices, http.MethodPost: handleGetAllRTSPDevices})
+	rt.handle(apiPrefix+"/scans", 0, map[string]http.HandlerFunc{http.MethodGet: handleListScans, http.MethodPost: handleStartScan})
+	rt.handle(apiPrefix+"/scans/checkpoints", 0, map[string]http.HandlerFunc{http.MethodGet: handleListCheckpoints})
+	rt.handle(apiPrefix+"/scans/{id}", 0, map[string]http.HandlerFunc{http.MethodGet: handleGetScan, http.MethodDelete: handleStopScan})
+	rt.handle(apiPrefix+"/scans/{id}/resume", 0, map[string]http.HandlerFunc{http.MethodPost: handleResumeScan})
+	rt.handle(apiPrefix+"/schedules", 0, map[string]http.HandlerFunc{http.MethodGet: handleListSchedules})
+	rt.handle(apiPrefix+"/probe", 0, map[string]http.HandlerFunc{http.MethodGet: handleProbeCamera})
+	rt.handle(apiPrefix+"/announced", 0, map[string]http.HandlerFunc{http.MethodGet: handleGetAnnouncedDevices})
+	rt.handle(apiPrefix+"/ignored", 0, map[string]http.HandlerFunc{http.MethodGet: handleListIgnored, http.MethodPost: handleAddIgnored})
+	rt.handle(apiPrefix+"/ignored/{key}", 0, map[string]http.HandlerFunc{http.MethodDelete: handleDeleteIgnored})
+	rt.handle(apiPrefix+"/cameras", 0, map[string]http.HandlerFunc{http.MethodGet: handleGetCameras, http.MethodPost: handleRegisterCamera})
+	rt.handle(apiPrefix+"/cameras/export", 0, map[string]http.HandlerFunc{http.MethodGet: handleExportCameras})
+	rt.handle(apiPrefix+"/cameras/last", 0, map[string]http.HandlerFunc{http.MethodGet: handleLastScan})
+	rt.handle(apiPrefix+"/cameras/diff", 0, map[string]http.HandlerFunc{http.MethodGet: handleCamerasDiff})
+	rt.handle(apiPrefix+"/cameras/{id}", 0, map[string]http.HandlerFunc{http.MethodDelete: handleDeleteCamera})
+	rt.handle(apiPrefix+"/cameras/{id}/metadata", 0, map[string]http.HandlerFunc{http.MethodGet: handleGetMetadata, http.MethodPut: handlePutMetadata, http.MethodPatch: handlePatchMetadata, http.MethodDelete: handleDeleteMetadata})
+	rt.handle(apiPrefix+"/cameras/{id}/rescan", 0, map[string]http.HandlerFunc{http.MethodPost: handleRescanCamera})
+	rt.handle(apiPrefix+"/cameras/{id}/snapshot", 0, map[string]http.HandlerFunc{http.MethodGet: handleCameraSnapshot})
+	rt.handle(apiPrefix+"/ws", routeStreaming, map[string]http.HandlerFunc{http.MethodGet: handleWebSocket})
+	rt.handle(apiPrefix+"/openapi.json", routePublic, map[string]http.HandlerFunc{http.MethodGet: rt.handleOpenAPI})
+	rt.handle(apiPrefix+"/docs", routePublic, map[string]http.HandlerFunc{http.MethodGet: handleSwaggerUI})
+	rt.handle("/metrics", 0, map[string]http.HandlerFunc{http.MethodGet: handleMetrics})
+	rt.handle("/healthz", routePublic, map[string]http.HandlerFunc{http.MethodGet: handleHealthz})
+	rt.handle("/readyz", routePublic, map[string]http.HandlerFunc{http.MethodGet: handleReadyz})
+
+	// The paths of earlier versions keep working until the next release.
+	rt.alias("/get_all_onvif_cameras", apiPrefix+"/scan")
+	rt.alias("/get_all_rtsp_cameras", apiPrefix+"/scan")
+	rt.alias("/get_all_rtsp_cameras/stream", apiPrefix+"/scan/stream")
+	rt.alias("/scans", apiPrefix+"/scans")
+	rt.alias("/scans/{id}", apiPrefix+"/scans/{id}")
+	rt.alias("/probe_camera", apiPrefix+"/probe")
+	rt.alias("/get_announced_cameras", apiPrefix+"/announced")
+	rt.alias("/cameras", apiPrefix+"/cameras")
+	rt.alias("/cameras/diff", apiPrefix+"/cameras/diff")
+	rt.alias("/ws", apiPrefix+"/ws")
+
+	rt.notFound = rt.chain("/", 0, handleNotFound)
+	return rt
+}
+
+func (rt *router) handle(pattern string, flags int, methods map[string]http.HandlerFunc) {
+	r := &route{pattern: pattern, segments: splitPath(pattern), flags: flags, methods: methods}
+	r.handler = rt.chain(pattern, flags, r.dispatch)
+	rt.routes = append(rt.routes, r)
+}
+
+// alias registers pattern as a deprecated path of the route registered as
+// successor.
+func (rt *router) alias(pattern, successor string) {
+	for _, target := range rt.routes {
+		if target.pattern == successor {
+			r := &route{pattern: pattern, segments: splitPath(pattern), flags: target.flags, successor: successor, methods: target.methods}
+			r.handler = rt.chain(pattern, r.flags, r.dispatch)
+			rt.routes = append(rt.routes, r)
+			return
+		}
+	}
+	panic("alias of unknown route " + successor)
+}
+
+// chain wraps the handler of a route in the middleware every request passes
+// through.
+func (rt *router) chain(pattern string, flags int, h http.HandlerFunc) http.HandlerFunc {
+	h = withRecovery(h)
+	if flags&routeStreaming == 0 {
+		h = withDeadline(h)
+	}
+	if flags&routePublic == 0 {
+		h = requireAPIKey(h)
+	}
+	h = withCORS(h)
+	if flags&routeStreaming == 0 {
+		h = withCompression(h)
+	}
+	return logRequest(pattern, h)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		if params, ok := route.match(segments); ok {
+			if len(params) > 0 {
+				r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+			}
+			route.handler(w, r)
+			return
+		}
+	}
+	rt.notFound(w, r)
+}
+
+func (route *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range route.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (route *route) dispatch(w http.ResponseWriter, r *http.Request) {
+	if route.successor != "" {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+route.successor+`>; rel="successor-version"`)
+	}
+	h, ok := route.methods[r.Method]
+	if !ok && r.Method == http.MethodHead {
+		h, ok = route.methods[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", route.allow())
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not allowed on "+route.pattern)
+		return
+	}
+	h(w, r)
+}
+
+func (route *route) allow() string {
+	methods := make([]string, 0, len(route.methods)+1)
+	for m := range route.methods {
+		methods = append(methods, m)
+	}
+	if route.methods[http.MethodGet] != nil {
+		methods = append(methods, http.MethodHead)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// splitPath returns the segments of a path, ignoring a trailing slash.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+type pathParamsKey struct{}
+
+// pathParam returns the segment of the request path matching {name} in the
+// pattern of its route.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubRouter routes a few patterns to handlers answering with the pattern
+// and the path parameters.
+func stubRouter() *router {
+	stub := func(pattern string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]string{"pattern": pattern, "id": pathParam(r, "id")})
+		}
+	}
+	rt := &router{}
+	rt.handle("/api/v1/items", routePublic, map[string]http.HandlerFunc{http.MethodGet: stub("items"), http.MethodPost: stub("items")})
+	rt.handle("/api/v1/items/export", routePublic, map[string]http.HandlerFunc{http.MethodGet: stub("export")})
+	rt.handle("/api/v1/items/{id}", routePublic, map[string]http.HandlerFunc{http.MethodDelete: stub("item")})
+	rt.alias("/items", "/api/v1/items")
+	rt.notFound = rt.chain("/", routePublic, handleNotFound)
+	return rt
+}
+
+func TestRouter(t *testing.T) {
+	rt := stubRouter()
+	tests := []struct {
+		method, path string
+		status       int
+		pattern, id  string
+		allow        string
+		deprecated   bool
+	}{
+		{http.MethodGet, "/api/v1/items", http.StatusOK, "items", "", "", false},
+		{http.MethodGet, "/api/v1/items/", http.StatusOK, "items", "", "", false},
+		{http.MethodPost, "/api/v1/items", http.StatusOK, "items", "", "", false},
+		{http.MethodHead, "/api/v1/items", http.StatusOK, "", "", "", false},
+		{http.MethodPut, "/api/v1/items", http.StatusMethodNotAllowed, "", "", "GET, HEAD, POST", false},
+		{http.MethodGet, "/api/v1/items/export", http.StatusOK, "export", "", "", false},
+		{http.MethodDelete, "/api/v1/items/mac:00:11:22:33:44:55", http.StatusOK, "item", "mac:00:11:22:33:44:55", "", false},
+		{http.MethodDelete, "/api/v1/items/42", http.StatusOK, "item", "42", "", false},
+		{http.MethodGet, "/api/v1/items/42", http.StatusMethodNotAllowed, "", "", "DELETE", false},
+		{http.MethodDelete, "/api/v1/items/export", http.StatusMethodNotAllowed, "", "", "GET, HEAD", false},
+		{http.MethodGet, "/items", http.StatusOK, "items", "", "", true},
+		{http.MethodDelete, "/items", http.StatusMethodNotAllowed, "", "", "GET, HEAD, POST", true},
+		{http.MethodGet, "/items/42", http.StatusNotFound, "", "", "", false},
+		{http.MethodGet, "/api/v1/items/42/more", http.StatusNotFound, "", "", "", false},
+		{http.MethodGet, "/", http.StatusNotFound, "", "", "", false},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		name := tt.method + " " + tt.path
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tt.status)
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s: Allow = %q, want %q", name, got, tt.allow)
+		}
+		if got := rec.Header().Get("Deprecation") == "true"; got != tt.deprecated {
+			t.Errorf("%s: Deprecation = %q", name, rec.Header().Get("Deprecation"))
+		}
+		if tt.deprecated && rec.Header().Get("Link") != `</api/v1/items>; rel="successor-version"` {
+			t.Errorf("%s: Link = %q", name, rec.Header().Get("Link"))
+		}
+		if tt.method == http.MethodHead {
+			continue
+		}
+		var body struct {
+			Pattern string   `json:"pattern"`
+			ID      string   `json:"id"`
+			Error   apiError `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: body %q: %v", name, rec.Body, err)
+			continue
+		}
+		switch tt.status {
+		case http.StatusOK:
+			if body.Pattern != tt.pattern || body.ID != tt.id {
+				t.Errorf("%s: routed to %q with id %q, want %q and %q", name, body.Pattern, body.ID, tt.pattern, tt.id)
+			}
+		case http.StatusMethodNotAllowed:
+			if body.Error.Code != codeMethodNotAllowed {
+				t.Errorf("%s: code %q", name, body.Error.Code)
+			}
+		case http.StatusNotFound:
+			if body.Error.Code != codeNotFound {
+				t.Errorf("%s: code %q", name, body.Error.Code)
+			}
+		}
+	}
+}
+
+func TestRouterAliases(t *testing.T) {
+	rt := newRouter().(*router)
+	for _, route := range rt.routes {
+		if route.successor == "" {
+			continue
+		}
+		for _, target := range rt.routes {
+			if target.pattern == route.successor && target.allow() != route.allow() {
+				t.Errorf("%s allows %s, its successor %s", route.pattern, route.allow(), target.allow())
+			}
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("alias of an unknown route registered")
+		}
+	}()
+	rt.alias("/old", "/missing")
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/", 0},
+		{"", 0},
+		{"/api/v1/scan", 3},
+		{"/api/v1/scan/", 3},
+		{"api/v1", 2},
+	}
+	for _, tt := range tests {
+		if got := splitPath(tt.path); len(got) != tt.want {
+			t.Errorf("splitPath(%q) = %q, want %d segments", tt.path, got, tt.want)
+		}
+	}
+}
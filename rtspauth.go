@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"find_cameras/digest"
+	"find_cameras/scanner"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authOK             = "ok"
+	authUnauthorized   = "unauthorized"
+	authNoAuthRequired = "no_auth_required"
+
+	rtspAuthTimeout = 5 * time.Second
+)
+
+// credential is a username and password, named by a label that is safe to
+// report.
+type credential struct {
+	label, username, password string
+}
+
+// credentialList holds the RTSP credentials tried on cameras without
+// credentials of the request. Every scan tries a single one per camera so
+// lockout-sensitive cameras are safe: the one that worked last time, or the
+// next one after a rejection.
+type credentialList struct {
+	credentials []credential
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+var rtspCredentials = &credentialList{}
+
+// parseCredentials parses entries of the form user:pass or label=user:pass.
+// The label defaults to the position of the entry.
+func parseCredentials(entries []string) (*credentialList, error) {
+	l := &credentialList{next: make(map[string]int)}
+	for i, entry := range entries {
+		username, password, ok := strings.Cut(entry, ":")
+		label := strconv.Itoa(i + 1)
+		if name, user, found := strings.Cut(username, "="); found {
+			label, username = name, user
+		}
+		if !ok || username == "" || label == "" {
+			// Never echo the entry, it holds a password.
+			return nil, fmt.Errorf("entry %d is not user:pass or label=user:pass", i+1)
+		}
+		l.credentials = append(l.credentials, credential{label, username, password})
+	}
+	return l, nil
+}
+
+func (l *credentialList) pick(ip string) (int, credential, bool) {
+	if len(l.credentials) == 0 {
+		return 0, credential{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.next[ip] % len(l.credentials)
+	return i, l.credentials[i], true
+}
+
+func (l *credentialList) rejected(ip string, i int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next[ip] = (i + 1) % len(l.credentials)
+}
+
+// checkDevicesAuth checks the RTSP credentials on every camera answering
+// RTSP, those of the request or otherwise one of the configured list.
+func checkDevicesAuth(ctx context.Context, devices []device, opts scanOptions) {
+	if opts.Username == "" && len(rtspCredentials.credentials) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, rtspAuthTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range devices {
+		if len(devices[i].Ports) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			cred, listed, index := credential{"request", opts.Username, opts.Password}, false, 0
+			if opts.Username == "" {
+				index, cred, listed = rtspCredentials.pick(d.IP)
+			}
+			port, path, secure := authTarget(d)
+			status, err := checkRTSPAuth(ctx, d.IP, port, path, secure, cred, opts.DialTimeout)
+			if err != nil {
+				d.AuthError = err.Error()
+				return
+			}
+			d.Auth = status
+			if status == authOK {
+				d.rtspCredential = &cred
+			}
+			if listed && status == authUnauthorized {
+				rtspCredentials.rejected(d.IP, index)
+			}
+		}(&devices[i])
+	}
+	wg.Wait()
+}
+
+// authTarget picks the port and path of the stream the credentials are
+// checked on: a stream URI reported over ONVIF, a path found by the path
+// probe, or the root. It tells as well whether the port is rtsps.
+func authTarget(d *device) (int, string, bool) {
+	for _, p := range d.Profiles {
+		u, err := url.Parse(p.StreamURI)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Hostname() != d.IP {
+			continue
+		}
+		port, secure := rtspURLPort(u.Scheme, u.Port())
+		return port, u.RequestURI(), secure
+	}
+	secure := containsInt(d.RTSPSPorts, d.Ports[0])
+	if len(d.Paths) > 0 {
+		return d.Ports[0], d.Paths[0].Path, secure
+	}
+	return d.Ports[0], "/", secure
+}
+
+// checkRTSPAuth sends an unauthenticated DESCRIBE and, when the camera
+// challenges it, a single authenticated one on the same connection.
+func checkRTSPAuth(ctx context.Context, ip string, port int, path string, secure bool, cred credential, dialTimeout time.Duration) (string, error) {
+	conn, err := dialRTSP(ctx, ip, port, dialTimeout, secure)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	defer scanner.AbandonOnCancel(ctx, conn)()
+
+	rc := scanner.NewConn(conn)
+	rc.Deadline, _ = ctx.Deadline()
+	rawURL := scanner.URL(ip, port, path)
+	if secure {
+		rawURL = scanner.SecureURL(ip, port, path)
+	}
+	headers := map[string]string{"Accept": "application/sdp"}
+	resp, err := rc.Do("DESCRIBE", rawURL, headers)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return authNoAuthRequired, nil
+	case 401:
+	default:
+		return "", fmt.Errorf("DESCRIBE answered %d", resp.StatusCode)
+	}
+
+	authorization, err := challengeAuthorization(resp.Header.Values("WWW-Authenticate"), cred, "DESCRIBE", rawURL)
+	if err != nil {
+		return "", err
+	}
+	headers["Authorization"] = authorization
+	if resp, err = rc.Do("DESCRIBE", rawURL, headers); err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return authOK, nil
+	case 401, 403:
+		return authUnauthorized, nil
+	default:
+		return "", fmt.Errorf("authenticated DESCRIBE answered %d", resp.StatusCode)
+	}
+}
+
+// challengeAuthorization answers the first Digest challenge, or else a Basic
+// one, of an RTSP or HTTP response.
+func challengeAuthorization(challenges []string, cred credential, method, uri string) (string, error) {
+	for _, challenge := range challenges {
+		if ch, err := digest.ParseChallenge(challenge); err == nil {
+			return ch.Authorize(cred.username, cred.password, method, uri)
+		}
+	}
+	for _, challenge := range challenges {
+		if scheme, _, _ := strings.Cut(challenge, " "); strings.EqualFold(scheme, "Basic") {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.username+":"+cred.password)), nil
+		}
+	}
+	return "", errors.New("no supported authentication challenge")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"find_cameras/scanner"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultRTSPSPort = 322
+
+var (
+	// rtspsVerify verifies the certificates of rtsps servers against the
+	// system roots, which cameras rarely pass.
+	rtspsVerify bool
+	// rtspsHandshakeTimeout bounds the TLS handshakes with rtsps servers,
+	// apart from the dial timeout.
+	rtspsHandshakeTimeout = scanner.DefaultTLSHandshakeTimeout
+)
+
+func rtspsTLSConfig() *tls.Config {
+	if !rtspsVerify {
+		return nil
+	}
+	return &tls.Config{}
+}
+
+// tlsCertificate is the certificate an rtsps port of a camera presented.
+type tlsCertificate struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+func newTLSCertificate(cert *scanner.Certificate) *tlsCertificate {
+	if cert == nil {
+		return nil
+	}
+	return &tlsCertificate{Subject: cert.Subject, Issuer: cert.Issuer, DNSNames: cert.DNSNames, IPAddresses: cert.IPAddresses, NotAfter: cert.NotAfter.UTC()}
+}
+
+// tlsPorts returns the ports of a scan probed over TLS, none unless the scan
+// asked for rtsps.
+func (opts scanOptions) tlsPorts() []int {
+	if !opts.RTSPS {
+		return nil
+	}
+	return opts.RTSPSPorts
+}
+
+// probedPorts returns the RTSP ports of a scan, with the rtsps ports it
+// asked for.
+func (opts scanOptions) probedPorts() []int {
+	ports := opts.Ports
+	for _, p := range opts.tlsPorts() {
+		if !containsInt(ports, p) {
+			ports = append(ports[:len(ports):len(ports)], p)
+		}
+	}
+	return ports
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// rtspURL returns the URL of path on port of the device, rtsps when the
+// port answered over TLS.
+func (d *device) rtspURL(port int, path string) string {
+	if containsInt(d.RTSPSPorts, port) {
+		return scanner.SecureURL(d.IP, port, path)
+	}
+	return scanner.URL(d.IP, port, path)
+}
+
+// dialRTSP connects to the RTSP server on port of ip, over TLS when secure.
+func dialRTSP(ctx context.Context, ip string, port int, dialTimeout time.Duration, secure bool) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil || !secure {
+		return conn, err
+	}
+	tc, _, err := scanner.ClientTLS(ctx, conn, ip, rtspsTLSConfig(), rtspsHandshakeTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// rtspURLPort returns the port of an rtsp or rtsps URL and whether it is
+// served over TLS.
+func rtspURLPort(scheme, port string) (int, bool) {
+	secure := strings.EqualFold(scheme, "rtsps")
+	if n, err := strconv.Atoi(port); err == nil {
+		return n, secure
+	}
+	if secure {
+		return defaultRTSPSPort, true
+	}
+	return defaultRTSPPort, false
+}
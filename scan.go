@@ -0,0 +1,969 @@
+package main
+
+import (
+	"context"
+	"find_cameras/discovery"
+	"find_cameras/scanner"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRTSPPort = 554
+
+const (
+	minDialTimeout  = 10 * time.Millisecond
+	maxDialTimeout  = 10 * time.Second
+	maxScanDeadline = 5 * time.Minute
+	maxRetries      = 5
+)
+
+// maxWorkers caps the number of concurrent probes a request may ask for.
+var maxWorkers = 1024
+
+// maxConnectionRate caps the connections per second a request may ask for,
+// 0 leaving it unbounded.
+var maxConnectionRate int
+
+type scanOptions struct {
+	Ports      []int
+	ONVIFPorts []int
+	Workers    int
+	// Rate is the number of new connections per second of the sweep, 0
+	// leaving it unlimited.
+	Rate            int
+	DialTimeout     time.Duration
+	Retries         int
+	AdaptiveTimeout bool
+	MinDialTimeout  time.Duration
+	Deadline        time.Duration
+	DiscoveryWindow time.Duration
+	Prefilter       string
+	ProbePaths      bool
+	// VerifyPlay plays the RTSP URLs of the cameras found.
+	VerifyPlay      bool
+	IPv6            bool
+	IncludeSelf     bool
+	Refresh         bool
+	MaxHosts        int
+	CIDRs           []*net.IPNet
+	Exclude         exclusionList
+	Interfaces      []string
+	AllowInterfaces []string
+	DenyInterfaces  []string
+	Username        string
+	Password        string
+	// EmbedCredentials puts the validated credentials into the RTSP URLs of
+	// the response.
+	EmbedCredentials bool
+
+	// Verbose reports the class of every probed address.
+	Verbose bool
+	// Unicast sends a unicast WS-Discovery Probe to every candidate, not
+	// only to those of requested networks that aren't attached.
+	Unicast bool
+	// RTSPS probes the RTSPSPorts with RTSP over TLS, along with Ports.
+	RTSPS      bool
+	RTSPSPorts []int
+
+	// interfaces explains which interfaces the networks were taken from.
+	interfaces []interfaceStatus
+	// hosts collects the probed addresses of a verbose scan.
+	hosts *hostLog
+	// throttle limits the dials of all sweeps of the scan to Rate.
+	throttle *scanner.Throttle
+	// enrich enriches the ONVIF devices as the scan finds them.
+	enrich *enrichStage
+	// query is the query the options were parsed from.
+	query url.Values
+}
+
+var defaultScanOptions = scanOptions{
+	Ports:           []int{554, 8554},
+	ONVIFPorts:      defaultONVIFPorts,
+	RTSPSPorts:      scanner.DefaultTLSPorts,
+	Workers:         256,
+	DialTimeout:     scanner.DefaultDialTimeout,
+	Retries:         1,
+	MinDialTimeout:  scanner.DefaultMinDialTimeout,
+	Deadline:        2 * time.Minute,
+	DiscoveryWindow: 3 * time.Second,
+	Prefilter:       prefilterARP,
+	MaxHosts:        4096,
+}
+
+type scanResult struct {
+	Devices    []device
+	Prefilters []string
+	Networks   []networkStats
+	Skipped    []skippedNetwork
+	Excluded   int
+	// Ignored counts the devices of the ignore list left out.
+	Ignored    int
+	Interfaces []interfaceStatus
+	// Concurrency is the number of concurrent probes of the scan.
+	Concurrency int
+	// ConnectionRate is the limit of new connections per second of the
+	// scan, 0 when unlimited.
+	ConnectionRate int
+	RTT            *rttSummary
+	// Hosts are the probed addresses of a verbose scan.
+	Hosts     []probedHost
+	Classes   map[scanner.Class]int
+	Progress  progressReport
+	Partial   bool
+	ScannedAt time.Time
+}
+
+// scanSummary is the metadata of a finished scan as returned by the streaming
+// responses.
+type scanSummary struct {
+	Found          int               `json:"found"`
+	Partial        bool              `json:"partial"`
+	Progress       progressReport    `json:"progress"`
+	Prefilters     []string          `json:"prefilters,omitempty"`
+	Networks       []networkStats    `json:"networks,omitempty"`
+	Skipped        []skippedNetwork  `json:"skipped,omitempty"`
+	Excluded       int               `json:"excluded,omitempty"`
+	Ignored        int               `json:"ignored,omitempty"`
+	Interfaces     []interfaceStatus `json:"interfaces,omitempty"`
+	Concurrency    int               `json:"concurrency"`
+	ConnectionRate int               `json:"connection_rate,omitempty"`
+	RTT            *rttSummary       `json:"rtt,omitempty"`
+	// Classes counts the probed addresses of a verbose scan by class.
+	Classes map[scanner.Class]int `json:"classes,omitempty"`
+}
+
+// rttSummary spans the round-trip times of the devices of a scan.
+type rttSummary struct {
+	MinMS float64 `json:"min_ms"`
+	AvgMS float64 `json:"avg_ms"`
+	MaxMS float64 `json:"max_ms"`
+}
+
+// summarizeRTT returns the span of the round-trip times of devices, nil when
+// none was measured.
+func summarizeRTT(devices []device) *rttSummary {
+	var s *rttSummary
+	var total float64
+	n := 0
+	for _, d := range devices {
+		if d.RTTMS <= 0 {
+			continue
+		}
+		if s == nil {
+			s = &rttSummary{MinMS: d.RTTMS, MaxMS: d.RTTMS}
+		}
+		if d.RTTMS < s.MinMS {
+			s.MinMS = d.RTTMS
+		}
+		if d.RTTMS > s.MaxMS {
+			s.MaxMS = d.RTTMS
+		}
+		total += d.RTTMS
+		n++
+	}
+	if s != nil {
+		s.AvgMS = math.Round(total/float64(n)*1000) / 1000
+	}
+	return s
+}
+
+func (r *scanResult) summary() scanSummary {
+	return scanSummary{
+		Found:          len(r.Devices),
+		Partial:        r.Partial,
+		Progress:       r.Progress,
+		Prefilters:     r.Prefilters,
+		Networks:       r.Networks,
+		Skipped:        r.Skipped,
+		Excluded:       r.Excluded,
+		Ignored:        r.Ignored,
+		Interfaces:     r.Interfaces,
+		Concurrency:    r.Concurrency,
+		ConnectionRate: r.ConnectionRate,
+		RTT:            r.RTT,
+		Classes:        r.Classes,
+	}
+}
+
+// scanResponse is the body of a scan response: the summary of the scan and
+// the cameras found.
+type scanResponse struct {
+	ScannedAt  time.Time `json:"scanned_at"`
+	DurationMS int64     `json:"duration_ms"`
+	Cached     bool      `json:"cached"`
+	scanSummary
+	Devices []scannedDevice `json:"devices"`
+	Hosts   []probedHost    `json:"hosts,omitempty"`
+}
+
+type scannedDevice struct {
+	device
+	// Sources hides the sources of device, reported as discovered_via.
+	Sources       []string  `json:"sources,omitempty"`
+	DiscoveredVia []string  `json:"discovered_via"`
+	ScannedAt     time.Time `json:"scanned_at"`
+}
+
+func (r *scanResult) response(cached bool) scanResponse {
+	resp := scanResponse{
+		ScannedAt:   r.ScannedAt,
+		DurationMS:  r.Progress.ElapsedMS,
+		Cached:      cached,
+		scanSummary: r.summary(),
+		Devices:     make([]scannedDevice, 0, len(r.Devices)),
+		Hosts:       r.Hosts,
+	}
+	for _, d := range r.Devices {
+		resp.Devices = append(resp.Devices, scannedDevice{device: d, DiscoveredVia: d.Sources, ScannedAt: r.ScannedAt})
+	}
+	return resp
+}
+
+type networkStats struct {
+	Network    string `json:"network"`
+	Hosts      uint64 `json:"hosts"`
+	Candidates int    `json:"candidates"`
+	Probed     int    `json:"probed"`
+	Found      int    `json:"found"`
+	// TimeoutMS is the dial timeout in effect at the end of the sweep.
+	TimeoutMS int64 `json:"timeout_ms"`
+	// Leased counts the candidates holding a DHCP lease, probed first.
+	Leased int `json:"leased,omitempty"`
+	// ONVIF counts the hosts only found by the ONVIF HTTP probe.
+	ONVIF int `json:"onvif,omitempty"`
+	// Unicast counts the hosts answering a unicast WS-Discovery Probe.
+	Unicast int `json:"unicast,omitempty"`
+	// Duplicates counts the hosts left to an earlier network also
+	// containing them.
+	Duplicates int `json:"duplicates,omitempty"`
+	// Resumed counts the hosts probed before the scan was resumed.
+	Resumed int `json:"resumed,omitempty"`
+	// Error tells why the hosts of the network could not be enumerated.
+	Error string `json:"error,omitempty"`
+}
+
+type skippedNetwork struct {
+	Network string `json:"network"`
+	Hosts   uint64 `json:"hosts"`
+	Reason  string `json:"reason"`
+}
+
+func parseScanOptions(query url.Values, defaults scanOptions) (scanOptions, error) {
+	opts := defaults
+
+	if v := query.Get("ports"); v != "" {
+		ports, err := parsePorts(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ports %q: %v", v, err)
+		}
+		opts.Ports = ports
+	}
+
+	if v := query.Get("onvif_ports"); v != "" {
+		ports, err := parseONVIFPorts(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid onvif_ports %q: %v", v, err)
+		}
+		opts.ONVIFPorts = ports
+	}
+
+	if v := query.Get("timeout"); v != "" {
+		d, err := parseBoundedDuration(v, minDialTimeout, maxDialTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid timeout %q: %v", v, err)
+		}
+		opts.DialTimeout = d
+	}
+
+	if v := query.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxRetries {
+			return opts, fmt.Errorf("invalid retries %q: must be between 0 and %d", v, maxRetries)
+		}
+		opts.Retries = n
+	}
+
+	if v := query.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid concurrency %q: must be a positive integer", v)
+		}
+		if n > maxWorkers {
+			n = maxWorkers
+		}
+		opts.Workers = n
+	}
+
+	if v := query.Get("rate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid rate %q: must be a positive number of connections per second", v)
+		}
+		opts.Rate = n
+	}
+	if maxConnectionRate > 0 && (opts.Rate == 0 || opts.Rate > maxConnectionRate) {
+		opts.Rate = maxConnectionRate
+	}
+
+	if v := query.Get("adaptive_timeout"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid adaptive_timeout %q", v)
+		}
+		opts.AdaptiveTimeout = b
+	}
+
+	if v := query.Get("deadline"); v != "" {
+		d, err := parseBoundedDuration(v, time.Second, maxScanDeadline)
+		if err != nil {
+			return opts, fmt.Errorf("invalid deadline %q: %v", v, err)
+		}
+		opts.Deadline = d
+	}
+
+	if v := query.Get("discovery_window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid discovery_window %q", v)
+		}
+		opts.DiscoveryWindow = d
+	}
+
+	if v := query.Get("paths"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid paths %q", v)
+		}
+		opts.ProbePaths = b
+	}
+
+	switch v := query.Get("verify"); v {
+	case "":
+	case verifyPlay:
+		opts.VerifyPlay = true
+	default:
+		return opts, fmt.Errorf("invalid verify %q, only %s is supported", v, verifyPlay)
+	}
+
+	if v := query.Get("verbose"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid verbose %q", v)
+		}
+		opts.Verbose = b
+	}
+
+	if v := query.Get("rtsps"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid rtsps %q", v)
+		}
+		opts.RTSPS = b
+	}
+
+	if v := query.Get("unicast"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid unicast %q", v)
+		}
+		opts.Unicast = b
+	}
+
+	if v := query.Get("ipv6"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid ipv6 %q", v)
+		}
+		opts.IPv6 = b
+	}
+
+	if v := query.Get("max_hosts"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid max_hosts %q", v)
+		}
+		opts.MaxHosts = n
+	}
+
+	if v := query.Get("exclude"); v != "" {
+		exclude, err := parseExclusions(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid exclude %q: %v", v, err)
+		}
+		opts.Exclude = append(append(exclusionList(nil), defaults.Exclude...), exclude...)
+	}
+
+	for _, v := range query["iface"] {
+		opts.Interfaces = append(opts.Interfaces, splitList(v)...)
+	}
+
+	for _, v := range query["cidr"] {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return opts, fmt.Errorf("invalid cidr %q", v)
+		}
+		if hosts := scanner.HostCount(cidr); hosts > uint64(opts.MaxHosts) {
+			return opts, fmt.Errorf("invalid cidr %q: %d hosts exceed max_hosts=%d", v, hosts, opts.MaxHosts)
+		}
+		opts.CIDRs = append(opts.CIDRs, cidr)
+	}
+
+	if v := query.Get("refresh"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid refresh %q", v)
+		}
+		opts.Refresh = b
+	}
+
+	if v := query.Get("include_self"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid include_self %q", v)
+		}
+		opts.IncludeSelf = b
+	}
+
+	if mode := query.Get("mode"); mode != "" {
+		if mode != "full" {
+			return opts, fmt.Errorf("invalid mode %q", mode)
+		}
+		opts.Prefilter = prefilterNone
+	}
+	if v := query.Get("prefilter"); v != "" {
+		if !validPrefilter(v) {
+			return opts, fmt.Errorf("invalid prefilter %q", v)
+		}
+		opts.Prefilter = v
+	}
+
+	if v := query.Get("embed_credentials"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid embed_credentials %q", v)
+		}
+		opts.EmbedCredentials = b
+	}
+
+	opts.Username = query.Get("user")
+	opts.Password = query.Get("pass")
+	return opts, nil
+}
+
+func parseBoundedDuration(s string, min, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < min || d > max {
+		return 0, fmt.Errorf("must be between %s and %s", min, max)
+	}
+	return d, nil
+}
+
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
+		}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return ports, nil
+}
+
+func joinPorts(ports []int) string {
+	fields := make([]string, len(ports))
+	for i, port := range ports {
+		fields[i] = strconv.Itoa(port)
+	}
+	return strings.Join(fields, ",")
+}
+
+// scanProber probes the ports of the scans instead of a scanner.RTSPProber
+// when set, by the tests.
+var scanProber scanner.Prober
+
+func scannerOptions(ctx context.Context, opts scanOptions) scanner.Options {
+	return scanner.Options{
+		Ports:               opts.probedPorts(),
+		Prober:              scanProber,
+		Workers:             opts.Workers,
+		DialTimeout:         opts.DialTimeout,
+		Retries:             opts.Retries,
+		AdaptiveTimeout:     opts.AdaptiveTimeout,
+		MinDialTimeout:      opts.MinDialTimeout,
+		Throttle:            opts.throttle,
+		TLSPorts:            opts.tlsPorts(),
+		TLSHandshakeTimeout: rtspsHandshakeTimeout,
+		TLSConfig:           rtspsTLSConfig(),
+		PortProbed:          func(o scanner.Outcome) { probesTotal.inc(string(o)) },
+		Panicked: func(ip string, port int, recovered interface{}, stack []byte) {
+			panicsTotal.inc(panicProbe)
+			loggerFrom(ctx).Error("Probe panicked", "ip", ip, "port", port, "panic", recovered, "stack", string(stack))
+		},
+	}
+}
+
+func scanIPs(ctx context.Context, ips []string, opts scanOptions, progress *scanProgress, limit *scanner.Limiter) ([]scanner.Result, scanner.Stats) {
+	log := loggerFrom(ctx)
+	var exhausted int64
+	so := scannerOptions(ctx, opts)
+	so.Limiter = limit
+	so.Probing = func(string) { progress.addProbed() }
+	so.Probed = func(result scanner.Result) {
+		switch {
+		case scanner.IsDescriptorExhaustion(result.Err):
+			if atomic.AddInt64(&exhausted, 1) == 1 {
+				log.Warn("Error probing host", "ip", result.IP, "err", result.Err)
+			}
+		case result.Outcome == scanner.OutcomeError:
+			log.Warn("Error probing host", "ip", result.IP, "err", result.Err)
+		default:
+			log.Debug("Probed host", "ip", result.IP, "outcome", result.Outcome, "ports", result.Ports)
+		}
+		if result.Outcome == scanner.OutcomeRTSP {
+			progress.addFound(result)
+		}
+		// A probe cut short by the end of the scan must be repeated when
+		// the scan is resumed.
+		if ctx.Err() == nil {
+			progress.addAddress(result.IP)
+		}
+		probedHostsTotal.inc(string(result.Outcome.Class()))
+		if opts.hosts != nil {
+			opts.hosts.add(result)
+		}
+	}
+	devices, stats := scanner.New(so).ProbeHosts(ctx, ips)
+
+	if exhausted > 0 {
+		log.Warn("Probes failed because the process ran out of file descriptors, consider lowering the number of workers", "failed", exhausted, "workers", opts.Workers)
+	}
+	return devices, stats
+}
+
+func scanNetworks(ctx context.Context, networks []localNetwork, opts scanOptions, progress *scanProgress) *scanResult {
+	ctx, cancel := context.WithTimeout(ctx, opts.Deadline)
+	defer cancel()
+	if progress == nil {
+		progress = newScanProgress()
+	}
+	scansTotal.inc(scanStarted)
+	if opts.Verbose {
+		opts.hosts = newHostLog()
+	}
+	opts.enrich = newEnrichStage(ctx, enrichOptions{Username: opts.Username, Password: opts.Password}, opts.Exclude, progress.addEnriched)
+
+	var matches []discovery.Match
+	var ssdpDevices []discovery.SSDPDevice
+	var mdnsServices []discovery.MDNSService
+	var discoveryWG sync.WaitGroup
+	if opts.DiscoveryWindow > 0 {
+		discoveryWG.Add(3)
+		go func() {
+			defer discoveryWG.Done()
+			matches = discoverONVIF(ctx, networks, opts.DiscoveryWindow)
+			opts.enrich.submitMatches(matches, sourceWSDiscovery)
+		}()
+		go func() {
+			defer discoveryWG.Done()
+			ssdpDevices = discoverSSDP(ctx, networks, opts.DiscoveryWindow, opts.Exclude)
+		}()
+		go func() {
+			defer discoveryWG.Done()
+			mdnsServices = discoverMDNS(ctx, networks, opts.DiscoveryWindow)
+		}()
+	}
+
+	// The hosts of all networks are enumerated first so an address on
+	// overlapping networks is probed once, with the first of them. The
+	// networks are then swept concurrently, sharing the workers of the scan.
+	leases := loadLeases(ctx)
+	sweeps := make([]networkSweep, len(networks))
+	concurrently(len(networks), func(i int) {
+		sweeps[i] = enumerateNetwork(ctx, networks[i], opts, leases)
+	})
+	claimed := make(map[string]bool)
+	for i := range sweeps {
+		sweeps[i].claim(claimed)
+		sweeps[i].skipProbed(progress.done)
+	}
+	limit := scanner.NewLimiter(opts.Workers)
+	scanConcurrency.set(int64(opts.Workers))
+	opts.throttle = scanner.NewThrottle(opts.Rate)
+	sweepStarted := time.Now()
+	concurrently(len(sweeps), func(i int) {
+		sweeps[i].probe(ctx, opts, progress, limit)
+	})
+
+	var allResults, onvifResults []scanner.Result
+	var unicastMatches []discovery.Match
+	probed := make(map[string]bool, len(progress.done))
+	for ip := range progress.done {
+		probed[ip] = true
+	}
+	prefiltersUsed := make(map[string]bool)
+	var skipped []skippedNetwork
+	var perNetwork []networkStats
+	excluded := make(map[string]bool)
+	for _, sweep := range sweeps {
+		for _, ip := range sweep.excluded {
+			excluded[ip] = true
+		}
+		if sweep.skipped != nil {
+			skipped = append(skipped, *sweep.skipped)
+			continue
+		}
+		if sweep.stats.Network == "" {
+			// The scan ended before the network was swept.
+			continue
+		}
+		for _, ip := range sweep.candidates {
+			probed[ip] = true
+		}
+		if sweep.prefilter != "" {
+			prefiltersUsed[sweep.prefilter] = true
+		}
+		allResults = append(allResults, sweep.results...)
+		onvifResults = append(onvifResults, sweep.onvif...)
+		unicastMatches = append(unicastMatches, sweep.matches...)
+		perNetwork = append(perNetwork, sweep.stats)
+	}
+	discoveryWG.Wait()
+
+	announced := onlineAnnouncements()
+	if len(opts.CIDRs) > 0 {
+		announced = matchesInNetworks(announced, networks)
+	}
+	if len(opts.Exclude) > 0 {
+		keep := func(ip string) bool {
+			if opts.Exclude.contains(ip) {
+				excluded[ip] = true
+				return false
+			}
+			return true
+		}
+		matches = filterSlice(matches, func(m discovery.Match) bool { return keep(m.IP) })
+		announced = filterSlice(announced, func(m discovery.Match) bool { return keep(m.IP) })
+		ssdpDevices = filterSlice(ssdpDevices, func(d discovery.SSDPDevice) bool { return keep(d.IP) })
+		mdnsServices = filterSlice(mdnsServices, func(s discovery.MDNSService) bool { return keep(s.IP) })
+	}
+
+	var unprobed []string
+	addUnprobed := func(ip string) {
+		if !probed[ip] {
+			probed[ip] = true
+			unprobed = append(unprobed, ip)
+		}
+	}
+	for _, m := range matches {
+		addUnprobed(m.IP)
+	}
+	for _, m := range announced {
+		addUnprobed(m.IP)
+	}
+	for _, d := range ssdpDevices {
+		addUnprobed(d.IP)
+	}
+	for _, s := range mdnsServices {
+		addUnprobed(s.IP)
+	}
+	progress.addCandidates(len(unprobed))
+	results, _ := scanIPs(ctx, unprobed, opts, progress, limit)
+	allResults = append(allResults, results...)
+	scanStageDurationSeconds.observe(time.Since(sweepStarted).Seconds(), stageSweep)
+
+	set := newDeviceSet()
+	set.addResumed(progress.resumed)
+	set.addRTSP(allResults)
+	set.addONVIFHTTP(onvifResults)
+	set.addMatches(matches, sourceWSDiscovery)
+	set.addMatches(announced, sourceHello)
+	set.addMatches(unicastMatches, sourceWSDiscoveryUnicast)
+	set.addSSDP(ssdpDevices)
+	set.addMDNS(mdnsServices)
+	set.addNetworks(networks)
+	if entries, err := neighbors.Neighbors(); err == nil {
+		set.addNeighbors(entries)
+	}
+	if opts.IPv6 {
+		if entries, err := ipv6Neighbors(); err == nil {
+			set.addNeighbors(entries)
+		}
+	}
+	set.addLeases(leases)
+	devices := set.devices
+
+	// The devices only the collection revealed a device service of, like
+	// those announcing themselves, join the enrichments still running.
+	for i := range devices {
+		opts.enrich.submit(devices[i])
+	}
+	opts.enrich.wait()
+	opts.enrich.apply(devices)
+
+	if ctx.Err() == nil {
+		hostnamesDone := make(chan struct{})
+		go func() {
+			defer close(hostnamesDone)
+			resolveHostnames(ctx, devices)
+		}()
+		fingerprintsDone := make(chan struct{})
+		go func() {
+			defer close(fingerprintsDone)
+			fingerprintDevices(ctx, devices)
+		}()
+		flagStrayAddresses(devices, networks, opts.Exclude)
+		if opts.ProbePaths {
+			probeDevicePaths(ctx, devices)
+		}
+		checkDevicesAuth(ctx, devices, opts)
+		<-fingerprintsDone
+		addRTSPURLs(devices)
+		verifyDevicesPlayback(ctx, devices, opts)
+		<-hostnamesDone
+	}
+
+	sortDevices(devices)
+	scannedAt := time.Now()
+	records := recordScan(devices, scannedAt, networks, ctx.Err() == nil)
+	devices, records, ignoredDevices := dropIgnored(devices, records)
+	if progress.id == "" {
+		progress.id, _ = newJobID()
+	}
+	if records == nil {
+		records = []cameraRecord{}
+	}
+	snapshots.add(scanSnapshot{
+		snapshotSummary: snapshotSummary{
+			ID:         progress.id,
+			RequestID:  requestID(ctx),
+			StartedAt:  progress.started,
+			ScannedAt:  scannedAt,
+			DurationMS: scannedAt.Sub(progress.started).Milliseconds(),
+			Complete:   ctx.Err() == nil,
+			Parameters: newScanParameters(networks, opts),
+			Found:      len(devices),
+		},
+		Devices: records,
+	})
+	state.changed()
+
+	result := &scanResult{Devices: devices, Networks: perNetwork, Skipped: skipped, Excluded: len(excluded), Ignored: ignoredDevices, Interfaces: opts.interfaces, Concurrency: opts.Workers, ConnectionRate: opts.Rate, RTT: summarizeRTT(devices), Progress: progress.report(), ScannedAt: scannedAt, Partial: ctx.Err() == context.DeadlineExceeded}
+	for used := range prefiltersUsed {
+		result.Prefilters = append(result.Prefilters, used)
+	}
+	sort.Strings(result.Prefilters)
+	if opts.hosts != nil {
+		for _, r := range onvifResults {
+			opts.hosts.add(r)
+		}
+		for _, m := range unicastMatches {
+			opts.hosts.add(scanner.Result{IP: m.IP, Outcome: scanner.OutcomeONVIF})
+		}
+		result.Hosts, result.Classes = opts.hosts.list()
+	}
+
+	stats := result.Progress
+	scanDurationSeconds.observe(scannedAt.Sub(progress.started).Seconds())
+	lastScanDevices.set(int64(len(devices)))
+	switch ctx.Err() {
+	case nil:
+		scansTotal.inc(scanCompleted)
+		reports.send(ctx, progress.id, result)
+	case context.DeadlineExceeded:
+		scansTotal.inc(scanFailed)
+		loggerFrom(ctx).Warn("Scan deadline exceeded, returning partial results", "deadline", opts.Deadline.String(), "probed", stats.Probed, "candidates", stats.Candidates)
+	case context.Canceled:
+		scansTotal.inc(scanCancelled)
+		loggerFrom(ctx).Info("Scan cancelled by the client", "probed", stats.Probed, "candidates", stats.Candidates)
+	}
+	loggerFrom(ctx).Info("Scan finished",
+		"devices_found", len(devices),
+		"rtsp", stats.Found,
+		"ws_discovery", len(matches),
+		"ssdp", len(ssdpDevices),
+		"mdns", len(mdnsServices),
+		"probed", stats.Probed,
+		"candidates", stats.Candidates,
+		"duration_ms", stats.ElapsedMS)
+	return result
+}
+
+// networkSweep is the outcome of sweeping a single network of a scan.
+type networkSweep struct {
+	stats      networkStats
+	skipped    *skippedNetwork
+	candidates []string
+	excluded   []string
+	prefilter  string
+	results    []scanner.Result
+	onvif      []scanner.Result
+	// unicast tells whether the candidates get a unicast WS-Discovery
+	// Probe, whose answers are matches.
+	unicast bool
+	matches []discovery.Match
+}
+
+// enumerateNetwork lists the candidates of a network, those holding a DHCP
+// lease first.
+func enumerateNetwork(ctx context.Context, network localNetwork, opts scanOptions, leases map[string]dhcpLease) networkSweep {
+	var sweep networkSweep
+	if ctx.Err() != nil {
+		return sweep
+	}
+	sweep.stats = networkStats{Network: network.String()}
+	sweep.unicast = unicastDiscovery(network, opts)
+	if network.isIPv6() && !network.Requested {
+		candidates, err := ipv6Candidates(ctx, network, opts.IncludeSelf)
+		if err != nil {
+			loggerFrom(ctx).Warn("Error enumerating network", "network", network.String(), "err", err)
+			sweep.stats.Error = err.Error()
+			return sweep
+		}
+		sweep.candidates, sweep.excluded = opts.Exclude.filter(candidates)
+		sweep.candidates, sweep.stats.Leased = leasesFirst(sweep.candidates, sweep.candidates, leases)
+		sweep.prefilter = prefilterNDP
+	} else {
+		if hosts := scanner.HostCount(network.IPNet); hosts > uint64(opts.MaxHosts) {
+			loggerFrom(ctx).Warn("Skipping network exceeding the host limit", "network", network.String(), "hosts", hosts, "max_hosts", opts.MaxHosts)
+			sweep.skipped = &skippedNetwork{
+				Network: network.String(),
+				Hosts:   hosts,
+				Reason:  fmt.Sprintf("%d hosts exceed max_hosts=%d", hosts, opts.MaxHosts),
+			}
+			return sweep
+		}
+		prefilter := opts.Prefilter
+		if network.Requested && prefilter == prefilterARP {
+			// The ARP table only knows the hosts of attached links.
+			prefilter = prefilterNone
+		}
+		hosts := scanner.Hosts(network.IPNet, opts.IncludeSelf || network.Requested)
+		sweep.stats.Hosts = uint64(len(hosts))
+		hosts, sweep.excluded = opts.Exclude.filter(hosts)
+		sweep.candidates, sweep.prefilter = prefilterCandidates(ctx, prefilter, network.IPNet, hosts)
+		sweep.candidates, sweep.stats.Leased = leasesFirst(sweep.candidates, hosts, leases)
+	}
+	return sweep
+}
+
+// claim drops the candidates already claimed by another network and claims
+// the remaining ones.
+func (s *networkSweep) claim(claimed map[string]bool) {
+	var candidates []string
+	for _, ip := range s.candidates {
+		if claimed[ip] {
+			s.stats.Duplicates++
+			continue
+		}
+		claimed[ip] = true
+		candidates = append(candidates, ip)
+	}
+	s.candidates = candidates
+}
+
+// skipProbed drops the candidates a resumed scan probed before.
+func (s *networkSweep) skipProbed(done map[string]bool) {
+	if len(done) == 0 {
+		return
+	}
+	s.candidates = filterSlice(s.candidates, func(ip string) bool {
+		if done[ip] {
+			s.stats.Resumed++
+			return false
+		}
+		return true
+	})
+}
+
+func (s *networkSweep) probe(ctx context.Context, opts scanOptions, progress *scanProgress, limit *scanner.Limiter) {
+	if s.stats.Network == "" || s.skipped != nil || s.stats.Error != "" {
+		return
+	}
+	progress.addCandidates(len(s.candidates))
+	results, stats := scanIPs(ctx, s.candidates, opts, progress, limit)
+	s.results = results
+	s.stats.Candidates, s.stats.Probed, s.stats.Found = len(s.candidates), stats.Probed, len(results)
+	s.stats.TimeoutMS = stats.DialTimeout.Milliseconds()
+
+	// Cameras may firewall RTSP but still serve ONVIF over HTTP.
+	found := make(map[string]bool, len(results))
+	for _, r := range results {
+		found[r.IP] = true
+	}
+	var misses []string
+	for _, ip := range s.candidates {
+		if !found[ip] {
+			misses = append(misses, ip)
+		}
+	}
+	s.onvif = scanONVIFHTTP(ctx, misses, opts, limit)
+	s.stats.ONVIF = len(s.onvif)
+
+	if s.unicast {
+		s.matches = scanUnicastWSDiscovery(ctx, s.candidates, opts, limit)
+		s.stats.Unicast = len(s.matches)
+		opts.enrich.submitMatches(s.matches, sourceWSDiscoveryUnicast)
+	}
+}
+
+// concurrently calls f with 0 to n-1 in goroutines of their own and waits for
+// all of them.
+func concurrently(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func matchesInNetworks(matches []discovery.Match, networks []localNetwork) []discovery.Match {
+	var filtered []discovery.Match
+	for _, m := range matches {
+		ip := net.ParseIP(m.IP)
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				filtered = append(filtered, m)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func filterSlice[T any](items []T, keep func(T) bool) []T {
+	var kept []T
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
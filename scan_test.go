@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"find_cameras/scanner"
+)
+
+func TestScanLegacyFormat(t *testing.T) {
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   string
+	}{
+		{"format", localScan(port) + "&format=legacy", "", `["127.0.0.1"]`},
+		{"accept", localScan(port), legacyMediaType, `["127.0.0.1"]`},
+		{"empty", localScan(closedPort(t)) + "&format=legacy", "", `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+apiPrefix+"/scan?"+tt.query, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var body json.RawMessage
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || string(body) != tt.want {
+				t.Errorf("got %d %s, want %s", resp.StatusCode, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanStructuredFormat(t *testing.T) {
+	port := fakeRTSP(t, "Hikvision")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + localScan(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Found   int `json:"found"`
+		Devices []struct {
+			IP            string   `json:"ip"`
+			Ports         []int    `json:"ports"`
+			Server        string   `json:"server"`
+			DiscoveredVia []string `json:"discovered_via"`
+		} `json:"devices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Found != 1 || len(body.Devices) != 1 {
+		t.Fatalf("found %d devices: %+v", body.Found, body.Devices)
+	}
+	d := body.Devices[0]
+	if d.IP != "127.0.0.1" || len(d.Ports) != 1 || d.Ports[0] != port || !strings.Contains(strings.Join(d.DiscoveredVia, ","), "rtsp") {
+		t.Errorf("device = %+v", d)
+	}
+}
+
+// networkProber fakes the hosts of several networks: the cameras answer RTSP,
+// the other hosts refuse. It counts the dials of every address and the
+// probes in flight. A negative delay delays the probes randomly, up to its
+// absolute value.
+type networkProber struct {
+	cameras map[string]bool
+	delay   time.Duration
+
+	mu       sync.Mutex
+	dials    map[string]int
+	inFlight int
+	max      int
+}
+
+func (p *networkProber) probe(ctx context.Context, ip string, port int) scanner.Result {
+	p.mu.Lock()
+	if p.dials == nil {
+		p.dials = make(map[string]int)
+	}
+	p.dials[ip]++
+	p.inFlight++
+	p.max = max(p.max, p.inFlight)
+	p.mu.Unlock()
+	if p.delay < 0 {
+		// The probes finish in any order.
+		time.Sleep(time.Duration(rand.Intn(int(-p.delay))))
+	} else {
+		time.Sleep(p.delay)
+	}
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+	if p.cameras[ip] {
+		return scanner.Result{IP: ip, Outcome: scanner.OutcomeRTSP, StatusCode: http.StatusOK, Attempts: 1}
+	}
+	return scanner.Result{IP: ip, Outcome: scanner.OutcomeRefused, Attempts: 1}
+}
+
+// scanNetworksResponse is the part of a scan response the network tests read.
+type scanNetworksResponse struct {
+	Networks []networkStats   `json:"networks"`
+	Skipped  []skippedNetwork `json:"skipped"`
+	Devices  []struct {
+		IP       string `json:"ip"`
+		Network  string `json:"network"`
+		Networks []struct {
+			Network string `json:"network"`
+		} `json:"networks"`
+	} `json:"devices"`
+}
+
+func getScan(t *testing.T, srv *httptest.Server, query string) scanNetworksResponse {
+	t.Helper()
+	resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body scanNetworksResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %v", resp.StatusCode, err)
+	}
+	return body
+}
+
+// fakeNetworks are the query parameters of a scan of fake networks alone. The
+// tests scan networks of 127.0.0.0/8, attached to the loopback interface, so
+// their hosts aren't sent unicast WS-Discovery Probes.
+const fakeNetworks = "mode=full&unicast=false&refresh=true&discovery_window=0s&onvif_ports=none&ports=554"
+
+func TestScanSharedBudget(t *testing.T) {
+	withStore(t)
+	prober := &networkProber{cameras: map[string]bool{"127.0.11.5": true, "127.0.13.9": true}, delay: 5 * time.Millisecond}
+	withProber(t, prober.probe)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	body := getScan(t, srv, fakeNetworks+"&concurrency=4&cidr=127.0.10.0/28&cidr=127.0.11.0/28&cidr=127.0.12.0/28&cidr=127.0.13.0/28")
+	if prober.max > 4 {
+		t.Errorf("%d probes in flight, want at most 4 across the networks", prober.max)
+	}
+	if prober.max < 2 {
+		t.Errorf("%d probe in flight, want the networks swept concurrently", prober.max)
+	}
+	if len(prober.dials) != 4*14 {
+		t.Errorf("%d addresses dialed, want %d", len(prober.dials), 4*14)
+	}
+	if len(body.Networks) != 4 {
+		t.Fatalf("networks = %+v", body.Networks)
+	}
+	for _, n := range body.Networks {
+		if n.Probed != 14 {
+			t.Errorf("%s: %d probed, want 14", n.Network, n.Probed)
+		}
+		if want := map[string]int{"127.0.11.0/28": 1, "127.0.13.0/28": 1}[n.Network]; n.Found != want {
+			t.Errorf("%s: %d found, want %d", n.Network, n.Found, want)
+		}
+	}
+	networks := make(map[string]string)
+	for _, d := range body.Devices {
+		networks[d.IP] = d.Network
+	}
+	if networks["127.0.11.5"] != "127.0.11.0/28" || networks["127.0.13.9"] != "127.0.13.0/28" || len(networks) != 2 {
+		t.Errorf("devices = %+v", body.Devices)
+	}
+}
+
+func TestScanOverlappingNetworks(t *testing.T) {
+	withStore(t)
+	prober := &networkProber{cameras: map[string]bool{"127.0.10.20": true}}
+	withProber(t, prober.probe)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	body := getScan(t, srv, fakeNetworks+"&cidr=127.0.10.0/24&cidr=127.0.10.0/26&cidr=127.0.10.16/28&cidr=127.0.10.0/24")
+	if len(prober.dials) != 254 {
+		t.Errorf("%d addresses dialed, want 254", len(prober.dials))
+	}
+	for ip, n := range prober.dials {
+		if n != 1 {
+			t.Errorf("%s dialed %d times", ip, n)
+		}
+	}
+	if len(body.Devices) != 1 {
+		t.Fatalf("devices = %+v", body.Devices)
+	}
+	var networks []string
+	for _, n := range body.Devices[0].Networks {
+		networks = append(networks, n.Network)
+	}
+	sort.Strings(networks)
+	if strings.Join(networks, " ") != "127.0.10.0/24 127.0.10.0/26 127.0.10.16/28" {
+		t.Errorf("networks of the camera = %q", networks)
+	}
+}
+
+// scanTimes matches the fields of a scan response that change with every
+// scan.
+var scanTimes = regexp.MustCompile(`"(scanned_at|duration_ms|elapsed_ms)":("[^"]*"|[0-9.]+)`)
+
+func TestScanDeterministicOrder(t *testing.T) {
+	withStore(t)
+	prober := &networkProber{delay: -3 * time.Millisecond, cameras: map[string]bool{
+		"127.0.10.2": true, "127.0.10.9": true, "127.0.10.10": true, "127.0.10.100": true, "127.0.10.25": true, "127.0.10.200": true,
+	}}
+	withProber(t, prober.probe)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	outputs := make(map[string]bool)
+	legacy := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		for format, seen := range map[string]map[string]bool{"json": outputs, "legacy": legacy} {
+			resp, err := http.Get(srv.URL + apiPrefix + "/scan?mode=full&unicast=false&refresh=true&discovery_window=0s&onvif_ports=none&ports=8554,554&cidr=127.0.10.0/24&format=" + format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			seen[string(scanTimes.ReplaceAll(body, nil))] = true
+		}
+	}
+	if len(outputs) != 1 || len(legacy) != 1 {
+		t.Fatalf("%d different responses and %d different legacy responses of the same scan", len(outputs), len(legacy))
+	}
+	for body := range legacy {
+		if want := `["127.0.10.2","127.0.10.9","127.0.10.10","127.0.10.25","127.0.10.100","127.0.10.200"]` + "\n"; body != want {
+			t.Errorf("legacy response = %s, want %s", body, want)
+		}
+	}
+	for body := range outputs {
+		if !strings.Contains(body, `"ports":[554,8554]`) {
+			t.Errorf("ports not sorted in %s", body)
+		}
+	}
+
+	// The registry lists the cameras in the same order.
+	resp, err := http.Get(srv.URL + apiPrefix + "/cameras/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var registry struct {
+		Devices []struct {
+			IP string `json:"ip"`
+		} `json:"devices"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registry)
+	var ips []string
+	for _, d := range registry.Devices {
+		ips = append(ips, d.IP)
+	}
+	if got := strings.Join(ips, " "); got != "127.0.10.2 127.0.10.9 127.0.10.10 127.0.10.25 127.0.10.100 127.0.10.200" {
+		t.Errorf("registry order = %s", got)
+	}
+}
+
+func TestScanConcurrency(t *testing.T) {
+	withStore(t)
+	withProber(t, countingProber(new(int64), 0))
+	defer func(n int) { maxWorkers = n }(maxWorkers)
+	maxWorkers = 32
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		concurrency string
+		status      int
+		want        int
+	}{
+		{"", http.StatusOK, defaultScanOptions.Workers},
+		{"8", http.StatusOK, 8},
+		{"5000", http.StatusOK, 32},
+		{"0", http.StatusBadRequest, 0},
+		{"many", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		query := localScan(554)
+		if tt.concurrency != "" {
+			query += "&concurrency=" + tt.concurrency
+		}
+		resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Concurrency int `json:"concurrency"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("concurrency=%s: status %d, want %d", tt.concurrency, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if body.Concurrency != tt.want {
+			t.Errorf("concurrency=%s: %d reported, want %d", tt.concurrency, body.Concurrency, tt.want)
+		}
+		if got := metricValue(t, srv, "onvif_finder_scan_concurrency"); got != float64(tt.want) {
+			t.Errorf("concurrency=%s: gauge %v, want %d", tt.concurrency, got, tt.want)
+		}
+	}
+}
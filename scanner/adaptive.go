@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMinDialTimeout is the lower bound of adaptive dial timeouts
+	// when Options.MinDialTimeout is not set.
+	DefaultMinDialTimeout = 10 * time.Millisecond
+
+	minRTTSamples = 3
+	maxRTTSamples = 256
+	// rttFactor is the multiple of the 95th percentile RTT that adaptive
+	// dial timeouts wait for.
+	rttFactor = 4
+)
+
+// rttEstimator adapts the dial timeout of a sweep to the round-trip times of
+// the connections that were accepted or refused so far. Until enough of them
+// were seen it keeps the maximum.
+type rttEstimator struct {
+	min, max time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration
+	timeout time.Duration
+}
+
+func newRTTEstimator(min, max time.Duration) *rttEstimator {
+	if min > max {
+		min = max
+	}
+	return &rttEstimator{min: min, max: max, timeout: max}
+}
+
+func (e *rttEstimator) observe(r Result) {
+	if r.RTT <= 0 || r.Outcome == OutcomeTimeout || r.Outcome == OutcomeError {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) >= maxRTTSamples {
+		return
+	}
+	e.samples = append(e.samples, r.RTT)
+	if len(e.samples) < minRTTSamples {
+		return
+	}
+	sorted := append([]time.Duration(nil), e.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p95 := sorted[(len(sorted)*95+99)/100-1]
+	timeout := rttFactor * p95
+	if timeout < e.min {
+		timeout = e.min
+	}
+	if timeout > e.max {
+		timeout = e.max
+	}
+	e.timeout = timeout
+}
+
+func (e *rttEstimator) current() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.timeout
+}
@@ -0,0 +1,58 @@
+package scanner
+
+import (
+	"math"
+	"net"
+)
+
+// HostCount returns the number of addresses Hosts enumerates for network, not
+// counting the address of the host itself.
+func HostCount(network *net.IPNet) uint64 {
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+	n := uint64(1) << uint(bits-ones)
+	if n > 2 {
+		n -= 2
+	}
+	return n
+}
+
+// Hosts lists the addresses of network worth probing. The network and
+// broadcast addresses are left out for prefixes shorter than /31, and
+// network.IP itself unless includeSelf is set. The whole list is built at
+// once, so callers check HostCount first: Scan rejects the networks larger
+// than Options.MaxHosts.
+func Hosts(network *net.IPNet, includeSelf bool) []string {
+	ones, bits := network.Mask.Size()
+	first := network.IP.Mask(network.Mask)
+	var last net.IP
+	if bits-ones > 1 {
+		last = make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+	}
+
+	var ips []string
+	for ip := append(net.IP(nil), first...); network.Contains(ip); incrementIP(ip) {
+		if last != nil && (ip.Equal(first) || ip.Equal(last)) {
+			continue
+		}
+		if !includeSelf && ip.Equal(network.IP) {
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+func incrementIP(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
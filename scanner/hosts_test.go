@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// selfNetwork is the network of an interface with the address and prefix of
+// cidr, as net.Interface.Addrs reports it.
+func selfNetwork(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: network.Mask}
+}
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		includeSelf bool
+		count       int
+		first, last string
+	}{
+		{"192.168.1.10/24", false, 253, "192.168.1.1", "192.168.1.254"},
+		{"192.168.1.10/24", true, 254, "192.168.1.1", "192.168.1.254"},
+		{"192.168.1.0/24", false, 254, "192.168.1.1", "192.168.1.254"},
+		{"10.0.0.5/30", false, 1, "10.0.0.6", "10.0.0.6"},
+		{"10.0.0.5/30", true, 2, "10.0.0.5", "10.0.0.6"},
+		// Point-to-point links have no network or broadcast address.
+		{"10.0.0.4/31", false, 1, "10.0.0.5", "10.0.0.5"},
+		{"10.0.0.4/31", true, 2, "10.0.0.4", "10.0.0.5"},
+		{"10.0.0.7/32", false, 0, "", ""},
+		{"10.0.0.7/32", true, 1, "10.0.0.7", "10.0.0.7"},
+		{"2001:db8::11/126", false, 1, "2001:db8::12", "2001:db8::12"},
+	}
+	for _, tt := range tests {
+		got := Hosts(selfNetwork(t, tt.cidr), tt.includeSelf)
+		if len(got) != tt.count {
+			t.Errorf("Hosts(%s, %t) = %d hosts, want %d: %s", tt.cidr, tt.includeSelf, len(got), tt.count, strings.Join(got, " "))
+			continue
+		}
+		if tt.count > 0 && (got[0] != tt.first || got[len(got)-1] != tt.last) {
+			t.Errorf("Hosts(%s, %t) = %s .. %s, want %s .. %s", tt.cidr, tt.includeSelf, got[0], got[len(got)-1], tt.first, tt.last)
+		}
+		for _, ip := range got {
+			if !tt.includeSelf && ip == strings.Split(tt.cidr, "/")[0] {
+				t.Errorf("Hosts(%s, false) includes the address of the host", tt.cidr)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package scanner
+
+import "context"
+
+// Limiter bounds the number of hosts probed at once by the scanners sharing
+// it, so sweeping several networks concurrently doesn't multiply the dials
+// in flight.
+type Limiter struct {
+	slots chan struct{}
+}
+
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a free slot and reports whether it got one before ctx
+// was done.
+func (l *Limiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *Limiter) release() {
+	<-l.slots
+}
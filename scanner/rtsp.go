@@ -0,0 +1,365 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is the default timeout of a single TCP dial.
+	DefaultDialTimeout = 50 * time.Millisecond
+	// HandshakeTimeout bounds every RTSP request and response.
+	HandshakeTimeout = 500 * time.Millisecond
+	// MaxBodySize bounds the body of a response and an interleaved packet,
+	// whatever length the server announces.
+	MaxBodySize = 64 << 10
+)
+
+// Outcome is the result of probing a host or a port.
+type Outcome string
+
+const (
+	OutcomeRTSP    Outcome = "rtsp"
+	OutcomeONVIF   Outcome = "onvif"
+	OutcomeRefused Outcome = "refused"
+	OutcomeTimeout Outcome = "timeout"
+	OutcomeSilent  Outcome = "silent"
+	OutcomeNotRTSP Outcome = "not_rtsp"
+	OutcomeError   Outcome = "error"
+)
+
+// Found reports whether the outcome is a positive detection.
+func (o Outcome) Found() bool {
+	return o == OutcomeRTSP || o == OutcomeONVIF
+}
+
+// Class is what an outcome tells about the reachability of a port.
+type Class string
+
+const (
+	// ClassOpen ports accepted the connection, whatever they answered.
+	ClassOpen Class = "open"
+	// ClassClosed ports refused the connection.
+	ClassClosed Class = "closed"
+	// ClassFiltered ports didn't answer the connection attempt in time.
+	ClassFiltered Class = "filtered"
+	// ClassError ports couldn't be probed.
+	ClassError Class = "error"
+)
+
+// Class returns the class of the outcome.
+func (o Outcome) Class() Class {
+	switch o {
+	case OutcomeRTSP, OutcomeONVIF, OutcomeSilent, OutcomeNotRTSP:
+		return ClassOpen
+	case OutcomeRefused:
+		return ClassClosed
+	case OutcomeTimeout:
+		return ClassFiltered
+	default:
+		return ClassError
+	}
+}
+
+var (
+	errNotRTSP      = errors.New("response is not RTSP")
+	errBodyTooLarge = fmt.Errorf("body larger than %d bytes", MaxBodySize)
+)
+
+// Result is the outcome of probing the ports of a host.
+type Result struct {
+	IP string
+	// Ports are the ports answering RTSP.
+	Ports      []int
+	Outcome    Outcome
+	StatusCode int
+	Server     string
+	// RTT is how long the TCP connection took to establish or to be refused,
+	// the fastest of the ports found once merged.
+	RTT time.Duration
+	// Attempts is how often the port was probed.
+	Attempts int
+	// TLSPorts are the ports of Ports answering RTSP over TLS, Certificate
+	// the certificate the first of them presented.
+	TLSPorts    []int
+	Certificate *Certificate
+	Err         error
+}
+
+// Response is an RTSP response.
+type Response struct {
+	StatusCode int
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// Conn is an RTSP client connection.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+	// Deadline bounds every request in addition to HandshakeTimeout.
+	Deadline time.Time
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Do sends a request and reads its response.
+func (c *Conn) Do(method, url string, headers map[string]string) (*Response, error) {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: 5s-onvif-finder\r\n", method, url, c.cseq)
+	for k, v := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+
+	deadline := time.Now().Add(HandshakeTimeout)
+	if !c.Deadline.IsZero() && c.Deadline.Before(deadline) {
+		deadline = c.Deadline
+	}
+	c.conn.SetDeadline(deadline)
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readResponse()
+}
+
+func (c *Conn) readResponse() (*Response, error) {
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(proto, "RTSP/") {
+		return nil, errNotRTSP
+	}
+	codeStr, _, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return nil, errNotRTSP
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	resp := &Response{StatusCode: code, Header: header}
+
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid Content-Length %q", cl)
+		}
+		if n > MaxBodySize {
+			return nil, errBodyTooLarge
+		}
+		resp.Body = make([]byte, n)
+		if _, err := io.ReadFull(c.reader, resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// ReadInterleaved reads the next RTP or RTCP packet interleaved in the
+// connection after PLAY, as defined by RFC 2326 section 10.12. It returns the
+// channel and the payload, and only waits until Deadline.
+func (c *Conn) ReadInterleaved() (int, []byte, error) {
+	c.conn.SetDeadline(c.Deadline)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != '$' {
+		return 0, nil, errors.New("no interleaved packet")
+	}
+	n := int(header[2])<<8 | int(header[3])
+	if n > MaxBodySize {
+		return 0, nil, errBodyTooLarge
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return 0, nil, err
+	}
+	return int(header[1]), data, nil
+}
+
+// URL returns the RTSP URL of path on ip and port.
+func URL(ip string, port int, path string) string {
+	return fmt.Sprintf("rtsp://%s%s", net.JoinHostPort(strings.Replace(ip, "%", "%25", 1), strconv.Itoa(port)), path)
+}
+
+// SecureURL returns the rtsps URL of path on ip and port.
+func SecureURL(ip string, port int, path string) string {
+	return "rtsps" + strings.TrimPrefix(URL(ip, port, path), "rtsp")
+}
+
+var outcomeRank = map[Outcome]int{
+	OutcomeRefused: 1,
+	OutcomeTimeout: 2,
+	OutcomeError:   3,
+	OutcomeSilent:  4,
+	OutcomeNotRTSP: 5,
+	OutcomeRTSP:    6,
+	OutcomeONVIF:   6,
+}
+
+// merge combines the results of the ports of a host: all ports with a
+// positive detection, or otherwise the most telling failure.
+func merge(results []Result, ports []int) Result {
+	var result Result
+	for i, r := range results {
+		if r.Outcome.Found() {
+			if !result.Outcome.Found() {
+				result = r
+			}
+			result.Ports = append(result.Ports, ports[i])
+			if r.Attempts > result.Attempts {
+				result.Attempts = r.Attempts
+			}
+			if r.RTT > 0 && (result.RTT == 0 || r.RTT < result.RTT) {
+				result.RTT = r.RTT
+			}
+			if r.Certificate != nil {
+				result.TLSPorts = append(result.TLSPorts, ports[i])
+				if result.Certificate == nil {
+					result.Certificate = r.Certificate
+				}
+			}
+			continue
+		}
+		if !result.Outcome.Found() && outcomeRank[r.Outcome] >= outcomeRank[result.Outcome] {
+			result = r
+		}
+	}
+	return result
+}
+
+// Prober probes a single port of a host.
+type Prober interface {
+	Probe(ctx context.Context, ip string, port int) Result
+}
+
+// ProberFunc adapts a function to a Prober.
+type ProberFunc func(ctx context.Context, ip string, port int) Result
+
+func (f ProberFunc) Probe(ctx context.Context, ip string, port int) Result {
+	return f(ctx, ip, port)
+}
+
+// RTSPProber dials the port and sends an RTSP OPTIONS request, the Prober
+// used unless Options.Prober is set. On TLSPorts the request follows a TLS
+// handshake bounded by TLSHandshakeTimeout rather than DialTimeout.
+type RTSPProber struct {
+	DialTimeout         time.Duration
+	TLSPorts            []int
+	TLSHandshakeTimeout time.Duration
+	// TLSConfig verifies the certificates of rtsps servers, which are
+	// accepted as they are when nil.
+	TLSConfig *tls.Config
+}
+
+func (p RTSPProber) isTLS(port int) bool {
+	for _, tp := range p.TLSPorts {
+		if tp == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RTSPProber) Probe(ctx context.Context, ip string, port int) Result {
+	result := Result{IP: ip}
+	dialer := net.Dialer{Timeout: p.DialTimeout}
+	dialed := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		result.Outcome, result.Err = ClassifyDialError(err), err
+		if result.Outcome == OutcomeRefused {
+			result.RTT = time.Since(dialed)
+		}
+		return result
+	}
+	result.RTT = time.Since(dialed)
+	defer conn.Close()
+	defer AbandonOnCancel(ctx, conn)()
+
+	rawURL := URL(ip, port, "")
+	if p.isTLS(port) {
+		tc, cert, err := ClientTLS(ctx, conn, ip, p.TLSConfig, p.TLSHandshakeTimeout)
+		if err != nil {
+			result.Outcome, result.Err = classifyHandshakeError(err), err
+			return result
+		}
+		conn, result.Certificate, rawURL = tc, cert, SecureURL(ip, port, "")
+	}
+
+	rc := NewConn(conn)
+	rc.Deadline, _ = ctx.Deadline()
+	resp, err := rc.Do("OPTIONS", rawURL, nil)
+	if err != nil {
+		result.Err, result.Certificate = err, nil
+		var ne net.Error
+		switch {
+		case errors.Is(err, errNotRTSP):
+			result.Outcome = OutcomeNotRTSP
+		case errors.As(err, &ne) && ne.Timeout(), errors.Is(err, io.EOF):
+			result.Outcome = OutcomeSilent
+		default:
+			result.Outcome = OutcomeError
+		}
+		return result
+	}
+
+	result.Outcome = OutcomeRTSP
+	result.StatusCode = resp.StatusCode
+	result.Server = resp.Header.Get("Server")
+	return result
+}
+
+// ClassifyDialError returns the outcome of a failed dial.
+func ClassifyDialError(err error) Outcome {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OutcomeRefused
+	case errors.As(err, &ne) && ne.Timeout():
+		return OutcomeTimeout
+	default:
+		return OutcomeError
+	}
+}
+
+// AbandonOnCancel unblocks the pending reads and writes of conn once ctx is
+// done, until stop is called.
+func AbandonOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// IsDescriptorExhaustion reports whether a probe failed because the process
+// ran out of file descriptors.
+func IsDescriptorExhaustion(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
@@ -0,0 +1,117 @@
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respond returns a Conn reading raw as the answer of the server.
+func respond(t *testing.T, raw string) *Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		// The request is read before answering, net.Pipe is synchronous.
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		server.Write([]byte(raw))
+		server.Close()
+	}()
+	c := NewConn(client)
+	c.Deadline = time.Now().Add(time.Second)
+	return c
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		code   int
+		server string
+		body   string
+		err    error
+	}{
+		{"ok", "RTSP/1.0 200 OK\r\nCSeq: 1\r\nServer: Hikvision\r\n\r\n", 200, "Hikvision", "", nil},
+		{"unauthorized", "RTSP/1.0 401 Unauthorized\r\nCSeq: 1\r\nWWW-Authenticate: Digest realm=\"x\"\r\n\r\n", 401, "", "", nil},
+		{"body", "RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 5\r\n\r\nv=0\r\n", 200, "", "v=0\r\n", nil},
+		{"no reason", "RTSP/1.0 200\r\nCSeq: 1\r\n\r\n", 200, "", "", nil},
+		{"http", "HTTP/1.1 400 Bad Request\r\n\r\n", 0, "", "", errNotRTSP},
+		{"garbage", "SSH-2.0-OpenSSH_8.4\r\n", 0, "", "", errNotRTSP},
+		{"no code", "RTSP/1.0 OK\r\n\r\n", 0, "", "", errNotRTSP},
+		{"body too large", "RTSP/1.0 200 OK\r\nContent-Length: 1073741824\r\n\r\n", 0, "", "", errBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := respond(t, tt.raw).Do("OPTIONS", "rtsp://192.0.2.1:554", nil)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.code || resp.Header.Get("Server") != tt.server || string(resp.Body) != tt.body {
+				t.Errorf("got %d %q %q, want %d %q %q", resp.StatusCode, resp.Header.Get("Server"), resp.Body, tt.code, tt.server, tt.body)
+			}
+		})
+	}
+}
+
+func TestReadResponseInvalidContentLength(t *testing.T) {
+	for _, cl := range []string{"-1", "abc", "99999999999999999999999"} {
+		_, err := respond(t, "RTSP/1.0 200 OK\r\nContent-Length: "+cl+"\r\n\r\n").Do("OPTIONS", "rtsp://192.0.2.1:554", nil)
+		if err == nil || !strings.Contains(err.Error(), "Content-Length") {
+			t.Errorf("Content-Length %s: err = %v", cl, err)
+		}
+	}
+}
+
+func TestReadInterleaved(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte("$\x01\x00\x03abc"))
+		server.Close()
+	}()
+	c := NewConn(client)
+	c.Deadline = time.Now().Add(time.Second)
+	channel, data, err := c.ReadInterleaved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != 1 || string(data) != "abc" {
+		t.Errorf("got channel %d data %q", channel, data)
+	}
+}
+
+func TestURL(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		path string
+		want string
+	}{
+		{"192.168.1.10", 554, "/stream1", "rtsp://192.168.1.10:554/stream1"},
+		{"fe80::1%eth0", 8554, "", "rtsp://[fe80::1%25eth0]:8554"},
+		{"2001:db8::1", 554, "/", "rtsp://[2001:db8::1]:554/"},
+	}
+	for _, tt := range tests {
+		if got := URL(tt.ip, tt.port, tt.path); got != tt.want {
+			t.Errorf("URL(%q, %d, %q) = %q, want %q", tt.ip, tt.port, tt.path, got, tt.want)
+		}
+	}
+	if got := SecureURL("192.168.1.10", 322, "/x"); got != "rtsps://192.168.1.10:322/x" {
+		t.Errorf("SecureURL = %q", got)
+	}
+}
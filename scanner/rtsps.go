@@ -0,0 +1,84 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// DefaultTLSPorts are the ports of RTSP over TLS (rtsps) servers.
+	DefaultTLSPorts = []int{322}
+	// DefaultTLSHandshakeTimeout is the default timeout of a TLS handshake,
+	// counted from the established TCP connection.
+	DefaultTLSHandshakeTimeout = time.Second
+)
+
+// Certificate describes the certificate an rtsps server presented.
+type Certificate struct {
+	Subject     string
+	Issuer      string
+	DNSNames    []string
+	IPAddresses []string
+	NotAfter    time.Time
+}
+
+func newCertificate(cert *x509.Certificate) *Certificate {
+	c := &Certificate{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		DNSNames: cert.DNSNames,
+		NotAfter: cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+	return c
+}
+
+// ClientTLS starts TLS on conn to the rtsps server at ip. A nil config
+// doesn't verify the certificate of the server, cameras mostly present
+// self-signed ones. The handshake must complete within timeout.
+func ClientTLS(ctx context.Context, conn net.Conn, ip string, config *tls.Config, timeout time.Duration) (*tls.Conn, *Certificate, error) {
+	if config == nil {
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = ip
+	}
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	var cert *Certificate
+	if peers := tc.ConnectionState().PeerCertificates; len(peers) > 0 {
+		cert = newCertificate(peers[0])
+	}
+	return tc, cert, nil
+}
+
+// classifyHandshakeError returns the outcome of a failed TLS handshake: a
+// port answering something else than TLS is not rtsps.
+func classifyHandshakeError(err error) Outcome {
+	var record tls.RecordHeaderError
+	var ne net.Error
+	switch {
+	case errors.As(err, &record):
+		return OutcomeNotRTSP
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout(), errors.Is(err, io.EOF):
+		return OutcomeSilent
+	default:
+		return OutcomeError
+	}
+}
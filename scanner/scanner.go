@@ -0,0 +1,359 @@
+// Package scanner finds RTSP servers by probing the hosts of IP networks.
+//
+//	s := scanner.New(scanner.Options{Ports: []int{554}})
+//	devices, err := s.Scan(ctx, networks)
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// DefaultPorts are the ports probed when Options.Ports is empty.
+	DefaultPorts = []int{554, 8554}
+	// DefaultWorkers is the number of hosts probed at once when
+	// Options.Workers is not set.
+	DefaultWorkers = 256
+	// DefaultRetryBackoff is the wait before the first retry when
+	// Options.RetryBackoff is not set.
+	DefaultRetryBackoff = 100 * time.Millisecond
+	// DefaultMaxHosts is the largest network Scan sweeps when
+	// Options.MaxHosts is not set, a /16.
+	DefaultMaxHosts = 1 << 16
+)
+
+// ErrNetworkTooLarge is returned by Scan for the networks with more hosts
+// than Options.MaxHosts, which are not swept.
+var ErrNetworkTooLarge = errors.New("network too large")
+
+// Options configure a Scanner.
+type Options struct {
+	Ports       []int
+	Workers     int
+	DialTimeout time.Duration
+	// IncludeSelf probes the address of the network itself, the address of
+	// the local host for networks of the local interfaces.
+	IncludeSelf bool
+	// MaxHosts bounds the number of hosts of a network Scan sweeps, checked
+	// before the addresses are listed.
+	MaxHosts int
+	// Prober probes the ports, an RTSPProber with DialTimeout and the TLS
+	// settings when nil.
+	Prober Prober
+	// TLSPorts are the ports of Ports probed with RTSP over TLS, the
+	// handshake taking at most TLSHandshakeTimeout and verifying the
+	// certificate with TLSConfig if set.
+	TLSPorts            []int
+	TLSHandshakeTimeout time.Duration
+	TLSConfig           *tls.Config
+	// Retries is how often a port is probed again after a timeout or a
+	// reset connection. Every retry waits twice as long as the previous one,
+	// starting at RetryBackoff plus up to as much again of jitter.
+	Retries      int
+	RetryBackoff time.Duration
+	// AdaptiveTimeout lets ProbeHosts shorten the dial timeout to four times
+	// the 95th percentile of the round-trip times observed, but not below
+	// MinDialTimeout. DialTimeout stays the upper bound and is used until
+	// hosts answered. It only applies to the RTSPProber.
+	AdaptiveTimeout bool
+	MinDialTimeout  time.Duration
+	// Limiter, when set, is shared with other scanners to bound the hosts
+	// probed at once by all of them.
+	Limiter *Limiter
+	// Throttle, when set, limits the rate of the dials of every probe and
+	// retry. It may be shared with other scanners too.
+	Throttle *Throttle
+
+	// Probing is called before a host is probed, Probed with its result and
+	// PortProbed with the outcome of every port. They are called from the
+	// workers concurrently.
+	Probing    func(ip string)
+	Probed     func(Result)
+	PortProbed func(Outcome)
+	// Panicked is called with the value and the stack of a panic of the
+	// Prober. The probe of the port fails with OutcomeError instead of
+	// crashing the process.
+	Panicked func(ip string, port int, recovered interface{}, stack []byte)
+}
+
+// Scanner probes hosts for RTSP servers. It is safe for concurrent use.
+type Scanner struct {
+	opts     Options
+	adaptive bool
+}
+
+// Stats describe a sweep of ProbeHosts.
+type Stats struct {
+	// Probed is the number of hosts probed before the context was done.
+	Probed int
+	// DialTimeout is the dial timeout in effect at the end of the sweep.
+	DialTimeout time.Duration
+}
+
+// Device is an RTSP server found by Scan.
+type Device struct {
+	IP          string
+	Ports       []int
+	StatusCode  int
+	Server      string
+	RTT         time.Duration
+	Attempts    int
+	TLSPorts    []int
+	Certificate *Certificate
+	// Network is the network the device was found on.
+	Network *net.IPNet
+}
+
+// busyWorkers counts the workers of all scanners that are busy with a host,
+// startedWorkers those started at all.
+var busyWorkers, startedWorkers int64
+
+// Workers returns the number of started workers of all scanners of the
+// process and how many of them are probing a host.
+func Workers() (started, busy int64) {
+	return atomic.LoadInt64(&startedWorkers), atomic.LoadInt64(&busyWorkers)
+}
+
+func New(opts Options) *Scanner {
+	if len(opts.Ports) == 0 {
+		opts.Ports = DefaultPorts
+	}
+	if opts.Workers < 1 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.MinDialTimeout <= 0 {
+		opts.MinDialTimeout = DefaultMinDialTimeout
+	}
+	if opts.MaxHosts <= 0 {
+		opts.MaxHosts = DefaultMaxHosts
+	}
+	adaptive := false
+	if opts.Prober == nil {
+		opts.Prober = RTSPProber{DialTimeout: opts.DialTimeout, TLSPorts: opts.TLSPorts, TLSHandshakeTimeout: opts.TLSHandshakeTimeout, TLSConfig: opts.TLSConfig}
+		adaptive = opts.AdaptiveTimeout
+	}
+	return &Scanner{opts: opts, adaptive: adaptive}
+}
+
+// Scan probes the hosts of networks and returns the RTSP servers found, by
+// network and by address. The networks are swept concurrently, without
+// probing more than Workers hosts at once unless a Limiter says otherwise.
+// When ctx is done it returns the servers found so far with the error of ctx.
+// Networks larger than MaxHosts are skipped, the others still swept, and
+// reported in an error wrapping ErrNetworkTooLarge.
+func (s *Scanner) Scan(ctx context.Context, networks []*net.IPNet) ([]Device, error) {
+	shared := *s
+	if shared.opts.Limiter == nil {
+		shared.opts.Limiter = NewLimiter(s.opts.Workers)
+	}
+	results := make([][]Result, len(networks))
+	var errs []error
+	var wg sync.WaitGroup
+	for i, network := range networks {
+		if n := HostCount(network); n > uint64(s.opts.MaxHosts) {
+			errs = append(errs, fmt.Errorf("%w: %s has %d hosts, more than %d", ErrNetworkTooLarge, network, n, s.opts.MaxHosts))
+			continue
+		}
+		wg.Add(1)
+		go func(i int, network *net.IPNet) {
+			defer wg.Done()
+			results[i], _ = shared.ProbeHosts(ctx, Hosts(network, s.opts.IncludeSelf))
+		}(i, network)
+	}
+	wg.Wait()
+
+	var found []Device
+	for i, network := range networks {
+		// The workers find the hosts in the order they answer.
+		sort.Slice(results[i], func(a, b int) bool { return lessIP(results[i][a].IP, results[i][b].IP) })
+		for _, r := range results[i] {
+			found = append(found, Device{IP: r.IP, Ports: r.Ports, StatusCode: r.StatusCode, Server: r.Server, RTT: r.RTT, Attempts: r.Attempts, TLSPorts: r.TLSPorts, Certificate: r.Certificate, Network: network})
+		}
+	}
+	return found, errors.Join(append(errs, ctx.Err())...)
+}
+
+func lessIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a < b
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16()) < 0
+}
+
+// Probe probes the ports of a single host.
+func (s *Scanner) Probe(ctx context.Context, ip string) Result {
+	return s.probe(ctx, ip, nil, false)
+}
+
+// probe probes the ports of ip. throttled tells that the token of the first
+// dial was taken already.
+func (s *Scanner) probe(ctx context.Context, ip string, rtt *rttEstimator, throttled bool) Result {
+	results := make([]Result, len(s.opts.Ports))
+	for i, port := range s.opts.Ports {
+		results[i] = s.probePort(ctx, ip, port, rtt, throttled && i == 0)
+	}
+	r := merge(results, s.opts.Ports)
+	r.IP = ip
+	return r
+}
+
+// probePort probes a port, retrying transient failures as long as the retry
+// can complete before the deadline of ctx. With an estimator the dial
+// timeout follows its estimate. Every dial waits for the throttle, but the
+// first one when throttled.
+func (s *Scanner) probePort(ctx context.Context, ip string, port int, rtt *rttEstimator, throttled bool) Result {
+	backoff := s.opts.RetryBackoff
+	var r Result
+	for attempt := 1; ; attempt++ {
+		if !(throttled && attempt == 1) && !s.opts.Throttle.wait(ctx) {
+			if attempt == 1 {
+				r = Result{IP: ip, Outcome: ClassifyDialError(ctx.Err()), Err: ctx.Err()}
+			}
+			return r
+		}
+		prober, timeout := s.opts.Prober, s.opts.DialTimeout
+		if rtt != nil {
+			timeout = rtt.current()
+			p := s.opts.Prober.(RTSPProber)
+			p.DialTimeout = timeout
+			prober = p
+		}
+		r = s.safeProbe(ctx, prober, ip, port)
+		r.Attempts = attempt
+		if rtt != nil {
+			rtt.observe(r)
+		}
+		if s.opts.PortProbed != nil {
+			s.opts.PortProbed(r.Outcome)
+		}
+		if attempt > s.opts.Retries || !retryable(r) {
+			return r
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait+timeout {
+			return r
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return r
+		}
+		backoff *= 2
+	}
+}
+
+func (s *Scanner) safeProbe(ctx context.Context, prober Prober, ip string, port int) (r Result) {
+	defer func() {
+		if v := recover(); v != nil {
+			r = Result{IP: ip, Outcome: OutcomeError, Err: fmt.Errorf("probe panicked: %v", v)}
+			if s.opts.Panicked != nil {
+				s.opts.Panicked(ip, port, v, debug.Stack())
+			}
+		}
+	}()
+	return prober.Probe(ctx, ip, port)
+}
+
+// retryable reports whether a probe failed in a way a lossy link explains.
+// Refused connections are never retried, the host answered.
+func retryable(r Result) bool {
+	return r.Outcome == OutcomeTimeout || errors.Is(r.Err, syscall.ECONNRESET)
+}
+
+// ProbeHosts probes ips with the workers of the scanner and returns the
+// results of the hosts with a positive detection.
+func (s *Scanner) ProbeHosts(ctx context.Context, ips []string) ([]Result, Stats) {
+	var rtt *rttEstimator
+	if s.adaptive {
+		rtt = newRTTEstimator(s.opts.MinDialTimeout, s.opts.DialTimeout)
+	}
+	workers := s.opts.Workers
+	if workers > len(ips) {
+		workers = len(ips)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var found []Result
+	var probed int64
+
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt64(&startedWorkers, 1)
+			defer atomic.AddInt64(&startedWorkers, -1)
+			for ip := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if s.opts.Limiter != nil && !s.opts.Limiter.acquire(ctx) {
+					continue
+				}
+				// The host counts as probed once its first dial may start.
+				if !s.opts.Throttle.wait(ctx) {
+					if s.opts.Limiter != nil {
+						s.opts.Limiter.release()
+					}
+					continue
+				}
+				atomic.AddInt64(&probed, 1)
+				if s.opts.Probing != nil {
+					s.opts.Probing(ip)
+				}
+				atomic.AddInt64(&busyWorkers, 1)
+				result := s.probe(ctx, ip, rtt, s.opts.Throttle != nil)
+				atomic.AddInt64(&busyWorkers, -1)
+				if s.opts.Limiter != nil {
+					s.opts.Limiter.release()
+				}
+				if s.opts.Probed != nil {
+					s.opts.Probed(result)
+				}
+				if result.Outcome.Found() {
+					mu.Lock()
+					found = append(found, result)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, ip := range ips {
+		select {
+		case jobs <- ip:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	stats := Stats{Probed: int(probed), DialTimeout: s.opts.DialTimeout}
+	if rtt != nil {
+		stats.DialTimeout = rtt.current()
+	}
+	return found, stats
+}
@@ -0,0 +1,467 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHost is how a host answers the fake prober on every port, unless ports
+// says otherwise.
+type fakeHost struct {
+	outcome Outcome
+	delay   time.Duration
+	ports   map[int]Outcome
+}
+
+// fakeProber simulates hosts deterministically: open, refused, timed out or
+// slow, without dialing. Hosts it doesn't know refuse the connection.
+type fakeProber struct {
+	hosts map[string]fakeHost
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	// probed is called with every probe started, before it completes.
+	probed func(ip string)
+}
+
+func newFakeProber(hosts map[string]fakeHost) *fakeProber {
+	return &fakeProber{hosts: hosts}
+}
+
+func (f *fakeProber) prober() ProberFunc {
+	return func(ctx context.Context, ip string, port int) Result {
+		f.mu.Lock()
+		f.inFlight++
+		if f.inFlight > f.max {
+			f.max = f.inFlight
+		}
+		probed := f.probed
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.inFlight--
+			f.mu.Unlock()
+		}()
+		if probed != nil {
+			probed(ip)
+		}
+
+		h, ok := f.hosts[ip]
+		if !ok {
+			return Result{IP: ip, Outcome: OutcomeRefused, Err: syscall.ECONNREFUSED}
+		}
+		if h.delay > 0 {
+			timer := time.NewTimer(h.delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return Result{IP: ip, Outcome: ClassifyDialError(ctx.Err()), Err: ctx.Err()}
+			}
+		}
+		outcome := h.outcome
+		if o, ok := h.ports[port]; ok {
+			outcome = o
+		}
+		r := Result{IP: ip, Outcome: outcome, RTT: time.Millisecond}
+		switch outcome {
+		case OutcomeRTSP:
+			r.StatusCode, r.Server = 200, "fake"
+		case OutcomeRefused:
+			r.Err = syscall.ECONNREFUSED
+		case OutcomeTimeout:
+			r.Err = timeoutError{}
+		}
+		return r
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func mustCIDR(t testing.TB, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestScanOrdering(t *testing.T) {
+	// The hosts answer in the reverse order of their addresses.
+	fake := newFakeProber(map[string]fakeHost{
+		"10.0.0.2":  {outcome: OutcomeRTSP, delay: 30 * time.Millisecond},
+		"10.0.0.3":  {outcome: OutcomeRTSP, delay: 20 * time.Millisecond},
+		"10.0.0.10": {outcome: OutcomeRTSP, delay: 10 * time.Millisecond},
+		"10.0.0.4":  {outcome: OutcomeTimeout},
+		"10.0.1.1":  {outcome: OutcomeRTSP},
+	})
+	s := New(Options{Ports: []int{554}, Prober: fake.prober()})
+	networks := []*net.IPNet{mustCIDR(t, "10.0.1.0/30"), mustCIDR(t, "10.0.0.0/28")}
+	for i := 0; i < 3; i++ {
+		devices, err := s.Scan(context.Background(), networks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, d := range devices {
+			got = append(got, d.IP+" "+d.Network.String())
+		}
+		want := []string{"10.0.1.1 10.0.1.0/30", "10.0.0.2 10.0.0.0/28", "10.0.0.3 10.0.0.0/28", "10.0.0.10 10.0.0.0/28"}
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestProbeHostsConcurrency(t *testing.T) {
+	hosts := make(map[string]fakeHost)
+	for _, ip := range Hosts(mustCIDR(t, "10.0.0.0/24"), false) {
+		hosts[ip] = fakeHost{outcome: OutcomeTimeout, delay: time.Millisecond}
+	}
+	for _, workers := range []int{1, 8, 64} {
+		fake := newFakeProber(hosts)
+		s := New(Options{Ports: []int{554}, Workers: workers, Prober: fake.prober()})
+		_, stats := s.ProbeHosts(context.Background(), Hosts(mustCIDR(t, "10.0.0.0/24"), false))
+		if stats.Probed != 254 {
+			t.Errorf("workers=%d: probed %d hosts, want 254", workers, stats.Probed)
+		}
+		if fake.max > workers {
+			t.Errorf("workers=%d: %d probes in flight", workers, fake.max)
+		}
+		if workers > 1 && fake.max < 2 {
+			t.Errorf("workers=%d: the hosts were probed one at a time", workers)
+		}
+	}
+}
+
+// TestScanLargeRange sweeps a /16 with the default pool, which must never
+// have more probes in flight than DefaultWorkers.
+func TestScanLargeRange(t *testing.T) {
+	network := mustCIDR(t, "10.1.0.0/16")
+	hosts := make(map[string]fakeHost)
+	for _, ip := range Hosts(network, false) {
+		hosts[ip] = fakeHost{outcome: OutcomeRefused, delay: time.Millisecond}
+	}
+	fake := newFakeProber(hosts)
+	s := New(Options{Ports: []int{554}, Prober: fake.prober()})
+	if _, err := s.Scan(context.Background(), []*net.IPNet{network}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.max > DefaultWorkers {
+		t.Errorf("%d probes in flight, want at most %d", fake.max, DefaultWorkers)
+	}
+	if fake.max < DefaultWorkers/2 {
+		t.Errorf("only %d probes in flight, the pool is barely used", fake.max)
+	}
+	if started, busy := Workers(); started != 0 || busy != 0 {
+		t.Errorf("%d workers left running after the scan, %d busy", started, busy)
+	}
+}
+
+// BenchmarkScanWorkers sweeps a /22 of hosts answering after a millisecond
+// with worker pools of several sizes.
+func BenchmarkScanWorkers(b *testing.B) {
+	network := mustCIDR(b, "10.2.0.0/22")
+	hosts := make(map[string]fakeHost)
+	for i, ip := range Hosts(network, false) {
+		hosts[ip] = fakeHost{outcome: OutcomeRefused, delay: time.Millisecond}
+		if i%64 == 0 {
+			hosts[ip] = fakeHost{outcome: OutcomeRTSP, delay: time.Millisecond}
+		}
+	}
+	for _, workers := range []int{16, 64, 256, 1024} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			s := New(Options{Ports: []int{554}, Workers: workers, Prober: newFakeProber(hosts).prober()})
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Scan(context.Background(), []*net.IPNet{network}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanCancellation(t *testing.T) {
+	hosts := make(map[string]fakeHost)
+	for _, ip := range Hosts(mustCIDR(t, "10.0.0.0/22"), false) {
+		hosts[ip] = fakeHost{outcome: OutcomeTimeout, delay: 5 * time.Millisecond}
+	}
+	fake := newFakeProber(hosts)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started, afterCancel int64
+	var cancelled int32
+	fake.probed = func(string) {
+		if atomic.LoadInt32(&cancelled) == 1 {
+			atomic.AddInt64(&afterCancel, 1)
+		}
+		if atomic.AddInt64(&started, 1) == 20 {
+			atomic.StoreInt32(&cancelled, 1)
+			cancel()
+		}
+	}
+	s := New(Options{Ports: []int{554}, Workers: 4, Prober: fake.prober()})
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Scan(ctx, []*net.IPNet{mustCIDR(t, "10.0.0.0/22")})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan still running after being cancelled")
+	}
+	// The workers busy when the scan was cancelled may start no new probe.
+	if n := atomic.LoadInt64(&afterCancel); n > 0 {
+		t.Errorf("%d probes started after the scan was cancelled", n)
+	}
+	if n := atomic.LoadInt64(&started); n >= 1020 {
+		t.Errorf("all %d hosts probed despite the cancellation", n)
+	}
+}
+
+func TestProbeClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     fakeHost
+		outcome  Outcome
+		ports    []int
+		attempts int
+	}{
+		{"open", fakeHost{outcome: OutcomeRTSP}, OutcomeRTSP, []int{554, 8554}, 1},
+		{"refused", fakeHost{outcome: OutcomeRefused}, OutcomeRefused, nil, 1},
+		{"timed out", fakeHost{outcome: OutcomeTimeout}, OutcomeTimeout, nil, 3},
+		{"slow", fakeHost{outcome: OutcomeRTSP, delay: 20 * time.Millisecond}, OutcomeRTSP, []int{554, 8554}, 1},
+		{"one port open", fakeHost{outcome: OutcomeRefused, ports: map[int]Outcome{8554: OutcomeRTSP}}, OutcomeRTSP, []int{8554}, 1},
+		{"timeout beats refused", fakeHost{outcome: OutcomeRefused, ports: map[int]Outcome{8554: OutcomeTimeout}}, OutcomeTimeout, nil, 3},
+		{"not rtsp beats silent", fakeHost{outcome: OutcomeSilent, ports: map[int]Outcome{554: OutcomeNotRTSP}}, OutcomeNotRTSP, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeProber(map[string]fakeHost{"10.0.0.1": tt.host})
+			s := New(Options{Ports: []int{554, 8554}, Retries: 2, RetryBackoff: time.Millisecond, Prober: fake.prober()})
+			r := s.Probe(context.Background(), "10.0.0.1")
+			if r.Outcome != tt.outcome || len(r.Ports) != len(tt.ports) || r.Attempts != tt.attempts {
+				t.Fatalf("got %s %v after %d attempts, want %s %v after %d", r.Outcome, r.Ports, r.Attempts, tt.outcome, tt.ports, tt.attempts)
+			}
+			for i := range tt.ports {
+				if r.Ports[i] != tt.ports[i] {
+					t.Errorf("ports = %v, want %v", r.Ports, tt.ports)
+				}
+			}
+		})
+	}
+}
+
+func TestProbePanic(t *testing.T) {
+	var panicked int32
+	s := New(Options{
+		Ports:    []int{554},
+		Prober:   ProberFunc(func(context.Context, string, int) Result { panic("broken prober") }),
+		Panicked: func(string, int, interface{}, []byte) { atomic.AddInt32(&panicked, 1) },
+	})
+	if r := s.Probe(context.Background(), "10.0.0.1"); r.Outcome != OutcomeError || atomic.LoadInt32(&panicked) != 1 {
+		t.Errorf("got %s, %d panics reported", r.Outcome, panicked)
+	}
+}
+
+// listen serves every connection of a local listener with serve and returns
+// its port.
+func listen(t *testing.T, serve func(conn net.Conn)) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// answer reads the request and writes response.
+func answer(response string) func(net.Conn) {
+	return func(conn net.Conn) {
+		buf := make([]byte, 1024)
+		conn.Read(buf)
+		io.WriteString(conn, response)
+	}
+}
+
+// TestRTSPProberClassification classifies what the RTSPProber hears in
+// answer to its OPTIONS request.
+func TestRTSPProberClassification(t *testing.T) {
+	// Closing without reading the request resets the connection instead.
+	closed := listen(t, func(conn net.Conn) { conn.Read(make([]byte, 1024)) })
+	tests := []struct {
+		name    string
+		port    int
+		outcome Outcome
+		code    int
+		server  string
+	}{
+		{"rtsp", listen(t, answer("RTSP/1.0 200 OK\r\nCSeq: 1\r\nServer: Dahua Rtsp Server/3.0\r\nPublic: OPTIONS, DESCRIBE\r\n\r\n")), OutcomeRTSP, 200, "Dahua Rtsp Server/3.0"},
+		{"rtsp unauthorized", listen(t, answer("RTSP/1.0 401 Unauthorized\r\nCSeq: 1\r\nWWW-Authenticate: Basic realm=\"cam\"\r\n\r\n")), OutcomeRTSP, 401, ""},
+		{"http", listen(t, answer("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")), OutcomeNotRTSP, 0, ""},
+		{"closed without answering", closed, OutcomeSilent, 0, ""},
+		{"silent", listen(t, func(conn net.Conn) { io.Copy(io.Discard, conn) }), OutcomeSilent, 0, ""},
+	}
+	p := RTSPProber{DialTimeout: time.Second}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := p.Probe(context.Background(), "127.0.0.1", tt.port)
+			if r.Outcome != tt.outcome || r.StatusCode != tt.code || r.Server != tt.server {
+				t.Errorf("got %s %d %q (%v), want %s %d %q", r.Outcome, r.StatusCode, r.Server, r.Err, tt.outcome, tt.code, tt.server)
+			}
+		})
+	}
+
+	// A port nothing listens on refuses the connection.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if r := p.Probe(context.Background(), "127.0.0.1", port); r.Outcome != OutcomeRefused {
+		t.Errorf("closed port: got %s (%v), want %s", r.Outcome, r.Err, OutcomeRefused)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Outcome
+	}{
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, OutcomeRefused},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, OutcomeTimeout},
+		{context.DeadlineExceeded, OutcomeTimeout},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, OutcomeError},
+		{&net.OpError{Op: "dial", Err: syscall.EMFILE}, OutcomeError},
+	}
+	for _, tt := range tests {
+		if got := ClassifyDialError(tt.err); got != tt.want {
+			t.Errorf("ClassifyDialError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+	if !IsDescriptorExhaustion(&net.OpError{Op: "dial", Err: syscall.EMFILE}) {
+		t.Error("EMFILE not reported as descriptor exhaustion")
+	}
+}
+
+func TestScanRejectsLargeNetworks(t *testing.T) {
+	fake := newFakeProber(map[string]fakeHost{"192.168.1.1": {outcome: OutcomeRTSP}})
+	var probed int64
+	fake.probed = func(ip string) {
+		if ip != "192.168.1.1" && ip != "192.168.1.2" {
+			atomic.AddInt64(&probed, 1)
+		}
+	}
+	s := New(Options{Ports: []int{554}, MaxHosts: 1024, Prober: fake.prober()})
+	networks := []*net.IPNet{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "192.168.1.0/30"), mustCIDR(t, "2001:db8::/64")}
+	devices, err := s.Scan(context.Background(), networks)
+	if !errors.Is(err, ErrNetworkTooLarge) {
+		t.Fatalf("err = %v, want ErrNetworkTooLarge", err)
+	}
+	for _, want := range []string{"10.0.0.0/8", "2001:db8::/64"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, doesn't name %s", err, want)
+		}
+	}
+	if len(devices) != 1 || devices[0].IP != "192.168.1.1" {
+		t.Errorf("devices = %+v, want the camera of the small network", devices)
+	}
+	if n := atomic.LoadInt64(&probed); n > 0 {
+		t.Errorf("%d hosts of the large networks probed", n)
+	}
+
+	// The networks within the limit are swept as usual.
+	if _, err := New(Options{Ports: []int{554}, MaxHosts: 1024, Prober: fake.prober()}).Scan(context.Background(), networks[1:2]); err != nil {
+		t.Errorf("err = %v for a network within the limit", err)
+	}
+}
+
+// TestScanSweep checks that a sweep probes every host of the networks on
+// every port exactly once.
+func TestScanSweep(t *testing.T) {
+	var mu sync.Mutex
+	dials := make(map[string]int)
+	prober := ProberFunc(func(ctx context.Context, ip string, port int) Result {
+		mu.Lock()
+		dials[net.JoinHostPort(ip, strconv.Itoa(port))]++
+		mu.Unlock()
+		return Result{IP: ip, Outcome: OutcomeRefused, Err: syscall.ECONNREFUSED}
+	})
+	s := New(Options{Ports: []int{554, 8554}, Workers: 16, Prober: prober})
+	networks := []*net.IPNet{mustCIDR(t, "10.0.0.0/26"), mustCIDR(t, "10.0.1.0/30")}
+	if _, err := s.Scan(context.Background(), networks); err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for _, network := range networks {
+		for _, ip := range Hosts(network, false) {
+			for _, port := range []int{554, 8554} {
+				want++
+				if n := dials[net.JoinHostPort(ip, strconv.Itoa(port))]; n != 1 {
+					t.Errorf("%s:%d probed %d times", ip, port, n)
+				}
+			}
+		}
+	}
+	if len(dials) != want {
+		t.Errorf("%d ports probed, want %d", len(dials), want)
+	}
+}
+
+func TestHostCount(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want uint64
+	}{
+		{"192.168.1.0/24", 254},
+		{"10.0.0.0/16", 65534},
+		{"10.0.0.0/8", 1<<24 - 2},
+		{"192.168.1.0/30", 2},
+		{"192.168.1.0/31", 2},
+		{"192.168.1.7/32", 1},
+		{"2001:db8::/120", 254},
+		{"2001:db8::/64", math.MaxUint64},
+		{"::/0", math.MaxUint64},
+	}
+	for _, tt := range tests {
+		if got := HostCount(mustCIDR(t, tt.cidr)); got != tt.want {
+			t.Errorf("HostCount(%s) = %d, want %d", tt.cidr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Throttle limits the rate at which the scanners sharing it open new
+// connections, so a sweep doesn't look like a burst to an intrusion
+// detection system. It is a token bucket holding a single token, spreading
+// the dials evenly, and is independent of the number of hosts probed at
+// once.
+type Throttle struct {
+	interval time.Duration
+	// turn is held by the waiter taking the next token, so the others don't
+	// all wake up for every token.
+	turn   chan struct{}
+	tokens float64
+	last   time.Time
+}
+
+// NewThrottle returns a throttle opening at most rate connections per
+// second, nil when rate is not positive.
+func NewThrottle(rate int) *Throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &Throttle{interval: time.Second / time.Duration(rate), turn: make(chan struct{}, 1), tokens: 1, last: time.Now()}
+}
+
+// wait takes a token, waiting for one, and reports whether it got one
+// before ctx was done. A waiter giving up takes no token, so a cancelled
+// scan doesn't slow down the scans sharing the throttle.
+func (t *Throttle) wait(ctx context.Context) bool {
+	if t == nil {
+		return true
+	}
+	select {
+	case t.turn <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	defer func() { <-t.turn }()
+	for {
+		now := time.Now()
+		if elapsed := now.Sub(t.last); elapsed > 0 {
+			t.tokens = math.Min(1, t.tokens+float64(elapsed)/float64(t.interval))
+			t.last = now
+		}
+		if t.tokens >= 1 {
+			t.tokens--
+			return true
+		}
+		timer := time.NewTimer(time.Duration((1 - t.tokens) * float64(t.interval)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
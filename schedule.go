@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanSchedule runs scans with its own parameters at the times of a cron
+// expression, next to the background scans.
+type scanSchedule struct {
+	name string
+	spec string
+	cron *cronSchedule
+	// query holds the scan parameters, credentials is the label of the
+	// configured credentials the scans use.
+	query       url.Values
+	credentials string
+	running     int32
+
+	mu      sync.Mutex
+	next    time.Time
+	lastRun *scheduleRun
+	skipped int
+}
+
+type scheduleRun struct {
+	ScanID     string     `json:"scan_id,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Found      int        `json:"found"`
+	Complete   bool       `json:"complete"`
+	Error      string     `json:"error,omitempty"`
+}
+
+var schedules []*scanSchedule
+
+// parseSchedules parses the -schedules flag: entries separated by ; of the
+// form name=cron?query, the query holding the parameters of the scan
+// endpoint and optionally credentials=<label>.
+func parseSchedules(s string) ([]*scanSchedule, error) {
+	var list []*scanSchedule
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(s, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("entry %q is not name=cron?parameters", entry)
+		}
+		if strings.IndexFunc(name, func(r rune) bool { return !isScheduleNameRune(r) }) >= 0 {
+			return nil, fmt.Errorf("invalid schedule name %q, expected letters, digits, -, _ and .", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate schedule %q", name)
+		}
+		names[name] = true
+
+		spec, rawQuery, _ := strings.Cut(rest, "?")
+		spec = strings.TrimSpace(spec)
+		cron, err := parseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid cron %q: %v", name, spec, err)
+		}
+		if cron.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("%s: cron %q never runs", name, spec)
+		}
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid parameters: %v", name, err)
+		}
+		if query.Has("user") || query.Has("pass") {
+			return nil, fmt.Errorf("%s: use credentials=<label> instead of user and pass", name)
+		}
+		sched := &scanSchedule{name: name, spec: spec, cron: cron, credentials: query.Get("credentials")}
+		query.Del("credentials")
+		sched.query = query
+		list = append(list, sched)
+	}
+	return list, nil
+}
+
+func isScheduleNameRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'
+}
+
+// validate checks the parameters and the credentials of the schedule against
+// the configuration.
+func (s *scanSchedule) validate() error {
+	if _, err := parseScanOptions(s.query, defaultScanOptions); err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	if _, ok := s.credential(); s.credentials != "" && !ok {
+		return fmt.Errorf("%s: unknown credentials %q", s.name, s.credentials)
+	}
+	return nil
+}
+
+// credential looks the credentials of the schedule up by their label.
+func (s *scanSchedule) credential() (credential, bool) {
+	return lookupCredential(s.credentials)
+}
+
+func (s *scanSchedule) run(ctx context.Context) {
+	s.mu.Lock()
+	s.next = s.cron.next(time.Now())
+	s.mu.Unlock()
+	for {
+		s.mu.Lock()
+		next := s.next
+		s.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		s.mu.Lock()
+		// The next run follows the one due, so a late timer doesn't run
+		// the schedule twice.
+		s.next = s.cron.next(next)
+		s.mu.Unlock()
+		s.trigger(ctx)
+	}
+}
+
+// trigger starts a scan unless the previous run of the schedule is still
+// going.
+func (s *scanSchedule) trigger(ctx context.Context) {
+	log := logger.With("schedule", s.name)
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+		s.mu.Lock()
+		s.skipped++
+		s.mu.Unlock()
+		log.Warn("Scheduled scan still running, skipping this run")
+		return
+	}
+	ctx = withRequestID(ctx, "schedule-"+s.name+"-"+newRequestID())
+	go func() {
+		defer atomic.StoreInt32(&s.running, 0)
+		run := &scheduleRun{StartedAt: time.Now()}
+		s.mu.Lock()
+		s.lastRun = run
+		s.mu.Unlock()
+
+		result, id, err := s.scan(ctx)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finished := time.Now()
+		run.FinishedAt = &finished
+		if err != nil {
+			run.Error = err.Error()
+			loggerFrom(ctx).Error("Scheduled scan failed", "schedule", s.name, "err", err)
+			return
+		}
+		run.ScanID, run.Found, run.Complete = id, len(result.Devices), !result.Partial && ctx.Err() == nil
+	}()
+}
+
+func (s *scanSchedule) scan(ctx context.Context) (*scanResult, string, error) {
+	query := make(url.Values, len(s.query)+2)
+	for k, v := range s.query {
+		query[k] = v
+	}
+	if c, ok := s.credential(); ok {
+		query.Set("user", c.username)
+		query.Set("pass", c.password)
+	}
+	networks, opts, err := resolveScan(query)
+	if err != nil {
+		return nil, "", err
+	}
+	progress := newScanProgress()
+	result := scanNetworks(ctx, networks, opts, progress)
+	if ctx.Err() == nil {
+		resultCache.put(scanKey(networks, opts), result)
+		if exportDir != "" {
+			if path, err := exportToDir(time.Now()); err != nil {
+				loggerFrom(ctx).Error("Error exporting cameras", "schedule", s.name, "dir", exportDir, "err", err)
+			} else {
+				loggerFrom(ctx).Info("Exported cameras", "schedule", s.name, "path", path)
+			}
+		}
+	}
+	return result, progress.id, nil
+}
+
+func runSchedules(ctx context.Context) {
+	for _, s := range schedules {
+		go s.run(ctx)
+	}
+}
+
+// scheduleStatus describes a configured schedule and its last run.
+type scheduleStatus struct {
+	Name        string       `json:"name"`
+	Cron        string       `json:"cron"`
+	Parameters  url.Values   `json:"parameters"`
+	Credentials string       `json:"credentials,omitempty"`
+	Running     bool         `json:"running"`
+	NextRun     *time.Time   `json:"next_run,omitempty"`
+	LastRun     *scheduleRun `json:"last_run,omitempty"`
+	// Skipped counts the runs skipped because the previous one was still
+	// going.
+	Skipped int `json:"skipped"`
+}
+
+func (s *scanSchedule) status() scheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := scheduleStatus{Name: s.name, Cron: s.spec, Parameters: s.query, Credentials: s.credentials, Running: atomic.LoadInt32(&s.running) == 1, Skipped: s.skipped}
+	if st.Parameters == nil {
+		st.Parameters = url.Values{}
+	}
+	if !s.next.IsZero() {
+		next := s.next
+		st.NextRun = &next
+	}
+	if s.lastRun != nil {
+		run := *s.lastRun
+		st.LastRun = &run
+	}
+	return st
+}
+
+func handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	list := make([]scheduleStatus, 0, len(schedules))
+	for _, s := range schedules {
+		list = append(list, s.status())
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].Name < list[k].Name })
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func writeShuttingDown(w http.ResponseWriter) {
+	writeError(w, http.StatusServiceUnavailable, codeShuttingDown, "the service is shutting down")
+}
+
+// stopAll cancels every running job, keeping their checkpoints.
+func (s *jobStore) stopAll() {
+	s.mu.Lock()
+	jobs := make([]*scanJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	for _, job := range jobs {
+		job.mu.Lock()
+		job.interrupted = true
+		job.mu.Unlock()
+		job.stop()
+	}
+}
+
+// shutdown stops the service within grace: the running scans are cancelled
+// with stopScans, the in-flight requests answered, the queued webhook and MQTT
+// messages delivered and the state saved. It reports whether requests had to
+// be cut off when grace ran out.
+func shutdown(server *http.Server, grace time.Duration, stopScans, stopDeliveries context.CancelFunc) (forced bool) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	logger.Info("Shutting down", "grace", grace.String())
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	stopScans()
+	scanJobs.stopAll()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("Grace period exceeded, closing the remaining connections", "err", err)
+		server.Close()
+		forced = true
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for webhooks.pending()+mqttPublisher.pending()+reports.pending() > 0 && ctx.Err() == nil {
+		<-ticker.C
+	}
+	if n := webhooks.pending() + mqttPublisher.pending() + reports.pending(); n > 0 {
+		logger.Warn("Grace period exceeded, dropping undelivered messages", "messages", n)
+	}
+	stopDeliveries()
+
+	if state != nil {
+		if err := state.save(); err != nil {
+			logger.Error("Error saving store", "path", state.path, "err", err)
+		}
+		state.close()
+	}
+	logger.Info("Shut down")
+	return forced
+}
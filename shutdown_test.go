@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"find_cameras/scanner"
+)
+
+// TestShutdown checks that a shutdown cancels the scans in flight, answering
+// their requests, and stops the scan jobs.
+func TestShutdown(t *testing.T) {
+	withStore(t)
+	t.Cleanup(func() { atomic.StoreInt32(&shuttingDown, 0) })
+	started := make(chan struct{}, 64)
+	withProber(t, func(ctx context.Context, ip string, port int) scanner.Result {
+		started <- struct{}{}
+		<-ctx.Done()
+		return scanner.Result{IP: ip, Outcome: scanner.ClassifyDialError(ctx.Err()), Err: ctx.Err()}
+	})
+	scans, stopScans := context.WithCancel(context.Background())
+	_, stopDeliveries := context.WithCancel(context.Background())
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.BaseContext = func(net.Listener) context.Context { return scans }
+	srv.Start()
+	defer srv.Close()
+
+	resp := postJSON(t, srv.URL+apiPrefix+"/scans?"+localScan(554), "")
+	var job startedScan
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	type answer struct {
+		status int
+		body   errorResponse
+	}
+	answers := make(chan answer, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + localScan(8554))
+		if err != nil {
+			t.Error(err)
+			answers <- answer{}
+			return
+		}
+		defer resp.Body.Close()
+		var a answer
+		a.status = resp.StatusCode
+		json.NewDecoder(resp.Body).Decode(&a.body)
+		answers <- a
+	}()
+	<-started
+
+	start := time.Now()
+	if forced := shutdown(srv.Config, 5*time.Second, stopScans, stopDeliveries); forced {
+		t.Error("requests cut off by the grace period")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	a := <-answers
+	if a.status != http.StatusServiceUnavailable || a.body.Error.Code != codeShuttingDown {
+		t.Errorf("scan in flight answered %d %+v, want 503 %s", a.status, a.body, codeShuttingDown)
+	}
+	if j := scanJobs.get(job.ID); j == nil || j.snapshot().Status != jobCancelled {
+		t.Errorf("scan job not stopped: %+v", j)
+	}
+}
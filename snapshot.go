@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scanParameters are the options of a scan worth keeping in its snapshot.
+// Credentials are left out.
+type scanParameters struct {
+	Networks        []string `json:"networks"`
+	Ports           []int    `json:"ports"`
+	ONVIFPorts      []int    `json:"onvif_ports,omitempty"`
+	RTSPSPorts      []int    `json:"rtsps_ports,omitempty"`
+	TimeoutMS       int64    `json:"timeout_ms"`
+	Retries         int      `json:"retries"`
+	Concurrency     int      `json:"concurrency"`
+	ConnectionRate  int      `json:"connection_rate,omitempty"`
+	AdaptiveTimeout bool     `json:"adaptive_timeout,omitempty"`
+	DeadlineMS      int64    `json:"deadline_ms"`
+	Prefilter       string   `json:"prefilter"`
+	ProbePaths      bool     `json:"paths,omitempty"`
+	VerifyPlay      bool     `json:"verify_play,omitempty"`
+	Verbose         bool     `json:"verbose,omitempty"`
+	Unicast         bool     `json:"unicast,omitempty"`
+	IPv6            bool     `json:"ipv6,omitempty"`
+	IncludeSelf     bool     `json:"include_self,omitempty"`
+	MaxHosts        int      `json:"max_hosts"`
+	Exclude         string   `json:"exclude,omitempty"`
+}
+
+func newScanParameters(networks []localNetwork, opts scanOptions) scanParameters {
+	p := scanParameters{
+		Networks:        make([]string, 0, len(networks)),
+		Ports:           opts.Ports,
+		ONVIFPorts:      opts.ONVIFPorts,
+		RTSPSPorts:      opts.tlsPorts(),
+		TimeoutMS:       opts.DialTimeout.Milliseconds(),
+		Retries:         opts.Retries,
+		Concurrency:     opts.Workers,
+		ConnectionRate:  opts.Rate,
+		AdaptiveTimeout: opts.AdaptiveTimeout,
+		DeadlineMS:      opts.Deadline.Milliseconds(),
+		Prefilter:       opts.Prefilter,
+		ProbePaths:      opts.ProbePaths,
+		VerifyPlay:      opts.VerifyPlay,
+		Verbose:         opts.Verbose,
+		Unicast:         opts.Unicast,
+		IPv6:            opts.IPv6,
+		IncludeSelf:     opts.IncludeSelf,
+		MaxHosts:        opts.MaxHosts,
+		Exclude:         opts.Exclude.String(),
+	}
+	for _, n := range networks {
+		p.Networks = append(p.Networks, n.String())
+	}
+	return p
+}
+
+// snapshotSummary describes a finished scan without its cameras.
+type snapshotSummary struct {
+	ID         string         `json:"id"`
+	RequestID  string         `json:"request_id,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	ScannedAt  time.Time      `json:"scanned_at"`
+	DurationMS int64          `json:"duration_ms"`
+	Complete   bool           `json:"complete"`
+	Parameters scanParameters `json:"parameters"`
+	Found      int            `json:"found"`
+}
+
+// scanSnapshot is a finished scan together with the cameras it found.
+type scanSnapshot struct {
+	snapshotSummary
+	Devices []cameraRecord `json:"devices"`
+}
+
+// snapshotStore keeps the snapshots of the most recent scans, oldest first.
+// Older snapshots are evicted once keep is reached.
+type snapshotStore struct {
+	keep int
+
+	mu        sync.Mutex
+	snapshots []scanSnapshot
+}
+
+var snapshots = &snapshotStore{keep: 20}
+
+func (s *snapshotStore) add(snap scanSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = append(s.snapshots, snap)
+	if n := len(s.snapshots) - s.keep; n > 0 {
+		s.snapshots = append([]scanSnapshot(nil), s.snapshots[n:]...)
+	}
+}
+
+func (s *snapshotStore) all() []scanSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]scanSnapshot(nil), s.snapshots...)
+}
+
+// restore replaces the snapshots with stored ones, keeping the newest.
+func (s *snapshotStore) restore(stored []scanSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(stored) - s.keep; n > 0 {
+		stored = stored[n:]
+	}
+	s.snapshots = append([]scanSnapshot(nil), stored...)
+}
+
+func (s *snapshotStore) get(id string) (scanSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, snap := range s.snapshots {
+		if snap.ID == id {
+			return snap, true
+		}
+	}
+	return scanSnapshot{}, false
+}
+
+// list returns the summaries of at most limit snapshots, newest first.
+func (s *snapshotStore) list(limit int) []snapshotSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []snapshotSummary{}
+	for i := len(s.snapshots) - 1; i >= 0 && len(list) < limit; i-- {
+		list = append(list, s.snapshots[i].snapshotSummary)
+	}
+	return list
+}
+
+// latest returns the newest complete snapshot.
+func (s *snapshotStore) latest() (scanSnapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.snapshots) - 1; i >= 0; i-- {
+		if s.snapshots[i].Complete {
+			return s.snapshots[i], true
+		}
+	}
+	return scanSnapshot{}, false
+}
+
+// pair returns the latest complete snapshot and the one it is compared with:
+// the previous complete one, or with a non-zero since the latest complete one
+// taken at or before since.
+func (s *snapshotStore) pair(since time.Time) (from, to scanSnapshot, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var complete []scanSnapshot
+	for _, snap := range s.snapshots {
+		if snap.Complete {
+			complete = append(complete, snap)
+		}
+	}
+	if len(complete) < 2 {
+		return from, to, false
+	}
+	to = complete[len(complete)-1]
+	if since.IsZero() {
+		return complete[len(complete)-2], to, true
+	}
+	for i := len(complete) - 2; i >= 0; i-- {
+		if !complete[i].ScannedAt.After(since) {
+			return complete[i], to, true
+		}
+	}
+	return from, to, false
+}
+
+type cameraChange struct {
+	ID       string       `json:"id"`
+	Fields   []string     `json:"fields"`
+	Previous cameraRecord `json:"previous"`
+	Current  cameraRecord `json:"current"`
+}
+
+type cameraDiff struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Added   []cameraRecord `json:"added"`
+	Removed []cameraRecord `json:"removed"`
+	Changed []cameraChange `json:"changed"`
+}
+
+// changedFields returns the fields that differ between two sightings of the
+// same camera. The firmware version reported over ONVIF is compared when
+// both sightings have it, the RTSP server banner otherwise.
+func changedFields(a, b *cameraRecord) []string {
+	var fields []string
+	if a.IP != b.IP {
+		fields = append(fields, "ip")
+	}
+	if !equalPorts(a.Ports, b.Ports) {
+		fields = append(fields, "ports")
+	}
+	if a.FirmwareVersion != "" && b.FirmwareVersion != "" {
+		if a.FirmwareVersion != b.FirmwareVersion {
+			fields = append(fields, "firmware_version")
+		}
+	} else if a.Server != b.Server {
+		fields = append(fields, "server")
+	}
+	return fields
+}
+
+func equalPorts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]int(nil), a...)
+	b = append([]int(nil), b...)
+	sort.Ints(a)
+	sort.Ints(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func diffSnapshots(from, to scanSnapshot) cameraDiff {
+	// Devices ignored since the scans are left out as well.
+	keep := func(r cameraRecord) bool { return !ignored.matches(&r.device, r.ID) }
+	from.Devices, to.Devices = filterSlice(from.Devices, keep), filterSlice(to.Devices, keep)
+	diff := cameraDiff{From: from.ScannedAt, To: to.ScannedAt, Added: []cameraRecord{}, Removed: []cameraRecord{}, Changed: []cameraChange{}}
+	previous := make(map[string]*cameraRecord, len(from.Devices))
+	for i := range from.Devices {
+		previous[from.Devices[i].ID] = &from.Devices[i]
+	}
+	current := make(map[string]bool, len(to.Devices))
+	for i := range to.Devices {
+		r := &to.Devices[i]
+		current[r.ID] = true
+		p, ok := previous[r.ID]
+		if !ok {
+			diff.Added = append(diff.Added, *r)
+			continue
+		}
+		if fields := changedFields(p, r); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, cameraChange{ID: r.ID, Fields: fields, Previous: *p, Current: *r})
+		}
+	}
+	for _, r := range from.Devices {
+		if !current[r.ID] {
+			diff.Removed = append(diff.Removed, r)
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].ID < diff.Added[j].ID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].ID < diff.Changed[j].ID })
+	return diff
+}
+
+func handleCamerasDiff(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid since: "+err.Error())
+			return
+		}
+	}
+	from, to, ok := snapshots.pair(since)
+	if !ok {
+		message := "At least two complete scans are needed to compute a diff"
+		if !since.IsZero() {
+			message = "No retained scan at or before " + since.Format(time.RFC3339) + " to compare with"
+		}
+		writeError(w, http.StatusConflict, codeNotEnoughSnapshots, message)
+		return
+	}
+	writeJSONCacheable(w, r, diffSnapshots(from, to), to.ScannedAt)
+}
+
+// lastScanResponse is the newest complete scan with its age.
+type lastScanResponse struct {
+	scanSnapshot
+	AgeSeconds int64 `json:"age_seconds"`
+}
+
+// handleLastScan returns the cameras of the newest complete scan from the
+// history. It never probes nor waits for running scans.
+func handleLastScan(w http.ResponseWriter, r *http.Request) {
+	snap, ok := snapshots.latest()
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "No scan has completed yet")
+		return
+	}
+	age := int64(time.Since(snap.ScannedAt).Seconds())
+	writeJSON(w, http.StatusOK, lastScanResponse{snap, age})
+}
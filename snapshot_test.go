@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	camera := func(id, ip string, ports []int, server, firmware string) cameraRecord {
+		return cameraRecord{ID: id, device: device{IP: ip, Ports: ports, Server: server, FirmwareVersion: firmware}}
+	}
+	gate := camera("mac:00:11:22:33:44:55", "10.0.0.7", []int{554}, "Hikvision RTSP Server", "V5.5.82 build 190909")
+	tests := []struct {
+		name                    string
+		from, to                []cameraRecord
+		added, removed, changed string
+	}{
+		{"unchanged", []cameraRecord{gate}, []cameraRecord{gate}, "", "", ""},
+		{"added", nil, []cameraRecord{gate}, "mac:00:11:22:33:44:55", "", ""},
+		{"removed", []cameraRecord{gate}, nil, "", "mac:00:11:22:33:44:55", ""},
+		{"ip", []cameraRecord{gate}, []cameraRecord{camera(gate.ID, "10.0.0.9", []int{554}, gate.Server, gate.FirmwareVersion)}, "", "", "ip"},
+		{"ports in another order", []cameraRecord{camera(gate.ID, gate.IP, []int{554, 8554}, "", "")}, []cameraRecord{camera(gate.ID, gate.IP, []int{8554, 554}, "", "")}, "", "", ""},
+		{"ports", []cameraRecord{gate}, []cameraRecord{camera(gate.ID, gate.IP, []int{554, 8554}, gate.Server, gate.FirmwareVersion)}, "", "", "ports"},
+		{"firmware version", []cameraRecord{gate}, []cameraRecord{camera(gate.ID, gate.IP, gate.Ports, gate.Server, "V5.7.3 build 220112")}, "", "", "firmware_version"},
+		// The banner is only compared when a sighting lacks the version.
+		{"banner with versions", []cameraRecord{gate}, []cameraRecord{camera(gate.ID, gate.IP, gate.Ports, "", gate.FirmwareVersion)}, "", "", ""},
+		{"banner without version", []cameraRecord{camera(gate.ID, gate.IP, gate.Ports, "Dahua Rtsp Server/2.0", "")}, []cameraRecord{camera(gate.ID, gate.IP, gate.Ports, "Dahua Rtsp Server/3.0", "")}, "", "", "server"},
+		{"version appearing", []cameraRecord{camera(gate.ID, gate.IP, gate.Ports, gate.Server, "")}, []cameraRecord{gate}, "", "", ""},
+		{"ip and ports", []cameraRecord{gate}, []cameraRecord{camera(gate.ID, "10.0.0.9", []int{8554}, gate.Server, gate.FirmwareVersion)}, "", "", "ip,ports"},
+	}
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ids := func(records []cameraRecord) string {
+		var list []string
+		for _, r := range records {
+			list = append(list, r.ID)
+		}
+		return strings.Join(list, ",")
+	}
+	for _, tt := range tests {
+		from := scanSnapshot{snapshotSummary: snapshotSummary{ScannedAt: at}, Devices: tt.from}
+		to := scanSnapshot{snapshotSummary: snapshotSummary{ScannedAt: at.Add(time.Minute)}, Devices: tt.to}
+		diff := diffSnapshots(from, to)
+		var changed []string
+		for _, c := range diff.Changed {
+			changed = append(changed, c.Fields...)
+		}
+		if ids(diff.Added) != tt.added || ids(diff.Removed) != tt.removed || strings.Join(changed, ",") != tt.changed {
+			t.Errorf("%s: added %q, removed %q, changed %q, want %q, %q and %q", tt.name, ids(diff.Added), ids(diff.Removed), changed, tt.added, tt.removed, tt.changed)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFetchTimeout = 5 * time.Second
+	maxSnapshotSize      = 8 << 20
+	// snapshotCacheTTL is how long a fetched image is served to every
+	// dashboard asking for it before the camera is asked again.
+	snapshotCacheTTL = 5 * time.Second
+)
+
+var (
+	errNoSnapshotURI  = errors.New("no snapshot URI known for this camera")
+	errSnapshotTooBig = fmt.Errorf("snapshot larger than %d bytes", maxSnapshotSize)
+	// errInsecureSnapshotBasic refuses to send the passwords in clear, like
+	// the ONVIF clients do.
+	errInsecureSnapshotBasic = errors.New("the camera asks for HTTP Basic authentication over plain http, which would send the password in clear; refused unless -onvif-insecure-basic is set")
+)
+
+// snapshotHTTPClient doesn't follow redirects, which cameras only send to
+// their login page.
+var snapshotHTTPClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// cameraSnapshot is a JPEG fetched from a camera.
+type cameraSnapshot struct {
+	done        chan struct{}
+	fetched     time.Time
+	contentType string
+	body        []byte
+	err         error
+}
+
+// snapshotCache keeps the snapshots of the cameras for snapshotCacheTTL.
+// Requests arriving while a snapshot is fetched wait for it instead of
+// fetching it again.
+type snapshotCache struct {
+	mu        sync.Mutex
+	snapshots map[string]*cameraSnapshot
+}
+
+var snapshotImages = &snapshotCache{snapshots: make(map[string]*cameraSnapshot)}
+
+// get returns the snapshot of the camera with the given id, fetching it
+// with fetch unless a recent one is cached. Failed fetches aren't cached.
+func (c *snapshotCache) get(ctx context.Context, id string, fetch func(context.Context) (string, []byte, error)) (*cameraSnapshot, error) {
+	c.mu.Lock()
+	now := time.Now()
+	for key, s := range c.snapshots {
+		if !s.fetched.IsZero() && now.Sub(s.fetched) > snapshotCacheTTL {
+			delete(c.snapshots, key)
+		}
+	}
+	s, ok := c.snapshots[id]
+	if !ok {
+		s = &cameraSnapshot{done: make(chan struct{})}
+		c.snapshots[id] = s
+		go func() {
+			fetchCtx, cancel := context.WithTimeout(withRequestID(context.Background(), requestID(ctx)), snapshotFetchTimeout)
+			defer cancel()
+			s.contentType, s.body, s.err = fetch(fetchCtx)
+			c.mu.Lock()
+			if s.err != nil {
+				delete(c.snapshots, id)
+			} else {
+				s.fetched = time.Now()
+			}
+			c.mu.Unlock()
+			close(s.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return s, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func handleCameraSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	record, ok := cameras.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, codeCameraNotFound, "unknown camera "+id)
+		return
+	}
+	if record.SnapshotURI == "" {
+		writeError(w, http.StatusNotFound, codeNoSnapshot, errNoSnapshotURI.Error())
+		return
+	}
+	query := r.URL.Query()
+	cred, hasCred := snapshotCredential(&record.device, query.Get("user"), query.Get("pass"))
+
+	key := id
+	if query.Get("user") != "" {
+		// Images fetched with other credentials of a request aren't shared.
+		key += "\xff" + query.Get("user") + "\xff" + query.Get("pass")
+	}
+	snap, err := snapshotImages.get(r.Context(), key, func(ctx context.Context) (string, []byte, error) {
+		return fetchSnapshot(ctx, record.SnapshotURI, cred, hasCred)
+	})
+	switch {
+	case err == nil:
+	case r.Context().Err() != nil:
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, codeCameraTimeout, fmt.Sprintf("the camera didn't send a snapshot within %s", snapshotFetchTimeout))
+		return
+	default:
+		writeError(w, http.StatusBadGateway, codeCameraError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", snap.contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(snapshotCacheTTL.Seconds())))
+	w.Header().Set("Last-Modified", snap.fetched.UTC().Format(http.TimeFormat))
+	w.Write(snap.body)
+}
+
+// snapshotCredential picks the credentials a snapshot is fetched with: those
+// of the request, the configured ONVIF credentials the camera accepted, or
+// the RTSP credentials it accepted.
+func snapshotCredential(d *device, username, password string) (credential, bool) {
+	if username != "" {
+		return credential{"request", username, password}, true
+	}
+	for _, cred := range onvifCredentials.credentials {
+		if cred.label == d.ONVIFCredential {
+			return cred, true
+		}
+	}
+	if d.rtspCredential != nil {
+		return *d.rtspCredential, true
+	}
+	return credential{}, false
+}
+
+// fetchSnapshot fetches an image from rawURL, answering a Basic or Digest
+// challenge of the camera once with cred. Basic challenges of http:// URLs
+// are only answered with -onvif-insecure-basic.
+func fetchSnapshot(ctx context.Context, rawURL string, cred credential, hasCred bool) (string, []byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	u.User = nil
+
+	resp, err := getSnapshot(ctx, u.String(), "")
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && hasCred {
+		resp.Body.Close()
+		var authorization string
+		if authorization, err = challengeAuthorization(resp.Header.Values("WWW-Authenticate"), cred, http.MethodGet, u.RequestURI()); err != nil {
+			return "", nil, err
+		}
+		if strings.HasPrefix(authorization, "Basic ") && u.Scheme != "https" && !onvifInsecureBasic {
+			return "", nil, errInsecureSnapshotBasic
+		}
+		if resp, err = getSnapshot(ctx, u.String(), authorization); err != nil {
+			return "", nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("the camera answered %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !strings.HasPrefix(mediaType, "image/") {
+		return "", nil, fmt.Errorf("the camera sent %q instead of an image", contentType)
+	}
+	if resp.ContentLength > maxSnapshotSize {
+		return "", nil, errSnapshotTooBig
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(body) > maxSnapshotSize {
+		return "", nil, errSnapshotTooBig
+	}
+	return contentType, body, nil
+}
+
+func getSnapshot(ctx context.Context, rawURL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return snapshotHTTPClient.Do(req)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// basicCamera serves a snapshot behind HTTP Basic authentication and counts
+// the requests carrying credentials.
+func basicCamera(authorized *int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			atomic.AddInt64(authorized, 1)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="camera"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("\xff\xd8jpeg"))
+	})
+}
+
+// TestSnapshotBasicAuth checks that the password is only sent to a camera
+// asking for Basic authentication over https, or with -onvif-insecure-basic.
+func TestSnapshotBasicAuth(t *testing.T) {
+	withStore(t)
+	var authorized int64
+	plain := httptest.NewServer(basicCamera(&authorized))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(basicCamera(&authorized))
+	defer secure.Close()
+	client := snapshotHTTPClient
+	snapshotHTTPClient = secure.Client()
+	snapshotHTTPClient.CheckRedirect = client.CheckRedirect
+	t.Cleanup(func() { snapshotHTTPClient = client })
+	cameras.restore([]storedCamera{
+		{cameraRecord: cameraRecord{ID: "ip:10.0.0.1", device: device{IP: "10.0.0.1", SnapshotURI: plain.URL + "/snap.jpg"}}},
+		{cameraRecord: cameraRecord{ID: "ip:10.0.0.2", device: device{IP: "10.0.0.2", SnapshotURI: plain.URL + "/snap.jpg"}}},
+		{cameraRecord: cameraRecord{ID: "ip:10.0.0.3", device: device{IP: "10.0.0.3", SnapshotURI: secure.URL + "/snap.jpg"}}},
+	})
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		id            string
+		insecureBasic bool
+		status        int
+		authorized    int64
+	}{
+		{"ip:10.0.0.1", false, http.StatusBadGateway, 0},
+		{"ip:10.0.0.2", true, http.StatusOK, 1},
+		{"ip:10.0.0.3", false, http.StatusOK, 1},
+	}
+	insecure := onvifInsecureBasic
+	t.Cleanup(func() { onvifInsecureBasic = insecure })
+	for _, tt := range tests {
+		onvifInsecureBasic = tt.insecureBasic
+		atomic.StoreInt64(&authorized, 0)
+		resp, body := doRequest(t, srv, http.MethodGet, apiPrefix+"/cameras/"+tt.id+"/snapshot?user=admin&pass=secret")
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d %s, want %d", tt.id, resp.StatusCode, body, tt.status)
+		}
+		if n := atomic.LoadInt64(&authorized); n != tt.authorized {
+			t.Errorf("%s: %d requests with credentials, want %d", tt.id, n, tt.authorized)
+		}
+		if tt.status == http.StatusBadGateway {
+			var e errorResponse
+			json.Unmarshal([]byte(body), &e)
+			if e.Error.Code != codeCameraError || !strings.Contains(e.Error.Message, "-onvif-insecure-basic") {
+				t.Errorf("%s: error %+v", tt.id, e.Error)
+			}
+		}
+	}
+}
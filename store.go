@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeVersion is the schema version of the store. Bump it together with a
+// new entry of storeMigrations when the layout changes.
+const storeVersion = 1
+
+// storeMigrations upgrade the store in place: storeMigrations[i] turns
+// version i+1 into version i+2.
+var storeMigrations = []func(tx *bolt.Tx) error{}
+
+var (
+	bucketMeta        = []byte("meta")
+	bucketCameras     = []byte("cameras")
+	bucketSnapshots   = []byte("snapshots")
+	bucketCheckpoints = []byte("checkpoints")
+	bucketIgnored     = []byte("ignored")
+
+	keyVersion = []byte("version")
+)
+
+// storeOpenTimeout bounds the wait for the lock of a store used by another
+// process.
+const storeOpenTimeout = time.Second
+
+type storedCamera struct {
+	cameraRecord
+	Missed  int  `json:"missed"`
+	Removed bool `json:"removed"`
+}
+
+// storeFile is the layout of the JSON file the store was kept in before it
+// moved to bbolt, imported once.
+type storeFile struct {
+	Version   int            `json:"version"`
+	SavedAt   time.Time      `json:"saved_at"`
+	Cameras   []storedCamera `json:"cameras"`
+	Snapshots []scanSnapshot `json:"snapshots"`
+	// Checkpoints are the scan jobs that can be resumed.
+	Checkpoints []scanCheckpoint `json:"checkpoints,omitempty"`
+	Ignored     []ignoreEntry    `json:"ignored,omitempty"`
+}
+
+// stateStore persists the camera registry, the scan history and the job
+// checkpoints to a bbolt database, so they survive restarts. Every camera,
+// snapshot, checkpoint and ignore entry is a key of its own: saves are
+// coalesced and only write the keys that changed, the history written once.
+type stateStore struct {
+	path  string
+	dirty chan struct{}
+
+	mu sync.Mutex
+	db *bolt.DB
+}
+
+var state *stateStore
+
+// newStateStore returns nil, which persists nothing, when path is empty.
+func newStateStore(path string) *stateStore {
+	if path == "" {
+		return nil
+	}
+	return &stateStore{path: path, dirty: make(chan struct{}, 1)}
+}
+
+// load opens the store and restores the registry and the history from it. A
+// store that cannot be read is moved aside so the service starts clean.
+func (s *stateStore) load() {
+	if s == nil {
+		return
+	}
+	legacy, err := readLegacyStore(s.path)
+	if err != nil {
+		s.moveAside(err)
+	}
+	if legacy != nil {
+		// The version 1 file is kept next to the database it was imported to.
+		aside := s.path + ".json"
+		if err := os.Rename(s.path, aside); err != nil {
+			fatal("Error moving the JSON store aside", "path", s.path, "err", err)
+		}
+		logger.Info("Importing JSON store", "path", s.path, "aside", aside)
+	}
+
+	f, err := s.open()
+	if errors.Is(err, bolt.ErrTimeout) {
+		fatal("Store is in use by another process", "path", s.path)
+	}
+	if err != nil {
+		s.moveAside(err)
+		if f, err = s.open(); err != nil {
+			fatal("Error creating store", "path", s.path, "err", err)
+		}
+	}
+	if legacy != nil {
+		f = legacy
+	}
+	cameras.restore(f.Cameras)
+	ignored.restore(f.Ignored)
+	snapshots.restore(f.Snapshots)
+	scanJobs.restoreCheckpoints(f.Checkpoints, time.Now())
+	logger.Info("Loaded store", "path", s.path, "cameras", len(f.Cameras), "snapshots", len(f.Snapshots), "checkpoints", len(f.Checkpoints))
+	if legacy != nil {
+		if err := s.save(); err != nil {
+			logger.Error("Error saving store", "path", s.path, "err", err)
+		}
+	}
+}
+
+func (s *stateStore) moveAside(err error) {
+	aside := fmt.Sprintf("%s.broken-%d", s.path, time.Now().Unix())
+	logger.Error("Error loading store, moving it aside and starting clean", "path", s.path, "aside", aside, "err", err)
+	if err := os.Rename(s.path, aside); err != nil {
+		logger.Error("Error moving store aside", "path", s.path, "err", err)
+	}
+}
+
+// open opens the database, creating or migrating it, and reads it. The
+// database is closed again when it cannot be read.
+func (s *stateStore) open() (f *storeFile, err error) {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: storeOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// bbolt panics on some corrupted pages rather than failing.
+		if v := recover(); v != nil {
+			err = fmt.Errorf("corrupted store: %v", v)
+		}
+		if err != nil {
+			db.Close()
+			return
+		}
+		s.mu.Lock()
+		s.db = db
+		s.mu.Unlock()
+	}()
+	if err := db.Update(migrateStore); err != nil {
+		return nil, err
+	}
+	f = &storeFile{Version: storeVersion}
+	err = db.View(func(tx *bolt.Tx) error {
+		return firstError(
+			readBucket(tx, bucketCameras, &f.Cameras),
+			readBucket(tx, bucketSnapshots, &f.Snapshots),
+			readBucket(tx, bucketCheckpoints, &f.Checkpoints),
+			readBucket(tx, bucketIgnored, &f.Ignored),
+		)
+	})
+	return f, err
+}
+
+// migrateStore creates the buckets of a new store and upgrades an older one.
+func migrateStore(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+	if err != nil {
+		return err
+	}
+	version := storeVersion
+	if v := meta.Get(keyVersion); v != nil {
+		if version, err = strconv.Atoi(string(v)); err != nil {
+			return fmt.Errorf("invalid version %q", v)
+		}
+	}
+	if version < 1 || version > storeVersion {
+		return fmt.Errorf("unsupported version %d", version)
+	}
+	for ; version < storeVersion; version++ {
+		if err := storeMigrations[version-1](tx); err != nil {
+			return fmt.Errorf("migrating from version %d: %w", version, err)
+		}
+	}
+	for _, name := range [][]byte{bucketCameras, bucketSnapshots, bucketCheckpoints, bucketIgnored} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return meta.Put(keyVersion, []byte(strconv.Itoa(storeVersion)))
+}
+
+// readBucket decodes the values of a bucket into list, in the order of their
+// keys.
+func readBucket[T any](tx *bolt.Tx, name []byte, list *[]T) error {
+	return tx.Bucket(name).ForEach(func(k, v []byte) error {
+		var item T
+		if err := json.Unmarshal(v, &item); err != nil {
+			return fmt.Errorf("%s %q: %w", name, k, err)
+		}
+		*list = append(*list, item)
+		return nil
+	})
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLegacyStore reads the JSON file of version 1 stores, nil when path is
+// missing or a database.
+func readLegacyStore(path string) (*storeFile, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// The JSON files were written without leading white space.
+	first := make([]byte, 1)
+	if _, err := file.Read(first); err != nil || first[0] != '{' {
+		return nil, nil
+	}
+	file.Seek(0, io.SeekStart)
+	var f storeFile
+	if err := json.NewDecoder(file).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", f.Version)
+	}
+	return &f, nil
+}
+
+// changed schedules a save of the current state.
+func (s *stateStore) changed() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stateStore) run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	for {
+		select {
+		case <-s.dirty:
+			if err := s.save(); err != nil {
+				logger.Error("Error saving store", "path", s.path, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// storeEntry is a key of a bucket, value encoding it on demand.
+type storeEntry struct {
+	key   []byte
+	value func() ([]byte, error)
+}
+
+func jsonEntry(key []byte, v interface{}) storeEntry {
+	return storeEntry{key, func() ([]byte, error) { return json.Marshal(v) }}
+}
+
+func (s *stateStore) save() error {
+	s.mu.Lock()
+	db := s.db
+	s.mu.Unlock()
+	if db == nil {
+		return errors.New("store is not open")
+	}
+
+	var cameraEntries, snapshotEntries, checkpointEntries, ignoredEntries []storeEntry
+	for _, c := range cameras.stored() {
+		c := c
+		cameraEntries = append(cameraEntries, jsonEntry([]byte(c.ID), &c))
+	}
+	for _, snap := range snapshots.all() {
+		snap := snap
+		snapshotEntries = append(snapshotEntries, jsonEntry(snapshotKey(&snap), &snap))
+	}
+	// The running jobs are checkpointed with every save.
+	for _, c := range scanJobs.checkpoints() {
+		c := c
+		checkpointEntries = append(checkpointEntries, jsonEntry([]byte(c.ID), &c))
+	}
+	for _, e := range ignored.list() {
+		e := e
+		ignoredEntries = append(ignoredEntries, jsonEntry([]byte(e.Key), &e))
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return firstError(
+			syncBucket(tx.Bucket(bucketCameras), cameraEntries, false),
+			// Snapshots never change once taken.
+			syncBucket(tx.Bucket(bucketSnapshots), snapshotEntries, true),
+			syncBucket(tx.Bucket(bucketCheckpoints), checkpointEntries, false),
+			syncBucket(tx.Bucket(bucketIgnored), ignoredEntries, false),
+		)
+	})
+}
+
+// snapshotKey orders the snapshots by the time they were taken.
+func snapshotKey(snap *scanSnapshot) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(snap.ScannedAt.UnixNano()))
+	return append(key, snap.ID...)
+}
+
+// syncBucket makes entries the contents of b, writing only the keys that
+// changed. The values of immutable entries already stored aren't encoded
+// again.
+func syncBucket(b *bolt.Bucket, entries []storeEntry, immutable bool) error {
+	keep := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		keep[string(e.key)] = true
+		old := b.Get(e.key)
+		if old != nil && immutable {
+			continue
+		}
+		data, err := e.value()
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(old, data) {
+			continue
+		}
+		if err := b.Put(e.key, data); err != nil {
+			return err
+		}
+	}
+	var stale [][]byte
+	err := b.ForEach(func(k, _ []byte) error {
+		if !keep[string(k)] {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range stale {
+		if err == nil {
+			err = b.Delete(k)
+		}
+	}
+	return err
+}
+
+// close closes the database once saved for the last time.
+func (s *stateStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
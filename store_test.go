@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// withStore runs the test against a store in a temporary directory, resetting
+// the state it persists.
+func withStore(t *testing.T) *stateStore {
+	t.Helper()
+	reset := func() {
+		cameras = newRegistry()
+		ignored.restore(nil)
+		snapshots.restore(nil)
+	}
+	reset()
+	t.Cleanup(reset)
+	s := newStateStore(filepath.Join(t.TempDir(), "state.db"))
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func storeTestCameras(at time.Time) []storedCamera {
+	return []storedCamera{
+		{cameraRecord: cameraRecord{ID: "mac:00:11:22:33:44:55", FirstSeen: at, LastSeen: at, device: device{IP: "10.0.0.7", MAC: "00:11:22:33:44:55", Ports: []int{554}}}},
+		{cameraRecord: cameraRecord{ID: "ip:10.0.0.8", FirstSeen: at, LastSeen: at, device: device{IP: "10.0.0.8", Ports: []int{8554}}}, Missed: 2, Removed: true},
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	s := withStore(t)
+	s.load()
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cameras.restore(storeTestCameras(at))
+	ignored.restore([]ignoreEntry{{Key: "ip:10.0.0.9", Type: "ip", Value: "10.0.0.9", AddedAt: at}})
+	for i := 0; i < 3; i++ {
+		snapshots.add(scanSnapshot{snapshotSummary: snapshotSummary{ID: "snap" + string(rune('a'+i)), ScannedAt: at.Add(time.Duration(i) * time.Minute)}})
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	cameras = newRegistry()
+	ignored.restore(nil)
+	snapshots.restore(nil)
+	s.load()
+	got := cameras.stored()
+	if len(got) != 2 || got[0].ID != "ip:10.0.0.8" || !got[0].Removed || got[0].Missed != 2 || got[1].MAC != "00:11:22:33:44:55" {
+		t.Errorf("cameras = %+v", got)
+	}
+	if l := ignored.list(); len(l) != 1 || l[0].Value != "10.0.0.9" {
+		t.Errorf("ignored = %+v", l)
+	}
+	snaps := snapshots.all()
+	if len(snaps) != 3 || snaps[0].ID != "snapa" || snaps[2].ID != "snapc" {
+		t.Errorf("snapshots out of order: %+v", snaps)
+	}
+}
+
+// TestStoreSavesChangesOnly checks that a save leaves the keys that didn't
+// change alone, so checkpoints don't rewrite the history.
+func TestStoreSavesChangesOnly(t *testing.T) {
+	s := withStore(t)
+	s.load()
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cameras.restore(storeTestCameras(at))
+	snapshots.add(scanSnapshot{snapshotSummary: snapshotSummary{ID: "first", ScannedAt: at}})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value bbolt would only keep if nothing rewrote the snapshot.
+	snap := snapshots.all()[0]
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshots).Put(snapshotKey(&snap), []byte(`{"id":"first","found":42}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := cameras.stored()[1]
+	cameras.restore([]storedCamera{record})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketSnapshots).Get(snapshotKey(&snap)); !strings.Contains(string(v), `"found":42`) {
+			t.Errorf("snapshot rewritten: %s", v)
+		}
+		if n := tx.Bucket(bucketCameras).Stats().KeyN; n != 1 {
+			t.Errorf("%d cameras stored, want 1", n)
+		}
+		return nil
+	})
+}
+
+func TestStoreCorrupted(t *testing.T) {
+	s := withStore(t)
+	if err := os.WriteFile(s.path, []byte("not a database, certainly not one of 4 KiB"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.load()
+	if s.db == nil {
+		t.Fatal("store not opened after moving the corrupted file aside")
+	}
+	aside, _ := filepath.Glob(s.path + ".broken-*")
+	if len(aside) != 1 {
+		t.Errorf("corrupted file not moved aside: %v", aside)
+	}
+	if n := len(cameras.list()); n != 0 {
+		t.Errorf("%d cameras loaded", n)
+	}
+}
+
+func TestStoreNewerVersion(t *testing.T) {
+	s := withStore(t)
+	db, err := bolt.Open(s.path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket(bucketMeta)
+		return meta.Put(keyVersion, []byte("99"))
+	})
+	db.Close()
+
+	s.load()
+	if aside, _ := filepath.Glob(s.path + ".broken-*"); len(aside) != 1 {
+		t.Errorf("store of a newer version not moved aside: %v", aside)
+	}
+	if s.db == nil {
+		t.Fatal("store not opened")
+	}
+}
+
+func TestStoreImportsJSON(t *testing.T) {
+	s := withStore(t)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	data, _ := json.Marshal(storeFile{Version: 1, SavedAt: at, Cameras: storeTestCameras(at)})
+	if err := os.WriteFile(s.path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.load()
+	if n := len(cameras.stored()); n != 2 {
+		t.Fatalf("%d cameras imported, want 2", n)
+	}
+	if _, err := os.Stat(s.path + ".json"); err != nil {
+		t.Errorf("JSON store not kept aside: %v", err)
+	}
+	s.close()
+
+	cameras = newRegistry()
+	s.load()
+	if n := len(cameras.stored()); n != 2 {
+		t.Errorf("%d cameras loaded from the database, want 2", n)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"find_cameras/scanner"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	streamProgressInterval  = time.Second
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *sseWriter) event(name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Error encoding event", "event", name, "err", err)
+		return
+	}
+	fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data)
+	s.flusher.Flush()
+}
+
+func (s *sseWriter) comment(text string) {
+	fmt.Fprintf(s.w, ": %s\n\n", text)
+	s.flusher.Flush()
+}
+
+// runStreamedScan runs a scan and hands the cameras found by the sweep to
+// found as they answer, in the order they answered, and the devices enriched
+// to enriched as their enrichment completes. found, enriched and tick are
+// called from the calling goroutine only, the final result is returned once
+// the scan completes.
+func runStreamedScan(ctx context.Context, networks []localNetwork, opts scanOptions, found func(scanner.Result), enriched func(device), tick func(progressReport)) *scanResult {
+	results := make(chan scanner.Result, 64)
+	enrichedDevices := make(chan device, 16)
+	progress := newScanProgress()
+	progress.onFound = func(r scanner.Result) {
+		select {
+		case results <- r:
+		case <-ctx.Done():
+		}
+	}
+	progress.onEnriched = func(d device) {
+		select {
+		case enrichedDevices <- d:
+		case <-ctx.Done():
+		}
+	}
+
+	done := make(chan *scanResult, 1)
+	go func() {
+		done <- scanNetworks(ctx, networks, opts, progress)
+	}()
+
+	ticker := time.NewTicker(streamProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-results:
+			found(r)
+		case d := <-enrichedDevices:
+			enriched(d)
+		case <-ticker.C:
+			tick(progress.report())
+		case result := <-done:
+			for {
+				select {
+				case r := <-results:
+					found(r)
+				case d := <-enrichedDevices:
+					enriched(d)
+				default:
+					return result
+				}
+			}
+		}
+	}
+}
+
+// streamEvents runs a scan and reports it as a sequence of events: a device
+// event per camera as soon as it is found, an update event once a camera is
+// enriched, progress events while the counters change and a final done event.
+// idle is called on the progress ticks where nothing changed.
+func streamEvents(ctx context.Context, networks []localNetwork, opts scanOptions, emit func(event string, v interface{}), idle func()) {
+	// emitted holds the last version of every device sent.
+	emitted := make(map[string]device)
+	var last progressReport
+	result := runStreamedScan(ctx, networks, opts,
+		func(found scanner.Result) {
+			if _, ok := emitted[found.IP]; ok {
+				return
+			}
+			set := newDeviceSet()
+			set.addRTSP([]scanner.Result{found})
+			if isIgnored(&set.devices[0]) {
+				return
+			}
+			emitted[found.IP] = set.devices[0]
+			emit("device", set.devices[0])
+		},
+		func(d device) {
+			if isIgnored(&d) {
+				return
+			}
+			// The update carries what the sweep found too.
+			if prev, ok := emitted[d.IP]; ok {
+				copyEnrichment(&prev, &d)
+				emitted[d.IP] = prev
+				emit("update", prev)
+			} else {
+				emitted[d.IP] = d
+				emit("device", d)
+			}
+		},
+		func(p progressReport) {
+			if p.Candidates != last.Candidates || p.Probed != last.Probed || p.Found != last.Found {
+				last = p
+				emit("progress", p)
+			} else {
+				idle()
+			}
+		})
+
+	if ctx.Err() == context.Canceled {
+		return
+	}
+	for _, d := range result.Devices {
+		if _, ok := emitted[d.IP]; ok {
+			emit("update", d)
+		} else {
+			emit("device", d)
+		}
+	}
+	emit("done", result.summary())
+}
+
+// streamScan answers a scan request with Server-Sent Events, sending
+// keep-alive comments while no event is due.
+func streamScan(w http.ResponseWriter, r *http.Request, networks []localNetwork, opts scanOptions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeStreamingUnsupported, "streaming is not supported")
+		return
+	}
+	extend := streamDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	sse := &sseWriter{w: w, flusher: flusher}
+	extend()
+	sse.comment("scan started")
+
+	lastWrite := time.Now()
+	streamEvents(r.Context(), networks, opts,
+		func(event string, v interface{}) {
+			extend()
+			sse.event(event, v)
+			lastWrite = time.Now()
+		},
+		func() {
+			if time.Since(lastWrite) >= streamKeepAliveInterval {
+				extend()
+				sse.comment("keep-alive")
+				lastWrite = time.Now()
+			}
+		})
+}
+
+// ndjsonScan answers a scan request with one JSON line per event. Devices are
+// written as they are found; errors occurring mid-stream are written as lines
+// with an error field since the status code is already sent.
+func ndjsonScan(w http.ResponseWriter, r *http.Request, networks []localNetwork, opts scanOptions) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeStreamingUnsupported, "streaming is not supported")
+		return
+	}
+	extend := streamDeadline(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	streamEvents(r.Context(), networks, opts, func(event string, v interface{}) {
+		if event == "progress" {
+			return
+		}
+		line := struct {
+			Type string      `json:"type"`
+			Data interface{} `json:"data"`
+		}{event, v}
+		extend()
+		if err := enc.Encode(line); err != nil {
+			logger.Error("Error encoding line", "event", event, "err", err)
+			enc.Encode(errorResponse{apiError{Code: codeInternal, Message: err.Error()}})
+		}
+		flusher.Flush()
+	}, func() {})
+}
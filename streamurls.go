@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// vendorStreamPaths are the default main stream paths of camera vendors,
+// matched against the vendor of the MAC address and the RTSP Server banner.
+var vendorStreamPaths = []struct {
+	keyword, path string
+}{
+	{"hikvision", "/Streaming/Channels/101"},
+	{"dahua", "/cam/realmonitor?channel=1&subtype=0"},
+	{"amcrest", "/cam/realmonitor?channel=1&subtype=0"},
+	{"axis", "/axis-media/media.amp"},
+	{"reolink", "/h264Preview_01_main"},
+	{"hanwha", "/profile2/media.smp"},
+	{"vivotek", "/live.sdp"},
+	{"bosch", "/rtsp_tunnel"},
+	{"uniview", "/media/video1"},
+	{"foscam", "/videoMain"},
+	{"tp-link", "/stream1"},
+	{"wyze", "/live"},
+	{"ubiquiti", "/live"},
+}
+
+// addRTSPURLs lists the RTSP URLs of every device answering RTSP: the stream
+// URIs reported over ONVIF, the paths found by the path probe, or else the
+// default path of its vendor. The URLs never carry credentials.
+func addRTSPURLs(devices []device) {
+	for i := range devices {
+		d := &devices[i]
+		seen := make(map[string]bool)
+		add := func(u string) {
+			if !seen[u] {
+				seen[u] = true
+				d.RTSPURLs = append(d.RTSPURLs, u)
+			}
+		}
+		for _, p := range d.Profiles {
+			if strings.HasPrefix(p.StreamURI, "rtsp://") || strings.HasPrefix(p.StreamURI, "rtsps://") {
+				add(stripUserinfo(rewriteHost(p.StreamURI, d.IP)))
+			}
+		}
+		if len(d.Ports) == 0 {
+			continue
+		}
+		for _, p := range d.Paths {
+			if p.StatusCode == 200 || p.StatusCode == 401 {
+				add(d.rtspURL(d.Ports[0], p.Path))
+			}
+		}
+		if len(d.RTSPURLs) == 0 {
+			if path := vendorStreamPath(d); path != "" {
+				add(d.rtspURL(d.Ports[0], path))
+			}
+		}
+	}
+}
+
+func vendorStreamPath(d *device) string {
+	known := strings.ToLower(d.Vendor + " " + d.VendorGuess + " " + d.Server)
+	for _, v := range vendorStreamPaths {
+		if strings.Contains(known, v.keyword) {
+			return v.path
+		}
+	}
+	return ""
+}
+
+func stripUserinfo(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// embedCredentials returns copies of devices whose RTSP URLs carry the
+// credentials the camera accepted. Devices without validated credentials
+// are left as they are.
+func embedCredentials(devices []device) []device {
+	embedded := make([]device, len(devices))
+	copy(embedded, devices)
+	for i := range embedded {
+		d := &embedded[i]
+		if d.Auth != authOK || d.rtspCredential == nil {
+			continue
+		}
+		urls := make([]string, len(d.RTSPURLs))
+		for j, rawURL := range d.RTSPURLs {
+			urls[j] = rawURL
+			if u, err := url.Parse(rawURL); err == nil {
+				u.User = url.UserPassword(d.rtspCredential.username, d.rtspCredential.password)
+				urls[j] = u.String()
+			}
+		}
+		d.RTSPURLs = urls
+	}
+	return embedded
+}
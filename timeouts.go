@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serverTimeouts bound how long a client may hold a connection of the API
+// server.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+	// request bounds the context of the scan handlers, so scans waited for
+	// by a request are cancelled before the write timeout closes the
+	// connection.
+	request time.Duration
+	// streamWrite bounds every single write of a streamed response, which
+	// is exempt from the write timeout.
+	streamWrite time.Duration
+}
+
+var timeouts = serverTimeouts{
+	readHeader:  10 * time.Second,
+	read:        time.Minute,
+	write:       6 * time.Minute,
+	idle:        2 * time.Minute,
+	request:     5*time.Minute + 30*time.Second,
+	streamWrite: 30 * time.Second,
+}
+
+func (t serverTimeouts) validate() error {
+	if t.readHeader <= 0 || t.read < 0 || t.write < 0 || t.idle < 0 || t.request < 0 {
+		return errors.New("timeouts must not be negative and read-header-timeout must be set")
+	}
+	if t.write > 0 && (t.request == 0 || t.request >= t.write) {
+		return fmt.Errorf("request-timeout %s must be shorter than write-timeout %s", t.request, t.write)
+	}
+	return nil
+}
+
+func (t serverTimeouts) apply(server *http.Server) {
+	server.ReadHeaderTimeout = t.readHeader
+	server.ReadTimeout = t.read
+	server.WriteTimeout = t.write
+	server.IdleTimeout = t.idle
+}
+
+// withDeadline ends the context of the request after the request timeout.
+func withDeadline(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if timeouts.request <= 0 {
+			h(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeouts.request)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+func requestTimedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+func writeRequestTimeout(w http.ResponseWriter) {
+	writeError(w, http.StatusGatewayTimeout, codeRequestTimeout, fmt.Sprintf("the request took longer than %s", timeouts.request))
+}
+
+// streamDeadline replaces the write timeout of the connection with a deadline
+// for every write, which the returned function extends before each one.
+func streamDeadline(w http.ResponseWriter) func() {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	return func() {
+		rc.SetWriteDeadline(time.Now().Add(timeouts.streamWrite))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"find_cameras/scanner"
+)
+
+// timeoutServer serves the API with the timeouts tt for the rest of the test.
+func timeoutServer(t *testing.T, tt serverTimeouts) *httptest.Server {
+	t.Helper()
+	old := timeouts
+	timeouts = tt
+	t.Cleanup(func() { timeouts = old })
+	srv := httptest.NewUnstartedServer(newRouter())
+	tt.apply(srv.Config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// slowProber answers every probe with a refusal after delay, or as soon as the
+// scan is cancelled.
+func slowProber(delay time.Duration) scanner.ProberFunc {
+	return func(ctx context.Context, ip string, port int) scanner.Result {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		return scanner.Result{IP: ip, Outcome: scanner.OutcomeRefused}
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	srv := timeoutServer(t, serverTimeouts{readHeader: 100 * time.Millisecond, idle: time.Minute})
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The headers are never finished.
+	io.WriteString(conn, "GET /healthz HTTP/1.1\r\nHost: localhost\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection closed after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestScanDeadline(t *testing.T) {
+	withStore(t)
+	withCache(t, 0)
+	withProber(t, slowProber(time.Minute))
+	srv := timeoutServer(t, serverTimeouts{readHeader: time.Second, write: time.Minute, request: 100 * time.Millisecond})
+	// The cancelled scan ends after the answer, before the state it uses is
+	// reset.
+	t.Cleanup(func() { waitForScans(t) })
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + apiPrefix + "/scan?" + localScan(554))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body errorResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusGatewayTimeout || body.Error.Code != codeRequestTimeout {
+		t.Errorf("status %d, code %q, want %d and %q", resp.StatusCode, body.Error.Code, http.StatusGatewayTimeout, codeRequestTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("answered after %v, want about 100ms", elapsed)
+	}
+}
+
+// waitForScans waits until no scan runs in the background.
+func waitForScans(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		scanFlights.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("scan still running")
+	}
+}
+
+// TestStreamOutlivesWriteTimeout checks that the streamed scans only have
+// their writes bounded, not the whole response.
+func TestStreamOutlivesWriteTimeout(t *testing.T) {
+	withStore(t)
+	withProber(t, slowProber(500*time.Millisecond))
+	srv := timeoutServer(t, serverTimeouts{readHeader: time.Second, write: 100 * time.Millisecond, request: 5 * time.Second, streamWrite: time.Second})
+
+	for _, path := range []string{"/scan/stream?", "/scan?format=ndjson&"} {
+		start := time.Now()
+		resp, err := http.Get(srv.URL + apiPrefix + path + localScan(554))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: stream cut: %v", path, err)
+		}
+		if !strings.Contains(string(body), "done") {
+			t.Errorf("%s: no done event in %q", path, body)
+		}
+		if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+			t.Errorf("%s: scan ended after %v, before its probe", path, elapsed)
+		}
+	}
+}
+
+func TestServerTimeoutsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		t    serverTimeouts
+		ok   bool
+	}{
+		{"defaults", timeouts, true},
+		{"no write timeout", serverTimeouts{readHeader: time.Second}, true},
+		{"no read-header timeout", serverTimeouts{write: time.Minute, request: time.Second}, false},
+		{"negative", serverTimeouts{readHeader: time.Second, idle: -time.Second}, false},
+		{"request outlives write", serverTimeouts{readHeader: time.Second, write: time.Minute, request: time.Minute}, false},
+		{"no request timeout", serverTimeouts{readHeader: time.Second, write: time.Minute}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.t.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tlsFiles serves the certificate and the client CAs loaded from files, and
+// reloads them on SIGHUP or periodically so they can be rotated without a
+// restart. A failed reload keeps the previous files in use.
+type tlsFiles struct {
+	certFile, keyFile string
+	clientCAFile      string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func (f *tlsFiles) load() error {
+	var cert *tls.Certificate
+	if f.certFile != "" {
+		c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if f.clientCAFile != "" {
+		data, err := os.ReadFile(f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", f.clientCAFile)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cert != nil {
+		f.cert = cert
+	}
+	f.clientCA = pool
+	return nil
+}
+
+func (f *tlsFiles) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert, nil
+}
+
+// config returns the server configuration. Mutual TLS is enforced when client
+// CAs are configured.
+func (f *tlsFiles) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mu.RLock()
+			defer f.mu.RUnlock()
+			c := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{"http/1.1"},
+				GetCertificate: f.certificate,
+			}
+			if f.clientCA != nil {
+				c.ClientCAs = f.clientCA
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+func (f *tlsFiles) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		if err := f.load(); err != nil {
+			logger.Error("Error reloading TLS files, keeping the previous ones", "err", err)
+			continue
+		}
+		logger.Info("Reloaded TLS files", "cert", f.certFile, "client_ca", f.clientCAFile)
+	}
+}
+
+// validateTLS checks the combination of the TLS settings.
+func validateTLS(certFile, keyFile, clientCAFile string, selfSigned bool) error {
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return errors.New("tls-cert and tls-key must be set together")
+	case selfSigned && certFile != "":
+		return errors.New("tls-self-signed can't be combined with tls-cert and tls-key")
+	case clientCAFile != "" && certFile == "" && !selfSigned:
+		return errors.New("tls-client-ca requires tls-cert and tls-key or tls-self-signed")
+	}
+	return nil
+}
+
+// selfSignedCertificate generates a certificate valid for a year for the
+// hostname and the loopback addresses, for setups without a PKI.
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "onvif-finder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func certificateFingerprint(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"find_cameras/scanner"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// verboseMaxHosts is the largest network a verbose scan may sweep, as it
+// reports every address.
+var verboseMaxHosts = 1024
+
+// probedHost is what a verbose scan tells about a probed address.
+type probedHost struct {
+	IP      string          `json:"ip"`
+	Class   scanner.Class   `json:"class"`
+	Outcome scanner.Outcome `json:"outcome"`
+	Ports   []int           `json:"ports,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// hostLog collects the probed addresses of a verbose scan. A host found over
+// ONVIF HTTP or unicast WS-Discovery is open even when its RTSP ports were
+// closed.
+type hostLog struct {
+	mu    sync.Mutex
+	hosts map[string]probedHost
+}
+
+func newHostLog() *hostLog {
+	return &hostLog{hosts: make(map[string]probedHost)}
+}
+
+func (l *hostLog) add(r scanner.Result) {
+	host := probedHost{IP: r.IP, Class: r.Outcome.Class(), Outcome: r.Outcome, Ports: r.Ports}
+	if host.Class == scanner.ClassError && r.Err != nil {
+		host.Error = r.Err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if existing, ok := l.hosts[r.IP]; ok && (existing.Class == scanner.ClassOpen || host.Class != scanner.ClassOpen) {
+		return
+	}
+	l.hosts[r.IP] = host
+}
+
+// list returns the hosts sorted by IP and their number by class.
+func (l *hostLog) list() ([]probedHost, map[scanner.Class]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := make([]probedHost, 0, len(l.hosts))
+	classes := map[scanner.Class]int{scanner.ClassOpen: 0, scanner.ClassClosed: 0, scanner.ClassFiltered: 0, scanner.ClassError: 0}
+	for _, h := range l.hosts {
+		hosts = append(hosts, h)
+		classes[h.Class]++
+	}
+	sort.Slice(hosts, func(i, j int) bool { return compareIPs(hosts[i].IP, hosts[j].IP) < 0 })
+	return hosts, classes
+}
+
+// checkVerbose rejects verbose scans of networks larger than verboseMaxHosts.
+// IPv6 networks only probe the neighbors found and pass.
+func checkVerbose(networks []localNetwork, opts scanOptions) error {
+	if !opts.Verbose {
+		return nil
+	}
+	for _, n := range networks {
+		if n.isIPv6() && !n.Requested {
+			continue
+		}
+		if hosts := scanner.HostCount(n.IPNet); hosts > uint64(verboseMaxHosts) {
+			return fmt.Errorf("verbose scans are limited to networks of at most %d hosts, %s has %d", verboseMaxHosts, n, hosts)
+		}
+	}
+	return nil
+}
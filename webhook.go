@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 256
+	webhookAttempts    = 5
+	webhookBackoff     = time.Second
+	webhookMaxBackoff  = time.Minute
+	webhookCallTimeout = 10 * time.Second
+)
+
+var webhookHTTPClient = &http.Client{Timeout: webhookCallTimeout}
+
+// webhook delivers camera events to one URL. Events are queued so a slow or
+// dead receiver never blocks a scan; they are dropped when the queue is full.
+type webhook struct {
+	url    string
+	secret string
+	queue  chan []byte
+}
+
+type webhookNotifier struct {
+	hooks []*webhook
+}
+
+var webhooks = &webhookNotifier{}
+
+func newWebhookNotifier(urls []string, secret string) *webhookNotifier {
+	n := &webhookNotifier{}
+	for _, u := range urls {
+		n.hooks = append(n.hooks, &webhook{url: u, secret: secret, queue: make(chan []byte, webhookQueueSize)})
+	}
+	return n
+}
+
+func (n *webhookNotifier) run(ctx context.Context) {
+	for _, h := range n.hooks {
+		go h.run(ctx)
+	}
+}
+
+// pending returns the number of queued events.
+func (n *webhookNotifier) pending() int {
+	count := 0
+	for _, h := range n.hooks {
+		count += len(h.queue)
+	}
+	return count
+}
+
+func (n *webhookNotifier) notify(events []cameraEvent) {
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			logger.Error("Error encoding event", "event", event.Event, "err", err)
+			continue
+		}
+		for _, h := range n.hooks {
+			select {
+			case h.queue <- body:
+			default:
+				logger.Warn("Webhook queue is full, dropping event", "url", h.url, "event", event.Event, "id", event.Device.ID)
+			}
+		}
+	}
+}
+
+func (h *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case body := <-h.queue:
+			h.deliver(ctx, body)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver posts body, retrying with exponential backoff.
+func (h *webhook) deliver(ctx context.Context, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := h.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			logger.Error("Giving up delivering webhook", "url", h.url, "attempts", attempt, "err", err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (h *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		req.Header.Set("X-Finder-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// wsRequest is a message sent by a WebSocket client: a scan request with the
+// same options as the scan endpoint, or a cancel of the running scan.
+type wsRequest struct {
+	Type     string            `json:"type"`
+	CIDR     []string          `json:"cidr"`
+	Ports    []int             `json:"ports"`
+	Timeout  string            `json:"timeout"`
+	Deadline string            `json:"deadline"`
+	Params   map[string]string `json:"params"`
+}
+
+type wsMessage struct {
+	Type  string      `json:"type"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+func (m *wsRequest) query() url.Values {
+	query := url.Values{}
+	for k, v := range m.Params {
+		query.Set(k, v)
+	}
+	query["cidr"] = append(query["cidr"], m.CIDR...)
+	if len(m.Ports) > 0 {
+		query.Set("ports", joinPorts(m.Ports))
+	}
+	if m.Timeout != "" {
+		query.Set("timeout", m.Timeout)
+	}
+	if m.Deadline != "" {
+		query.Set("deadline", m.Deadline)
+	}
+	return query
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if errors.Is(err, errWSOrigin) {
+		writeError(w, http.StatusForbidden, codeForbiddenOrigin, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// The scans end with the connection or the shutdown of the server, the
+	// request context isn't cancelled by a client leaving once hijacked.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// The server doesn't close hijacked connections on shutdown.
+	context.AfterFunc(ctx, func() {
+		conn.writeFrame(wsOpClose, nil)
+		conn.Close()
+	})
+
+	send := func(m wsMessage) {
+		data, err := json.Marshal(m)
+		if err != nil {
+			logger.Error("Error encoding message", "type", m.Type, "err", err)
+			return
+		}
+		if err := conn.writeText(data); err != nil {
+			cancel()
+		}
+	}
+
+	var scanCancel context.CancelFunc = func() {}
+	var scanDone chan struct{}
+	running := func() bool {
+		if scanDone == nil {
+			return false
+		}
+		select {
+		case <-scanDone:
+			return false
+		default:
+			return true
+		}
+	}
+
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			break
+		}
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			send(wsMessage{Type: "error", Error: "invalid message: " + err.Error()})
+			continue
+		}
+
+		switch req.Type {
+		case "scan":
+			if running() {
+				send(wsMessage{Type: "error", Error: "a scan is already running"})
+				continue
+			}
+			networks, opts, err := resolveScan(req.query())
+			if err != nil {
+				send(wsMessage{Type: "error", Error: err.Error()})
+				continue
+			}
+			if ok, wait := scanLimiter.allow(clientAddr(r), time.Now()); !ok {
+				send(wsMessage{Type: "error", Error: fmt.Sprintf("too many scans started, retry in %ds", int(math.Ceil(wait.Seconds())))})
+				continue
+			}
+			scanCtx, stop := context.WithCancel(ctx)
+			scanCancel = stop
+			done := make(chan struct{})
+			scanDone = done
+			go func() {
+				defer close(done)
+				defer stop()
+				streamEvents(scanCtx, networks, opts, func(event string, v interface{}) {
+					send(wsMessage{Type: event, Data: v})
+				}, func() {})
+				if scanCtx.Err() == context.Canceled && ctx.Err() == nil {
+					send(wsMessage{Type: "cancelled"})
+				}
+			}()
+		case "cancel":
+			scanCancel()
+		default:
+			send(wsMessage{Type: "error", Error: "unknown message type " + strconv.Quote(req.Type)})
+		}
+	}
+
+	cancel()
+	if scanDone != nil {
+		<-scanDone
+	}
+}
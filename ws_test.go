@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens a WebSocket to the server, sending origin unless empty.
+// The client reuses the server connection: the server doesn't require the
+// frames of clients to be masked.
+func dialWebSocket(t *testing.T, srv *httptest.Server, origin string) (*wsConn, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+apiPrefix+"/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp.StatusCode
+	}
+	return &wsConn{conn: conn, reader: reader}, resp.StatusCode
+}
+
+func sendWS(t *testing.T, c *wsConn, v interface{}) {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	if err := c.writeText(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readWS(t *testing.T, c *wsConn) wsMessage {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m wsMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("invalid message %s: %v", data, err)
+	}
+	return m
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c, status := dialWebSocket(t, srv, "")
+	if c == nil {
+		t.Fatalf("handshake status %d", status)
+	}
+
+	c.writeText([]byte("{not json"))
+	if m := readWS(t, c); m.Type != "error" || !strings.Contains(m.Error, "invalid message") {
+		t.Errorf("invalid message answered with %+v", m)
+	}
+	sendWS(t, c, map[string]string{"type": "rescan"})
+	if m := readWS(t, c); m.Type != "error" || !strings.Contains(m.Error, "unknown message type") {
+		t.Errorf("unknown type answered with %+v", m)
+	}
+	sendWS(t, c, wsRequest{Type: "scan", CIDR: []string{"not-a-cidr"}})
+	if m := readWS(t, c); m.Type != "error" {
+		t.Errorf("invalid scan answered with %+v", m)
+	}
+
+	// A port nothing listens on: the scan finds nothing and is done.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	sendWS(t, c, wsRequest{Type: "scan", CIDR: []string{"127.0.0.1/32"}, Ports: []int{port}, Params: map[string]string{
+		"include_self": "true", "discovery_window": "0s", "onvif_ports": "none", "refresh": "true",
+	}})
+	for {
+		m := readWS(t, c)
+		if m.Type == "error" {
+			t.Fatalf("scan failed: %s", m.Error)
+		}
+		if m.Type == "done" {
+			break
+		}
+	}
+}
+
+func TestWebSocketCancel(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c, status := dialWebSocket(t, srv, "")
+	if c == nil {
+		t.Fatalf("handshake status %d", status)
+	}
+	// A listener never answering keeps the scan running until cancelled.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sendWS(t, c, wsRequest{Type: "scan", CIDR: []string{"127.0.0.1/32"}, Ports: []int{ln.Addr().(*net.TCPAddr).Port}, Params: map[string]string{
+		"include_self": "true", "discovery_window": "0s", "onvif_ports": "none", "refresh": "true", "timeout": "5s",
+	}})
+	sendWS(t, c, wsRequest{Type: "scan"})
+	if m := readWS(t, c); m.Type != "error" || !strings.Contains(m.Error, "already running") {
+		t.Fatalf("second scan answered with %+v", m)
+	}
+	sendWS(t, c, wsRequest{Type: "cancel"})
+	for {
+		m := readWS(t, c)
+		if m.Type == "cancelled" {
+			break
+		}
+		if m.Type == "done" {
+			t.Fatal("scan completed instead of being cancelled")
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	corsOrigins = []string{"https://installer.example.com"}
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{srv.URL, http.StatusSwitchingProtocols},
+		{"https://installer.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if _, status := dialWebSocket(t, srv, tt.origin); status != tt.status {
+			t.Errorf("origin %q: status %d, want %d", tt.origin, status, tt.status)
+		}
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	base, shutdown := context.WithCancel(context.Background())
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.BaseContext = func(net.Listener) context.Context { return base }
+	srv.Start()
+	defer srv.Close()
+	c, status := dialWebSocket(t, srv, "")
+	if c == nil {
+		t.Fatalf("handshake status %d", status)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sendWS(t, c, wsRequest{Type: "scan", CIDR: []string{"127.0.0.1/32"}, Ports: []int{ln.Addr().(*net.TCPAddr).Port}, Params: map[string]string{
+		"include_self": "true", "discovery_window": "0s", "onvif_ports": "none", "refresh": "true", "timeout": "5s",
+	}})
+	shutdown()
+	// The scan is cancelled with the server and the connection closed.
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		data, err := c.readMessage()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+		if strings.Contains(string(data), `"type":"done"`) {
+			t.Fatal("scan completed instead of being cancelled")
+		}
+	}
+}
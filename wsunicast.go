@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"find_cameras/discovery"
+	"find_cameras/scanner"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sourceWSDiscoveryUnicast = "ws-discovery-unicast"
+
+	// unicastProbeTimeout is how long a host has to answer a unicast Probe.
+	unicastProbeTimeout = 500 * time.Millisecond
+	// unicastRetries is how often an unanswered unicast Probe is sent again
+	// at least, as UDP datagrams get lost.
+	unicastRetries = 2
+)
+
+// unicastProber sends WS-Discovery Probes to single hosts, keeping the
+// ProbeMatches they answer.
+type unicastProber struct {
+	mu      sync.Mutex
+	matches map[string]discovery.Match
+}
+
+func (p *unicastProber) Probe(ctx context.Context, ip string, port int) scanner.Result {
+	result := scanner.Result{IP: ip}
+	m, err := discovery.ProbeUnicast(ctx, ip, unicastProbeTimeout)
+	if err != nil {
+		result.Outcome, result.Err = scanner.ClassifyDialError(err), err
+		return result
+	}
+	result.Outcome = scanner.OutcomeONVIF
+	p.mu.Lock()
+	p.matches[ip] = *m
+	p.mu.Unlock()
+	return result
+}
+
+// unicastDiscovery reports whether the hosts of network get a unicast
+// WS-Discovery Probe: on request, and for the networks of the caller the
+// multicast Probe doesn't reach.
+func unicastDiscovery(network localNetwork, opts scanOptions) bool {
+	return opts.Unicast || (network.Requested && !isAttached(network))
+}
+
+// isAttached reports whether a network overlaps a network of the local
+// interfaces.
+func isAttached(network localNetwork) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if local, ok := addr.(*net.IPNet); ok && (local.Contains(network.IP) || network.Contains(local.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanUnicastWSDiscovery sends a unicast Probe to every address of ips,
+// sharing the workers of the scan, and returns the ProbeMatches received.
+func scanUnicastWSDiscovery(ctx context.Context, ips []string, opts scanOptions, limit *scanner.Limiter) []discovery.Match {
+	if len(ips) == 0 {
+		return nil
+	}
+	p := &unicastProber{matches: make(map[string]discovery.Match)}
+	so := scannerOptions(ctx, opts)
+	so.Ports = []int{discovery.Port}
+	so.Prober = p
+	so.AdaptiveTimeout = false
+	so.Limiter = limit
+	if so.Retries < unicastRetries {
+		so.Retries = unicastRetries
+	}
+	scanner.New(so).ProbeHosts(ctx, ips)
+
+	var matches []discovery.Match
+	for _, ip := range ips {
+		if m, ok := p.matches[ip]; ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}